@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ardanlabs/conf/v3"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/signer"
+	"github.com/toqns/toqns/foundation/logger"
+	"go.uber.org/zap"
+)
+
+// build is the git version of this program. It is set using build flags in the makefile.
+var build = "develop"
+
+func main() {
+	// Construct the application logger.
+	log, err := logger.New("SIGNER", build == "develop")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer log.Sync()
+
+	// Perform the startup and shutdown sequence.
+	if err := run(log); err != nil {
+		log.Errorw("startup", "ERROR", err)
+		log.Sync()
+		os.Exit(1)
+	}
+}
+
+func run(log *zap.SugaredLogger) error {
+	// =========================================================================
+	// Configuration
+
+	cfg := struct {
+		conf.Version
+		Listen string `conf:"default:unix://./.signer/signer.sock,help:address to listen on as unix:///path or tcp://host:port"`
+		TLS    struct {
+			CertFile string `conf:"help:certificate of the signer for tcp listeners"`
+			KeyFile  string `conf:"help:key of the certificate of the signer"`
+			CAFile   string `conf:"help:CA certificate that signs the certificates of nodes"`
+		}
+		Key struct {
+			File     string `conf:"default:./.node/node.key"`
+			Pass     string `conf:"mask,help:passphrase of an encrypted key file"`
+			PassFile string `conf:"help:file with the passphrase of an encrypted key file"`
+		}
+		Policy struct {
+			AllowedTypes  []string      `conf:"help:message types that may be signed separated by ;"`
+			MaxSignatures int           `conf:"default:60,help:maximum number of signatures per interval, 0 for no limit"`
+			Interval      time.Duration `conf:"default:1m"`
+			StateFile     string        `conf:"default:./.signer/sign_state.json,help:file that keeps the last signed height and round"`
+		}
+	}{
+		Version: conf.Version{
+			Build: build,
+			Desc:  "copyright information here",
+		},
+	}
+
+	const prefix = "SIGNER"
+	help, err := conf.Parse(prefix, &cfg)
+	if err != nil {
+		if errors.Is(err, conf.ErrHelpWanted) {
+			fmt.Println(help)
+			return nil
+		}
+		return fmt.Errorf("parsing config: %w", err)
+	}
+
+	// =========================================================================
+	// App Starting
+
+	log.Infow("starting service", "version", build)
+	defer log.Infow("shutdown complete")
+
+	out, err := conf.String(&cfg)
+	if err != nil {
+		return fmt.Errorf("generating config for output: %w", err)
+	}
+	log.Infow("startup", "config", out)
+
+	// =========================================================================
+	// Key Support
+
+	passphrase := []byte(cfg.Key.Pass)
+	if cfg.Key.PassFile != "" {
+		b, err := os.ReadFile(cfg.Key.PassFile)
+		if err != nil {
+			return fmt.Errorf("reading key passphrase file: %w", err)
+		}
+		passphrase = bytes.TrimRight(b, "\r\n")
+	}
+
+	k, err := key.Load(cfg.Key.File, passphrase)
+	if err != nil {
+		return fmt.Errorf("reading key: %w", err)
+	}
+
+	id, _ := k.Address(key.NodeAddress)
+	log.Infow("startup", "status", "key loaded", "id", id, "algorithm", k.Algorithm())
+
+	// =========================================================================
+	// Start Signer
+
+	var tlsConfig *tls.Config
+	if cfg.TLS.CertFile != "" {
+		if tlsConfig, err = signer.ServerTLSConfig(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.CAFile); err != nil {
+			return err
+		}
+	}
+
+	l, err := signer.Listen(cfg.Listen, tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	srv := signer.Server{
+		Signer: k,
+		Policy: signer.Policy{
+			AllowedTypes:  cfg.Policy.AllowedTypes,
+			MaxSignatures: cfg.Policy.MaxSignatures,
+			Interval:      cfg.Policy.Interval,
+			StateFile:     cfg.Policy.StateFile,
+		},
+		Log: log,
+	}
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+
+	serverErrors := make(chan error, 1)
+
+	go func() {
+		log.Infow("startup", "status", "signer started", "listen", cfg.Listen)
+		serverErrors <- srv.Serve(l)
+	}()
+
+	// =========================================================================
+	// Shutdown
+
+	select {
+	case err := <-serverErrors:
+		return fmt.Errorf("server error: %w", err)
+
+	case sig := <-shutdown:
+		log.Infow("shutdown", "status", "shutdown started", "signal", sig)
+		defer log.Infow("shutdown", "status", "shutdown complete", "signal", sig)
+
+		return srv.Close()
+	}
+}
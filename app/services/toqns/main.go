@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -45,11 +46,31 @@ func run(log *zap.SugaredLogger) error {
 	// values.
 	cfg := struct {
 		conf.Version
+		Chain struct {
+			ID             string `conf:"default:toqns-devnet"`
+			DataDir        string `conf:"default:./.node/data,help:directory of the chain data"`
+			GenesisFile    string `conf:"env:CHAIN_GENESISFILE,help:genesis file of the network"`
+			SnapshotEpochs uint64 `conf:"default:10,help:number of epochs between state snapshots or 0 to disable them"`
+			SnapshotKeep   int    `conf:"default:2,help:number of state snapshots to keep"`
+			TrustedHeight  uint64 `conf:"help:height of a block to restore the state snapshot of on first start"`
+			TrustedHash    string `conf:"help:hash of the block at the trusted height"`
+		}
 		P2P struct {
 			Address         string        `conf:"default:0.0.0.0"`
 			Port            int           `conf:"default:3000"`
 			Protocol        string        `conf:"default:udp"`
+			ListenAddrs     []string      `conf:"help:additional listen addresses as ip/port/protocol separated by ;"`
+			AnnounceAddrs   []string      `conf:"help:addresses advertised to peers as ip/port/protocol separated by ;"`
+			Seeds           []string      `conf:"help:bootstrap nodes as id@host/port/protocol or multiaddr separated by ;"`
+			DNSSeeds        []string      `conf:"help:dns names listing bootstrap nodes separated by ;"`
 			NodeKeyFile     string        `conf:"default:./.node/node.key"`
+			NodeKeyPass     string        `conf:"mask,help:passphrase of an encrypted node key file"`
+			NodeKeyPassFile string        `conf:"help:file with the passphrase of an encrypted node key file"`
+			NodeKeyRotation string        `conf:"default:./.node/rotation.json,help:rotation statement of the node key to announce to peers"`
+			SignerAddress   string        `conf:"help:remote signer holding the node key as unix:///path or tcp://host:port"`
+			SignerCertFile  string        `conf:"help:certificate of the node for a tcp remote signer"`
+			SignerKeyFile   string        `conf:"help:key of the certificate of the node"`
+			SignerCAFile    string        `conf:"help:CA certificate that signs the certificate of the remote signer"`
 			ShutdownTimeout time.Duration `conf:"default:20s"`
 		}
 	}{
@@ -104,11 +125,45 @@ func run(log *zap.SugaredLogger) error {
 
 	log.Infow("startup", "status", "initializing p2p support")
 
+	passphrase := []byte(cfg.P2P.NodeKeyPass)
+	if cfg.P2P.NodeKeyPassFile != "" {
+		b, err := os.ReadFile(cfg.P2P.NodeKeyPassFile)
+		if err != nil {
+			return fmt.Errorf("reading node key passphrase file: %w", err)
+		}
+		passphrase = bytes.TrimRight(b, "\r\n")
+	}
+
+	// Peers only accept semantic versions, so development builds run as
+	// major version 0.
+	version := build
+	if build == "develop" {
+		version = "v0.0.0-develop"
+	}
+
 	n, err := node.New(log, node.NodeConfig{
-		Address:     cfg.P2P.Address,
-		Port:        cfg.P2P.Port,
-		Protocol:    cfg.P2P.Protocol,
-		NodeKeyFile: cfg.P2P.NodeKeyFile,
+		Version:             version,
+		ChainID:             cfg.Chain.ID,
+		Address:             cfg.P2P.Address,
+		Port:                cfg.P2P.Port,
+		Protocol:            cfg.P2P.Protocol,
+		NodeKeyFile:         cfg.P2P.NodeKeyFile,
+		NodeKeyPassphrase:   passphrase,
+		ListenAddrs:         cfg.P2P.ListenAddrs,
+		AnnounceAddrs:       cfg.P2P.AnnounceAddrs,
+		Seeds:               cfg.P2P.Seeds,
+		DNSSeeds:            cfg.P2P.DNSSeeds,
+		NodeKeyRotationFile: cfg.P2P.NodeKeyRotation,
+		SignerAddress:       cfg.P2P.SignerAddress,
+		SignerCertFile:      cfg.P2P.SignerCertFile,
+		SignerKeyFile:       cfg.P2P.SignerKeyFile,
+		SignerCAFile:        cfg.P2P.SignerCAFile,
+		DataDir:             cfg.Chain.DataDir,
+		GenesisFile:         cfg.Chain.GenesisFile,
+		SnapshotEpochs:      cfg.Chain.SnapshotEpochs,
+		SnapshotKeep:        cfg.Chain.SnapshotKeep,
+		TrustedHeight:       cfg.Chain.TrustedHeight,
+		TrustedHash:         cfg.Chain.TrustedHash,
 	})
 	if err != nil {
 		return fmt.Errorf("setting up p2p node: %w", err)
@@ -120,6 +175,13 @@ func run(log *zap.SugaredLogger) error {
 
 		if err := n.ListenAndServe(); err != nil {
 			serverErrors <- err
+			return
+		}
+
+		n.Bootstrap(context.Background())
+
+		if err := n.Sync(context.Background()); err != nil {
+			serverErrors <- err
 		}
 	}()
 
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/toqns/toqns/business/key"
+)
+
+var accountCmd = &cobra.Command{
+	Use:   "account",
+	Short: "Manage accounts",
+}
+
+var accountDeriveCmd = &cobra.Command{
+	Use:   "derive",
+	Short: "Derive a key from a mnemonic seed phrase",
+	Run:   accountDerive,
+}
+
+var (
+	accountIndex   uint32
+	accountNode    bool
+	accountKeyFile string
+)
+
+func init() {
+	rootCmd.AddCommand(accountCmd)
+	accountDeriveCmd.Flags().Uint32VarP(&accountIndex, "index", "i", 0, "Index of the key to derive")
+	accountDeriveCmd.Flags().BoolVar(&accountNode, "node", false, "Derive a node key instead of an account key")
+	accountDeriveCmd.Flags().StringVarP(&accountKeyFile, "keyfile", "k", "", "Store the derived key encrypted in this file")
+	accountDeriveCmd.Flags().StringVar(&mnemonicFile, "mnemonic-file", "", "File with the mnemonic seed phrase, or enter it when prompted")
+	accountDeriveCmd.Flags().StringVar(&passphraseFile, "passphrase-file", "", "File with the passphrase of the key file, or set "+passphraseEnv)
+
+	accountCmd.AddCommand(accountDeriveCmd)
+}
+
+func accountDerive(cmd *cobra.Command, args []string) {
+	path, d := key.AccountPath(accountIndex), key.AccountAddress
+	if accountNode {
+		path, d = key.NodePath(accountIndex), key.NodeAddress
+	}
+
+	mnemonic, err := readMnemonic()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	seed, err := key.MnemonicToSeed(mnemonic, "")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	k, err := key.FromSeed(seed, path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	addr, err := k.Address(d)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Path:", path)
+	printAddress(addr)
+	fmt.Println("Public key:", k.PublicKeyString())
+
+	if accountKeyFile == "" {
+		return
+	}
+
+	passphrase, err := readPassphrase(true)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err := k.SaveEncrypted(accountKeyFile, passphrase, d); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Key file created as:", accountKeyFile)
+}
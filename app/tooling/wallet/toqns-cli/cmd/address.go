@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/toqns/toqns/business/key"
+)
+
+var addressCmd = &cobra.Command{
+	Use:   "address <address>",
+	Short: "Validate an address and show its encodings",
+	Args:  cobra.ExactArgs(1),
+	Run:   addressRun,
+}
+
+func init() {
+	rootCmd.AddCommand(addressCmd)
+}
+
+func addressRun(cmd *cobra.Command, args []string) {
+	a, err := parseAddress(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	printAddress(a)
+}
+
+// parseAddress parses a checksummed address.
+//
+// Node IDs are accepted in the unchecksummed hex form as well, as they are
+// configured in that form in network addresses.
+func parseAddress(v string) (key.Address, error) {
+	a := key.Address(v)
+	if a.IsValid() && a.IsNode() {
+		return a, nil
+	}
+
+	return key.ParseAddress(v)
+}
+
+// parseAccountAddress parses a checksummed account address. The hex form
+// isn't accepted, so a typo can't send funds to the wrong account.
+func parseAccountAddress(v string) (key.Address, error) {
+	a, err := key.ParseAddress(v)
+	if err != nil {
+		return "", err
+	}
+
+	if !a.IsAccount() {
+		return "", fmt.Errorf("%w: %s is not an account address", key.ErrInvalidAddress, v)
+	}
+
+	return a, nil
+}
+
+// printAddress prints the checksummed address, and the hex form that is
+// used as ID in network addresses.
+func printAddress(a key.Address) {
+	c, err := a.Checksummed()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Address:", c)
+	fmt.Println("ID:     ", a)
+}
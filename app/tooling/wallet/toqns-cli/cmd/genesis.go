@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/toqns/toqns/business/genesis"
+	"github.com/toqns/toqns/business/key"
+)
+
+var genesisCmd = &cobra.Command{
+	Use:   "genesis",
+	Short: "Create the genesis file of a new network",
+}
+
+var genesisInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Create a genesis file without accounts and validators",
+	Run:   genesisInit,
+}
+
+var genesisAddAccountCmd = &cobra.Command{
+	Use:   "add-account <address> <balance>",
+	Short: "Add an initial account balance to the genesis file",
+	Args:  cobra.ExactArgs(2),
+	Run:   genesisAddAccount,
+}
+
+var genesisAddValidatorCmd = &cobra.Command{
+	Use:   "add-validator",
+	Short: "Add an initial validator to the genesis file",
+	Run:   genesisAddValidator,
+}
+
+var (
+	genesisFile        string
+	genesisChainID     string
+	genesisEngine      string
+	genesisBlockTime   time.Duration
+	genesisMaxBlockTxs int
+	genesisEpoch       uint64
+	genesisUnbonding   uint64
+	genesisValidators  int
+	genesisSlash       uint64
+	genesisPublicKey   string
+	genesisKeyFile     string
+	genesisPower       uint64
+)
+
+func init() {
+	rootCmd.AddCommand(genesisCmd)
+
+	genesisCmd.PersistentFlags().StringVarP(&genesisFile, "file", "f", "genesis.json", "Path of the genesis file")
+
+	genesisInitCmd.Flags().StringVar(&genesisChainID, "chain-id", "", "Chain ID of the network")
+	genesisInitCmd.Flags().StringVar(&genesisEngine, "engine", genesis.DefaultEngine, "Consensus engine: poa or bft")
+	genesisInitCmd.Flags().DurationVar(&genesisBlockTime, "block-time", genesis.DefaultBlockTime, "Time between blocks")
+	genesisInitCmd.Flags().IntVar(&genesisMaxBlockTxs, "max-block-txs", genesis.DefaultMaxBlockTxs, "Maximum number of transactions per block")
+	genesisInitCmd.Flags().Uint64Var(&genesisEpoch, "epoch-length", genesis.DefaultEpochLength, "Number of blocks between validator set changes")
+	genesisInitCmd.Flags().Uint64Var(&genesisUnbonding, "unbonding-period", genesis.DefaultUnbondingPeriod, "Number of blocks until unbonded stake is released")
+	genesisInitCmd.Flags().IntVar(&genesisValidators, "max-validators", genesis.DefaultMaxValidators, "Maximum number of validators")
+	genesisInitCmd.Flags().Uint64Var(&genesisSlash, "slash-percent", genesis.DefaultSlashPercent, "Percentage of the stake slashed for double signing")
+	genesisInitCmd.MarkFlagRequired("chain-id")
+
+	genesisAddValidatorCmd.Flags().StringVarP(&genesisPublicKey, "pubkey", "p", "", "Public key of the validator's node key")
+	genesisAddValidatorCmd.Flags().StringVarP(&genesisKeyFile, "keyfile", "k", "", "Node key file of the validator, instead of the public key")
+	genesisAddValidatorCmd.Flags().StringVar(&passphraseFile, "passphrase-file", "", "File with the passphrase of the key file, or set "+passphraseEnv)
+	genesisAddValidatorCmd.Flags().Uint64Var(&genesisPower, "power", 1, "Voting power of the validator")
+
+	genesisCmd.AddCommand(genesisInitCmd)
+	genesisCmd.AddCommand(genesisAddAccountCmd)
+	genesisCmd.AddCommand(genesisAddValidatorCmd)
+}
+
+func genesisInit(cmd *cobra.Command, args []string) {
+	if _, err := os.Stat(genesisFile); err == nil {
+		fmt.Println("genesis file", genesisFile, "already exists")
+		os.Exit(1)
+	}
+
+	g := genesis.New(genesisChainID)
+	g.Consensus.Engine = genesisEngine
+	g.Consensus.BlockTime = genesis.Duration{Duration: genesisBlockTime}
+	g.Consensus.MaxBlockTxs = genesisMaxBlockTxs
+	g.Consensus.EpochLength = genesisEpoch
+	g.Consensus.UnbondingPeriod = genesisUnbonding
+	g.Consensus.MaxValidators = genesisValidators
+	g.Consensus.SlashPercent = genesisSlash
+
+	if err := g.Save(genesisFile); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Genesis file created as:", genesisFile)
+	fmt.Println("Add accounts and validators with add-account and add-validator.")
+}
+
+func genesisAddAccount(cmd *cobra.Command, args []string) {
+	addr, err := parseAccountAddress(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	balance, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		fmt.Println("parsing balance:", err)
+		os.Exit(1)
+	}
+
+	g := readGenesis()
+	if err := g.AddAccount(addr, balance); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	writeGenesis(g)
+
+	fmt.Println("Account added with balance", balance)
+	printAddress(addr)
+}
+
+func genesisAddValidator(cmd *cobra.Command, args []string) {
+	var pub key.PublicKey
+	switch {
+	case genesisKeyFile != "":
+		k, err := loadKey(genesisKeyFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		pub = k.PublicKey()
+
+	case genesisPublicKey != "":
+		var err error
+		if pub, err = key.ParsePublicKey(genesisPublicKey); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+	default:
+		fmt.Println("either --pubkey or --keyfile is required")
+		os.Exit(1)
+	}
+
+	g := readGenesis()
+	if err := g.AddValidator(pub, genesisPower); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	writeGenesis(g)
+
+	addr, _ := pub.Address(key.NodeAddress)
+	fmt.Println("Validator added with power", genesisPower)
+	printAddress(addr)
+}
+
+// readGenesis reads the genesis file without validating it, as it's still
+// being built.
+func readGenesis() genesis.Genesis {
+	g, err := genesis.Read(genesisFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return g
+}
+
+// writeGenesis writes the genesis file.
+func writeGenesis(g genesis.Genesis) {
+	if err := g.Save(genesisFile); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
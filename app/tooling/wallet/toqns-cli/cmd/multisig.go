@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/tx"
+)
+
+var multisigCmd = &cobra.Command{
+	Use:   "multisig",
+	Short: "Build and sign multisig authorizations offline",
+}
+
+var multisigBuildCmd = &cobra.Command{
+	Use:   "build <file>",
+	Short: "Create an unsigned multisig authorization file",
+	Args:  cobra.ExactArgs(1),
+	Run:   multisigBuild,
+}
+
+var multisigSignCmd = &cobra.Command{
+	Use:   "sign <file>",
+	Short: "Add a signature to a multisig authorization file",
+	Args:  cobra.ExactArgs(1),
+	Run:   multisigSign,
+}
+
+var multisigFinalizeCmd = &cobra.Command{
+	Use:   "finalize <file>",
+	Short: "Verify that a multisig authorization file meets its threshold",
+	Args:  cobra.ExactArgs(1),
+	Run:   multisigFinalize,
+}
+
+var (
+	multisigThreshold  int
+	multisigPublicKeys []string
+	multisigData       string
+	multisigDataFile   string
+	multisigKeyFile    string
+)
+
+func init() {
+	rootCmd.AddCommand(multisigCmd)
+
+	multisigBuildCmd.Flags().IntVarP(&multisigThreshold, "threshold", "m", 0, "Number of required signatures")
+	multisigBuildCmd.Flags().StringSliceVarP(&multisigPublicKeys, "pubkey", "p", nil, "Public key of a keyholder, repeat for every keyholder")
+	multisigBuildCmd.Flags().StringVar(&multisigData, "data", "", "Hex encoded data to authorize")
+	multisigBuildCmd.Flags().StringVar(&multisigDataFile, "data-file", "", "File with the data to authorize")
+	multisigBuildCmd.MarkFlagRequired("threshold")
+	multisigBuildCmd.MarkFlagRequired("pubkey")
+
+	multisigSignCmd.Flags().StringVarP(&multisigKeyFile, "keyfile", "k", "", "Key file of the keyholder")
+	multisigSignCmd.Flags().StringVar(&passphraseFile, "passphrase-file", "", "File with the passphrase of the key file, or set "+passphraseEnv)
+	multisigSignCmd.MarkFlagRequired("keyfile")
+
+	multisigCmd.AddCommand(multisigBuildCmd)
+	multisigCmd.AddCommand(multisigSignCmd)
+	multisigCmd.AddCommand(multisigFinalizeCmd)
+}
+
+// authorizationFile is the file format of a multisig authorization that is
+// passed between keyholders.
+//
+// Authorizations of transactions include the transaction, so keyholders
+// can review it before signing.
+type authorizationFile struct {
+	Data          string            `json:"data"`
+	Tx            *tx.Tx            `json:"tx,omitempty"`
+	Authorization key.Authorization `json:"authorization"`
+}
+
+func multisigBuild(cmd *cobra.Command, args []string) {
+	pubs := make([]key.PublicKey, len(multisigPublicKeys))
+	for i, v := range multisigPublicKeys {
+		pub, err := key.ParsePublicKey(v)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		pubs[i] = pub
+	}
+
+	m, err := key.NewMultisig(multisigThreshold, pubs...)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	data, err := hex.DecodeString(multisigData)
+	if err != nil {
+		fmt.Println("decoding data:", err)
+		os.Exit(1)
+	}
+	if multisigDataFile != "" {
+		if data, err = os.ReadFile(multisigDataFile); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	af := authorizationFile{
+		Data:          hex.EncodeToString(data),
+		Authorization: key.Authorization{Multisig: m},
+	}
+	if err := writeAuthorization(args[0], af); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	addr, _ := m.Address()
+	fmt.Printf("Authorization file created as %s for %d of %d keys\n", args[0], m.Threshold, len(m.PublicKeys))
+	printAddress(addr)
+}
+
+func multisigSign(cmd *cobra.Command, args []string) {
+	af, data, err := readAuthorization(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if af.Tx != nil {
+		if hex.EncodeToString(af.Tx.SigningBytes()) != af.Data {
+			fmt.Println("transaction in authorization file", args[0], "doesn't match its data")
+			os.Exit(1)
+		}
+
+		b, _ := json.MarshalIndent(af.Tx, "", "  ")
+		fmt.Println("Signing transaction", af.Tx.Hash())
+		fmt.Println(string(b))
+	}
+
+	k, err := loadKey(multisigKeyFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err := af.Authorization.Sign(k, data); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err := writeAuthorization(args[0], af); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Signed, %d of %d required signatures\n", len(af.Authorization.Signatures), af.Authorization.Multisig.Threshold)
+}
+
+func multisigFinalize(cmd *cobra.Command, args []string) {
+	af, data, err := readAuthorization(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err := af.Authorization.Verify(data); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// Only the threshold of signatures is needed.
+	af.Authorization.Signatures = af.Authorization.Signatures[:af.Authorization.Multisig.Threshold]
+	if err := writeAuthorization(args[0], af); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	addr, _ := af.Authorization.Multisig.Address()
+	fmt.Println("Authorization complete")
+	printAddress(addr)
+}
+
+// readAuthorization reads an authorization file and returns it with the
+// decoded data.
+func readAuthorization(name string) (authorizationFile, []byte, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return authorizationFile{}, nil, err
+	}
+
+	var af authorizationFile
+	if err := json.Unmarshal(b, &af); err != nil {
+		return authorizationFile{}, nil, fmt.Errorf("decoding authorization file: %w", err)
+	}
+
+	if err := af.Authorization.Multisig.Validate(); err != nil {
+		return authorizationFile{}, nil, err
+	}
+
+	data, err := hex.DecodeString(af.Data)
+	if err != nil {
+		return authorizationFile{}, nil, fmt.Errorf("decoding data: %w", err)
+	}
+
+	return af, data, nil
+}
+
+// writeAuthorization writes an authorization file.
+func writeAuthorization(name string, af authorizationFile) error {
+	b, err := json.MarshalIndent(af, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding authorization file: %w", err)
+	}
+
+	return os.WriteFile(name, b, 0644)
+}
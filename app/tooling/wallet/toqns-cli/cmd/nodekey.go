@@ -8,31 +8,137 @@ import (
 	"github.com/toqns/toqns/business/key"
 )
 
-var balanceCmd = &cobra.Command{
+var nodeKeyCmd = &cobra.Command{
 	Use:   "nodekey",
 	Short: "Create a node key",
 	Run:   nodeKey,
 }
 
-var nodeKeyFile string
+var nodeKeyMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Encrypt a plaintext node key file in place",
+	Run:   nodeKeyMigrate,
+}
+
+var nodeKeyRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Replace the node key and sign a rotation statement with the old key",
+	Run:   nodeKeyRotate,
+}
+
+var (
+	nodeKeyFile  string
+	plaintext    bool
+	algorithm    string
+	rotationFile string
+)
 
 func init() {
-	rootCmd.AddCommand(balanceCmd)
-	balanceCmd.Flags().StringVarP(&nodeKeyFile, "nodekey", "n", "./.node/node.key", "Key file of the node")
+	rootCmd.AddCommand(nodeKeyCmd)
+	nodeKeyCmd.PersistentFlags().StringVarP(&nodeKeyFile, "nodekey", "n", "./.node/node.key", "Key file of the node")
+	nodeKeyCmd.PersistentFlags().StringVar(&passphraseFile, "passphrase-file", "", "File with the passphrase of the key file, or set "+passphraseEnv)
+	nodeKeyCmd.Flags().BoolVar(&plaintext, "plaintext", false, "Store the key unencrypted")
+	nodeKeyCmd.Flags().StringVarP(&algorithm, "algorithm", "a", string(key.P256), "Key algorithm: p256 or ed25519")
+
+	nodeKeyRotateCmd.Flags().StringVar(&rotationFile, "rotation-file", "./.node/rotation.json", "File to store the rotation statement in")
+	nodeKeyRotateCmd.Flags().BoolVar(&plaintext, "plaintext", false, "Store the new key unencrypted")
+
+	nodeKeyCmd.AddCommand(nodeKeyMigrateCmd)
+	nodeKeyCmd.AddCommand(nodeKeyRotateCmd)
 }
 
 func nodeKey(cmd *cobra.Command, args []string) {
-	fmt.Printf("\nCreating node key...\n")
-	k, err := key.New()
+	alg, err := key.ParseAlgorithm(algorithm)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	if err := k.Save(nodeKeyFile); err != nil {
+	fmt.Printf("\nCreating %s node key...\n", alg)
+	k, err := key.NewWithAlgorithm(alg)
+	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
+	if err := saveNodeKey(k); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	addr, _ := k.Address(key.NodeAddress)
 	fmt.Println("Node key file created as:", nodeKeyFile)
+	printAddress(addr)
+	fmt.Println("Public key:", k.PublicKeyString())
+}
+
+// saveNodeKey stores the key in the node key file, encrypted unless the
+// plaintext flag is set.
+func saveNodeKey(k key.Key) error {
+	if plaintext {
+		return k.Save(nodeKeyFile)
+	}
+
+	passphrase, err := readPassphrase(true)
+	if err != nil {
+		return err
+	}
+
+	return k.SaveEncrypted(nodeKeyFile, passphrase, key.NodeAddress)
+}
+
+func nodeKeyMigrate(cmd *cobra.Command, args []string) {
+	fmt.Printf("\nEncrypting node key %s...\n", nodeKeyFile)
+
+	passphrase, err := readPassphrase(true)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err := key.Migrate(nodeKeyFile, passphrase, key.NodeAddress); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Node key file encrypted:", nodeKeyFile)
+}
+
+func nodeKeyRotate(cmd *cobra.Command, args []string) {
+	fmt.Printf("\nRotating node key %s...\n", nodeKeyFile)
+
+	old, err := loadKey(nodeKeyFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	k, err := key.NewWithAlgorithm(old.Algorithm())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	r, err := key.NewRotation(old, k)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// Store the statement first, so the old ID isn't lost if storing the
+	// new key fails.
+	if err := r.Save(rotationFile); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err := saveNodeKey(k); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Rotation statement created as:", rotationFile)
+	fmt.Println("Old ID:", r.OldID)
+	fmt.Println("New ID:", r.NewID)
+	fmt.Println("Restart the node to announce the rotation to its peers, and update seed lists with the new ID.")
 }
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/foundation/terminal"
+)
+
+// passphraseEnv is the environment variable to read a passphrase from.
+const passphraseEnv = "TOQNS_PASSPHRASE"
+
+// passphraseFile is the file to read a passphrase from.
+var passphraseFile string
+
+// readPassphrase returns the passphrase from the passphrase file, the
+// environment, or prompts for it.
+//
+// When confirm is set, the prompt asks for the passphrase twice.
+func readPassphrase(confirm bool) ([]byte, error) {
+	if passphraseFile != "" {
+		b, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading passphrase file: %w", err)
+		}
+		return bytes.TrimRight(b, "\r\n"), nil
+	}
+
+	if v := os.Getenv(passphraseEnv); v != "" {
+		return []byte(v), nil
+	}
+
+	p, err := terminal.ReadPassword("Passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+
+	if confirm {
+		c, err := terminal.ReadPassword("Repeat passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(p, c) {
+			return nil, errors.New("passphrases don't match")
+		}
+	}
+
+	return p, nil
+}
+
+// loadKey loads a key file, and reads the passphrase if the key file is
+// encrypted.
+func loadKey(name string) (key.Key, error) {
+	enc, err := key.IsEncrypted(name)
+	if err != nil {
+		return key.Key{}, err
+	}
+
+	var passphrase []byte
+	if enc {
+		if passphrase, err = readPassphrase(false); err != nil {
+			return key.Key{}, err
+		}
+	}
+
+	return key.Load(name, passphrase)
+}
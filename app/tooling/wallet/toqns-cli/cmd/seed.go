@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/foundation/terminal"
+)
+
+var seedCmd = &cobra.Command{
+	Use:   "seed",
+	Short: "Manage mnemonic seed phrases",
+}
+
+var seedNewCmd = &cobra.Command{
+	Use:   "new",
+	Short: "Create a new mnemonic seed phrase",
+	Run:   seedNew,
+}
+
+var seedRestoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore the addresses of a mnemonic seed phrase",
+	Run:   seedRestore,
+}
+
+var (
+	mnemonicFile string
+	seedWords    int
+	seedCount    uint32
+)
+
+func init() {
+	rootCmd.AddCommand(seedCmd)
+	seedCmd.PersistentFlags().StringVar(&mnemonicFile, "mnemonic-file", "", "File with the mnemonic seed phrase, or enter it when prompted")
+	seedNewCmd.Flags().IntVarP(&seedWords, "words", "w", 24, "Number of words: 12, 15, 18, 21 or 24")
+	seedRestoreCmd.Flags().Uint32VarP(&seedCount, "count", "c", 5, "Number of addresses to show")
+
+	seedCmd.AddCommand(seedNewCmd)
+	seedCmd.AddCommand(seedRestoreCmd)
+}
+
+func seedNew(cmd *cobra.Command, args []string) {
+	mnemonic, err := key.NewMnemonic(seedWords * 32 / 3)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("\nWrite down the seed phrase and keep it safe. Anyone with it can access your accounts.")
+	fmt.Printf("\n%s\n\n", mnemonic)
+
+	if err := printSeedAddresses(mnemonic, 1); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func seedRestore(cmd *cobra.Command, args []string) {
+	mnemonic, err := readMnemonic()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err := printSeedAddresses(mnemonic, seedCount); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// printSeedAddresses prints the first count account and node addresses
+// derived from the mnemonic.
+func printSeedAddresses(mnemonic string, count uint32) error {
+	seed, err := key.MnemonicToSeed(mnemonic, "")
+	if err != nil {
+		return err
+	}
+
+	for i := uint32(0); i < count; i++ {
+		ac, err := deriveAddress(seed, key.AccountPath(i), key.AccountAddress)
+		if err != nil {
+			return err
+		}
+
+		nd, err := deriveAddress(seed, key.NodePath(i), key.NodeAddress)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%d: account %s node %s\n", i, ac, nd)
+	}
+
+	return nil
+}
+
+// deriveAddress returns the checksummed address for designation d of the
+// key derived from the seed.
+func deriveAddress(seed []byte, path string, d string) (string, error) {
+	k, err := key.FromSeed(seed, path)
+	if err != nil {
+		return "", err
+	}
+
+	a, err := k.Address(d)
+	if err != nil {
+		return "", err
+	}
+	return a.Checksummed()
+}
+
+// readMnemonic returns the mnemonic from the mnemonic file or prompts for
+// it, and validates it.
+func readMnemonic() (string, error) {
+	var b []byte
+	if mnemonicFile != "" {
+		var err error
+		if b, err = os.ReadFile(mnemonicFile); err != nil {
+			return "", fmt.Errorf("reading mnemonic file: %w", err)
+		}
+	} else {
+		var err error
+		if b, err = terminal.ReadPassword("Seed phrase: "); err != nil {
+			return "", err
+		}
+	}
+
+	mnemonic := string(bytes.TrimSpace(b))
+	if err := key.ValidateMnemonic(mnemonic); err != nil {
+		return "", err
+	}
+
+	return mnemonic, nil
+}
@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/tx"
+)
+
+var txCmd = &cobra.Command{
+	Use:   "tx",
+	Short: "Create transactions",
+}
+
+var txSignCmd = &cobra.Command{
+	Use:   "sign",
+	Short: "Create and sign a transaction",
+	Long: `Create and sign a transaction. The type is one of:
+
+  transfer            transfer the amount to the receiving account
+  register_validator  register the validator the account operates, signed with
+                      the node key of the validator from --validator-keyfile
+  bond                bond the amount as stake to the account's validator
+  unbond              unbond the amount of stake, released after the unbonding period
+
+Transactions of a multisig account are signed with --multisig instead of
+--keyfile. The first run stores the transaction in the authorization file,
+which the keyholders sign with multisig sign. Once the threshold is met,
+running the same command again creates the signed transaction.`,
+	Run: txSign,
+}
+
+var (
+	txKeyFile          string
+	txChainID          string
+	txType             string
+	txTo               string
+	txValidatorKeyFile string
+	txAmount           uint64
+	txFee              uint64
+	txNonce            uint64
+	txMemo             string
+	txOut              string
+	txMultisig         string
+)
+
+func init() {
+	rootCmd.AddCommand(txCmd)
+
+	txSignCmd.Flags().StringVarP(&txKeyFile, "keyfile", "k", "", "Key file of the sending account")
+	txSignCmd.Flags().StringVar(&passphraseFile, "passphrase-file", "", "File with the passphrase of the key file, or set "+passphraseEnv)
+	txSignCmd.Flags().StringVar(&txChainID, "chain-id", "toqns-devnet", "Chain ID of the network")
+	txSignCmd.Flags().StringVar(&txType, "type", "transfer", "Type of the transaction")
+	txSignCmd.Flags().StringVar(&txTo, "to", "", "Address of the receiving account of a transfer")
+	txSignCmd.Flags().StringVar(&txValidatorKeyFile, "validator-keyfile", "", "Node key file of the validator to register")
+	txSignCmd.Flags().Uint64Var(&txAmount, "amount", 0, "Amount to transfer, bond or unbond")
+	txSignCmd.Flags().Uint64Var(&txFee, "fee", 0, "Fee to pay")
+	txSignCmd.Flags().Uint64Var(&txNonce, "nonce", 0, "Nonce of the sending account")
+	txSignCmd.Flags().StringVar(&txMemo, "memo", "", "Optional memo")
+	txSignCmd.Flags().StringVarP(&txOut, "out", "o", "", "File to store the signed transaction, or print it")
+	txSignCmd.Flags().StringVar(&txMultisig, "multisig", "", "Authorization file of the sending multisig account")
+
+	txCmd.AddCommand(txSignCmd)
+}
+
+func txSign(cmd *cobra.Command, args []string) {
+	typ := txType
+	if typ == "transfer" {
+		typ = tx.TypeTransfer
+	}
+
+	var to key.Address
+	var err error
+	if txTo != "" {
+		if to, err = parseAccountAddress(txTo); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if (typ == tx.TypeRegister) != (txValidatorKeyFile != "") {
+		fmt.Println("--validator-keyfile is required for", tx.TypeRegister, "and only for it")
+		os.Exit(1)
+	}
+
+	if (txKeyFile == "") == (txMultisig == "") {
+		fmt.Println("either --keyfile or --multisig is required")
+		os.Exit(1)
+	}
+
+	var k key.Key
+	var af authorizationFile
+	var from key.Address
+	if txMultisig != "" {
+		if af, _, err = readAuthorization(txMultisig); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		from, err = af.Authorization.Multisig.Address()
+	} else {
+		if k, err = loadKey(txKeyFile); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		from, err = k.Address(key.AccountAddress)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	t := tx.Tx{
+		Type:    typ,
+		ChainID: txChainID,
+		Nonce:   txNonce,
+		From:    from,
+		To:      to,
+		Amount:  txAmount,
+		Fee:     txFee,
+		Memo:    txMemo,
+	}
+
+	// The node key of the validator signs that the account operates it.
+	if txValidatorKeyFile != "" {
+		node, err := loadKey(txValidatorKeyFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if t, err = t.SignValidator(node); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if err := t.Validate(txChainID); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if txMultisig != "" {
+		txSignMultisig(t, af)
+		return
+	}
+
+	stx, err := t.Sign(k)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	writeTx(stx)
+}
+
+// txSignMultisig stores the transaction in the authorization file for the
+// keyholders to sign, or creates the signed transaction once the
+// authorization meets its threshold.
+func txSignMultisig(t tx.Tx, af authorizationFile) {
+	data := hex.EncodeToString(t.SigningBytes())
+
+	if af.Data != data {
+		if len(af.Authorization.Signatures) > 0 {
+			fmt.Println("authorization file", txMultisig, "is signed for another transaction")
+			os.Exit(1)
+		}
+
+		af.Data = data
+		af.Tx = &t
+		if err := writeAuthorization(txMultisig, af); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Println("Transaction", t.Hash(), "stored in", txMultisig)
+		fmt.Printf("Collect %d signatures with multisig sign, then run this command again\n", af.Authorization.Multisig.Threshold)
+		return
+	}
+
+	if err := af.Authorization.Verify(t.SigningBytes()); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	auth := af.Authorization
+	auth.Signatures = auth.Signatures[:auth.Multisig.Threshold]
+
+	writeTx(tx.SignedTx{Tx: t, Multisig: &auth})
+}
+
+// writeTx stores the signed transaction in the output file, or prints it.
+func writeTx(stx tx.SignedTx) {
+	b, err := json.MarshalIndent(stx, "", "  ")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if txOut == "" {
+		fmt.Println(string(b))
+		return
+	}
+
+	if err := os.WriteFile(txOut, b, 0644); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("Transaction", stx.Hash(), "stored as:", txOut)
+}
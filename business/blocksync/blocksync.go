@@ -0,0 +1,528 @@
+// Package blocksync catches the chain up with the chains of peers, for
+// nodes that join late or restart behind.
+//
+// Peers advertise the height and hash of the head of their chain. The
+// syncing node requests ranges of blocks from the peers that are ahead,
+// from several peers in parallel, and applies the blocks in order. Every
+// block is checked before it's applied: it must pass the verification of
+// the consensus engine, which checks that it follows the chain, and
+// produce the state root of its header. Blocks of engines whose blocks
+// aren't final on their own, such as proof of authority, are held back
+// until the blocks on top of them make them final. The sync ends with the
+// blocks that aren't final yet, which the consensus engine waits for.
+//
+// Peers that don't answer in time, or that serve blocks that fail the
+// checks or that don't match their advertised head, are dropped for the
+// rest of the sync. Their ranges are requested from the other peers.
+package blocksync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/consensus"
+	"github.com/toqns/toqns/business/genesis"
+	"github.com/toqns/toqns/business/state"
+	"go.uber.org/zap"
+)
+
+// Limits of a sync.
+const (
+	// RangeSize is the maximum number of blocks requested at once.
+	RangeSize = 100
+
+	// MaxRequests is the maximum number of requests in flight, each to a
+	// different peer.
+	MaxRequests = 8
+
+	// RequestTimeout is the time a peer has to answer a request.
+	RequestTimeout = 10 * time.Second
+
+	// PollInterval is the time between requests for the status of the
+	// peers when the last round of requests applied no blocks.
+	PollInterval = time.Second
+)
+
+// window is how far ahead of the head blocks are requested, which bounds
+// the blocks that are kept until the blocks before them arrive.
+const window = MaxRequests * RangeSize
+
+// errPeer is returned for responses that show that the peer is stalled or
+// lying.
+var errPeer = errors.New("peer misbehaved")
+
+// Status is the head of a peer's chain.
+type Status struct {
+	Height uint64 `json:"height"`
+	Hash   string `json:"hash"`
+
+	// Base is the height of the first block after the genesis block that
+	// the peer has, for peers that restored their chain from a snapshot.
+	Base uint64 `json:"base,omitempty"`
+}
+
+// Network requests the chain status and blocks of peers.
+type Network interface {
+	// Peers returns the IDs of the peers.
+	Peers() []string
+
+	// Status returns the head of the peer's chain.
+	Status(ctx context.Context, peer string) (Status, error)
+
+	// Blocks returns the blocks of the peer's chain from height from up to
+	// and including height to. Peers may return fewer blocks, such as to
+	// limit the size of the response, but at least one.
+	Blocks(ctx context.Context, peer string, from, to uint64) ([]chain.Block, error)
+}
+
+// Config contains the dependencies of a sync.
+type Config struct {
+	Genesis genesis.Genesis
+	State   *state.State
+	Store   *chain.Store
+	Network Network
+
+	// Verify verifies the block on top of the parent against the rules of
+	// the consensus engine. The parent is the head, or a verified block
+	// that's held back as it isn't final yet.
+	Verify func(parent, b chain.Block) error
+
+	// Final returns the number of the verified blocks after the head that
+	// are final, for engines whose blocks aren't final on their own. It's
+	// nil when every verified block is final.
+	Final func(blocks []chain.Block) int
+
+	Log *zap.SugaredLogger
+}
+
+// Sync requests the blocks that peers have beyond the stored chain, and
+// applies them until no peer is ahead anymore. It returns the number of
+// blocks applied.
+//
+// Failing peers don't fail the sync, which ends when no peer that's left
+// is ahead, or when none of the peers that are ahead has the block after
+// the head. Errors are returned for failures of the store and the state,
+// and when the context is done.
+func Sync(ctx context.Context, cfg Config) (uint64, error) {
+	head, err := cfg.Store.Head()
+	if err != nil {
+		return 0, fmt.Errorf("reading head: %w", err)
+	}
+
+	s := syncer{
+		cfg:     cfg,
+		head:    head,
+		dropped: make(map[string]bool),
+	}
+
+	for {
+		peers, err := s.poll(ctx)
+		if err != nil {
+			return s.applied, err
+		}
+
+		if len(peers) == 0 {
+			return s.applied, nil
+		}
+
+		applied := s.applied
+		if err := s.fetch(ctx, peers); err != nil {
+			return s.applied, err
+		}
+
+		// Peers are given time to answer again if none of them served
+		// blocks that could be applied, unless the blocks they served
+		// aren't final yet.
+		if s.applied == applied {
+			if len(s.held) > 0 {
+				s.cfg.Log.Infow("sync", "status", "blocks aren't final yet", "height", s.head.Height, "held", len(s.held))
+				return s.applied, nil
+			}
+
+			select {
+			case <-ctx.Done():
+				return s.applied, ctx.Err()
+			case <-time.After(PollInterval):
+			}
+		}
+	}
+}
+
+// =============================================================================
+
+// syncer holds the state of a sync.
+type syncer struct {
+	cfg     Config
+	head    chain.Block
+	applied uint64
+	dropped map[string]bool
+
+	// held are the verified blocks after the head that aren't final yet.
+	held []held
+}
+
+// held is a verified block that's held back until it's final.
+type held struct {
+	block chain.Block
+	peer  string
+}
+
+// span is a range of heights to request. Heights start at 1, as the
+// genesis block is never requested, so the zero span is no range.
+type span struct {
+	from, to uint64
+}
+
+// result is the response of a peer to a request for a range.
+type result struct {
+	peer   string
+	span   span
+	blocks []chain.Block
+	err    error
+}
+
+// poll requests the status of the peers, and returns the peers that are
+// ahead of the head. Peers with a different block at their head height
+// are dropped. No peers are returned when none of the peers that are ahead
+// has the block after the head, as the chain can't be synced from them.
+func (s *syncer) poll(ctx context.Context) (map[string]Status, error) {
+	type reply struct {
+		peer   string
+		status Status
+		err    error
+	}
+
+	var peers []string
+	for _, p := range s.cfg.Network.Peers() {
+		if !s.dropped[p] {
+			peers = append(peers, p)
+		}
+	}
+
+	replies := make(chan reply, len(peers))
+	for _, p := range peers {
+		p := p
+		go func() {
+			ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+			defer cancel()
+
+			st, err := s.cfg.Network.Status(ctx, p)
+			replies <- reply{peer: p, status: st, err: err}
+		}()
+	}
+
+	ahead := make(map[string]Status)
+	for range peers {
+		r := <-replies
+		switch {
+		case r.err != nil:
+			s.cfg.Log.Debugw("sync", "status", "requesting status failed", "peer", r.peer, "ERROR", r.err)
+
+		case r.status.Height > s.head.Height:
+			ahead[r.peer] = r.status
+
+		default:
+			// Heads before the base of a restored chain can't be checked.
+			b, err := s.cfg.Store.ByHeight(r.status.Height)
+			if errors.Is(err, chain.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("reading block %d: %w", r.status.Height, err)
+			}
+			if b.Hash() != r.status.Hash {
+				s.drop(r.peer, fmt.Errorf("%w: head %d %s isn't in the chain", errPeer, r.status.Height, r.status.Hash))
+			}
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, st := range ahead {
+		if st.Base <= s.head.Height+1 {
+			return ahead, nil
+		}
+	}
+
+	if len(ahead) > 0 {
+		s.cfg.Log.Warnw("sync", "status", "no peer has the next block", "height", s.head.Height, "peers", len(ahead))
+	}
+
+	return nil, nil
+}
+
+// fetch requests the blocks of the peers in ranges and applies them, until
+// the blocks up to the highest head of the peers are applied or no peer
+// is left to request the missing blocks from.
+func (s *syncer) fetch(ctx context.Context, peers map[string]Status) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var target uint64
+	for _, st := range peers {
+		if st.Height > target {
+			target = st.Height
+		}
+	}
+
+	s.cfg.Log.Infow("sync", "status", "syncing blocks", "height", s.head.Height, "target", target, "peers", len(peers))
+
+	// Blocks that were held back in an earlier round are requested again,
+	// as the peers may have moved on to another chain since.
+	s.held = nil
+
+	var (
+		next     = s.head.Height + 1
+		retry    []span
+		busy     = make(map[string]bool)
+		blocks   = make(map[uint64]chain.Block)
+		servedBy = make(map[uint64]string)
+		results  = make(chan result)
+	)
+
+	// requeue requests the blocks the peer served again, as they can't
+	// be trusted once the peer misbehaved.
+	requeue := func(peer string) {
+		for h, p := range servedBy {
+			if p == peer {
+				retry = append(retry, span{from: h, to: h})
+				delete(blocks, h)
+				delete(servedBy, h)
+			}
+		}
+	}
+
+	for {
+		// Requests are sent to idle peers that have the blocks, within
+		// the window after the head.
+		for len(busy) < MaxRequests {
+			var sp span
+			switch {
+			case len(retry) > 0:
+				sp = retry[0]
+			case next <= target && next <= s.head.Height+window:
+				sp = span{from: next, to: next + RangeSize - 1}
+				if sp.to > target {
+					sp.to = target
+				}
+			}
+			if sp.from == 0 {
+				break
+			}
+
+			peer, ok := s.pick(peers, busy, sp.from)
+			if !ok {
+				break
+			}
+
+			// Only the part of the range that the peer has is requested
+			// from it, the rest is left for later.
+			rest := sp
+			if st := peers[peer]; sp.to > st.Height {
+				sp.to = st.Height
+			}
+			rest.from = sp.to + 1
+
+			switch {
+			case len(retry) > 0 && rest.from <= rest.to:
+				retry[0] = rest
+			case len(retry) > 0:
+				retry = retry[1:]
+			default:
+				next = rest.from
+			}
+
+			busy[peer] = true
+			go s.request(ctx, peer, sp, results)
+		}
+
+		if len(busy) == 0 {
+			if s.tip().Height < target {
+				s.cfg.Log.Warnw("sync", "status", "no peer left to sync from", "height", s.head.Height, "target", target)
+			}
+			return nil
+		}
+
+		var r result
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case r = <-results:
+		}
+		delete(busy, r.peer)
+
+		if err := s.check(r, peers[r.peer]); err != nil {
+			s.drop(r.peer, err)
+			delete(peers, r.peer)
+			requeue(r.peer)
+			retry = append(retry, r.span)
+			continue
+		}
+
+		for _, b := range r.blocks {
+			if b.Height > s.tip().Height {
+				blocks[b.Height] = b
+				servedBy[b.Height] = r.peer
+			}
+		}
+
+		// The rest of a partial response is requested again.
+		if last := r.blocks[len(r.blocks)-1].Height; last < r.span.to {
+			retry = append(retry, span{from: last + 1, to: r.span.to})
+		}
+
+		// Blocks are verified in order, as far as they are there, and
+		// applied once they are final.
+		for {
+			h := s.tip().Height + 1
+			b, ok := blocks[h]
+			if !ok {
+				break
+			}
+			peer := servedBy[h]
+			delete(blocks, h)
+			delete(servedBy, h)
+
+			if err := s.cfg.Verify(s.tip(), b); err != nil {
+				s.drop(peer, fmt.Errorf("%w: block %d: %v", errPeer, h, err))
+				delete(peers, peer)
+				requeue(peer)
+				retry = append(retry, span{from: h, to: h})
+				break
+			}
+			s.held = append(s.held, held{block: b, peer: peer})
+
+			// The blocks on top of a block that fails to apply were
+			// verified against it, so they are requested again with it.
+			failed, err := s.applyFinal()
+			if err != nil {
+				if !errors.Is(err, errPeer) {
+					return err
+				}
+				s.drop(failed.peer, err)
+				delete(peers, failed.peer)
+				requeue(failed.peer)
+				retry = append(retry, span{from: failed.block.Height, to: h})
+				break
+			}
+		}
+	}
+}
+
+// pick returns an idle peer that has the block at the height.
+func (s *syncer) pick(peers map[string]Status, busy map[string]bool, height uint64) (string, bool) {
+	for p, st := range peers {
+		if !busy[p] && st.Height >= height && st.Base <= height {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// request requests the range of blocks from the peer and sends the result.
+func (s *syncer) request(ctx context.Context, peer string, sp span, results chan<- result) {
+	rctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
+
+	blocks, err := s.cfg.Network.Blocks(rctx, peer, sp.from, sp.to)
+
+	select {
+	case results <- result{peer: peer, span: sp, blocks: blocks, err: err}:
+	case <-ctx.Done():
+	}
+}
+
+// check checks that the response has the consecutive blocks of the range,
+// and the advertised head if it's in the range.
+func (s *syncer) check(r result, st Status) error {
+	if r.err != nil {
+		return fmt.Errorf("%w: requesting blocks %d to %d: %v", errPeer, r.span.from, r.span.to, r.err)
+	}
+
+	if len(r.blocks) == 0 || uint64(len(r.blocks)) > r.span.to-r.span.from+1 {
+		return fmt.Errorf("%w: %d blocks for range %d to %d", errPeer, len(r.blocks), r.span.from, r.span.to)
+	}
+
+	for i, b := range r.blocks {
+		if b.Height != r.span.from+uint64(i) {
+			return fmt.Errorf("%w: block %d at height %d of the range", errPeer, b.Height, r.span.from+uint64(i))
+		}
+
+		if b.Height == st.Height && b.Hash() != st.Hash {
+			return fmt.Errorf("%w: block %d isn't the advertised head", errPeer, b.Height)
+		}
+	}
+
+	return nil
+}
+
+// tip returns the last verified block, which is the last block that's
+// held back or the head.
+func (s *syncer) tip() chain.Block {
+	if len(s.held) > 0 {
+		return s.held[len(s.held)-1].block
+	}
+	return s.head
+}
+
+// applyFinal applies the held blocks that are final. When a block fails to
+// apply, it's returned with the error, and the blocks that are held on top
+// of it are discarded.
+func (s *syncer) applyFinal() (held, error) {
+	final := len(s.held)
+	if s.cfg.Final != nil {
+		blocks := make([]chain.Block, len(s.held))
+		for i, h := range s.held {
+			blocks[i] = h.block
+		}
+		final = s.cfg.Final(blocks)
+	}
+
+	for ; final > 0; final-- {
+		h := s.held[0]
+		if err := s.apply(h.block); err != nil {
+			s.held = nil
+			return h, err
+		}
+		s.held = s.held[1:]
+	}
+
+	return held{}, nil
+}
+
+// apply applies the verified block on top of the head to the state and
+// stores it. Blocks with changes that fail to apply return errPeer.
+func (s *syncer) apply(b chain.Block) error {
+	batch := s.cfg.State.Begin(b.Height)
+	if err := consensus.Apply(batch, b, s.cfg.Genesis.Consensus); err != nil {
+		return fmt.Errorf("%w: block %d: %v", errPeer, b.Height, err)
+	}
+
+	if err := s.cfg.Store.Append(b); err != nil {
+		return fmt.Errorf("storing block %d: %w", b.Height, err)
+	}
+
+	if err := batch.Commit(); err != nil {
+		return fmt.Errorf("committing block %d: %w", b.Height, err)
+	}
+
+	s.head = b
+	s.applied++
+
+	if b.Height%RangeSize == 0 {
+		s.cfg.Log.Infow("sync", "status", "blocks synced", "height", b.Height)
+	}
+
+	return nil
+}
+
+// drop drops the peer for the rest of the sync.
+func (s *syncer) drop(peer string, err error) {
+	s.dropped[peer] = true
+	s.cfg.Log.Warnw("sync", "status", "peer dropped", "peer", peer, "ERROR", err)
+}
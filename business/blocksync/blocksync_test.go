@@ -0,0 +1,393 @@
+package blocksync_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/toqns/toqns/business/blocksync"
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/consensus"
+	"github.com/toqns/toqns/business/genesis"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/state"
+	"github.com/toqns/toqns/business/tx"
+	"go.uber.org/zap"
+)
+
+// Success and failure markers.
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+const chainID = "toqns-test"
+
+func TestSync(t *testing.T) {
+	validator, _ := key.New()
+	alice, _ := key.New()
+	aliceAddr, _ := alice.Address(key.AccountAddress)
+	bob, _ := key.New()
+	bobAddr, _ := bob.Address(key.AccountAddress)
+
+	g := genesis.New(chainID)
+	g.Consensus.EpochLength = 50
+	g.AddAccount(aliceAddr, 1000)
+	g.AddValidator(validator.PublicKey(), 1)
+
+	source := newChain(t, g)
+	var snapshot map[key.Address]state.Account
+	for h := uint64(1); h <= 250; h++ {
+		var txs []tx.SignedTx
+		if h%10 == 0 {
+			stx, _ := tx.Tx{ChainID: chainID, Nonce: h/10 - 1, From: aliceAddr, To: bobAddr, Amount: 1}.Sign(alice)
+			txs = append(txs, stx)
+		}
+		source.add(t, validator, txs)
+
+		if h == 100 {
+			_, _, snapshot = source.state.Snapshot()
+		}
+	}
+
+	t.Log("Given the need to catch up with the chain of peers.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen all peers are honest.", testID)
+		{
+			n := newChain(t, g)
+			net := network{"a": source.peer(), "b": source.peer(), "c": source.peer()}
+
+			applied, err := n.sync(g, net)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to sync: %v.", failed, testID, err)
+			}
+			if applied != 250 {
+				t.Fatalf("\t%s\tTest %d:\tShould apply 250 blocks, but applied %d.", failed, testID, applied)
+			}
+			t.Logf("\t%s\tTest %d:\tShould apply 250 blocks.", success, testID)
+
+			n.checkSynced(t, testID, source)
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen peers stall, lie and serve partial ranges.", testID)
+		{
+			n := newChain(t, g)
+
+			liar := source.peer()
+			liar.tamper = 120
+			stalled := source.peer()
+			stalled.stall = true
+			slow := source.peer()
+			slow.limit = 7
+			net := network{"liar": liar, "stalled": stalled, "slow": slow}
+
+			applied, err := n.sync(g, net)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to sync: %v.", failed, testID, err)
+			}
+			if applied != 250 {
+				t.Fatalf("\t%s\tTest %d:\tShould apply 250 blocks from the honest peer, but applied %d.", failed, testID, applied)
+			}
+			t.Logf("\t%s\tTest %d:\tShould apply 250 blocks from the honest peer.", success, testID)
+
+			n.checkSynced(t, testID, source)
+		}
+
+		testID = 2
+		t.Logf("\tTest %d:\tWhen a peer advertises blocks it doesn't have.", testID)
+		{
+			n := newChain(t, g)
+
+			liar := source.peer()
+			liar.claim = 1000
+			net := network{"liar": liar}
+
+			applied, err := n.sync(g, net)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould end the sync without error: %v.", failed, testID, err)
+			}
+			if applied != 250 {
+				t.Fatalf("\t%s\tTest %d:\tShould apply the blocks the peer has, but applied %d.", failed, testID, applied)
+			}
+			t.Logf("\t%s\tTest %d:\tShould apply the blocks the peer has and drop it.", success, testID)
+		}
+
+		testID = 3
+		t.Logf("\tTest %d:\tWhen the chain is restored from a snapshot.", testID)
+		{
+			n := newChain(t, g)
+
+			base, _ := source.store.ByHeight(100)
+			if err := n.store.Restore(base); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to restore the chain: %v.", failed, testID, err)
+			}
+			if err := n.state.Restore(100, base.StateRoot, snapshot); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to restore the state: %v.", failed, testID, err)
+			}
+
+			// A peer that's behind has a head in the gap of the chain.
+			behind := newChain(t, g)
+			for h := uint64(1); h <= 20; h++ {
+				blk, _ := source.store.ByHeight(h)
+				behind.store.Append(blk)
+			}
+			net := network{"a": source.peer(), "behind": behind.peer()}
+
+			applied, err := n.sync(g, net)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to sync: %v.", failed, testID, err)
+			}
+			if applied != 150 {
+				t.Fatalf("\t%s\tTest %d:\tShould apply the 150 blocks after the snapshot, but applied %d.", failed, testID, applied)
+			}
+			t.Logf("\t%s\tTest %d:\tShould apply the 150 blocks after the snapshot.", success, testID)
+
+			n.checkSynced(t, testID, source)
+		}
+
+		testID = 4
+		t.Logf("\tTest %d:\tWhen the peers that are ahead don't have the next block.", testID)
+		{
+			n := newChain(t, g)
+
+			restored := newChain(t, g)
+			for h := uint64(100); h <= 250; h++ {
+				blk, _ := source.store.ByHeight(h)
+				if h == 100 {
+					restored.store.Restore(blk)
+					continue
+				}
+				restored.store.Append(blk)
+			}
+			p := restored.peer()
+			p.base = 101
+			net := network{"restored": p}
+
+			applied, err := n.sync(g, net)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould end the sync without error: %v.", failed, testID, err)
+			}
+			if applied != 0 {
+				t.Fatalf("\t%s\tTest %d:\tShould apply no blocks, but applied %d.", failed, testID, applied)
+			}
+			if p.statuses != 1 {
+				t.Fatalf("\t%s\tTest %d:\tShould request the status once, but requested it %d times.", failed, testID, p.statuses)
+			}
+			t.Logf("\t%s\tTest %d:\tShould end the sync after requesting the status once.", success, testID)
+		}
+
+		testID = 5
+		t.Logf("\tTest %d:\tWhen the blocks at the head of the peers aren't final.", testID)
+		{
+			n := newChain(t, g)
+
+			// Blocks are final with five blocks on top of them.
+			n.final = func(blocks []chain.Block) int {
+				if len(blocks) < 5 {
+					return 0
+				}
+				return len(blocks) - 5
+			}
+			net := network{"a": source.peer(), "b": source.peer()}
+
+			applied, err := n.sync(g, net)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould end the sync without error: %v.", failed, testID, err)
+			}
+			if applied != 245 {
+				t.Fatalf("\t%s\tTest %d:\tShould apply the 245 final blocks, but applied %d.", failed, testID, applied)
+			}
+			head, _ := n.store.Head()
+			if head.Height != 245 {
+				t.Fatalf("\t%s\tTest %d:\tShould have the head at height 245, got %d.", failed, testID, head.Height)
+			}
+			t.Logf("\t%s\tTest %d:\tShould apply the final blocks and hold back the rest.", success, testID)
+		}
+	}
+}
+
+// =============================================================================
+
+// testChain is a chain with its state.
+type testChain struct {
+	state *state.State
+	store *chain.Store
+	g     genesis.Genesis
+
+	// final returns the number of final blocks, for syncs of blocks
+	// that aren't final on their own.
+	final func(blocks []chain.Block) int
+}
+
+func newChain(t *testing.T, g genesis.Genesis) *testChain {
+	st, _ := state.New(chainID, state.NewMemoryStorage())
+	store, err := chain.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	if _, err := genesis.Init(g, st, store); err != nil {
+		t.Fatalf("initializing genesis: %v", err)
+	}
+
+	return &testChain{state: st, store: store, g: g}
+}
+
+// add adds a block with the transactions, proposed by the validator.
+func (c *testChain) add(t *testing.T, validator key.Key, txs []tx.SignedTx) {
+	head, _ := c.store.Head()
+
+	batch := c.state.Begin(head.Height + 1)
+	for _, stx := range txs {
+		if err := batch.Apply(stx, ""); err != nil {
+			t.Fatalf("applying transaction: %v", err)
+		}
+	}
+	vals := consensus.EndBlock(batch, c.g.Consensus)
+
+	h := chain.Header{
+		ChainID:        chainID,
+		Height:         head.Height + 1,
+		ParentHash:     head.Hash(),
+		Timestamp:      head.Timestamp + 1000,
+		TxRoot:         chain.TxRoot(txs),
+		StateRoot:      batch.Root(),
+		ValidatorsHash: chain.ValidatorsHash(vals),
+	}
+
+	b, err := chain.Sign(h, txs, validator)
+	if err != nil {
+		t.Fatalf("signing block: %v", err)
+	}
+	b.Validators = vals
+
+	if err := c.store.Append(b); err != nil {
+		t.Fatalf("storing block: %v", err)
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatalf("committing block: %v", err)
+	}
+}
+
+// peer returns a peer that serves the chain.
+func (c *testChain) peer() *peer {
+	return &peer{store: c.store}
+}
+
+// sync syncs the chain with the network.
+func (c *testChain) sync(g genesis.Genesis, net network) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return blocksync.Sync(ctx, blocksync.Config{
+		Genesis: g,
+		State:   c.state,
+		Store:   c.store,
+		Network: net,
+		Verify: func(parent, b chain.Block) error {
+			if b.ParentHash != parent.Hash() {
+				return fmt.Errorf("%w: unknown parent", chain.ErrInvalidBlock)
+			}
+			return b.Verify(chainID)
+		},
+		Final: c.final,
+		Log:   zap.NewNop().Sugar(),
+	})
+}
+
+// checkSynced checks that the chain and state are the same as the source's.
+func (c *testChain) checkSynced(t *testing.T, testID int, source *testChain) {
+	head, _ := c.store.Head()
+	want, _ := source.store.Head()
+	if head.Hash() != want.Hash() {
+		t.Fatalf("\t%s\tTest %d:\tShould have the head of the peers, got %d, expected %d.", failed, testID, head.Height, want.Height)
+	}
+	if c.state.Root() != source.state.Root() {
+		t.Fatalf("\t%s\tTest %d:\tShould have the state of the peers.", failed, testID)
+	}
+	t.Logf("\t%s\tTest %d:\tShould have the head and state of the peers.", success, testID)
+}
+
+// =============================================================================
+
+// peer serves blocks of a store, possibly misbehaving.
+type peer struct {
+	store *chain.Store
+
+	// claim is the height to advertise instead of the head's.
+	claim uint64
+
+	// tamper is the height of a block to serve altered.
+	tamper uint64
+
+	// stall makes the peer not answer requests for blocks.
+	stall bool
+
+	// limit is the maximum number of blocks per response.
+	limit int
+
+	// base is the base to advertise, for peers with a restored chain.
+	base uint64
+
+	// statuses is the number of requests for the status.
+	statuses int
+}
+
+type network map[string]*peer
+
+func (net network) Peers() []string {
+	var ids []string
+	for id := range net {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (net network) Status(ctx context.Context, id string) (blocksync.Status, error) {
+	p := net[id]
+	p.statuses++
+
+	head, err := p.store.Head()
+	if err != nil {
+		return blocksync.Status{}, err
+	}
+
+	st := blocksync.Status{Height: head.Height, Hash: head.Hash(), Base: p.base}
+	if p.claim != 0 {
+		st = blocksync.Status{Height: p.claim, Hash: "00"}
+	}
+	return st, nil
+}
+
+func (net network) Blocks(ctx context.Context, id string, from, to uint64) ([]chain.Block, error) {
+	p := net[id]
+
+	if p.stall {
+		return nil, context.DeadlineExceeded
+	}
+
+	if p.limit > 0 && to-from+1 > uint64(p.limit) {
+		to = from + uint64(p.limit) - 1
+	}
+
+	blocks, err := p.store.Range(from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 {
+		return nil, errors.New("not found")
+	}
+
+	for i := range blocks {
+		if blocks[i].Height == p.tamper {
+			blocks[i].Timestamp++
+		}
+	}
+
+	return blocks, nil
+}
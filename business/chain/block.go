@@ -0,0 +1,294 @@
+// Package chain provides the blocks of the Toqns chain and the store that
+// keeps them on disk.
+package chain
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/tx"
+	"github.com/toqns/toqns/foundation/canonical"
+	"github.com/toqns/toqns/foundation/merkle"
+)
+
+// MaxBlockTxs is the maximum number of transactions in a block.
+const MaxBlockTxs = 10_000
+
+// MaxBlockSize is the maximum size of the JSON encoding of a block without
+// its justification. Blocks are proposed to peers in UDP datagrams, so a
+// block must fit in one with the encoding of the message that carries it.
+// Messages with the justification, which grows with the validators, are
+// sent over TCP when they don't fit.
+const MaxBlockSize = 32 << 10
+
+// MaxValidators is the maximum number of validators, so the validator set
+// fits in a block.
+const MaxValidators = 128
+
+// signingPrefix is the domain prefix of the signed data of blocks.
+const signingPrefix = "toqns/block:"
+
+// encodingVersion is the version of the canonical encoding.
+const encodingVersion = 1
+
+// ErrInvalidBlock is returned when a block fails verification.
+var ErrInvalidBlock = errors.New("invalid block")
+
+// Header is the part of a block that identifies it. The transactions are
+// committed to by their Merkle root.
+type Header struct {
+	ChainID    string `json:"chain_id"`
+	Height     uint64 `json:"height"`
+	ParentHash string `json:"parent_hash"`
+
+	// Timestamp is the time the block was proposed in Unix milliseconds.
+	Timestamp int64 `json:"timestamp"`
+
+	// Proposer is the node address of the validator that proposed the
+	// block.
+	Proposer key.Address `json:"proposer"`
+
+	// TxRoot is the Merkle root of the hashes of the transactions.
+	TxRoot string `json:"tx_root"`
+
+	// StateRoot is the state root after the block's transactions are
+	// applied.
+	StateRoot string `json:"state_root"`
+
+	// ValidatorsHash is the hash of the validator set that the block
+	// starts, at the end of an epoch.
+	ValidatorsHash string `json:"validators_hash,omitempty"`
+
+	// EvidenceRoot is the Merkle root of the evidence in the block.
+	EvidenceRoot string `json:"evidence_root,omitempty"`
+}
+
+// Bytes returns the canonical encoding of the header.
+func (h Header) Bytes() []byte {
+	b := make([]byte, 0, 256)
+	b = append(b, encodingVersion)
+	b = canonical.AppendString(b, h.ChainID)
+	b = canonical.AppendUint64(b, h.Height)
+	b = canonical.AppendString(b, h.ParentHash)
+	b = canonical.AppendUint64(b, uint64(h.Timestamp))
+	b = canonical.AppendString(b, string(h.Proposer))
+	b = canonical.AppendString(b, h.TxRoot)
+	b = canonical.AppendString(b, h.StateRoot)
+
+	// Headers without validators and evidence encode the same as before
+	// these existed.
+	if h.ValidatorsHash != "" || h.EvidenceRoot != "" {
+		b = canonical.AppendString(b, h.ValidatorsHash)
+		b = canonical.AppendString(b, h.EvidenceRoot)
+	}
+	return b
+}
+
+// SigningBytes returns the data that is signed by the proposer, which is
+// the canonical encoding with a domain prefix.
+func (h Header) SigningBytes() []byte {
+	return append([]byte(signingPrefix), h.Bytes()...)
+}
+
+// Hash returns the hex encoded hash of the header, which identifies the
+// block.
+func (h Header) Hash() string {
+	return key.HashString(h.SigningBytes())
+}
+
+// Time returns the timestamp as time.
+func (h Header) Time() time.Time {
+	return time.UnixMilli(h.Timestamp)
+}
+
+// =============================================================================
+
+// Validator is a validator with its voting power.
+type Validator struct {
+	Address key.Address `json:"address"`
+	Power   uint64      `json:"power"`
+}
+
+// ValidatorsHash returns the hex encoded Merkle root of the validators, or
+// an empty string if there are none.
+func ValidatorsHash(vals []Validator) string {
+	if len(vals) == 0 {
+		return ""
+	}
+
+	leaves := make([][]byte, len(vals))
+	for i, v := range vals {
+		leaves[i] = canonical.AppendUint64(canonical.AppendString(nil, string(v.Address)), v.Power)
+	}
+	return hex.EncodeToString(merkle.Root(leaves))
+}
+
+// Evidence is proof that a validator misbehaved, such as two conflicting
+// votes it signed. The messages are specific to the consensus engine,
+// which verifies them.
+type Evidence struct {
+	Validator key.Address     `json:"validator"`
+	Height    uint64          `json:"height"`
+	A         json.RawMessage `json:"a"`
+	B         json.RawMessage `json:"b"`
+}
+
+// EvidenceRoot returns the hex encoded Merkle root of the evidence, or an
+// empty string if there is none.
+func EvidenceRoot(evidence []Evidence) string {
+	if len(evidence) == 0 {
+		return ""
+	}
+
+	leaves := make([][]byte, len(evidence))
+	for i, ev := range evidence {
+		b := canonical.AppendString(nil, string(ev.Validator))
+		b = canonical.AppendUint64(b, ev.Height)
+		b = canonical.AppendString(b, string(ev.A))
+		leaves[i] = canonical.AppendString(b, string(ev.B))
+	}
+	return hex.EncodeToString(merkle.Root(leaves))
+}
+
+// =============================================================================
+
+// Block is a header with its transactions and the proposer's signature.
+type Block struct {
+	Header
+	Txs       []tx.SignedTx `json:"txs"`
+	PublicKey key.PublicKey `json:"public_key,omitempty"`
+	Signature string        `json:"signature,omitempty"`
+
+	// Validators is the validator set from the next block on. It's only
+	// set at the end of an epoch, when the set changes.
+	Validators []Validator `json:"validators,omitempty"`
+
+	// Evidence is the proof of misbehaving validators that are slashed by
+	// the block.
+	Evidence []Evidence `json:"evidence,omitempty"`
+
+	// Justification proves that the block is final, such as the votes of
+	// the validators that committed it. It's specific to the consensus
+	// engine and isn't part of the hash, as it's only known after the
+	// block is proposed.
+	Justification json.RawMessage `json:"justification,omitempty"`
+}
+
+// New returns a block with the transactions on top of the parent, signed
+// by the proposer.
+//
+// The state root must be the root after the transactions are applied.
+func New(parent Header, txs []tx.SignedTx, stateRoot string, proposer key.Signer) (Block, error) {
+	h := Header{
+		ChainID:    parent.ChainID,
+		Height:     parent.Height + 1,
+		ParentHash: parent.Hash(),
+		Timestamp:  time.Now().UnixMilli(),
+		TxRoot:     TxRoot(txs),
+		StateRoot:  stateRoot,
+	}
+
+	// Blocks are always newer than their parent, also with clock skew.
+	if h.Timestamp <= parent.Timestamp {
+		h.Timestamp = parent.Timestamp + 1
+	}
+
+	return Sign(h, txs, proposer)
+}
+
+// Sign signs the header as proposer and returns the block. The proposer
+// field is set to the node address of the signer.
+func Sign(h Header, txs []tx.SignedTx, proposer key.Signer) (Block, error) {
+	id, err := proposer.PublicKey().Address(key.NodeAddress)
+	if err != nil {
+		return Block{}, fmt.Errorf("getting proposer address: %w", err)
+	}
+	h.Proposer = id
+
+	sig, err := proposer.Sign(h.SigningBytes())
+	if err != nil {
+		return Block{}, fmt.Errorf("signing block: %w", err)
+	}
+
+	return Block{
+		Header:    h,
+		Txs:       txs,
+		PublicKey: proposer.PublicKey(),
+		Signature: hex.EncodeToString(sig),
+	}, nil
+}
+
+// Size returns the size of the JSON encoding of the block without its
+// justification, which is limited by MaxBlockSize.
+func (b Block) Size() int {
+	b.Justification = nil
+
+	bb, err := json.Marshal(b)
+	if err != nil {
+		return math.MaxInt32
+	}
+	return len(bb)
+}
+
+// Verify verifies the block on its own: the chain ID, the transaction
+// root, the validators hash, the evidence root and the proposer's
+// signature. Whether the proposer was allowed to
+// propose, the link to the parent and the transactions themselves are
+// verified by the consensus and the state.
+//
+// Returns ErrInvalidBlock if verification fails.
+func (b Block) Verify(chainID string) error {
+	if b.ChainID != chainID {
+		return fmt.Errorf("%w: chain id %q, expected %q", ErrInvalidBlock, b.ChainID, chainID)
+	}
+
+	if len(b.Txs) > MaxBlockTxs {
+		return fmt.Errorf("%w: %d transactions exceed %d", ErrInvalidBlock, len(b.Txs), MaxBlockTxs)
+	}
+
+	if size := b.Size(); size > MaxBlockSize {
+		return fmt.Errorf("%w: size of %d bytes exceeds %d", ErrInvalidBlock, size, MaxBlockSize)
+	}
+
+	if root := TxRoot(b.Txs); root != b.TxRoot {
+		return fmt.Errorf("%w: tx root %s, expected %s", ErrInvalidBlock, b.TxRoot, root)
+	}
+
+	if hash := ValidatorsHash(b.Validators); hash != b.ValidatorsHash {
+		return fmt.Errorf("%w: validators hash %s, expected %s", ErrInvalidBlock, b.ValidatorsHash, hash)
+	}
+
+	if root := EvidenceRoot(b.Evidence); root != b.EvidenceRoot {
+		return fmt.Errorf("%w: evidence root %s, expected %s", ErrInvalidBlock, b.EvidenceRoot, root)
+	}
+
+	id, err := b.PublicKey.Address(key.NodeAddress)
+	if err != nil || id != b.Proposer {
+		return fmt.Errorf("%w: public key is not the proposer", ErrInvalidBlock)
+	}
+
+	sig, err := hex.DecodeString(b.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
+
+	if err := b.PublicKey.Verify(b.SigningBytes(), sig); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
+
+	return nil
+}
+
+// TxRoot returns the hex encoded Merkle root of the transaction hashes.
+func TxRoot(txs []tx.SignedTx) string {
+	leaves := make([][]byte, len(txs))
+	for i, stx := range txs {
+		leaves[i] = []byte(stx.Hash())
+	}
+	return hex.EncodeToString(merkle.Root(leaves))
+}
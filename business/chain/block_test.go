@@ -0,0 +1,122 @@
+package chain_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/tx"
+)
+
+// Success and failure markers.
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+const chainID = "toqns-test"
+
+func TestBlock(t *testing.T) {
+	proposer, err := key.New()
+	if err != nil {
+		t.Fatalf("creating key: %v", err)
+	}
+
+	t.Log("Given the need to sign and verify blocks.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen verifying a signed block.", testID)
+		{
+			genesis := chain.Block{Header: chain.Header{ChainID: chainID, Timestamp: 1}}
+			b, err := chain.New(genesis.Header, []tx.SignedTx{transfer(t, 0), transfer(t, 1)}, "root", proposer)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to create a block: %v.", failed, testID, err)
+			}
+
+			if err := b.Verify(chainID); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to verify the block: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to verify the block.", success, testID)
+
+			if b.Height != 1 || b.ParentHash != genesis.Hash() {
+				t.Fatalf("\t%s\tTest %d:\tShould follow the parent, but got height %d and parent %s.", failed, testID, b.Height, b.ParentHash)
+			}
+			t.Logf("\t%s\tTest %d:\tShould follow the parent.", success, testID)
+
+			tt := []struct {
+				name   string
+				tamper func(b *chain.Block)
+			}{
+				{"chainID", func(b *chain.Block) { b.ChainID = "other" }},
+				{"stateRoot", func(b *chain.Block) { b.StateRoot = "other" }},
+				{"txs", func(b *chain.Block) { b.Txs = b.Txs[:1] }},
+				{"proposer", func(b *chain.Block) {
+					k, _ := key.New()
+					b.PublicKey = k.PublicKey()
+				}},
+			}
+
+			for _, tc := range tt {
+				t.Run(tc.name, func(t *testing.T) {
+					tb := b
+					tb.Txs = append([]tx.SignedTx(nil), b.Txs...)
+					tc.tamper(&tb)
+
+					if err := tb.Verify(chainID); !errors.Is(err, chain.ErrInvalidBlock) {
+						t.Fatalf("\t%s\tTest %d:\tShould get ErrInvalidBlock, but got: %v.", failed, testID, err)
+					}
+					t.Logf("\t%s\tTest %d:\tShould get ErrInvalidBlock.", success, testID)
+				})
+			}
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen verifying a block over the maximum size.", testID)
+		{
+			genesis := chain.Block{Header: chain.Header{ChainID: chainID, Timestamp: 1}}
+
+			var txs []tx.SignedTx
+			for i := 0; i < 100; i++ {
+				txs = append(txs, transferMemo(t, strings.Repeat("m", tx.MaxMemoSize)))
+			}
+
+			b, err := chain.New(genesis.Header, txs, "root", proposer)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to create a block: %v.", failed, testID, err)
+			}
+
+			if err := b.Verify(chainID); !errors.Is(err, chain.ErrInvalidBlock) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInvalidBlock for a block of %d bytes, but got: %v.", failed, testID, b.Size(), err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrInvalidBlock for a block of %d bytes.", success, testID, b.Size())
+		}
+	}
+}
+
+// transfer returns a signed transaction with the nonce.
+func transfer(t *testing.T, nonce uint64) tx.SignedTx {
+	return sign(t, tx.Tx{ChainID: chainID, Nonce: nonce, Amount: 1})
+}
+
+// transferMemo returns a signed transaction with the memo.
+func transferMemo(t *testing.T, memo string) tx.SignedTx {
+	return sign(t, tx.Tx{ChainID: chainID, Amount: 1, Memo: memo})
+}
+
+// sign signs the transaction from and to the account of a new key.
+func sign(t *testing.T, tr tx.Tx) tx.SignedTx {
+	k, err := key.New()
+	if err != nil {
+		t.Fatalf("creating key: %v", err)
+	}
+	tr.From, _ = k.Address(key.AccountAddress)
+	tr.To = tr.From
+
+	stx, err := tr.Sign(k)
+	if err != nil {
+		t.Fatalf("signing transaction: %v", err)
+	}
+	return stx
+}
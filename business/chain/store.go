@@ -0,0 +1,646 @@
+package chain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// maxSegmentSize is the size after which blocks are appended to a new
+// segment file.
+const maxSegmentSize = 128 << 20
+
+// Sizes of the store's records.
+const (
+	// recordHeaderSize is the size of the length and checksum that
+	// precede each block in a segment.
+	recordHeaderSize = 4 + sha256.Size
+
+	// indexEntrySize is the size of an index entry: the segment, offset
+	// and size of the record and the block hash.
+	indexEntrySize = 4 + 8 + 4 + sha256.Size
+)
+
+// indexName is the name of the index file in the store directory.
+const indexName = "index"
+
+// baseName is the name of the file with the base height of a store that
+// was restored from a snapshot.
+const baseName = "base"
+
+var (
+	// ErrNotFound is returned when a block isn't in the store.
+	ErrNotFound = errors.New("block not found")
+
+	// ErrNotNext is returned when a block doesn't follow the head of the
+	// store.
+	ErrNotNext = errors.New("block doesn't follow the head")
+
+	// ErrCorrupted is returned when the store has invalid data that can't
+	// be the result of an interrupted write.
+	ErrCorrupted = errors.New("chain store corrupted")
+)
+
+// indexEntry is the location of a block in the segments.
+type indexEntry struct {
+	segment uint32
+	offset  int64
+	size    uint32
+	hash    [sha256.Size]byte
+}
+
+// Store is an append-only store of blocks.
+//
+// Blocks are appended to segment files, each block as a record with its
+// length and checksum. The index file has an entry per height with the
+// block's location and hash. The block is synced before its index entry
+// is written, so a crash leaves at most a partially written block or
+// index entry at the end, which are removed when the store is opened.
+//
+// A store that's restored from a snapshot has the genesis block followed
+// by the blocks from the base height of the snapshot, without the blocks
+// in between.
+type Store struct {
+	dir string
+
+	mu      sync.RWMutex
+	index   *os.File
+	segment *os.File
+	entries []indexEntry
+	byHash  map[[sha256.Size]byte]uint64
+
+	// gap is the number of heights after the genesis block that the
+	// store has no blocks of.
+	gap uint64
+}
+
+// Open opens the store in the directory, which is created if it doesn't
+// exist.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating directory: %w", err)
+	}
+
+	index, err := os.OpenFile(filepath.Join(dir, indexName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening index: %w", err)
+	}
+
+	s := Store{
+		dir:    dir,
+		index:  index,
+		byHash: make(map[[sha256.Size]byte]uint64),
+	}
+
+	if err := s.recover(); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	if err := s.loadBase(); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// loadBase reads the base height of a restored store. The base is ignored
+// when the store has no block after the genesis block, as the store was
+// interrupted while it was restored.
+func (s *Store) loadBase() error {
+	name := filepath.Join(s.dir, baseName)
+
+	b, err := os.ReadFile(name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil
+	case err != nil:
+		return fmt.Errorf("reading base: %w", err)
+	}
+
+	if len(s.entries) <= 1 {
+		return os.Remove(name)
+	}
+
+	if len(b) != 8 {
+		return fmt.Errorf("%w: base of %d bytes", ErrCorrupted, len(b))
+	}
+
+	base := binary.BigEndian.Uint64(b)
+	if base == 0 {
+		return fmt.Errorf("%w: base at genesis", ErrCorrupted)
+	}
+	s.gap = base - 1
+
+	for hash, i := range s.byHash {
+		if i > 0 {
+			s.byHash[hash] = i + s.gap
+		}
+	}
+
+	return nil
+}
+
+// recover reads the index and removes partially written blocks and index
+// entries.
+func (s *Store) recover() error {
+	b, err := io.ReadAll(s.index)
+	if err != nil {
+		return fmt.Errorf("reading index: %w", err)
+	}
+
+	// A partial entry at the end is an interrupted write.
+	n := len(b) / indexEntrySize
+	s.entries = make([]indexEntry, 0, n)
+	for i := 0; i < n; i++ {
+		e := decodeEntry(b[i*indexEntrySize:])
+		if !s.follows(e) {
+			// Only the last entry can have been written partially.
+			if i < n-1 {
+				return fmt.Errorf("%w: index entry of height %d", ErrCorrupted, i)
+			}
+			break
+		}
+		s.entries = append(s.entries, e)
+	}
+
+	// The last entry may point to a block that wasn't synced completely,
+	// when the file system reordered the writes.
+	for len(s.entries) > 0 {
+		e := s.entries[len(s.entries)-1]
+		if _, err := s.readRecord(e); err == nil {
+			break
+		}
+		s.entries = s.entries[:len(s.entries)-1]
+	}
+
+	if err := truncate(s.index, int64(len(s.entries))*indexEntrySize); err != nil {
+		return fmt.Errorf("truncating index: %w", err)
+	}
+
+	for h, e := range s.entries {
+		s.byHash[e.hash] = uint64(h)
+	}
+
+	// Remove the data after the last block, which is a block that was
+	// written without its index entry.
+	var seg uint32
+	var end int64
+	if len(s.entries) > 0 {
+		e := s.entries[len(s.entries)-1]
+		seg, end = e.segment, e.offset+recordHeaderSize+int64(e.size)
+	}
+
+	if err := s.removeSegmentsAfter(seg); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.segmentName(seg), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("opening segment: %w", err)
+	}
+	s.segment = f
+
+	if err := truncate(f, end); err != nil {
+		return fmt.Errorf("truncating segment: %w", err)
+	}
+
+	return nil
+}
+
+// follows reports whether the index entry follows the last entry: either
+// directly after it in the same segment, or at the start of the next
+// segment.
+func (s *Store) follows(e indexEntry) bool {
+	if len(s.entries) == 0 {
+		return e.segment == 0 && e.offset == 0
+	}
+
+	prev := s.entries[len(s.entries)-1]
+	switch e.segment {
+	case prev.segment:
+		return e.offset == prev.offset+recordHeaderSize+int64(prev.size)
+	case prev.segment + 1:
+		return e.offset == 0
+	default:
+		return false
+	}
+}
+
+// removeSegmentsAfter removes the segment files after the segment.
+func (s *Store) removeSegmentsAfter(seg uint32) error {
+	for i := seg + 1; ; i++ {
+		err := os.Remove(s.segmentName(i))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			return nil
+		case err != nil:
+			return fmt.Errorf("removing segment: %w", err)
+		}
+	}
+}
+
+// Height returns the height of the head of the store. The bool is false
+// if the store is empty.
+func (s *Store) Height() (uint64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.entries) == 0 {
+		return 0, false
+	}
+	return s.heightOf(len(s.entries) - 1), true
+}
+
+// Base returns the height of the first block after the genesis block that
+// the store has, or would have. It's 1 unless the store was restored from
+// a snapshot.
+func (s *Store) Base() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.gap + 1
+}
+
+// Head returns the block at the head of the store.
+func (s *Store) Head() (Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.entries) == 0 {
+		return Block{}, ErrNotFound
+	}
+	return s.read(s.heightOf(len(s.entries) - 1))
+}
+
+// Append appends the block to the store.
+//
+// The block must follow the head: its height is the next height and its
+// parent hash is the hash of the head. The first block is the genesis
+// block at height 0. The block itself isn't verified.
+func (s *Store) Append(b Block) error {
+	hash, err := decodeHash(b.Hash())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.heightOf(len(s.entries))
+	if b.Height != next {
+		return fmt.Errorf("%w: height %d, expected %d", ErrNotNext, b.Height, next)
+	}
+
+	if len(s.entries) > 0 {
+		parent := s.entries[len(s.entries)-1].hash
+		if b.ParentHash != hex.EncodeToString(parent[:]) {
+			return fmt.Errorf("%w: parent %s isn't the head", ErrNotNext, b.ParentHash)
+		}
+	}
+
+	return s.append(b, hash)
+}
+
+// Restore appends the block after the genesis block, as the base of a
+// store that's restored from a snapshot at the block's height. The store
+// must have no other block than the genesis block. The block isn't
+// verified, its hash must be trusted.
+func (s *Store) Restore(b Block) error {
+	hash, err := decodeHash(b.Hash())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.entries) != 1 {
+		return fmt.Errorf("%w: store has blocks after the genesis block", ErrNotNext)
+	}
+	if b.Height < 2 {
+		return fmt.Errorf("%w: height %d is no base", ErrNotNext, b.Height)
+	}
+
+	// The base is written first, as it's ignored without the block.
+	var base [8]byte
+	binary.BigEndian.PutUint64(base[:], b.Height)
+	f, err := os.OpenFile(filepath.Join(s.dir, baseName), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("creating base: %w", err)
+	}
+	err = s.write(f, 0, base[:])
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("writing base: %w", err)
+	}
+
+	s.gap = b.Height - 1
+
+	if err := s.append(b, hash); err != nil {
+		s.gap = 0
+		os.Remove(filepath.Join(s.dir, baseName))
+		return err
+	}
+
+	return nil
+}
+
+// append writes the block with the hash at the end of the store. The
+// caller must hold the lock.
+func (s *Store) append(b Block, hash [sha256.Size]byte) error {
+	next := len(s.entries)
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		return fmt.Errorf("encoding block: %w", err)
+	}
+
+	// The location of the block follows the previous block, or starts a
+	// new segment when the current one is full.
+	e := indexEntry{size: uint32(len(data)), hash: hash}
+	seg := s.segment
+	if next > 0 {
+		prev := s.entries[next-1]
+		e.segment = prev.segment
+		e.offset = prev.offset + recordHeaderSize + int64(prev.size)
+		if e.offset+recordHeaderSize+int64(e.size) > maxSegmentSize {
+			if seg, err = s.createSegment(prev.segment + 1); err != nil {
+				return err
+			}
+			e.segment, e.offset = prev.segment+1, 0
+		}
+	}
+
+	err = s.write(seg, e.offset, encodeRecord(data))
+	if err != nil {
+		err = fmt.Errorf("writing block: %w", err)
+	} else if err = s.write(s.index, int64(next)*indexEntrySize, encodeEntry(e)); err != nil {
+		err = fmt.Errorf("writing index: %w", err)
+	}
+
+	// The store only moves on to a new segment once the block is stored
+	// in it, so the current segment stays open when storing fails.
+	if seg != s.segment {
+		if err != nil {
+			seg.Close()
+			os.Remove(seg.Name())
+			return err
+		}
+
+		s.segment.Close()
+		s.segment = seg
+	}
+	if err != nil {
+		return err
+	}
+
+	s.entries = append(s.entries, e)
+	s.byHash[hash] = b.Height
+
+	return nil
+}
+
+// write writes the data at the offset and syncs the file. Data written by
+// a failed write is removed, so the file ends at the offset.
+func (s *Store) write(f *os.File, offset int64, b []byte) error {
+	if _, err := f.WriteAt(b, offset); err != nil {
+		truncate(f, offset)
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		truncate(f, offset)
+		return err
+	}
+
+	return nil
+}
+
+// createSegment creates the segment file, which replaces an incomplete
+// segment of a failed write.
+func (s *Store) createSegment(seg uint32) (*os.File, error) {
+	f, err := os.OpenFile(s.segmentName(seg), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("creating segment: %w", err)
+	}
+
+	return f, nil
+}
+
+// ByHeight returns the block at the height.
+func (s *Store) ByHeight(height uint64) (Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.read(height)
+}
+
+// ByHash returns the block with the hex encoded hash.
+func (s *Store) ByHash(hash string) (Block, error) {
+	h, err := decodeHash(hash)
+	if err != nil {
+		return Block{}, ErrNotFound
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	height, ok := s.byHash[h]
+	if !ok {
+		return Block{}, ErrNotFound
+	}
+
+	return s.read(height)
+}
+
+// Range returns the blocks from height from up to and including height
+// to. The range ends at the head if to is beyond the head, and at the
+// genesis block if it starts there in a restored store.
+func (s *Store) Range(from, to uint64) ([]Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.entries) == 0 {
+		return nil, ErrNotFound
+	}
+
+	head := s.heightOf(len(s.entries) - 1)
+	if from > head || (from > 0 && from <= s.gap) {
+		return nil, ErrNotFound
+	}
+	if to > head {
+		to = head
+	}
+	if from == 0 && to > 0 && s.gap > 0 {
+		to = 0
+	}
+
+	var blocks []Block
+	for h := from; h <= to; h++ {
+		b, err := s.read(h)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+
+	return blocks, nil
+}
+
+// Close closes the files of the store.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.segment != nil {
+		err = s.segment.Close()
+	}
+	if cerr := s.index.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// heightOf returns the height of the block of the index entry. The caller
+// must hold the lock.
+func (s *Store) heightOf(i int) uint64 {
+	if i == 0 {
+		return 0
+	}
+	return uint64(i) + s.gap
+}
+
+// read returns the block at the height. The caller must hold the lock.
+func (s *Store) read(height uint64) (Block, error) {
+	i := height
+	if height > 0 {
+		if height <= s.gap {
+			return Block{}, ErrNotFound
+		}
+		i -= s.gap
+	}
+
+	if i >= uint64(len(s.entries)) {
+		return Block{}, ErrNotFound
+	}
+
+	data, err := s.readRecord(s.entries[i])
+	if err != nil {
+		return Block{}, fmt.Errorf("%w: block at height %d: %v", ErrCorrupted, height, err)
+	}
+
+	var b Block
+	if err := json.Unmarshal(data, &b); err != nil {
+		return Block{}, fmt.Errorf("%w: block at height %d: %v", ErrCorrupted, height, err)
+	}
+
+	return b, nil
+}
+
+// readRecord reads and checks the record of the index entry.
+func (s *Store) readRecord(e indexEntry) ([]byte, error) {
+	f := s.segment
+	if f == nil || e.segment != s.segmentNumber() {
+		var err error
+		if f, err = os.Open(s.segmentName(e.segment)); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+
+	b := make([]byte, recordHeaderSize+int(e.size))
+	if _, err := f.ReadAt(b, e.offset); err != nil {
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint32(b) != e.size {
+		return nil, errors.New("size mismatch")
+	}
+
+	data := b[recordHeaderSize:]
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(sum[:], b[4:recordHeaderSize]) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	return data, nil
+}
+
+// segmentNumber returns the number of the open segment. The caller must
+// hold the lock.
+func (s *Store) segmentNumber() uint32 {
+	if len(s.entries) == 0 {
+		return 0
+	}
+	return s.entries[len(s.entries)-1].segment
+}
+
+// segmentName returns the file name of the segment.
+func (s *Store) segmentName(seg uint32) string {
+	return filepath.Join(s.dir, fmt.Sprintf("blocks-%06d.seg", seg))
+}
+
+// =============================================================================
+
+// encodeRecord returns the data prefixed with its length and checksum.
+func encodeRecord(data []byte) []byte {
+	b := make([]byte, recordHeaderSize, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	sum := sha256.Sum256(data)
+	copy(b[4:], sum[:])
+	return append(b, data...)
+}
+
+// encodeEntry returns the binary encoding of the index entry.
+func encodeEntry(e indexEntry) []byte {
+	b := make([]byte, indexEntrySize)
+	binary.BigEndian.PutUint32(b, e.segment)
+	binary.BigEndian.PutUint64(b[4:], uint64(e.offset))
+	binary.BigEndian.PutUint32(b[12:], e.size)
+	copy(b[16:], e.hash[:])
+	return b
+}
+
+// decodeEntry decodes the index entry at the start of the data.
+func decodeEntry(b []byte) indexEntry {
+	e := indexEntry{
+		segment: binary.BigEndian.Uint32(b),
+		offset:  int64(binary.BigEndian.Uint64(b[4:])),
+		size:    binary.BigEndian.Uint32(b[12:]),
+	}
+	copy(e.hash[:], b[16:indexEntrySize])
+	return e
+}
+
+// decodeHash decodes a hex encoded block hash.
+func decodeHash(v string) ([sha256.Size]byte, error) {
+	var h [sha256.Size]byte
+	b, err := hex.DecodeString(v)
+	if err != nil || len(b) != sha256.Size {
+		return h, fmt.Errorf("invalid block hash %q", v)
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+// truncate truncates the file to the size and syncs it.
+func truncate(f *os.File, size int64) error {
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,186 @@
+package chain_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/tx"
+)
+
+func TestStore(t *testing.T) {
+	proposer, err := key.New()
+	if err != nil {
+		t.Fatalf("creating key: %v", err)
+	}
+
+	t.Log("Given the need to store blocks.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen appending and reading blocks.", testID)
+		{
+			s, err := chain.Open(t.TempDir())
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to open the store: %v.", failed, testID, err)
+			}
+			defer s.Close()
+
+			blocks := newChain(t, proposer, 5)
+			for _, b := range blocks {
+				if err := s.Append(b); err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to append block %d: %v.", failed, testID, b.Height, err)
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to append blocks.", success, testID)
+
+			if err := s.Append(blocks[2]); !errors.Is(err, chain.ErrNotNext) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrNotNext for an old block, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrNotNext for an old block.", success, testID)
+
+			b, err := s.ByHeight(3)
+			if err != nil || b.Hash() != blocks[3].Hash() {
+				t.Fatalf("\t%s\tTest %d:\tShould get the block by height: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the block by height.", success, testID)
+
+			b, err = s.ByHash(blocks[2].Hash())
+			if err != nil || b.Height != 2 {
+				t.Fatalf("\t%s\tTest %d:\tShould get the block by hash: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the block by hash.", success, testID)
+
+			r, err := s.Range(3, 10)
+			if err != nil || len(r) != 2 || r[1].Hash() != blocks[4].Hash() {
+				t.Fatalf("\t%s\tTest %d:\tShould get the range up to the head: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the range up to the head.", success, testID)
+
+			if _, err := s.ByHeight(5); !errors.Is(err, chain.ErrNotFound) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrNotFound beyond the head, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrNotFound beyond the head.", success, testID)
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen recovering from an interrupted append.", testID)
+		{
+			dir := t.TempDir()
+			s, err := chain.Open(dir)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to open the store: %v.", failed, testID, err)
+			}
+
+			blocks := newChain(t, proposer, 4)
+			for _, b := range blocks[:3] {
+				s.Append(b)
+			}
+			s.Close()
+
+			// A partially written block without index entry, and a
+			// partially written index entry.
+			appendFile(t, filepath.Join(dir, "blocks-000000.seg"), []byte{0, 0, 0, 200, 1, 2, 3})
+			appendFile(t, filepath.Join(dir, "index"), []byte{0, 0, 0, 0, 0, 0})
+
+			s, err = chain.Open(dir)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to reopen the store: %v.", failed, testID, err)
+			}
+			defer s.Close()
+			t.Logf("\t%s\tTest %d:\tShould be able to reopen the store.", success, testID)
+
+			if h, ok := s.Height(); !ok || h != 2 {
+				t.Fatalf("\t%s\tTest %d:\tShould keep the appended blocks, but got height %d.", failed, testID, h)
+			}
+			t.Logf("\t%s\tTest %d:\tShould keep the appended blocks.", success, testID)
+
+			if err := s.Append(blocks[3]); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to append after recovery: %v.", failed, testID, err)
+			}
+			if b, err := s.Head(); err != nil || b.Hash() != blocks[3].Hash() {
+				t.Fatalf("\t%s\tTest %d:\tShould read the appended block: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to append after recovery.", success, testID)
+		}
+
+		testID = 2
+		t.Logf("\tTest %d:\tWhen restoring from a snapshot.", testID)
+		{
+			dir := t.TempDir()
+			s, err := chain.Open(dir)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to open the store: %v.", failed, testID, err)
+			}
+
+			blocks := newChain(t, proposer, 8)
+			s.Append(blocks[0])
+
+			if err := s.Restore(blocks[5]); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to restore at a base block: %v.", failed, testID, err)
+			}
+			if err := s.Append(blocks[6]); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to append after the base: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to restore and append after the base.", success, testID)
+
+			if err := s.Restore(blocks[7]); !errors.Is(err, chain.ErrNotNext) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrNotNext restoring a chain with blocks, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrNotNext restoring a chain with blocks.", success, testID)
+			s.Close()
+
+			s, err = chain.Open(dir)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to reopen the store: %v.", failed, testID, err)
+			}
+			defer s.Close()
+
+			if h, _ := s.Height(); h != 6 || s.Base() != 5 {
+				t.Fatalf("\t%s\tTest %d:\tShould have height 6 from base 5, but got height %d from base %d.", failed, testID, h, s.Base())
+			}
+			t.Logf("\t%s\tTest %d:\tShould keep the base when reopened.", success, testID)
+
+			if _, err := s.ByHeight(3); !errors.Is(err, chain.ErrNotFound) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrNotFound before the base, but got: %v.", failed, testID, err)
+			}
+			if b, err := s.ByHash(blocks[6].Hash()); err != nil || b.Height != 6 {
+				t.Fatalf("\t%s\tTest %d:\tShould get the block by hash after the base: %v.", failed, testID, err)
+			}
+			if r, err := s.Range(5, 10); err != nil || len(r) != 2 || r[0].Hash() != blocks[5].Hash() {
+				t.Fatalf("\t%s\tTest %d:\tShould get the range from the base: %v.", failed, testID, err)
+			}
+			if r, err := s.Range(0, 10); err != nil || len(r) != 1 || r[0].Height != 0 {
+				t.Fatalf("\t%s\tTest %d:\tShould get only the genesis block for a range into the gap: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould only read the genesis block and the blocks from the base.", success, testID)
+		}
+	}
+}
+
+// newChain returns a chain of blocks starting with a genesis block.
+func newChain(t *testing.T, proposer key.Key, n int) []chain.Block {
+	blocks := []chain.Block{{Header: chain.Header{ChainID: chainID, Timestamp: 1}}}
+	for i := 1; i < n; i++ {
+		b, err := chain.New(blocks[i-1].Header, []tx.SignedTx{transfer(t, 0)}, "root", proposer)
+		if err != nil {
+			t.Fatalf("creating block: %v", err)
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+func appendFile(t *testing.T, name string, b []byte) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("opening file: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(b); err != nil {
+		t.Fatalf("writing file: %v", err)
+	}
+}
@@ -0,0 +1,934 @@
+// Package bft provides Byzantine fault tolerant consensus among the
+// validators of the genesis, in the style of Tendermint.
+//
+// Each height is decided in rounds. In each round, the proposer of the
+// round proposes a block and the validators vote on it in two steps. A
+// validator prevotes the block if it's valid, and precommits it once
+// prevotes of more than two thirds of the voting power are for the block.
+// The block is committed once precommits of more than two thirds are for
+// it. These precommits are the quorum certificate of the block, which is
+// stored as its justification. Committed blocks are final right away: as
+// long as less than a third of the voting power is faulty, no other block
+// can get a quorum at the height.
+//
+// A validator that precommits a block locks on it. It only prevotes other
+// blocks after a quorum of prevotes for them in a later round, so a block
+// that might have been committed is the only block that can get a quorum
+// in the later rounds.
+//
+// Steps that don't complete, such as when the proposer is offline, time
+// out and the validators move on to the next round. Timeouts grow with
+// the round, so the validators eventually wait long enough to agree.
+//
+// The validator set changes at the end of each epoch, to the set that the
+// last block of the epoch lists, with voting power by stake. Validators
+// that sign conflicting votes are reported as evidence in a later block,
+// which slashes them.
+//
+// The algorithm is described in "The latest gossip on BFT consensus" by
+// Buchman, Kwon and Milosevic.
+package bft
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/consensus"
+	"github.com/toqns/toqns/business/genesis"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/state"
+	"github.com/toqns/toqns/business/tx"
+)
+
+// MaxClockDrift is how far the timestamp of a block may be ahead of the
+// local clock.
+const MaxClockDrift = time.Second
+
+// maxFuture is the maximum number of messages for the next height that
+// are kept until the height starts.
+const maxFuture = 1000
+
+// step is a step of a round.
+type step int
+
+// Steps of a round.
+const (
+	stepPropose step = iota + 1
+	stepPrevote
+	stepPrecommit
+)
+
+// candidate is a block that's proposed at the current height.
+type candidate struct {
+	chain.Block
+	hash string
+
+	// batch has the changes of the block, if it's valid. Otherwise err is
+	// the reason it's invalid.
+	batch *state.Batch
+	err   error
+}
+
+// round is the state of a round at the current height.
+type round struct {
+	proposal *candidate
+	polRound int
+
+	prevotes   *voteSet
+	precommits *voteSet
+
+	// Rules that apply only once per round.
+	prevoteTimeout   bool
+	precommitTimeout bool
+	polSeen          bool
+}
+
+// votes returns the vote set of the type.
+func (r *round) votes(typ VoteType) *voteSet {
+	if typ == Prevote {
+		return r.prevotes
+	}
+	return r.precommits
+}
+
+// power returns the voting power of the validators that voted in the
+// round.
+func (r *round) power(vals validatorSet) uint64 {
+	var power uint64
+	for addr := range r.prevotes.votes {
+		p, _ := vals.power(addr)
+		power += p
+	}
+	for addr := range r.precommits.votes {
+		if _, ok := r.prevotes.votes[addr]; !ok {
+			p, _ := vals.power(addr)
+			power += p
+		}
+	}
+	return power
+}
+
+// =============================================================================
+
+// Engine is the BFT consensus engine.
+type Engine struct {
+	cfg  consensus.Config
+	vals validatorSet
+	id   key.Address
+	now  func() time.Time
+
+	mu          sync.Mutex
+	signs       signState
+	final       chain.Block
+	height      uint64
+	round       int
+	step        step
+	rounds      map[int]*round
+	candidates  map[string]*candidate
+	lockedRound int
+	lockedBlock *candidate
+	validRound  int
+	validBlock  *candidate
+	future      map[string]consensus.Message
+	evidence    map[key.Address]chain.Evidence
+	out         []consensus.Message
+	started     bool
+	stopped     bool
+}
+
+// New returns an engine that continues the stored chain, which must have
+// been initialized with the genesis.
+func New(cfg consensus.Config) (*Engine, error) {
+	if err := consensus.Replay(cfg.State, cfg.Store, cfg.Genesis.Consensus); err != nil {
+		return nil, err
+	}
+
+	head, err := cfg.Store.Head()
+	if err != nil {
+		return nil, fmt.Errorf("reading head: %w", err)
+	}
+
+	vals, err := consensus.Validators(cfg.Store, cfg.Genesis, head.Height+1)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Engine{
+		cfg:      cfg,
+		vals:     newValidatorSet(vals),
+		now:      time.Now,
+		future:   make(map[string]consensus.Message),
+		evidence: make(map[key.Address]chain.Evidence),
+	}
+
+	if cfg.Signer != nil {
+		if e.id, err = cfg.Signer.PublicKey().Address(key.NodeAddress); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.signs, err = loadSignState(cfg.DataDir); err != nil {
+		return nil, err
+	}
+
+	e.newHeight(head)
+
+	return &e, nil
+}
+
+// Start starts taking part in consensus.
+func (e *Engine) Start() {
+	e.mu.Lock()
+	e.started = true
+	e.startRound(e.round)
+	e.check()
+	out := e.flush()
+	e.mu.Unlock()
+
+	e.broadcast(out)
+}
+
+// Stop stops taking part in consensus.
+func (e *Engine) Stop() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stopped = true
+}
+
+// Final returns the header of the last committed block.
+func (e *Engine) Final() chain.Header {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.final.Header
+}
+
+// Receive processes a proposal, vote or commit from the network.
+//
+// Returns consensus.ErrKnown for known and outdated messages,
+// consensus.ErrUnknownParent for messages beyond the next height, and
+// consensus.ErrInvalidMessage or chain.ErrInvalidBlock for messages that
+// violate the consensus rules. Messages for the next height are kept
+// until the height starts.
+func (e *Engine) Receive(m consensus.Message) error {
+	e.mu.Lock()
+	err := e.receive(m)
+	out := e.flush()
+	e.mu.Unlock()
+
+	e.broadcast(out)
+
+	return err
+}
+
+// receive processes the message. The caller must hold the lock.
+func (e *Engine) receive(m consensus.Message) error {
+	switch m.Type {
+	case MessageProposal:
+		var p Proposal
+		if err := m.Decode(&p); err != nil {
+			return err
+		}
+		return e.addProposal(m, p)
+
+	case MessageVote:
+		var v Vote
+		if err := m.Decode(&v); err != nil {
+			return err
+		}
+		return e.addVote(m, v)
+
+	case MessageCommit:
+		var b chain.Block
+		if err := m.Decode(&b); err != nil {
+			return err
+		}
+		return e.addCommit(m, b)
+	}
+
+	return fmt.Errorf("%w: unknown message type %q", consensus.ErrInvalidMessage, m.Type)
+}
+
+// atHeight reports whether the message is for the current height. Messages
+// for the next height are kept for later.
+func (e *Engine) atHeight(m consensus.Message, height uint64) (bool, error) {
+	switch {
+	case height < e.height:
+		return false, consensus.ErrKnown
+	case height == e.height:
+		return true, nil
+	case height > e.height+1:
+		return false, fmt.Errorf("%w: message for height %d at height %d", consensus.ErrUnknownParent, height, e.height)
+	}
+
+	k := key.HashString([]byte(m.Type), m.Payload)
+	if _, ok := e.future[k]; ok {
+		return false, consensus.ErrKnown
+	}
+
+	if len(e.future) >= maxFuture {
+		return false, fmt.Errorf("%w: too many messages for height %d", consensus.ErrUnknownParent, height)
+	}
+	e.future[k] = m
+
+	return false, nil
+}
+
+// addProposal verifies the proposal and adds it to its round.
+func (e *Engine) addProposal(m consensus.Message, p Proposal) error {
+	if err := p.verify(e.cfg.Genesis.ChainID); err != nil {
+		return err
+	}
+
+	if ok, err := e.atHeight(m, p.Block.Height); !ok {
+		return err
+	}
+
+	if proposer := e.vals.proposer(e.height, p.Round); p.Proposer != proposer {
+		return fmt.Errorf("%w: %s isn't the proposer of round %d, expected %s", consensus.ErrInvalidMessage, p.Proposer, p.Round, proposer)
+	}
+
+	r := e.roundOf(p.Round)
+	if r.proposal != nil {
+		if r.proposal.hash == p.Block.Hash() {
+			return consensus.ErrKnown
+		}
+		e.cfg.Log.Warnw("consensus", "status", "conflicting proposal", "height", e.height, "round", p.Round, "proposer", p.Proposer)
+		return fmt.Errorf("%w: conflicting proposal of %s", consensus.ErrInvalidMessage, p.Proposer)
+	}
+
+	// Invalid blocks are kept as proposal, so the validators prevote for
+	// no block, but the proposal isn't forwarded.
+	c := e.candidate(p.Block)
+	r.proposal = c
+	r.polRound = p.POLRound
+
+	e.check()
+
+	return c.err
+}
+
+// addVote verifies the vote and adds it to its round.
+func (e *Engine) addVote(m consensus.Message, v Vote) error {
+	if err := v.verify(e.cfg.Genesis.ChainID); err != nil {
+		return err
+	}
+
+	// The validator set of the next height is only known once the current
+	// height is committed.
+	if ok, err := e.atHeight(m, v.Height); !ok {
+		return err
+	}
+
+	power, ok := e.vals.power(v.Validator)
+	if !ok {
+		return fmt.Errorf("%w: %s isn't a validator", consensus.ErrInvalidMessage, v.Validator)
+	}
+
+	set := e.roundOf(v.Round).votes(v.Type)
+	if prev, ok := set.votes[v.Validator]; ok && prev.BlockHash != v.BlockHash {
+		e.addEvidence(prev, v)
+	}
+
+	if err := set.add(v, power); err != nil {
+		return err
+	}
+
+	e.check()
+
+	return nil
+}
+
+// addCommit verifies the quorum certificate of the block and commits it.
+// Commits let validators that missed votes catch up.
+func (e *Engine) addCommit(m consensus.Message, b chain.Block) error {
+	if ok, err := e.atHeight(m, b.Height); !ok {
+		return err
+	}
+
+	if err := VerifyCommit(e.cfg.Genesis.ChainID, e.vals.validators, b); err != nil {
+		return err
+	}
+
+	c := e.candidate(b)
+	if c.err != nil {
+		e.cfg.Log.Errorw("consensus", "status", "invalid block committed", "height", b.Height, "hash", c.hash, "ERROR", c.err)
+		return c.err
+	}
+
+	if err := e.decide(c, b.Justification); err != nil {
+		return err
+	}
+
+	e.check()
+
+	return nil
+}
+
+// addEvidence keeps the conflicting votes as evidence, to be included in
+// a block the validator proposes.
+func (e *Engine) addEvidence(a, b Vote) {
+	e.cfg.Log.Warnw("consensus", "status", "conflicting vote", "height", a.Height, "round", a.Round, "validator", a.Validator, "type", a.Type)
+
+	if _, ok := e.evidence[a.Validator]; ok {
+		return
+	}
+
+	ev, err := newEvidence(a, b)
+	if err != nil {
+		e.cfg.Log.Errorw("consensus", "status", "encoding evidence failed", "ERROR", err)
+		return
+	}
+	e.evidence[a.Validator] = ev
+}
+
+// roundOf returns the state of the round at the current height.
+func (e *Engine) roundOf(rn int) *round {
+	r, ok := e.rounds[rn]
+	if !ok {
+		r = &round{
+			polRound:   -1,
+			prevotes:   newVoteSet(),
+			precommits: newVoteSet(),
+		}
+		e.rounds[rn] = r
+	}
+	return r
+}
+
+// candidate returns the validated block.
+func (e *Engine) candidate(b chain.Block) *candidate {
+	hash := b.Hash()
+	if c, ok := e.candidates[hash]; ok {
+		return c
+	}
+
+	b.Justification = nil
+	c := candidate{Block: b, hash: hash}
+	c.batch, c.err = e.validate(b)
+	e.candidates[hash] = &c
+
+	return &c
+}
+
+// validate checks the block against the consensus rules and applies it on
+// top of the final block.
+func (e *Engine) validate(b chain.Block) (*state.Batch, error) {
+	if err := verifyBlock(e.cfg.Genesis, e.vals, e.final, b); err != nil {
+		return nil, err
+	}
+
+	if b.Time().After(e.now().Add(MaxClockDrift)) {
+		return nil, fmt.Errorf("%w: timestamp %s is in the future", chain.ErrInvalidBlock, b.Time())
+	}
+
+	batch := e.cfg.State.Begin(b.Height)
+	if err := consensus.Apply(batch, b, e.cfg.Genesis.Consensus); err != nil {
+		return nil, fmt.Errorf("%w: %v", chain.ErrInvalidBlock, err)
+	}
+
+	return batch, nil
+}
+
+// VerifyBlock verifies that the block follows the parent, and that the
+// validators of its height committed it. It's used for blocks that are
+// synced from peers rather than decided. The changes of the block aren't
+// checked, which is left to applying it.
+//
+// Returns chain.ErrInvalidBlock if verification fails.
+func VerifyBlock(g genesis.Genesis, validators []chain.Validator, parent, b chain.Block) error {
+	if err := verifyBlock(g, newValidatorSet(validators), parent, b); err != nil {
+		return err
+	}
+
+	if err := VerifyCommit(g.ChainID, validators, b); err != nil {
+		return fmt.Errorf("%w: %v", chain.ErrInvalidBlock, err)
+	}
+
+	return nil
+}
+
+// verifyBlock checks the block on top of the parent against the consensus
+// rules.
+func verifyBlock(g genesis.Genesis, vals validatorSet, parent, b chain.Block) error {
+	if err := b.Verify(g.ChainID); err != nil {
+		return err
+	}
+
+	switch {
+	case b.Height != parent.Height+1:
+		return fmt.Errorf("%w: height %d on parent at height %d", chain.ErrInvalidBlock, b.Height, parent.Height)
+	case b.ParentHash != parent.Hash():
+		return fmt.Errorf("%w: parent %s isn't the last block", chain.ErrInvalidBlock, b.ParentHash)
+	case len(b.Txs) > g.Consensus.MaxBlockTxs:
+		return fmt.Errorf("%w: %d transactions exceed %d", chain.ErrInvalidBlock, len(b.Txs), g.Consensus.MaxBlockTxs)
+	case b.Timestamp <= parent.Timestamp:
+		return fmt.Errorf("%w: timestamp isn't after the parent's", chain.ErrInvalidBlock)
+	}
+
+	if _, ok := vals.power(b.Proposer); !ok {
+		return fmt.Errorf("%w: proposer %s isn't a validator", chain.ErrInvalidBlock, b.Proposer)
+	}
+
+	// Stake can only be slashed until it's released.
+	for _, ev := range b.Evidence {
+		if ev.Height > b.Height || b.Height-ev.Height > g.Consensus.UnbondingPeriod {
+			return fmt.Errorf("%w: evidence of height %d is expired", chain.ErrInvalidBlock, ev.Height)
+		}
+
+		if err := verifyEvidence(g.ChainID, ev); err != nil {
+			return fmt.Errorf("%w: %v", chain.ErrInvalidBlock, err)
+		}
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// check applies the rules of the algorithm until none applies anymore.
+// The caller must hold the lock.
+func (e *Engine) check() {
+	for e.apply() {
+	}
+}
+
+// apply applies the first rule that applies, and reports whether one did.
+func (e *Engine) apply() bool {
+	// A valid block with a quorum of precommits in any round is committed.
+	for rn, r := range e.rounds {
+		for hash, power := range r.precommits.power {
+			if hash == "" || !e.vals.quorum(power) {
+				continue
+			}
+
+			c, ok := e.candidates[hash]
+			if !ok || c.err != nil {
+				continue
+			}
+
+			justification, err := json.Marshal(r.precommits.commit(e.height, rn, hash))
+			if err != nil {
+				e.cfg.Log.Errorw("consensus", "status", "encoding commit failed", "ERROR", err)
+				return false
+			}
+
+			if err := e.decide(c, justification); err != nil {
+				e.cfg.Log.Errorw("consensus", "status", "committing block failed", "height", c.Height, "ERROR", err)
+				return false
+			}
+
+			b := c.Block
+			b.Justification = justification
+			e.send(MessageCommit, b)
+
+			return true
+		}
+	}
+
+	// Votes of more than a third of the power in a later round show that
+	// at least one honest validator moved on, so the validator follows.
+	for rn, r := range e.rounds {
+		if rn > e.round && e.vals.oneThird(r.power(e.vals)) {
+			e.startRound(rn)
+			return true
+		}
+	}
+
+	r := e.roundOf(e.round)
+	c := r.proposal
+
+	// Prevote the proposal if it's valid and the validator isn't locked on
+	// another block, or the block got a quorum of prevotes in a round
+	// after the one the validator locked in.
+	if e.step == stepPropose && c != nil {
+		switch {
+		case r.polRound == -1:
+			if c.err == nil && (e.lockedRound == -1 || e.lockedBlock == c) {
+				e.vote(Prevote, c.hash)
+			} else {
+				e.vote(Prevote, "")
+			}
+			e.step = stepPrevote
+			return true
+
+		case e.vals.quorum(e.roundOf(r.polRound).prevotes.power[c.hash]):
+			if c.err == nil && (e.lockedRound <= r.polRound || e.lockedBlock == c) {
+				e.vote(Prevote, c.hash)
+			} else {
+				e.vote(Prevote, "")
+			}
+			e.step = stepPrevote
+			return true
+		}
+	}
+
+	if e.step == stepPrevote && !r.prevoteTimeout && e.vals.quorum(r.prevotes.total) {
+		r.prevoteTimeout = true
+		e.schedule(e.timeout(e.round), stepPrevote)
+		return true
+	}
+
+	// A quorum of prevotes for the proposal locks the validator on it.
+	if e.step >= stepPrevote && !r.polSeen && c != nil && c.err == nil && e.vals.quorum(r.prevotes.power[c.hash]) {
+		r.polSeen = true
+		if e.step == stepPrevote {
+			e.lockedRound, e.lockedBlock = e.round, c
+			e.vote(Precommit, c.hash)
+			e.step = stepPrecommit
+		}
+		e.validRound, e.validBlock = e.round, c
+		return true
+	}
+
+	if e.step == stepPrevote && e.vals.quorum(r.prevotes.power[""]) {
+		e.vote(Precommit, "")
+		e.step = stepPrecommit
+		return true
+	}
+
+	if !r.precommitTimeout && e.vals.quorum(r.precommits.total) {
+		r.precommitTimeout = true
+		e.schedule(e.timeout(e.round), stepPrecommit)
+		return true
+	}
+
+	return false
+}
+
+// decide stores the block with its justification, commits its changes
+// and starts the next height.
+func (e *Engine) decide(c *candidate, justification json.RawMessage) error {
+	b := c.Block
+	b.Justification = justification
+
+	if err := e.cfg.Store.Append(b); err != nil {
+		return fmt.Errorf("storing block %d: %w", b.Height, err)
+	}
+
+	if err := c.batch.Commit(); err != nil {
+		return fmt.Errorf("committing block %d: %w", b.Height, err)
+	}
+
+	e.cfg.Log.Infow("consensus", "status", "block committed", "height", b.Height, "hash", c.hash, "round", e.round, "txs", len(b.Txs))
+
+	e.cfg.Mempool.Revalidate()
+
+	for _, ev := range b.Evidence {
+		delete(e.evidence, ev.Validator)
+	}
+
+	if len(b.Validators) > 0 {
+		e.vals = newValidatorSet(b.Validators)
+		e.cfg.Log.Infow("consensus", "status", "validator set changed", "height", b.Height, "validators", len(b.Validators), "power", e.vals.total)
+	}
+
+	e.newHeight(b)
+	e.startRound(0)
+
+	future := e.future
+	e.future = make(map[string]consensus.Message)
+	for _, m := range future {
+		e.receive(m)
+	}
+
+	return nil
+}
+
+// newHeight resets the state for the height after the final block.
+func (e *Engine) newHeight(final chain.Block) {
+	e.final = final
+	e.height = final.Height + 1
+	e.round = 0
+	e.step = 0
+	e.rounds = make(map[int]*round)
+	e.candidates = make(map[string]*candidate)
+	e.lockedRound, e.lockedBlock = -1, nil
+	e.validRound, e.validBlock = -1, nil
+}
+
+// startRound starts the round at the current height. The first round
+// starts the block time after the last block.
+func (e *Engine) startRound(rn int) {
+	e.round = rn
+	e.step = stepPropose
+
+	e.cfg.Log.Debugw("consensus", "status", "round started", "height", e.height, "round", rn)
+
+	if !e.active() {
+		return
+	}
+
+	var wait time.Duration
+	if rn == 0 {
+		wait = e.final.Time().Add(e.cfg.Genesis.Consensus.BlockTime.Duration).Sub(e.now())
+		if wait < 0 {
+			wait = 0
+		}
+	}
+
+	height := e.height
+	if e.vals.proposer(height, rn) == e.id {
+		e.after(wait, func() { e.propose(height, rn) })
+	}
+	e.after(wait+e.timeout(rn), func() { e.onTimeout(height, rn, stepPropose) })
+}
+
+// timeout returns the timeout of the steps of the round.
+func (e *Engine) timeout(rn int) time.Duration {
+	bt := e.cfg.Genesis.Consensus.BlockTime.Duration
+	return bt + time.Duration(rn)*bt/2
+}
+
+// schedule schedules the timeout of the step in the current round.
+func (e *Engine) schedule(d time.Duration, st step) {
+	if !e.active() {
+		return
+	}
+
+	height, rn := e.height, e.round
+	e.after(d, func() { e.onTimeout(height, rn, st) })
+}
+
+// onTimeout moves on when the step of the round didn't complete in time.
+func (e *Engine) onTimeout(height uint64, rn int, st step) {
+	if height != e.height || rn != e.round {
+		return
+	}
+
+	switch st {
+	case stepPropose:
+		if e.step == stepPropose {
+			e.vote(Prevote, "")
+			e.step = stepPrevote
+		}
+	case stepPrevote:
+		if e.step == stepPrevote {
+			e.vote(Precommit, "")
+			e.step = stepPrecommit
+		}
+	case stepPrecommit:
+		e.startRound(rn + 1)
+	}
+}
+
+// after runs the function with the lock held after the duration, unless
+// the engine is stopped by then.
+func (e *Engine) after(d time.Duration, f func()) {
+	time.AfterFunc(d, func() {
+		e.mu.Lock()
+		if e.stopped {
+			e.mu.Unlock()
+			return
+		}
+		f()
+		e.check()
+		out := e.flush()
+		e.mu.Unlock()
+
+		e.broadcast(out)
+	})
+}
+
+// =============================================================================
+
+// propose proposes the valid block of an earlier round, or a new block on
+// top of the final block.
+func (e *Engine) propose(height uint64, rn int) {
+	if height != e.height || rn != e.round || e.step != stepPropose || e.roundOf(rn).proposal != nil {
+		return
+	}
+
+	c := e.validBlock
+	if c == nil {
+		var err error
+		if c, err = e.build(); err != nil {
+			e.cfg.Log.Errorw("consensus", "status", "building block failed", "height", height, "ERROR", err)
+			return
+		}
+	}
+
+	if !e.sign(stepPropose) {
+		return
+	}
+
+	p, err := signProposal(e.cfg.Genesis.ChainID, rn, e.validRound, c.Block, e.cfg.Signer)
+	if err != nil {
+		e.cfg.Log.Errorw("consensus", "status", "signing proposal failed", "height", height, "ERROR", err)
+		return
+	}
+
+	r := e.roundOf(rn)
+	r.proposal = c
+	r.polRound = e.validRound
+
+	e.send(MessageProposal, p)
+}
+
+// build builds a block with the evidence and transactions of the mempool
+// on top of the final block.
+func (e *Engine) build() (*candidate, error) {
+	batch := e.cfg.State.Begin(e.height)
+
+	space := consensus.BlockSpace(e.cfg.Genesis.ChainID, e.height, e.final.Hash(), e.cfg.Genesis.Consensus)
+
+	// Slashing is applied in the order of the evidence in the block.
+	pending := make([]chain.Evidence, 0, len(e.evidence))
+	for _, ev := range e.evidence {
+		pending = append(pending, ev)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Validator < pending[j].Validator })
+
+	// Evidence of validators that can't be slashed anymore, such as
+	// because they already are, is dropped. Evidence that doesn't fit is
+	// kept for a later block.
+	var evidence []chain.Evidence
+	for _, ev := range pending {
+		size := consensus.ItemSize(ev)
+		if size > space {
+			continue
+		}
+		if err := batch.Slash(ev.Validator, e.cfg.Genesis.Consensus.SlashPercent); err != nil {
+			delete(e.evidence, ev.Validator)
+			continue
+		}
+		evidence = append(evidence, ev)
+		space -= size
+	}
+
+	var txs []tx.SignedTx
+	for _, stx := range e.cfg.Mempool.Pick(e.cfg.Genesis.Consensus.MaxBlockTxs) {
+		size := consensus.ItemSize(stx)
+		if size > space {
+			continue
+		}
+		if err := batch.Apply(stx, ""); err != nil {
+			continue
+		}
+		txs = append(txs, stx)
+		space -= size
+	}
+
+	ts := e.now().UnixMilli()
+	if ts <= e.final.Timestamp {
+		ts = e.final.Timestamp + 1
+	}
+
+	vals := consensus.EndBlock(batch, e.cfg.Genesis.Consensus)
+
+	h := chain.Header{
+		ChainID:        e.cfg.Genesis.ChainID,
+		Height:         e.height,
+		ParentHash:     e.final.Hash(),
+		Timestamp:      ts,
+		TxRoot:         chain.TxRoot(txs),
+		StateRoot:      batch.Root(),
+		ValidatorsHash: chain.ValidatorsHash(vals),
+		EvidenceRoot:   chain.EvidenceRoot(evidence),
+	}
+
+	b, err := chain.Sign(h, txs, e.cfg.Signer)
+	if err != nil {
+		return nil, err
+	}
+	b.Validators = vals
+	b.Evidence = evidence
+
+	if size := b.Size(); size > chain.MaxBlockSize {
+		return nil, fmt.Errorf("block of %d bytes exceeds %d", size, chain.MaxBlockSize)
+	}
+
+	c := candidate{Block: b, hash: b.Hash(), batch: batch}
+	e.candidates[c.hash] = &c
+
+	return &c, nil
+}
+
+// vote casts the validator's vote in the current round.
+func (e *Engine) vote(typ VoteType, hash string) {
+	st := stepPrevote
+	if typ == Precommit {
+		st = stepPrecommit
+	}
+
+	if !e.sign(st) {
+		return
+	}
+
+	v, err := signVote(e.cfg.Genesis.ChainID, typ, e.height, e.round, hash, e.cfg.Signer)
+	if err != nil {
+		e.cfg.Log.Errorw("consensus", "status", "signing vote failed", "height", e.height, "ERROR", err)
+		return
+	}
+
+	power, _ := e.vals.power(e.id)
+	e.roundOf(e.round).votes(typ).add(v, power)
+
+	e.send(MessageVote, v)
+}
+
+// sign reports whether the validator may sign a message of the step in
+// the current round, and records it in the sign state if so.
+func (e *Engine) sign(st step) bool {
+	if !e.active() {
+		return false
+	}
+
+	if _, ok := e.vals.power(e.id); !ok {
+		return false
+	}
+
+	if !e.signs.allows(e.height, e.round, st) {
+		return false
+	}
+
+	if err := e.signs.update(e.height, e.round, st); err != nil {
+		e.cfg.Log.Errorw("consensus", "status", "updating sign state failed", "ERROR", err)
+		return false
+	}
+
+	return true
+}
+
+// active reports whether the engine takes part in consensus.
+func (e *Engine) active() bool {
+	return e.started && !e.stopped && e.cfg.Signer != nil
+}
+
+// send queues the message to be broadcast once the lock is released.
+func (e *Engine) send(typ string, v any) {
+	m, err := consensus.NewMessage(typ, v)
+	if err != nil {
+		e.cfg.Log.Errorw("consensus", "status", "encoding message failed", "ERROR", err)
+		return
+	}
+	e.out = append(e.out, m)
+}
+
+// flush returns the queued messages. Nothing is sent when the engine
+// isn't running.
+func (e *Engine) flush() []consensus.Message {
+	out := e.out
+	e.out = nil
+
+	if !e.started || e.stopped {
+		return nil
+	}
+	return out
+}
+
+// broadcast sends the messages to the network.
+func (e *Engine) broadcast(out []consensus.Message) {
+	if e.cfg.Broadcast == nil {
+		return
+	}
+
+	for _, m := range out {
+		e.cfg.Broadcast(m)
+	}
+}
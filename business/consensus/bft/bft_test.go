@@ -0,0 +1,662 @@
+package bft_test
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/consensus"
+	"github.com/toqns/toqns/business/consensus/bft"
+	"github.com/toqns/toqns/business/consensus/consensustest"
+	"github.com/toqns/toqns/business/genesis"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/tx"
+)
+
+// Success and failure markers.
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+const chainID = consensustest.ChainID
+
+func TestBFT(t *testing.T) {
+	alice, _ := key.New()
+	aliceAddr, _ := alice.Address(key.AccountAddress)
+	bob, _ := key.New()
+	bobAddr, _ := bob.Address(key.AccountAddress)
+
+	t.Log("Given the need to commit blocks with instant finality.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen all validators are online.", testID)
+		{
+			net := newNetwork(t, 4, 4, aliceAddr)
+
+			stx, _ := tx.Tx{ChainID: chainID, From: aliceAddr, To: bobAddr, Amount: 100, Fee: 1}.Sign(alice)
+			for _, n := range net.Nodes {
+				if err := n.Mempool.Add(stx); err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to add the transaction: %v.", failed, testID, err)
+				}
+			}
+
+			net.Run(time.Second)
+
+			height := net.FinalHeight()
+			if height < 3 {
+				t.Fatalf("\t%s\tTest %d:\tShould commit blocks, but final height is %d.", failed, testID, height)
+			}
+			t.Logf("\t%s\tTest %d:\tShould commit blocks up to height %d.", success, testID, height)
+
+			net.CheckAgreement(t, testID, height, verifyCommit)
+
+			for i, n := range net.Nodes {
+				if b := n.State.Balance(bobAddr); b != 100 {
+					t.Fatalf("\t%s\tTest %d:\tShould include the transaction on node %d, but balance is %d.", failed, testID, i, b)
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould include the transaction on all nodes.", success, testID)
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen a validator is offline.", testID)
+		{
+			net := newNetwork(t, 4, 3, aliceAddr)
+			net.Run(1500 * time.Millisecond)
+
+			height := net.FinalHeight()
+			if height < 3 {
+				t.Fatalf("\t%s\tTest %d:\tShould commit blocks with a validator offline, but final height is %d.", failed, testID, height)
+			}
+			t.Logf("\t%s\tTest %d:\tShould commit blocks with a validator offline up to height %d.", success, testID, height)
+
+			net.CheckAgreement(t, testID, height, verifyCommit)
+		}
+
+		testID = 2
+		t.Logf("\tTest %d:\tWhen an account bonds stake to a new validator.", testID)
+		{
+			net := newNetwork(t, 4, 4, aliceAddr)
+
+			node, _ := key.New()
+			reg, _ := tx.Tx{Type: tx.TypeRegister, ChainID: chainID, From: aliceAddr}.SignValidator(node)
+			register, _ := reg.Sign(alice)
+			bond, _ := tx.Tx{Type: tx.TypeBond, ChainID: chainID, Nonce: 1, From: aliceAddr, Amount: 1}.Sign(alice)
+			for _, n := range net.Nodes {
+				for _, stx := range []tx.SignedTx{register, bond} {
+					if err := n.Mempool.Add(stx); err != nil {
+						t.Fatalf("\t%s\tTest %d:\tShould be able to add the transaction: %v.", failed, testID, err)
+					}
+				}
+			}
+
+			net.Run(time.Second)
+
+			height := net.FinalHeight()
+			vals, err := consensus.Validators(net.Nodes[0].Store, net.Genesis, height+1)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould get the validators: %v.", failed, testID, err)
+			}
+			if len(vals) != 5 {
+				t.Fatalf("\t%s\tTest %d:\tShould add the validator at the end of the epoch, but got %d validators.", failed, testID, len(vals))
+			}
+			t.Logf("\t%s\tTest %d:\tShould add the validator at the end of the epoch.", success, testID)
+
+			net.CheckAgreement(t, testID, height, verifyCommit)
+		}
+
+		testID = 3
+		t.Logf("\tTest %d:\tWhen a third of the validators is offline.", testID)
+		{
+			net := newNetwork(t, 3, 2, aliceAddr)
+			net.Run(500 * time.Millisecond)
+
+			if height := net.FinalHeight(); height != 0 {
+				t.Fatalf("\t%s\tTest %d:\tShould not commit blocks without a quorum, but final height is %d.", failed, testID, height)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not commit blocks without a quorum.", success, testID)
+		}
+
+		testID = 4
+		t.Logf("\tTest %d:\tWhen a validator double-signs.", testID)
+		{
+			g, keys := newGenesis(5, aliceAddr)
+			net := consensustest.NewNetwork(t, g, keys, 4, newEngine)
+
+			// The offline validator prevotes for two blocks at the first
+			// height.
+			signer := keys[4]
+			for _, hash := range []string{strings.Repeat("a", 64), strings.Repeat("b", 64)} {
+				v, _ := bft.SignVote(chainID, bft.Prevote, 1, 0, hash, signer)
+				m, _ := consensus.NewMessage(bft.MessageVote, v)
+				for _, n := range net.Nodes {
+					n.Engine.Receive(m)
+				}
+			}
+
+			net.Run(time.Second)
+
+			height := net.FinalHeight()
+			if height < 2 {
+				t.Fatalf("\t%s\tTest %d:\tShould commit an epoch, but final height is %d.", failed, testID, height)
+			}
+			net.CheckAgreement(t, testID, height, verifyCommit)
+
+			operator, _ := signer.Address(key.AccountAddress)
+			validator, _ := signer.Address(key.NodeAddress)
+			for i, n := range net.Nodes {
+				if a := n.State.Account(operator); !a.Jailed {
+					t.Fatalf("\t%s\tTest %d:\tShould jail the validator on node %d.", failed, testID, i)
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould jail the validator on all nodes.", success, testID)
+
+			vals, err := consensus.Validators(net.Nodes[0].Store, net.Genesis, height+1)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould get the validators: %v.", failed, testID, err)
+			}
+			for _, v := range vals {
+				if v.Address == validator {
+					t.Fatalf("\t%s\tTest %d:\tShould remove the validator at the end of the epoch.", failed, testID)
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould remove the validator at the end of the epoch.", success, testID)
+		}
+	}
+}
+
+// =============================================================================
+
+// newEngine returns a BFT engine as consensus.Engine.
+func newEngine(cfg consensus.Config) (consensus.Engine, error) {
+	return bft.New(cfg)
+}
+
+// newNetwork returns a network of validators, of which only the first
+// online validators run.
+func newNetwork(t *testing.T, validators, online int, account key.Address) *consensustest.Network {
+	g, keys := newGenesis(validators, account)
+	return consensustest.NewNetwork(t, g, keys, online, newEngine)
+}
+
+// newGenesis returns a genesis of new validators and the account, with
+// short blocks and epochs, and the keys of the validators.
+func newGenesis(validators int, account key.Address) (genesis.Genesis, []key.Key) {
+	g, keys := consensustest.NewGenesis(genesis.EngineBFT, validators, account)
+	g.Consensus.BlockTime = genesis.Duration{Duration: 50 * time.Millisecond}
+	g.Consensus.EpochLength = 2
+
+	return g, keys
+}
+
+// verifyCommit checks that the block has a valid commit of the validators.
+func verifyCommit(vals []chain.Validator, b chain.Block) error {
+	return bft.VerifyCommit(chainID, vals, b)
+}
+
+func TestRules(t *testing.T) {
+	t.Log("Given the need to follow the consensus rules message by message.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen a locked validator gets a new block without a proof of lock.", testID)
+		{
+			p := newPlayer(t)
+			a := p.block(0, 1)
+
+			p.receive(testID, p.proposal(0, -1, a), nil)
+			p.checkVote(testID, bft.Prevote, 0, a.Hash())
+
+			p.receive(testID, p.vote(0, bft.Prevote, 0, a.Hash()), nil)
+			p.receive(testID, p.vote(1, bft.Prevote, 0, a.Hash()), nil)
+			p.checkVote(testID, bft.Precommit, 0, a.Hash())
+
+			// The other validators time out and move to the next round.
+			p.receive(testID, p.vote(0, bft.Prevote, 1, ""), nil)
+			p.receive(testID, p.vote(1, bft.Prevote, 1, ""), nil)
+
+			b := p.block(1, 2)
+			p.receive(testID, p.proposal(1, -1, b), nil)
+			p.checkVotes(testID, []bft.Vote{
+				{Type: bft.Prevote, Round: 1},
+				{Type: bft.Precommit, Round: 1},
+			})
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen a locked validator gets a block with a later proof of lock.", testID)
+		{
+			p := newPlayer(t)
+			a := p.block(0, 1)
+
+			p.receive(testID, p.proposal(0, -1, a), nil)
+			p.receive(testID, p.vote(0, bft.Prevote, 0, a.Hash()), nil)
+			p.receive(testID, p.vote(1, bft.Prevote, 0, a.Hash()), nil)
+			p.checkVotes(testID, []bft.Vote{
+				{Type: bft.Prevote, Round: 0, BlockHash: a.Hash()},
+				{Type: bft.Precommit, Round: 0, BlockHash: a.Hash()},
+			})
+
+			// The other validators prevote a block in round 1 that the
+			// validator missed.
+			b := p.block(1, 2)
+			for i := range p.others {
+				p.receive(testID, p.vote(i, bft.Prevote, 1, b.Hash()), nil)
+			}
+
+			// The proposer of round 2 proposes it again with the proof of
+			// lock, and the other validators move to round 2.
+			p.receive(testID, p.proposal(2, 1, b), nil)
+			p.receive(testID, p.vote(0, bft.Prevote, 2, b.Hash()), nil)
+			p.receive(testID, p.vote(1, bft.Prevote, 2, b.Hash()), nil)
+
+			p.checkVotes(testID, []bft.Vote{
+				{Type: bft.Prevote, Round: 2, BlockHash: b.Hash()},
+				{Type: bft.Precommit, Round: 2, BlockHash: b.Hash()},
+			})
+		}
+
+		testID = 2
+		t.Logf("\tTest %d:\tWhen the proposer is byzantine.", testID)
+		{
+			p := newPlayer(t)
+			a := p.block(0, 1)
+
+			for _, addr := range p.others {
+				if addr != p.proposer(0) {
+					p.receive(testID, p.signProposal(addr, 0, -1, a), consensus.ErrInvalidMessage)
+					break
+				}
+			}
+			p.checkVotes(testID, nil)
+
+			p.receive(testID, p.proposal(0, -1, a), nil)
+			p.checkVote(testID, bft.Prevote, 0, a.Hash())
+
+			p.receive(testID, p.proposal(0, -1, p.block(0, 2)), consensus.ErrInvalidMessage)
+			p.checkVotes(testID, nil)
+
+			// More than a third of the validators moving on starts the
+			// round, whose proposer proposes an invalid block.
+			p.receive(testID, p.vote(0, bft.Precommit, 1, ""), nil)
+			p.receive(testID, p.vote(1, bft.Precommit, 1, ""), nil)
+
+			invalid := p.block(1, 0)
+			p.receive(testID, p.proposal(1, -1, invalid), chain.ErrInvalidBlock)
+			p.checkVote(testID, bft.Prevote, 1, "")
+		}
+
+		testID = 3
+		t.Logf("\tTest %d:\tWhen a commit doesn't have a quorum.", testID)
+		{
+			p := newPlayer(t)
+			a := p.block(0, 1)
+
+			a.Justification = p.commit(a, p.others[:2]...)
+
+			m, _ := consensus.NewMessage(bft.MessageCommit, a)
+			p.receive(testID, m, consensus.ErrInvalidMessage)
+
+			if final := p.node.Engine.Final(); final.Height != 0 {
+				t.Fatalf("\t%s\tTest %d:\tShould not commit the block, but final height is %d.", failed, testID, final.Height)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not commit the block.", success, testID)
+		}
+
+		testID = 4
+		t.Logf("\tTest %d:\tWhen a validator double-signs.", testID)
+		{
+			p := newPlayer(t)
+			a := p.block(0, 1)
+
+			p.receive(testID, p.vote(0, bft.Prevote, 0, a.Hash()), nil)
+			p.receive(testID, p.vote(0, bft.Prevote, 0, ""), consensus.ErrInvalidMessage)
+			p.receive(testID, p.vote(0, bft.Prevote, 0, p.block(0, 2).Hash()), consensus.ErrInvalidMessage)
+
+			// The other validators move to the first round the validator
+			// proposes in.
+			rn := 3
+			for p.proposer(rn) != p.self {
+				rn++
+			}
+			p.receive(testID, p.vote(1, bft.Prevote, rn, ""), nil)
+			p.receive(testID, p.vote(2, bft.Prevote, rn, ""), nil)
+
+			prop := p.waitProposal(testID)
+			if len(prop.Block.Evidence) != 1 || prop.Block.Evidence[0].Validator != p.others[0] {
+				t.Fatalf("\t%s\tTest %d:\tShould propose a block with the evidence once, got %d pieces of evidence.", failed, testID, len(prop.Block.Evidence))
+			}
+			t.Logf("\t%s\tTest %d:\tShould propose a block with the evidence once.", success, testID)
+
+			if err := bft.VerifyEvidence(chainID, prop.Block.Evidence[0]); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould propose valid evidence: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould propose valid evidence.", success, testID)
+		}
+
+		testID = 5
+		t.Logf("\tTest %d:\tWhen a proposal holds evidence.", testID)
+		{
+			tt := []struct {
+				name     string
+				evidence func(p *player) []chain.Evidence
+				err      error
+			}{
+				{"valid", func(p *player) []chain.Evidence { return []chain.Evidence{p.evidence(0, 1)} }, nil},
+				{"duplicate", func(p *player) []chain.Evidence { return []chain.Evidence{p.evidence(0, 1), p.evidence(0, 1)} }, chain.ErrInvalidBlock},
+				{"future", func(p *player) []chain.Evidence { return []chain.Evidence{p.evidence(0, 2)} }, chain.ErrInvalidBlock},
+			}
+
+			for _, test := range tt {
+				p := newPlayer(t)
+				b := p.block(0, 1, test.evidence(p)...)
+
+				p.receive(testID, p.proposal(0, -1, b), test.err)
+				if test.err == nil {
+					p.checkVote(testID, bft.Prevote, 0, b.Hash())
+					continue
+				}
+				p.checkVote(testID, bft.Prevote, 0, "")
+				t.Logf("\t%s\tTest %d:\tShould reject %s evidence.", success, testID, test.name)
+			}
+		}
+
+		testID = 6
+		t.Logf("\tTest %d:\tWhen a synced block holds expired evidence.", testID)
+		{
+			p := newPlayer(t)
+
+			parent := chain.Block{Header: chain.Header{
+				ChainID:   chainID,
+				Height:    p.genesis.Consensus.UnbondingPeriod + 1,
+				Timestamp: p.parent.Timestamp,
+			}}
+			h := chain.Header{
+				ChainID:    chainID,
+				Height:     parent.Height + 1,
+				ParentHash: parent.Hash(),
+				Timestamp:  parent.Timestamp + 1,
+				TxRoot:     chain.TxRoot(nil),
+			}
+
+			b := p.sign(h, p.proposer(0))
+			b.Justification = p.commit(b, p.others...)
+			if err := bft.VerifyBlock(p.genesis, p.vals, parent, b); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould verify the block without evidence: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould verify the block without evidence.", success, testID)
+
+			b = p.sign(h, p.proposer(0), p.evidence(0, 1))
+			b.Justification = p.commit(b, p.others...)
+			if err := bft.VerifyBlock(p.genesis, p.vals, parent, b); !errors.Is(err, chain.ErrInvalidBlock) {
+				t.Fatalf("\t%s\tTest %d:\tShould reject the block with expired evidence, got %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould reject the block with expired evidence.", success, testID)
+		}
+	}
+}
+
+// =============================================================================
+
+// player plays the other validators of a network against the engine of
+// one validator at height 1, so the rules can be checked message by
+// message. The block time is an hour, so no timeout fires during a test.
+type player struct {
+	t       *testing.T
+	genesis genesis.Genesis
+	node    *consensustest.Node
+	parent  chain.Block
+	vals    []chain.Validator
+	keys    map[key.Address]key.Key
+	self    key.Address
+
+	// others are the other validators, none of which is the proposer of
+	// the first three rounds.
+	others []key.Address
+
+	// out are the messages the engine broadcast, which it broadcasts from
+	// its timers when it proposes.
+	mu  sync.Mutex
+	out []consensus.Message
+}
+
+// newPlayer returns a player against a validator that isn't the proposer
+// of the first three rounds of a network of four validators.
+func newPlayer(t *testing.T) *player {
+	g, keys := consensustest.NewGenesis(genesis.EngineBFT, 4)
+	g.Consensus.BlockTime = genesis.Duration{Duration: time.Hour}
+
+	p := player{
+		t:       t,
+		genesis: g,
+		vals:    g.ValidatorSet(),
+		keys:    make(map[key.Address]key.Key),
+	}
+
+	proposers := make(map[key.Address]bool)
+	for rn := 0; rn < 3; rn++ {
+		proposers[p.proposer(rn)] = true
+	}
+
+	self := -1
+	for i, k := range keys {
+		addr, _ := k.Address(key.NodeAddress)
+		p.keys[addr] = k
+		if self == -1 && !proposers[addr] {
+			self, p.self = i, addr
+			continue
+		}
+		if !proposers[addr] {
+			p.others = append(p.others, addr)
+		}
+	}
+	for addr := range proposers {
+		p.others = append(p.others, addr)
+	}
+
+	broadcast := func(m consensus.Message) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.out = append(p.out, m)
+	}
+
+	p.node = consensustest.NewNode(t, g, keys[self], broadcast, newEngine)
+	p.parent, _ = p.node.Store.ByHeight(0)
+
+	p.node.Engine.Start()
+	t.Cleanup(p.node.Engine.Stop)
+
+	return &p
+}
+
+// block returns a block at height 1 of the proposer of the round with the
+// evidence, with the timestamp the milliseconds after the parent's. Blocks
+// with a timestamp that isn't after the parent's are invalid.
+func (p *player) block(round int, ms int64, evidence ...chain.Evidence) chain.Block {
+	batch := p.node.State.Begin(1)
+	for _, ev := range evidence {
+		batch.Slash(ev.Validator, p.genesis.Consensus.SlashPercent)
+	}
+
+	h := chain.Header{
+		ChainID:    chainID,
+		Height:     1,
+		ParentHash: p.parent.Hash(),
+		Timestamp:  p.parent.Timestamp + ms,
+		TxRoot:     chain.TxRoot(nil),
+		StateRoot:  batch.Root(),
+	}
+
+	return p.sign(h, p.proposer(round), evidence...)
+}
+
+// sign returns the block of the header with the evidence, signed by the
+// validator.
+func (p *player) sign(h chain.Header, addr key.Address, evidence ...chain.Evidence) chain.Block {
+	h.EvidenceRoot = chain.EvidenceRoot(evidence)
+
+	b, err := chain.Sign(h, nil, p.keys[addr])
+	if err != nil {
+		p.t.Fatalf("\t%s\tShould be able to sign the block: %v.", failed, err)
+	}
+	b.Evidence = evidence
+
+	return b
+}
+
+// commit returns the commit of the block in round 0 with the precommits of
+// the validators.
+func (p *player) commit(b chain.Block, addrs ...key.Address) json.RawMessage {
+	c := bft.Commit{Height: b.Height, BlockHash: b.Hash()}
+	for _, addr := range addrs {
+		v, err := bft.SignVote(chainID, bft.Precommit, b.Height, 0, b.Hash(), p.keys[addr])
+		if err != nil {
+			p.t.Fatalf("\t%s\tShould be able to sign the precommit: %v.", failed, err)
+		}
+		c.Precommits = append(c.Precommits, v)
+	}
+
+	j, err := json.Marshal(c)
+	if err != nil {
+		p.t.Fatalf("\t%s\tShould be able to encode the commit: %v.", failed, err)
+	}
+	return j
+}
+
+// evidence returns evidence of the other validator at the index prevoting
+// for two blocks in round 0 at the height.
+func (p *player) evidence(i int, height uint64) chain.Evidence {
+	k := p.keys[p.others[i]]
+	a, errA := bft.SignVote(chainID, bft.Prevote, height, 0, strings.Repeat("a", 64), k)
+	b, errB := bft.SignVote(chainID, bft.Prevote, height, 0, strings.Repeat("b", 64), k)
+	if errA != nil || errB != nil {
+		p.t.Fatalf("\t%s\tShould be able to sign the votes.", failed)
+	}
+
+	ev, err := bft.NewEvidence(a, b)
+	if err != nil {
+		p.t.Fatalf("\t%s\tShould be able to create the evidence: %v.", failed, err)
+	}
+	return ev
+}
+
+// proposer returns the proposer of the round at height 1.
+func (p *player) proposer(round int) key.Address {
+	return bft.Proposer(p.vals, 1, round)
+}
+
+// proposal returns the proposal of the block by the proposer of the round.
+func (p *player) proposal(round, polRound int, b chain.Block) consensus.Message {
+	return p.signProposal(p.proposer(round), round, polRound, b)
+}
+
+// signProposal returns the proposal of the block signed by the validator.
+func (p *player) signProposal(addr key.Address, round, polRound int, b chain.Block) consensus.Message {
+	prop, err := bft.SignProposal(chainID, round, polRound, b, p.keys[addr])
+	if err != nil {
+		p.t.Fatalf("\t%s\tShould be able to sign the proposal: %v.", failed, err)
+	}
+
+	m, err := consensus.NewMessage(bft.MessageProposal, prop)
+	if err != nil {
+		p.t.Fatalf("\t%s\tShould be able to encode the proposal: %v.", failed, err)
+	}
+	return m
+}
+
+// vote returns the vote of the other validator at the index.
+func (p *player) vote(i int, typ bft.VoteType, round int, hash string) consensus.Message {
+	m, err := consensus.NewMessage(bft.MessageVote, p.signVote(p.others[i], typ, round, hash))
+	if err != nil {
+		p.t.Fatalf("\t%s\tShould be able to encode the vote: %v.", failed, err)
+	}
+	return m
+}
+
+// signVote returns the vote at height 1 signed by the validator.
+func (p *player) signVote(addr key.Address, typ bft.VoteType, round int, hash string) bft.Vote {
+	v, err := bft.SignVote(chainID, typ, 1, round, hash, p.keys[addr])
+	if err != nil {
+		p.t.Fatalf("\t%s\tShould be able to sign the vote: %v.", failed, err)
+	}
+	return v
+}
+
+// receive delivers the message to the engine and checks that it returns
+// the error.
+func (p *player) receive(testID int, m consensus.Message, want error) {
+	err := p.node.Engine.Receive(m)
+	if want == nil && err != nil {
+		p.t.Fatalf("\t%s\tTest %d:\tShould accept the %s: %v.", failed, testID, m.Type, err)
+	}
+	if want != nil && !errors.Is(err, want) {
+		p.t.Fatalf("\t%s\tTest %d:\tShould reject the %s with %q, got %v.", failed, testID, m.Type, want, err)
+	}
+}
+
+// checkVote checks that the engine broadcast only the vote since the last
+// check.
+func (p *player) checkVote(testID int, typ bft.VoteType, round int, hash string) {
+	p.checkVotes(testID, []bft.Vote{{Type: typ, Round: round, BlockHash: hash}})
+}
+
+// checkVotes checks that the engine broadcast the votes, compared by type,
+// round and block hash, since the last check.
+func (p *player) checkVotes(testID int, want []bft.Vote) {
+	p.mu.Lock()
+	out := p.out
+	p.out = nil
+	p.mu.Unlock()
+
+	if len(out) != len(want) {
+		p.t.Fatalf("\t%s\tTest %d:\tShould broadcast %d votes, got %d messages.", failed, testID, len(want), len(out))
+	}
+
+	for i, m := range out {
+		var v bft.Vote
+		if m.Type != bft.MessageVote || m.Decode(&v) != nil {
+			p.t.Fatalf("\t%s\tTest %d:\tShould broadcast a vote, got a %s.", failed, testID, m.Type)
+		}
+
+		w := want[i]
+		if v.Type != w.Type || v.Height != 1 || v.Round != w.Round || v.BlockHash != w.BlockHash {
+			p.t.Fatalf("\t%s\tTest %d:\tShould %s %s in round %d, got %s %s in round %d.", failed, testID, w.Type, blockName(w.BlockHash), w.Round, v.Type, blockName(v.BlockHash), v.Round)
+		}
+		p.t.Logf("\t%s\tTest %d:\tShould %s %s in round %d.", success, testID, w.Type, blockName(w.BlockHash), w.Round)
+	}
+
+	if len(want) == 0 {
+		p.t.Logf("\t%s\tTest %d:\tShould not vote.", success, testID)
+	}
+}
+
+// blockName returns the block hash of a vote for logs.
+func blockName(hash string) string {
+	if hash == "" {
+		return "no block"
+	}
+	return "block " + hash[:8]
+}
+
+// waitProposal waits for the engine to broadcast a proposal.
+func (p *player) waitProposal(testID int) bft.Proposal {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		p.mu.Lock()
+		out := p.out
+		p.mu.Unlock()
+
+		for _, m := range out {
+			var prop bft.Proposal
+			if m.Type == bft.MessageProposal && m.Decode(&prop) == nil {
+				return prop
+			}
+		}
+	}
+
+	p.t.Fatalf("\t%s\tTest %d:\tShould propose a block.", failed, testID)
+	return bft.Proposal{}
+}
@@ -0,0 +1,19 @@
+package bft
+
+import (
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/key"
+)
+
+// Exports for the tests that play the other validators.
+var (
+	SignProposal   = signProposal
+	SignVote       = signVote
+	NewEvidence    = newEvidence
+	VerifyEvidence = verifyEvidence
+)
+
+// Proposer returns the proposer of the round at the height.
+func Proposer(validators []chain.Validator, height uint64, round int) key.Address {
+	return newValidatorSet(validators).proposer(height, round)
+}
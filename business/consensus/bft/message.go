@@ -0,0 +1,409 @@
+package bft
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/consensus"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/foundation/canonical"
+)
+
+// Types of consensus messages.
+const (
+	MessageProposal = "proposal"
+	MessageVote     = "vote"
+	MessageCommit   = "commit"
+)
+
+// Domain prefixes of the signed data of messages.
+const (
+	proposalPrefix = "toqns/proposal:"
+	votePrefix     = "toqns/vote:"
+)
+
+// VoteType is the type of a vote.
+type VoteType uint8
+
+// Types of votes.
+const (
+	Prevote   VoteType = 1
+	Precommit VoteType = 2
+)
+
+// String implements the stringer interface.
+func (t VoteType) String() string {
+	switch t {
+	case Prevote:
+		return "prevote"
+	case Precommit:
+		return "precommit"
+	}
+	return fmt.Sprintf("VoteType(%d)", t)
+}
+
+// =============================================================================
+
+// Proposal is the block that the proposer of a round proposes.
+type Proposal struct {
+	Round int `json:"round"`
+
+	// POLRound is the round in which the block got a quorum of prevotes,
+	// when the proposer proposes a block of an earlier round, or -1.
+	POLRound int `json:"pol_round"`
+
+	Block     chain.Block   `json:"block"`
+	Proposer  key.Address   `json:"proposer"`
+	PublicKey key.PublicKey `json:"public_key"`
+	Signature string        `json:"signature"`
+}
+
+// signProposal returns the proposal of the block, signed by the proposer.
+func signProposal(chainID string, round, polRound int, b chain.Block, signer key.Signer) (Proposal, error) {
+	id, err := signer.PublicKey().Address(key.NodeAddress)
+	if err != nil {
+		return Proposal{}, err
+	}
+
+	p := Proposal{
+		Round:     round,
+		POLRound:  polRound,
+		Block:     b,
+		Proposer:  id,
+		PublicKey: signer.PublicKey(),
+	}
+
+	sig, err := signer.Sign(p.signingBytes(chainID))
+	if err != nil {
+		return Proposal{}, fmt.Errorf("signing proposal: %w", err)
+	}
+	p.Signature = hex.EncodeToString(sig)
+
+	return p, nil
+}
+
+// signingBytes returns the data that's signed by the proposer.
+func (p Proposal) signingBytes(chainID string) []byte {
+	b := []byte(proposalPrefix)
+	b = canonical.AppendString(b, chainID)
+	b = canonical.AppendUint64(b, p.Block.Height)
+	b = canonical.AppendUint64(b, uint64(p.Round))
+	b = canonical.AppendUint64(b, uint64(int64(p.POLRound)))
+	b = canonical.AppendString(b, p.Block.Hash())
+	return b
+}
+
+// verify verifies the rounds and the proposer's signature.
+func (p Proposal) verify(chainID string) error {
+	if p.Round < 0 || p.POLRound < -1 || p.POLRound >= p.Round {
+		return fmt.Errorf("%w: invalid rounds %d and %d", consensus.ErrInvalidMessage, p.Round, p.POLRound)
+	}
+
+	return verifySignature(p.PublicKey, p.Proposer, p.signingBytes(chainID), p.Signature)
+}
+
+// =============================================================================
+
+// Vote is the vote of a validator for a block in a round. Votes with an
+// empty block hash are votes for no block.
+type Vote struct {
+	Type      VoteType      `json:"type"`
+	Height    uint64        `json:"height"`
+	Round     int           `json:"round"`
+	BlockHash string        `json:"block_hash"`
+	Validator key.Address   `json:"validator"`
+	PublicKey key.PublicKey `json:"public_key"`
+	Signature string        `json:"signature"`
+}
+
+// signVote returns the vote, signed by the validator.
+func signVote(chainID string, typ VoteType, height uint64, round int, hash string, signer key.Signer) (Vote, error) {
+	id, err := signer.PublicKey().Address(key.NodeAddress)
+	if err != nil {
+		return Vote{}, err
+	}
+
+	v := Vote{
+		Type:      typ,
+		Height:    height,
+		Round:     round,
+		BlockHash: hash,
+		Validator: id,
+		PublicKey: signer.PublicKey(),
+	}
+
+	sig, err := signer.Sign(v.signingBytes(chainID))
+	if err != nil {
+		return Vote{}, fmt.Errorf("signing %s: %w", typ, err)
+	}
+	v.Signature = hex.EncodeToString(sig)
+
+	return v, nil
+}
+
+// signingBytes returns the data that's signed by the validator.
+func (v Vote) signingBytes(chainID string) []byte {
+	b := []byte(votePrefix)
+	b = canonical.AppendString(b, chainID)
+	b = append(b, byte(v.Type))
+	b = canonical.AppendUint64(b, v.Height)
+	b = canonical.AppendUint64(b, uint64(v.Round))
+	b = canonical.AppendString(b, v.BlockHash)
+	return b
+}
+
+// verify verifies the type, the round and the validator's signature.
+func (v Vote) verify(chainID string) error {
+	if v.Type != Prevote && v.Type != Precommit {
+		return fmt.Errorf("%w: unknown vote type %d", consensus.ErrInvalidMessage, v.Type)
+	}
+
+	if v.Round < 0 {
+		return fmt.Errorf("%w: invalid round %d", consensus.ErrInvalidMessage, v.Round)
+	}
+
+	return verifySignature(v.PublicKey, v.Validator, v.signingBytes(chainID), v.Signature)
+}
+
+// =============================================================================
+
+// Commit is the quorum certificate of a block: the precommits for the
+// block of validators with more than two thirds of the voting power. It's
+// stored as the justification of the block.
+type Commit struct {
+	Height     uint64 `json:"height"`
+	Round      int    `json:"round"`
+	BlockHash  string `json:"block_hash"`
+	Precommits []Vote `json:"precommits"`
+}
+
+// VerifyCommit verifies that the justification of the block is a commit
+// of the validators.
+//
+// Returns consensus.ErrInvalidMessage if verification fails.
+func VerifyCommit(chainID string, validators []chain.Validator, b chain.Block) error {
+	var c Commit
+	if err := json.Unmarshal(b.Justification, &c); err != nil {
+		return fmt.Errorf("%w: decoding commit: %v", consensus.ErrInvalidMessage, err)
+	}
+
+	if c.Height != b.Height || c.BlockHash != b.Hash() {
+		return fmt.Errorf("%w: commit isn't for block %d %s", consensus.ErrInvalidMessage, b.Height, b.Hash())
+	}
+
+	vals := newValidatorSet(validators)
+	voted := make(map[key.Address]bool)
+	var power uint64
+	for _, v := range c.Precommits {
+		if v.Type != Precommit || v.Height != c.Height || v.Round != c.Round || v.BlockHash != c.BlockHash {
+			return fmt.Errorf("%w: vote of %s isn't a precommit for the block", consensus.ErrInvalidMessage, v.Validator)
+		}
+
+		p, ok := vals.power(v.Validator)
+		if !ok {
+			return fmt.Errorf("%w: %s isn't a validator", consensus.ErrInvalidMessage, v.Validator)
+		}
+
+		if voted[v.Validator] {
+			return fmt.Errorf("%w: duplicate vote of %s", consensus.ErrInvalidMessage, v.Validator)
+		}
+		voted[v.Validator] = true
+
+		if err := v.verify(chainID); err != nil {
+			return err
+		}
+		power += p
+	}
+
+	if !vals.quorum(power) {
+		return fmt.Errorf("%w: commit has power %d of %d", consensus.ErrInvalidMessage, power, vals.total)
+	}
+
+	return nil
+}
+
+// newEvidence returns the evidence of the conflicting votes.
+func newEvidence(a, b Vote) (chain.Evidence, error) {
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return chain.Evidence{}, err
+	}
+
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return chain.Evidence{}, err
+	}
+
+	return chain.Evidence{Validator: a.Validator, Height: a.Height, A: ja, B: jb}, nil
+}
+
+// verifyEvidence verifies that the evidence holds two conflicting votes
+// that the validator signed.
+func verifyEvidence(chainID string, ev chain.Evidence) error {
+	var a, b Vote
+	if err := json.Unmarshal(ev.A, &a); err != nil {
+		return fmt.Errorf("%w: decoding evidence: %v", consensus.ErrInvalidMessage, err)
+	}
+	if err := json.Unmarshal(ev.B, &b); err != nil {
+		return fmt.Errorf("%w: decoding evidence: %v", consensus.ErrInvalidMessage, err)
+	}
+
+	switch {
+	case a.Validator != ev.Validator || b.Validator != ev.Validator:
+		return fmt.Errorf("%w: evidence votes aren't of %s", consensus.ErrInvalidMessage, ev.Validator)
+	case a.Height != ev.Height || b.Height != ev.Height:
+		return fmt.Errorf("%w: evidence votes aren't at height %d", consensus.ErrInvalidMessage, ev.Height)
+	case a.Type != b.Type || a.Round != b.Round:
+		return fmt.Errorf("%w: evidence votes are for different steps", consensus.ErrInvalidMessage)
+	case a.BlockHash == b.BlockHash:
+		return fmt.Errorf("%w: evidence votes don't conflict", consensus.ErrInvalidMessage)
+	}
+
+	if err := a.verify(chainID); err != nil {
+		return err
+	}
+	return b.verify(chainID)
+}
+
+// =============================================================================
+
+// validatorSet is the set of validators with their voting power.
+type validatorSet struct {
+	validators []chain.Validator
+	index      map[key.Address]int
+	total      uint64
+}
+
+// newValidatorSet returns the set of the validators.
+func newValidatorSet(validators []chain.Validator) validatorSet {
+	s := validatorSet{
+		validators: validators,
+		index:      make(map[key.Address]int, len(validators)),
+	}
+
+	for i, v := range validators {
+		s.index[v.Address] = i
+		s.total += v.Power
+	}
+
+	return s
+}
+
+// power returns the voting power of the validator. The bool is false if
+// the address isn't a validator.
+func (s validatorSet) power(addr key.Address) (uint64, bool) {
+	i, ok := s.index[addr]
+	if !ok {
+		return 0, false
+	}
+	return s.validators[i].Power, true
+}
+
+// quorum reports whether the power is more than two thirds of the total
+// power.
+func (s validatorSet) quorum(power uint64) bool {
+	return 3*power > 2*s.total
+}
+
+// oneThird reports whether the power is more than a third of the total
+// power, so at least one honest validator is included.
+func (s validatorSet) oneThird(power uint64) bool {
+	return 3*power > s.total
+}
+
+// proposer returns the proposer of the round. Proposers are picked by the
+// hash of the height and round, weighted by voting power.
+func (s validatorSet) proposer(height uint64, round int) key.Address {
+	b := canonical.AppendUint64(nil, height)
+	b = canonical.AppendUint64(b, uint64(round))
+	n := binary.BigEndian.Uint64(key.Hash(b)) % s.total
+
+	for _, v := range s.validators {
+		if n < v.Power {
+			return v.Address
+		}
+		n -= v.Power
+	}
+
+	return s.validators[len(s.validators)-1].Address
+}
+
+// =============================================================================
+
+// voteSet is the set of votes of one type in a round.
+type voteSet struct {
+	votes map[key.Address]Vote
+
+	// power is the voting power by block hash.
+	power map[string]uint64
+
+	// total is the voting power of all votes.
+	total uint64
+}
+
+// newVoteSet returns an empty vote set.
+func newVoteSet() *voteSet {
+	return &voteSet{
+		votes: make(map[key.Address]Vote),
+		power: make(map[string]uint64),
+	}
+}
+
+// add adds the vote with the validator's power.
+//
+// Returns consensus.ErrKnown if the validator already cast the vote, and
+// consensus.ErrInvalidMessage if it cast a different vote.
+func (vs *voteSet) add(v Vote, power uint64) error {
+	if prev, ok := vs.votes[v.Validator]; ok {
+		if prev.BlockHash == v.BlockHash {
+			return consensus.ErrKnown
+		}
+		return fmt.Errorf("%w: conflicting %s of %s", consensus.ErrInvalidMessage, v.Type, v.Validator)
+	}
+
+	vs.votes[v.Validator] = v
+	vs.power[v.BlockHash] += power
+	vs.total += power
+
+	return nil
+}
+
+// commit returns the commit of the block from the precommits in the set.
+func (vs *voteSet) commit(height uint64, round int, hash string) Commit {
+	c := Commit{Height: height, Round: round, BlockHash: hash}
+	for _, v := range vs.votes {
+		if v.BlockHash == hash {
+			c.Precommits = append(c.Precommits, v)
+		}
+	}
+
+	sort.Slice(c.Precommits, func(i, j int) bool { return c.Precommits[i].Validator < c.Precommits[j].Validator })
+
+	return c
+}
+
+// =============================================================================
+
+// verifySignature verifies that the public key belongs to the node address
+// and that the hex encoded signature verifies.
+func verifySignature(pub key.PublicKey, id key.Address, data []byte, signature string) error {
+	addr, err := pub.Address(key.NodeAddress)
+	if err != nil || addr != id {
+		return fmt.Errorf("%w: public key doesn't belong to %s", consensus.ErrInvalidMessage, id)
+	}
+
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", consensus.ErrInvalidMessage, err)
+	}
+
+	if err := pub.Verify(data, sig); err != nil {
+		return fmt.Errorf("%w: %v", consensus.ErrInvalidMessage, err)
+	}
+
+	return nil
+}
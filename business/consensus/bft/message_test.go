@@ -0,0 +1,161 @@
+package bft_test
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/consensus"
+	"github.com/toqns/toqns/business/consensus/bft"
+	"github.com/toqns/toqns/business/key"
+)
+
+func TestVerifyCommit(t *testing.T) {
+	p := newPlayer(t)
+	b := p.block(0, 1)
+	hash := b.Hash()
+
+	outsider, _ := key.New()
+
+	precommits := func(addrs ...key.Address) []bft.Vote {
+		votes := make([]bft.Vote, len(addrs))
+		for i, addr := range addrs {
+			votes[i] = p.signVote(addr, bft.Precommit, 0, hash)
+		}
+		return votes
+	}
+
+	a, c, d := p.others[0], p.others[1], p.others[2]
+
+	outsiderVote, _ := bft.SignVote(chainID, bft.Precommit, 1, 0, hash, outsider)
+	forged := p.signVote(d, bft.Precommit, 0, hash)
+	forged.Signature = p.signVote(a, bft.Precommit, 0, hash).Signature
+
+	tt := []struct {
+		name   string
+		commit bft.Commit
+	}{
+		{"a quorum of precommits", bft.Commit{Height: 1, BlockHash: hash, Precommits: precommits(a, c, d)}},
+		{"too few precommits", bft.Commit{Height: 1, BlockHash: hash, Precommits: precommits(a, c)}},
+		{"a duplicate precommit", bft.Commit{Height: 1, BlockHash: hash, Precommits: precommits(a, c, c)}},
+		{"a precommit of a non-validator", bft.Commit{Height: 1, BlockHash: hash, Precommits: append(precommits(a, c), outsiderVote)}},
+		{"a forged precommit", bft.Commit{Height: 1, BlockHash: hash, Precommits: append(precommits(a, c), forged)}},
+		{"a precommit of another round", bft.Commit{Height: 1, Round: 1, BlockHash: hash, Precommits: precommits(a, c, d)}},
+		{"another block", bft.Commit{Height: 1, BlockHash: p.block(0, 2).Hash(), Precommits: precommits(a, c, d)}},
+		{"another height", bft.Commit{Height: 2, BlockHash: hash, Precommits: precommits(a, c, d)}},
+		{"prevotes", bft.Commit{Height: 1, BlockHash: hash, Precommits: []bft.Vote{
+			p.signVote(a, bft.Prevote, 0, hash),
+			p.signVote(c, bft.Prevote, 0, hash),
+			p.signVote(d, bft.Prevote, 0, hash),
+		}}},
+	}
+
+	t.Log("Given the need to verify the commits of blocks.")
+	{
+		for testID, test := range tt {
+			t.Logf("\tTest %d:\tWhen the commit has %s.", testID, test.name)
+			{
+				blk := b
+				blk.Justification, _ = json.Marshal(test.commit)
+
+				err := bft.VerifyCommit(chainID, p.vals, blk)
+				if testID == 0 {
+					if err != nil {
+						t.Fatalf("\t%s\tTest %d:\tShould verify the commit: %v.", failed, testID, err)
+					}
+					t.Logf("\t%s\tTest %d:\tShould verify the commit.", success, testID)
+					continue
+				}
+
+				if !errors.Is(err, consensus.ErrInvalidMessage) {
+					t.Fatalf("\t%s\tTest %d:\tShould reject the commit, got %v.", failed, testID, err)
+				}
+				t.Logf("\t%s\tTest %d:\tShould reject the commit: %v.", success, testID, err)
+			}
+		}
+
+		testID := len(tt)
+		t.Logf("\tTest %d:\tWhen the justification isn't a commit.", testID)
+		{
+			blk := b
+			blk.Justification = json.RawMessage(`"commit"`)
+
+			if err := bft.VerifyCommit(chainID, p.vals, blk); !errors.Is(err, consensus.ErrInvalidMessage) {
+				t.Fatalf("\t%s\tTest %d:\tShould reject the justification, got %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould reject the justification.", success, testID)
+		}
+	}
+}
+
+func TestVerifyEvidence(t *testing.T) {
+	k, _ := key.New()
+	other, _ := key.New()
+
+	vote := func(k key.Key, typ bft.VoteType, round int, hash string) bft.Vote {
+		v, err := bft.SignVote(chainID, typ, 1, round, hash, k)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to sign the vote: %v.", failed, err)
+		}
+		return v
+	}
+
+	evidence := func(a, b bft.Vote) chain.Evidence {
+		ev, err := bft.NewEvidence(a, b)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to create the evidence: %v.", failed, err)
+		}
+		return ev
+	}
+
+	blockA, blockB := strings.Repeat("a", 64), strings.Repeat("b", 64)
+
+	forged := vote(k, bft.Prevote, 0, blockB)
+	forged.Signature = vote(k, bft.Prevote, 0, blockA).Signature
+
+	otherHeight := evidence(vote(k, bft.Prevote, 0, blockA), vote(k, bft.Prevote, 0, blockB))
+	otherHeight.Height = 2
+
+	undecodable := evidence(vote(k, bft.Prevote, 0, blockA), vote(k, bft.Prevote, 0, blockB))
+	undecodable.B = json.RawMessage(`"vote"`)
+
+	tt := []struct {
+		name  string
+		ev    chain.Evidence
+		valid bool
+	}{
+		{"conflicting prevotes", evidence(vote(k, bft.Prevote, 0, blockA), vote(k, bft.Prevote, 0, blockB)), true},
+		{"a precommit for a block and for no block", evidence(vote(k, bft.Precommit, 1, blockA), vote(k, bft.Precommit, 1, "")), true},
+		{"votes of two validators", evidence(vote(k, bft.Prevote, 0, blockA), vote(other, bft.Prevote, 0, blockB)), false},
+		{"votes of another height", otherHeight, false},
+		{"votes of two rounds", evidence(vote(k, bft.Prevote, 0, blockA), vote(k, bft.Prevote, 1, blockB)), false},
+		{"a prevote and a precommit", evidence(vote(k, bft.Prevote, 0, blockA), vote(k, bft.Precommit, 0, blockB)), false},
+		{"votes for the same block", evidence(vote(k, bft.Prevote, 0, blockA), vote(k, bft.Prevote, 0, blockA)), false},
+		{"a forged vote", evidence(vote(k, bft.Prevote, 0, blockA), forged), false},
+		{"a vote that can't be decoded", undecodable, false},
+	}
+
+	t.Log("Given the need to verify evidence of double signing.")
+	{
+		for testID, test := range tt {
+			t.Logf("\tTest %d:\tWhen the evidence holds %s.", testID, test.name)
+			{
+				err := bft.VerifyEvidence(chainID, test.ev)
+				if test.valid {
+					if err != nil {
+						t.Fatalf("\t%s\tTest %d:\tShould verify the evidence: %v.", failed, testID, err)
+					}
+					t.Logf("\t%s\tTest %d:\tShould verify the evidence.", success, testID)
+					continue
+				}
+
+				if !errors.Is(err, consensus.ErrInvalidMessage) {
+					t.Fatalf("\t%s\tTest %d:\tShould reject the evidence, got %v.", failed, testID, err)
+				}
+				t.Logf("\t%s\tTest %d:\tShould reject the evidence: %v.", success, testID, err)
+			}
+		}
+	}
+}
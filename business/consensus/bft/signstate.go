@@ -0,0 +1,87 @@
+package bft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/toqns/toqns/foundation/atomicfile"
+)
+
+// signStateName is the name of the sign state file in the data directory.
+const signStateName = "sign_state.json"
+
+// signState is the last height, round and step the validator signed a
+// message for. It's kept on disk, so a validator that restarts in the
+// middle of a height doesn't sign a conflicting message.
+type signState struct {
+	Height uint64 `json:"height"`
+	Round  int    `json:"round"`
+	Step   step   `json:"step"`
+
+	// name is the file name, or empty to keep the state in memory only.
+	name string
+}
+
+// loadSignState reads the sign state from the file in the directory. A
+// missing file is a validator that hasn't signed anything yet.
+func loadSignState(dir string) (signState, error) {
+	if dir == "" {
+		return signState{}, nil
+	}
+	name := filepath.Join(dir, signStateName)
+
+	b, err := os.ReadFile(name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return signState{name: name}, nil
+	case err != nil:
+		return signState{}, fmt.Errorf("reading sign state: %w", err)
+	}
+
+	var s signState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return signState{}, fmt.Errorf("decoding sign state: %w", err)
+	}
+	s.name = name
+
+	return s, nil
+}
+
+// allows reports whether a message of the step may be signed, which is
+// when it comes after the last signed message.
+func (s signState) allows(height uint64, round int, st step) bool {
+	switch {
+	case height != s.Height:
+		return height > s.Height
+	case round != s.Round:
+		return round > s.Round
+	default:
+		return st > s.Step
+	}
+}
+
+// update records the step as signed. The file is written before the
+// message is signed, so a crash in between loses a message rather than
+// risking a conflicting one.
+func (s *signState) update(height uint64, round int, st step) error {
+	next := signState{Height: height, Round: round, Step: st, name: s.name}
+
+	if s.name != "" {
+		b, err := json.Marshal(next)
+		if err != nil {
+			return err
+		}
+
+		if err := atomicfile.Write(s.name, b); err != nil {
+			return fmt.Errorf("writing sign state: %w", err)
+		}
+	}
+
+	*s = next
+
+	return nil
+}
@@ -0,0 +1,281 @@
+// Package consensus provides what the consensus engines share: the Engine
+// interface that nodes run, the messages that engines exchange, applying
+// blocks to the state and catching the state up with the stored chain.
+//
+// The engine of a network is picked by the genesis consensus parameters.
+//
+// Validator set changes take effect at epoch boundaries. The last block
+// of an epoch releases the unbonded stake whose unbonding period passed,
+// and lists the validators of the next epoch: the validators with the
+// most stake that aren't jailed. Blocks slash the validators of the
+// evidence they include.
+package consensus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/genesis"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/mempool"
+	"github.com/toqns/toqns/business/state"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrStateRoot is returned when the state root after applying a block
+	// differs from the block's state root.
+	ErrStateRoot = errors.New("state root mismatch")
+
+	// ErrValidators is returned when the validator set of a block differs
+	// from the validator set after applying it.
+	ErrValidators = errors.New("validator set mismatch")
+
+	// ErrKnown is returned for messages that are already known or
+	// outdated, which needn't be forwarded.
+	ErrKnown = errors.New("message already known")
+
+	// ErrUnknownParent is returned for messages that build on blocks that
+	// aren't known yet.
+	ErrUnknownParent = errors.New("unknown parent block")
+
+	// ErrInvalidMessage is returned for messages that violate the
+	// consensus rules.
+	ErrInvalidMessage = errors.New("invalid consensus message")
+)
+
+// Engine is a consensus engine, which agrees with the other validators on
+// the blocks of the chain. Final blocks are stored in the chain and
+// committed to the state.
+type Engine interface {
+	// Start starts taking part in consensus.
+	Start()
+
+	// Stop stops taking part in consensus. Received messages are still
+	// processed, but no messages are sent anymore.
+	Stop()
+
+	// Final returns the header of the last final block.
+	Final() chain.Header
+
+	// Receive processes a message from the network. Messages that are
+	// accepted should be forwarded to the other peers.
+	Receive(m Message) error
+}
+
+// Config contains the configuration of an engine.
+type Config struct {
+	Genesis genesis.Genesis
+	State   *state.State
+	Store   *chain.Store
+	Mempool *mempool.Mempool
+
+	// Signer is the node key. Nodes that aren't validators follow the
+	// chain without taking part in consensus.
+	Signer key.Signer
+
+	// Broadcast sends the messages of the engine to the network.
+	Broadcast func(Message)
+
+	// DataDir is the directory where the engine keeps its own data.
+	DataDir string
+
+	Log *zap.SugaredLogger
+}
+
+// Message is a consensus message. The type and the payload are specific to
+// the engine.
+type Message struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// NewMessage returns a message with the JSON encoded value as payload.
+func NewMessage(typ string, v any) (Message, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return Message{}, fmt.Errorf("encoding %s message: %w", typ, err)
+	}
+
+	return Message{Type: typ, Payload: payload}, nil
+}
+
+// Decode decodes the payload into the value. Returns ErrInvalidMessage
+// if the payload can't be decoded.
+func (m Message) Decode(v any) error {
+	if err := json.Unmarshal(m.Payload, v); err != nil {
+		return fmt.Errorf("%w: decoding %s message: %v", ErrInvalidMessage, m.Type, err)
+	}
+	return nil
+}
+
+// Apply applies the evidence and the transactions of the block to the
+// batch, and checks the resulting validator set and state root.
+//
+// Fees are burned, as validators have no account to receive them.
+func Apply(b *state.Batch, blk chain.Block, params genesis.Consensus) error {
+	for i, ev := range blk.Evidence {
+		if err := b.Slash(ev.Validator, params.SlashPercent); err != nil {
+			return fmt.Errorf("evidence %d: %w", i, err)
+		}
+	}
+
+	for i, stx := range blk.Txs {
+		if err := b.Apply(stx, ""); err != nil {
+			return fmt.Errorf("transaction %d %s: %w", i, stx.Hash(), err)
+		}
+	}
+
+	vals := EndBlock(b, params)
+	if hash := chain.ValidatorsHash(vals); hash != blk.ValidatorsHash {
+		return fmt.Errorf("%w: got %s, block has %s", ErrValidators, hash, blk.ValidatorsHash)
+	}
+
+	if root := b.Root(); root != blk.StateRoot {
+		return fmt.Errorf("%w: got %s, block has %s", ErrStateRoot, root, blk.StateRoot)
+	}
+
+	return nil
+}
+
+// EndBlock ends the block that's applied to the batch. At the end of an
+// epoch, it releases the unbonded stake and returns the validator set of
+// the next epoch. It returns nil for other blocks, and when no validator
+// has stake, in which case the validator set stays the same.
+func EndBlock(b *state.Batch, params genesis.Consensus) []chain.Validator {
+	if b.Height()%params.EpochLength != 0 {
+		return nil
+	}
+
+	b.Release(params.UnbondingPeriod)
+
+	var vals []chain.Validator
+	for _, a := range b.Accounts() {
+		if a.Validator == "" || a.Jailed || a.Stake == 0 {
+			continue
+		}
+		vals = append(vals, chain.Validator{Address: a.Validator, Power: a.Stake})
+	}
+
+	sort.Slice(vals, func(i, j int) bool {
+		if vals[i].Power != vals[j].Power {
+			return vals[i].Power > vals[j].Power
+		}
+		return vals[i].Address < vals[j].Address
+	})
+
+	if len(vals) > params.MaxValidators {
+		vals = vals[:params.MaxValidators]
+	}
+
+	return vals
+}
+
+// Sizes reserved in blocks that are built, so they stay within
+// chain.MaxBlockSize.
+const (
+	// blockOverhead is the size of the fields of a block that are set when
+	// it's signed: the roots, the timestamp, the proposer, its public key
+	// and the signature.
+	blockOverhead = 1024
+
+	// validatorSize is the maximum size of a validator in a block.
+	validatorSize = 96
+)
+
+// BlockSpace returns the space for the evidence and transactions of a
+// block at the height on top of the parent. Space for the fields that are
+// set when the block is signed and, at the end of an epoch, for the
+// validator set is reserved.
+func BlockSpace(chainID string, height uint64, parentHash string, params genesis.Consensus) int {
+	draft := chain.Block{Header: chain.Header{ChainID: chainID, Height: height, ParentHash: parentHash}}
+
+	reserved := draft.Size() + blockOverhead
+	if height%params.EpochLength == 0 {
+		reserved += params.MaxValidators * validatorSize
+	}
+
+	return chain.MaxBlockSize - reserved
+}
+
+// ItemSize returns the space that evidence or a transaction takes in a
+// block.
+func ItemSize(v any) int {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return chain.MaxBlockSize
+	}
+	return len(b) + 1
+}
+
+// Validators returns the validator set of the block at the height, which
+// is the set of the last block of the previous epoch that changed it, or
+// the validators of the genesis.
+//
+// A chain restored from a snapshot has no blocks before its base, so the
+// set must have changed at or after the base.
+func Validators(store *chain.Store, g genesis.Genesis, height uint64) ([]chain.Validator, error) {
+	if height == 0 {
+		return g.ValidatorSet(), nil
+	}
+
+	epoch := g.Consensus.EpochLength
+	base := store.Base()
+	for h := (height - 1) / epoch * epoch; h > 0; h -= epoch {
+		if h < base {
+			return nil, fmt.Errorf("validator set of height %d changed before the base %d of the chain", height, base)
+		}
+
+		blk, err := store.ByHeight(h)
+		if err != nil {
+			return nil, fmt.Errorf("reading block %d: %w", h, err)
+		}
+
+		if len(blk.Validators) > 0 {
+			return blk.Validators, nil
+		}
+	}
+
+	return g.ValidatorSet(), nil
+}
+
+// Replay applies the stored blocks that are beyond the state's height.
+//
+// Blocks are stored before their changes are committed to the state, so
+// the state can be behind the chain when the node stopped in between.
+func Replay(st *state.State, store *chain.Store, params genesis.Consensus) error {
+	head, ok := store.Height()
+	if !ok {
+		return nil
+	}
+
+	height, ok := st.Height()
+	if !ok {
+		return errors.New("state isn't initialized")
+	}
+
+	if height > head {
+		return fmt.Errorf("state at height %d is ahead of chain at height %d", height, head)
+	}
+
+	for h := height + 1; h <= head; h++ {
+		blk, err := store.ByHeight(h)
+		if err != nil {
+			return err
+		}
+
+		b := st.Begin(h)
+		if err := Apply(b, blk, params); err != nil {
+			return fmt.Errorf("replaying block %d: %w", h, err)
+		}
+
+		if err := b.Commit(); err != nil {
+			return fmt.Errorf("replaying block %d: %w", h, err)
+		}
+	}
+
+	return nil
+}
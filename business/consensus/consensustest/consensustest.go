@@ -0,0 +1,207 @@
+// Package consensustest provides a network of validators in memory, to
+// test consensus engines with.
+package consensustest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/consensus"
+	"github.com/toqns/toqns/business/genesis"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/mempool"
+	"github.com/toqns/toqns/business/state"
+	"go.uber.org/zap"
+)
+
+// Success and failure markers.
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+// ChainID is the chain ID of the test networks.
+const ChainID = "toqns-test"
+
+// Balance is the balance of the accounts of the genesis.
+const Balance = 1000
+
+// NewEngine returns the engine of a validator.
+type NewEngine func(cfg consensus.Config) (consensus.Engine, error)
+
+// NewGenesis returns a genesis of the engine with the accounts and new
+// validators with a voting power of 1, and the keys of the validators.
+func NewGenesis(engine string, validators int, accounts ...key.Address) (genesis.Genesis, []key.Key) {
+	g := genesis.New(ChainID)
+	g.Consensus.Engine = engine
+	for _, a := range accounts {
+		g.AddAccount(a, Balance)
+	}
+
+	keys := make([]key.Key, validators)
+	for i := range keys {
+		keys[i], _ = key.New()
+		g.AddValidator(keys[i].PublicKey(), 1)
+	}
+
+	return g, keys
+}
+
+// =============================================================================
+
+// Node is a validator of a network.
+type Node struct {
+	Engine  consensus.Engine
+	State   *state.State
+	Store   *chain.Store
+	Mempool *mempool.Mempool
+
+	inbox chan consensus.Message
+}
+
+// NewNode returns a validator with the key that starts at the genesis and
+// broadcasts its messages with the function.
+func NewNode(t testing.TB, g genesis.Genesis, k key.Key, broadcast func(consensus.Message), newEngine NewEngine) *Node {
+	st, _ := state.New(g.ChainID, state.NewMemoryStorage())
+	store, err := chain.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	if _, err := genesis.Init(g, st, store); err != nil {
+		t.Fatalf("initializing genesis: %v", err)
+	}
+
+	n := Node{
+		State:   st,
+		Store:   store,
+		Mempool: mempool.New(mempool.Config{ChainID: g.ChainID}, st),
+		inbox:   make(chan consensus.Message, 1000),
+	}
+
+	n.Engine, err = newEngine(consensus.Config{
+		Genesis:   g,
+		State:     st,
+		Store:     store,
+		Mempool:   n.Mempool,
+		Signer:    k,
+		Broadcast: broadcast,
+		DataDir:   t.TempDir(),
+		Log:       zap.NewNop().Sugar(),
+	})
+	if err != nil {
+		t.Fatalf("creating engine: %v", err)
+	}
+
+	return &n
+}
+
+// =============================================================================
+
+// Network is a network of validators that deliver every message to all
+// validators, in order.
+type Network struct {
+	Genesis genesis.Genesis
+	Nodes   []*Node
+
+	done chan struct{}
+}
+
+// NewNetwork returns a network of the validators with the keys, of which
+// only the first online validators run.
+func NewNetwork(t testing.TB, g genesis.Genesis, keys []key.Key, online int, newEngine NewEngine) *Network {
+	net := Network{
+		Genesis: g,
+		Nodes:   make([]*Node, online),
+		done:    make(chan struct{}),
+	}
+
+	for i := range net.Nodes {
+		net.Nodes[i] = NewNode(t, g, keys[i], net.broadcast, newEngine)
+	}
+
+	return &net
+}
+
+// broadcast delivers the message to the inboxes of all nodes.
+func (net *Network) broadcast(m consensus.Message) {
+	for _, n := range net.Nodes {
+		select {
+		case n.inbox <- m:
+		case <-net.done:
+			return
+		}
+	}
+}
+
+// Run runs the network for the duration.
+func (net *Network) Run(d time.Duration) {
+	for _, n := range net.Nodes {
+		n := n
+		go func() {
+			for {
+				select {
+				case m := <-n.inbox:
+					n.Engine.Receive(m)
+				case <-net.done:
+					return
+				}
+			}
+		}()
+	}
+
+	for _, n := range net.Nodes {
+		n.Engine.Start()
+	}
+
+	time.Sleep(d)
+
+	for _, n := range net.Nodes {
+		n.Engine.Stop()
+	}
+	close(net.done)
+}
+
+// FinalHeight returns the lowest final height of the nodes.
+func (net *Network) FinalHeight() uint64 {
+	var height uint64
+	for i, n := range net.Nodes {
+		h, _ := n.Store.Height()
+		if i == 0 || h < height {
+			height = h
+		}
+	}
+	return height
+}
+
+// CheckAgreement checks that all nodes have the same final block at the
+// height. The block is also checked with the function, if there is one,
+// with the validators of its height.
+func (net *Network) CheckAgreement(t testing.TB, testID int, height uint64, check func(vals []chain.Validator, b chain.Block) error) {
+	var hash string
+	for i, n := range net.Nodes {
+		b, err := n.Store.ByHeight(height)
+		if err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould have block %d on node %d: %v.", failed, testID, height, i, err)
+		}
+		if i > 0 && b.Hash() != hash {
+			t.Fatalf("\t%s\tTest %d:\tShould have the same final block on all nodes.", failed, testID)
+		}
+		hash = b.Hash()
+
+		if check == nil {
+			continue
+		}
+
+		vals, err := consensus.Validators(n.Store, net.Genesis, height)
+		if err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould get the validators of block %d on node %d: %v.", failed, testID, height, i, err)
+		}
+		if err := check(vals, b); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould have a valid block on node %d: %v.", failed, testID, i, err)
+		}
+	}
+	t.Logf("\t%s\tTest %d:\tShould have the same final block on all nodes.", success, testID)
+}
@@ -0,0 +1,502 @@
+// Package poa provides round-robin proof-of-authority consensus among the
+// validators of the genesis.
+//
+// Time is divided in slots of the genesis block time, counted from the
+// genesis time. Validators take turns in the order of the genesis: the
+// validator of slot s is validator s mod n. Only the scheduled validator
+// may propose a block in a slot, with a timestamp in the slot. A validator
+// that misses its slot is skipped: the slot stays empty and the next
+// validator proposes on top of the head, so blocks only need increasing
+// slots, not consecutive ones.
+//
+// Blocks that aren't final are kept in a tree. The fork choice rule picks
+// the highest block as head, and on equal height the block with the
+// earliest slot, then the lowest hash, so all nodes pick the same head.
+//
+// A block is final when it and the blocks on top of it in the head's
+// chain were proposed by more than two thirds of the validators. Honest
+// validators only build on their head, so a competing chain can't gather
+// that many validators anymore. Final blocks are stored in the chain and
+// committed to the state.
+//
+// The validators are the authorities of the genesis for the lifetime of
+// the chain. Blocks still list the stake-weighted validator set at the end
+// of each epoch, so the chain can move to an engine that uses it.
+package poa
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/consensus"
+	"github.com/toqns/toqns/business/genesis"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/state"
+	"github.com/toqns/toqns/business/tx"
+)
+
+// MaxClockDrift is how far the timestamp of a block may be ahead of the
+// local clock.
+const MaxClockDrift = time.Second
+
+// MessageBlock is the type of messages with a proposed block.
+const MessageBlock = "block"
+
+// block is a block in the tree of blocks that aren't final.
+type block struct {
+	chain.Block
+	hash   string
+	slot   uint64
+	parent *block
+
+	// batch has the changes of the block on top of its parent. It's nil
+	// for the final block, as its changes are committed.
+	batch *state.Batch
+}
+
+// Engine is the proof-of-authority consensus engine.
+type Engine struct {
+	cfg        consensus.Config
+	validators []key.Address
+	id         key.Address
+	now        func() time.Time
+
+	mu       sync.Mutex
+	final    *block
+	head     *block
+	blocks   map[string]*block
+	proposed uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New returns an engine that continues the stored chain, which must have
+// been initialized with the genesis.
+func New(cfg consensus.Config) (*Engine, error) {
+	if err := consensus.Replay(cfg.State, cfg.Store, cfg.Genesis.Consensus); err != nil {
+		return nil, err
+	}
+
+	head, err := cfg.Store.Head()
+	if err != nil {
+		return nil, fmt.Errorf("reading head: %w", err)
+	}
+
+	e := Engine{
+		cfg:    cfg,
+		now:    time.Now,
+		blocks: make(map[string]*block),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	for _, v := range cfg.Genesis.Validators {
+		e.validators = append(e.validators, v.Address)
+	}
+
+	if cfg.Signer != nil {
+		if e.id, err = cfg.Signer.PublicKey().Address(key.NodeAddress); err != nil {
+			return nil, err
+		}
+	}
+
+	final := &block{Block: head, hash: head.Hash(), slot: e.slot(head.Timestamp)}
+	e.final = final
+	e.head = final
+	e.blocks[final.hash] = final
+
+	return &e, nil
+}
+
+// Start starts proposing blocks in the slots of the node.
+func (e *Engine) Start() {
+	go e.run()
+}
+
+// Stop stops proposing blocks.
+func (e *Engine) Stop() {
+	close(e.stop)
+	<-e.done
+}
+
+// Head returns the header of the head block.
+func (e *Engine) Head() chain.Header {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.head.Header
+}
+
+// Final returns the header of the last final block.
+func (e *Engine) Final() chain.Header {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.final.Header
+}
+
+// Proposer returns the validator that's scheduled for the slot.
+func (e *Engine) Proposer(slot uint64) key.Address {
+	return e.validators[slot%uint64(len(e.validators))]
+}
+
+// slot returns the slot of the timestamp in Unix milliseconds.
+func (e *Engine) slot(ts int64) uint64 {
+	return slotOf(e.cfg.Genesis, ts)
+}
+
+// slotOf returns the slot of the timestamp in Unix milliseconds.
+func slotOf(g genesis.Genesis, ts int64) uint64 {
+	d := ts - g.Time.UnixMilli()
+	if d < 0 {
+		return 0
+	}
+	return uint64(d / g.Consensus.BlockTime.Milliseconds())
+}
+
+// slotStart returns the start of the slot.
+func (e *Engine) slotStart(slot uint64) time.Time {
+	return e.cfg.Genesis.Time.Add(time.Duration(slot) * e.cfg.Genesis.Consensus.BlockTime.Duration)
+}
+
+// =============================================================================
+
+// Receive processes a message with a block from the network.
+func (e *Engine) Receive(m consensus.Message) error {
+	if m.Type != MessageBlock {
+		return fmt.Errorf("%w: unknown message type %q", consensus.ErrInvalidMessage, m.Type)
+	}
+
+	var b chain.Block
+	if err := m.Decode(&b); err != nil {
+		return err
+	}
+
+	return e.AddBlock(b)
+}
+
+// AddBlock verifies a block from the network and adds it to the tree.
+//
+// Returns consensus.ErrKnown for known blocks, which needn't be
+// forwarded, consensus.ErrUnknownParent when the parent hasn't been
+// received yet, and chain.ErrInvalidBlock for blocks that violate the
+// consensus rules.
+func (e *Engine) AddBlock(b chain.Block) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.add(b)
+}
+
+// add verifies the block and adds it to the tree. The caller must hold
+// the lock.
+func (e *Engine) add(b chain.Block) error {
+	hash := b.Hash()
+	if _, ok := e.blocks[hash]; ok || b.Height <= e.final.Height {
+		return consensus.ErrKnown
+	}
+
+	parent, ok := e.blocks[b.ParentHash]
+	if !ok {
+		return fmt.Errorf("%w: %s", consensus.ErrUnknownParent, b.ParentHash)
+	}
+
+	if err := e.verify(b, parent); err != nil {
+		return err
+	}
+
+	batch := e.batchOn(parent, b.Height)
+	if err := consensus.Apply(batch, b, e.cfg.Genesis.Consensus); err != nil {
+		return fmt.Errorf("%w: %v", chain.ErrInvalidBlock, err)
+	}
+
+	nb := block{Block: b, hash: hash, slot: e.slot(b.Timestamp), parent: parent, batch: batch}
+	e.blocks[hash] = &nb
+
+	if e.better(&nb, e.head) {
+		e.head = &nb
+	}
+
+	e.cfg.Log.Debugw("consensus", "status", "block added", "height", b.Height, "hash", hash, "proposer", b.Proposer, "head", e.head.hash)
+
+	return e.finalize()
+}
+
+// verify checks the block against the consensus rules.
+func (e *Engine) verify(b chain.Block, parent *block) error {
+	if err := Verify(e.cfg.Genesis, parent.Block, b); err != nil {
+		return err
+	}
+
+	if b.Time().After(e.now().Add(MaxClockDrift)) {
+		return fmt.Errorf("%w: timestamp %s is in the future", chain.ErrInvalidBlock, b.Time())
+	}
+
+	return nil
+}
+
+// Verify verifies that the block follows the parent and that it's proposed
+// by the validator of its slot. It's used for blocks that are synced from
+// peers, which are only final once Final says so. The changes of the block
+// aren't checked, which is left to applying it.
+//
+// Returns chain.ErrInvalidBlock if verification fails.
+func Verify(g genesis.Genesis, parent, b chain.Block) error {
+	if err := b.Verify(g.ChainID); err != nil {
+		return err
+	}
+
+	switch {
+	case b.Height != parent.Height+1:
+		return fmt.Errorf("%w: height %d on parent at height %d", chain.ErrInvalidBlock, b.Height, parent.Height)
+	case b.ParentHash != parent.Hash():
+		return fmt.Errorf("%w: parent %s isn't the parent block", chain.ErrInvalidBlock, b.ParentHash)
+	case len(b.Txs) > g.Consensus.MaxBlockTxs:
+		return fmt.Errorf("%w: %d transactions exceed %d", chain.ErrInvalidBlock, len(b.Txs), g.Consensus.MaxBlockTxs)
+
+	// Authorities don't vote, so there is no evidence to slash them with.
+	case len(b.Evidence) > 0:
+		return fmt.Errorf("%w: evidence in a proof of authority block", chain.ErrInvalidBlock)
+	}
+
+	slot, parentSlot := slotOf(g, b.Timestamp), slotOf(g, parent.Timestamp)
+	if slot <= parentSlot || b.Timestamp <= parent.Timestamp {
+		return fmt.Errorf("%w: slot %d isn't after the parent's slot %d", chain.ErrInvalidBlock, slot, parentSlot)
+	}
+
+	if p := g.Validators[slot%uint64(len(g.Validators))].Address; b.Proposer != p {
+		return fmt.Errorf("%w: proposer %s isn't scheduled for slot %d, expected %s", chain.ErrInvalidBlock, b.Proposer, slot, p)
+	}
+
+	return nil
+}
+
+// Final returns the number of blocks of the chain that are final, for
+// blocks that are synced from peers. The blocks must follow each other
+// and be verified. The rule is the engine's: a block is final when it and
+// the blocks on top of it were proposed by more than two thirds of the
+// validators.
+func Final(g genesis.Genesis, blocks []chain.Block) int {
+	proposers := make(map[key.Address]bool)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		proposers[blocks[i].Proposer] = true
+		if quorum(len(proposers), len(g.Validators)) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// quorum reports whether the number of proposers is more than two thirds
+// of the validators.
+func quorum(proposers, validators int) bool {
+	return 3*proposers > 2*validators
+}
+
+// batchOn returns a batch for a block on top of the parent.
+func (e *Engine) batchOn(parent *block, height uint64) *state.Batch {
+	if parent.batch == nil {
+		return e.cfg.State.Begin(height)
+	}
+	return parent.batch.Begin(height)
+}
+
+// better reports whether block a is preferred over block b as head.
+func (e *Engine) better(a, b *block) bool {
+	switch {
+	case a.Height != b.Height:
+		return a.Height > b.Height
+	case a.slot != b.slot:
+		return a.slot < b.slot
+	default:
+		return a.hash < b.hash
+	}
+}
+
+// finalize stores and commits the blocks that became final, and prunes
+// the blocks that can't become final anymore. The caller must hold the
+// lock.
+func (e *Engine) finalize() error {
+	var chainToHead []*block
+	for b := e.head; b != e.final; b = b.parent {
+		chainToHead = append(chainToHead, b)
+	}
+
+	// Walk down from the head until the blocks on top of a block were
+	// proposed by more than two thirds of the validators.
+	proposers := make(map[key.Address]bool)
+	var final *block
+	for _, b := range chainToHead {
+		proposers[b.Proposer] = true
+		if quorum(len(proposers), len(e.validators)) {
+			final = b
+			break
+		}
+	}
+
+	if final == nil {
+		return nil
+	}
+
+	var blocks []*block
+	for b := final; b != e.final; b = b.parent {
+		blocks = append([]*block{b}, blocks...)
+	}
+
+	for _, b := range blocks {
+		if err := e.cfg.Store.Append(b.Block); err != nil {
+			return fmt.Errorf("storing block %d: %w", b.Height, err)
+		}
+
+		if err := b.batch.Commit(); err != nil {
+			return fmt.Errorf("committing block %d: %w", b.Height, err)
+		}
+
+		b.batch = nil
+		b.parent = nil
+		e.final = b
+
+		e.cfg.Log.Infow("consensus", "status", "block final", "height", b.Height, "hash", b.hash, "txs", len(b.Txs))
+	}
+
+	// Only the blocks on top of the final block can become final.
+	for hash, b := range e.blocks {
+		if !e.descends(b) {
+			delete(e.blocks, hash)
+		}
+	}
+
+	e.cfg.Mempool.Revalidate()
+
+	return nil
+}
+
+// descends reports whether the block is the final block or on top of it.
+func (e *Engine) descends(b *block) bool {
+	for ; b != nil; b = b.parent {
+		if b == e.final {
+			return true
+		}
+		if b.Height <= e.final.Height {
+			return false
+		}
+	}
+	return false
+}
+
+// =============================================================================
+
+// run proposes a block at the start of each slot of the node.
+func (e *Engine) run() {
+	defer close(e.done)
+
+	for {
+		next := e.slot(e.now().UnixMilli()) + 1
+		t := time.NewTimer(e.slotStart(next).Sub(e.now()))
+
+		select {
+		case <-e.stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		if e.cfg.Signer == nil || e.Proposer(next) != e.id {
+			continue
+		}
+
+		b, err := e.propose(next)
+		if err != nil {
+			e.cfg.Log.Errorw("consensus", "status", "proposing block failed", "slot", next, "ERROR", err)
+			continue
+		}
+
+		m, err := consensus.NewMessage(MessageBlock, b)
+		if err != nil {
+			e.cfg.Log.Errorw("consensus", "status", "encoding block failed", "ERROR", err)
+			continue
+		}
+
+		if e.cfg.Broadcast != nil {
+			e.cfg.Broadcast(m)
+		}
+	}
+}
+
+// propose builds a block on top of the head for the slot and adds it to
+// the tree.
+func (e *Engine) propose(slot uint64) (chain.Block, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if slot <= e.proposed || slot <= e.head.slot {
+		return chain.Block{}, fmt.Errorf("slot %d already has a block", slot)
+	}
+	e.proposed = slot
+
+	parent := e.head
+	batch := e.batchOn(parent, parent.Height+1)
+
+	// Transactions of blocks that aren't final are still in the mempool
+	// and fail to apply, so more transactions are picked to fill the
+	// block.
+	var pending int
+	for b := parent; b != e.final; b = b.parent {
+		pending += len(b.Txs)
+	}
+
+	max := e.cfg.Genesis.Consensus.MaxBlockTxs
+	space := consensus.BlockSpace(e.cfg.Genesis.ChainID, parent.Height+1, parent.hash, e.cfg.Genesis.Consensus)
+	var txs []tx.SignedTx
+	for _, stx := range e.cfg.Mempool.Pick(max + pending) {
+		if len(txs) == max {
+			break
+		}
+
+		size := consensus.ItemSize(stx)
+		if size > space {
+			continue
+		}
+		if err := batch.Apply(stx, ""); err != nil {
+			continue
+		}
+		txs = append(txs, stx)
+		space -= size
+	}
+
+	ts := e.now().UnixMilli()
+	if s := e.slotStart(slot).UnixMilli(); ts < s {
+		ts = s
+	}
+
+	vals := consensus.EndBlock(batch, e.cfg.Genesis.Consensus)
+
+	h := chain.Header{
+		ChainID:        e.cfg.Genesis.ChainID,
+		Height:         parent.Height + 1,
+		ParentHash:     parent.hash,
+		Timestamp:      ts,
+		TxRoot:         chain.TxRoot(txs),
+		StateRoot:      batch.Root(),
+		ValidatorsHash: chain.ValidatorsHash(vals),
+	}
+
+	b, err := chain.Sign(h, txs, e.cfg.Signer)
+	if err != nil {
+		return chain.Block{}, err
+	}
+	b.Validators = vals
+
+	if size := b.Size(); size > chain.MaxBlockSize {
+		return chain.Block{}, fmt.Errorf("block of %d bytes exceeds %d", size, chain.MaxBlockSize)
+	}
+
+	if err := e.add(b); err != nil {
+		return chain.Block{}, err
+	}
+
+	return b, nil
+}
@@ -0,0 +1,210 @@
+package poa_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/consensus"
+	"github.com/toqns/toqns/business/consensus/consensustest"
+	"github.com/toqns/toqns/business/consensus/poa"
+	"github.com/toqns/toqns/business/genesis"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/tx"
+)
+
+// Success and failure markers.
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+const chainID = consensustest.ChainID
+
+func TestPoA(t *testing.T) {
+	alice, _ := key.New()
+	aliceAddr, _ := alice.Address(key.AccountAddress)
+	bob, _ := key.New()
+	bobAddr, _ := bob.Address(key.AccountAddress)
+
+	t.Log("Given the need to reach consensus among validators.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen all validators are online.", testID)
+		{
+			net := newNetwork(t, 3, 3, aliceAddr)
+
+			stx, _ := tx.Tx{ChainID: chainID, From: aliceAddr, To: bobAddr, Amount: 100, Fee: 1}.Sign(alice)
+			for _, n := range net.Nodes {
+				if err := n.Mempool.Add(stx); err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to add the transaction: %v.", failed, testID, err)
+				}
+			}
+
+			net.Run(1500 * time.Millisecond)
+
+			height := net.FinalHeight()
+			if height < 3 {
+				t.Fatalf("\t%s\tTest %d:\tShould reach finality, but final height is %d.", failed, testID, height)
+			}
+			t.Logf("\t%s\tTest %d:\tShould reach finality at height %d.", success, testID, height)
+
+			net.CheckAgreement(t, testID, height, nil)
+
+			for i, n := range net.Nodes {
+				if b := n.State.Balance(bobAddr); b != 100 {
+					t.Fatalf("\t%s\tTest %d:\tShould include the transaction on node %d, but balance is %d.", failed, testID, i, b)
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould include the transaction on all nodes.", success, testID)
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen a validator is offline.", testID)
+		{
+			net := newNetwork(t, 4, 3, aliceAddr)
+			net.Run(1500 * time.Millisecond)
+
+			height := net.FinalHeight()
+			if height < 3 {
+				t.Fatalf("\t%s\tTest %d:\tShould reach finality with missed slots, but final height is %d.", failed, testID, height)
+			}
+			t.Logf("\t%s\tTest %d:\tShould reach finality with missed slots at height %d.", success, testID, height)
+
+			net.CheckAgreement(t, testID, height, nil)
+		}
+
+		testID = 2
+		t.Logf("\tTest %d:\tWhen the mempool holds more than fits in a block.", testID)
+		{
+			keys := make([]key.Key, 100)
+			addrs := make([]key.Address, len(keys))
+			for i := range keys {
+				keys[i], _ = key.New()
+				addrs[i], _ = keys[i].Address(key.AccountAddress)
+			}
+
+			net := newNetwork(t, 1, 1, addrs...)
+			for i, k := range keys {
+				stx, _ := tx.Tx{ChainID: chainID, From: addrs[i], To: bobAddr, Amount: 1, Fee: 1, Memo: strings.Repeat("m", tx.MaxMemoSize)}.Sign(k)
+				if err := net.Nodes[0].Mempool.Add(stx); err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to add the transaction: %v.", failed, testID, err)
+				}
+			}
+
+			net.Run(500 * time.Millisecond)
+
+			b, err := net.Nodes[0].Store.ByHeight(1)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould have block 1: %v.", failed, testID, err)
+			}
+			if size := b.Size(); size > chain.MaxBlockSize || len(b.Txs) == 0 || len(b.Txs) == len(keys) {
+				t.Fatalf("\t%s\tTest %d:\tShould fill the block up to the maximum size, but got %d transactions in %d bytes.", failed, testID, len(b.Txs), size)
+			}
+			t.Logf("\t%s\tTest %d:\tShould fill the block up to the maximum size with %d transactions in %d bytes.", success, testID, len(b.Txs), b.Size())
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	g, keys := consensustest.NewGenesis(genesis.EnginePoA, 1)
+	parent, _ := g.Block()
+
+	// block returns a block of the validator in the slot after the
+	// genesis with the evidence.
+	block := func(evidence []chain.Evidence) chain.Block {
+		h := chain.Header{
+			ChainID:      chainID,
+			Height:       1,
+			ParentHash:   parent.Hash(),
+			Timestamp:    parent.Timestamp + g.Consensus.BlockTime.Milliseconds(),
+			TxRoot:       chain.TxRoot(nil),
+			EvidenceRoot: chain.EvidenceRoot(evidence),
+		}
+
+		b, err := chain.Sign(h, nil, keys[0])
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to sign the block: %v.", failed, err)
+		}
+		b.Evidence = evidence
+		return b
+	}
+
+	t.Log("Given the need to verify blocks of authorities.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen the block is proposed in the validator's slot.", testID)
+		{
+			if err := poa.Verify(g, parent, block(nil)); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould verify the block: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould verify the block.", success, testID)
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen the block holds evidence.", testID)
+		{
+			validator, _ := keys[0].Address(key.NodeAddress)
+			ev := chain.Evidence{Validator: validator, Height: 1, A: []byte(`{}`), B: []byte(`{}`)}
+
+			if err := poa.Verify(g, parent, block([]chain.Evidence{ev})); !errors.Is(err, chain.ErrInvalidBlock) {
+				t.Fatalf("\t%s\tTest %d:\tShould reject the block, got %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould reject the block.", success, testID)
+		}
+	}
+}
+
+func TestFinal(t *testing.T) {
+	g, keys := consensustest.NewGenesis(genesis.EnginePoA, 4)
+
+	// proposed returns blocks proposed by the validators in order.
+	proposed := func(validators ...int) []chain.Block {
+		blocks := make([]chain.Block, len(validators))
+		for i, v := range validators {
+			blocks[i].Height = uint64(i + 1)
+			blocks[i].Proposer, _ = keys[v].Address(key.NodeAddress)
+		}
+		return blocks
+	}
+
+	t.Log("Given the need to know which synced blocks are final.")
+	{
+		tt := []struct {
+			name       string
+			validators []int
+			final      int
+		}{
+			{"no blocks", nil, 0},
+			{"two of four validators", []int{0, 1, 0, 1}, 0},
+			{"three of four validators", []int{0, 1, 2}, 1},
+			{"a tail of two validators", []int{0, 1, 2, 3, 0, 1, 0}, 4},
+			{"three validators on top", []int{0, 0, 0, 1, 2, 3}, 4},
+		}
+
+		for testID, tc := range tt {
+			t.Logf("\tTest %d:\tWhen the chain has %s.", testID, tc.name)
+			{
+				if final := poa.Final(g, proposed(tc.validators...)); final != tc.final {
+					t.Fatalf("\t%s\tTest %d:\tShould have %d final blocks, but got %d.", failed, testID, tc.final, final)
+				}
+				t.Logf("\t%s\tTest %d:\tShould have %d final blocks.", success, testID, tc.final)
+			}
+		}
+	}
+}
+
+// =============================================================================
+
+// newNetwork returns a network of validators, of which only the first
+// online validators run.
+func newNetwork(t *testing.T, validators, online int, accounts ...key.Address) *consensustest.Network {
+	g, keys := consensustest.NewGenesis(genesis.EnginePoA, validators, accounts...)
+	g.Consensus.BlockTime = genesis.Duration{Duration: 100 * time.Millisecond}
+
+	return consensustest.NewNetwork(t, g, keys, online, func(cfg consensus.Config) (consensus.Engine, error) {
+		return poa.New(cfg)
+	})
+}
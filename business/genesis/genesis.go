@@ -0,0 +1,441 @@
+// Package genesis provides the genesis file that starts a Toqns network:
+// the chain ID, the initial account balances, the initial validators and
+// the consensus parameters.
+//
+// The genesis is the first block of the chain, at height 0. Its parent
+// hash is the hash of the genesis file, so networks with different
+// genesis files have different genesis blocks.
+package genesis
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/state"
+)
+
+// Consensus engines.
+const (
+	// EnginePoA is round-robin proof-of-authority, with finality once
+	// more than two thirds of the validators built on a block.
+	EnginePoA = "poa"
+
+	// EngineBFT is Byzantine fault tolerant consensus, with finality as
+	// soon as a block is committed.
+	EngineBFT = "bft"
+)
+
+// MaxTotalPower is the maximum voting power of all validators together,
+// which keeps quorum calculations from overflowing. As voting power is
+// stake, it's also the maximum total supply.
+const MaxTotalPower = math.MaxInt64 / 8
+
+// Default consensus parameters.
+const (
+	DefaultEngine          = EnginePoA
+	DefaultBlockTime       = 5 * time.Second
+	DefaultMaxBlockTxs     = 1000
+	DefaultEpochLength     = 100
+	DefaultUnbondingPeriod = 10_000
+	DefaultMaxValidators   = 100
+	DefaultSlashPercent    = 5
+)
+
+// hashPrefix is the domain prefix of the hashed genesis file.
+const hashPrefix = "toqns/genesis:"
+
+var (
+	// ErrInvalidGenesis is returned when a genesis file fails validation.
+	ErrInvalidGenesis = errors.New("invalid genesis")
+
+	// ErrMismatch is returned when the stored chain doesn't start with the
+	// genesis.
+	ErrMismatch = errors.New("stored chain doesn't match genesis")
+)
+
+// Genesis is the genesis file of a network.
+type Genesis struct {
+	ChainID    string      `json:"chain_id"`
+	Time       time.Time   `json:"genesis_time"`
+	Consensus  Consensus   `json:"consensus"`
+	Accounts   []Account   `json:"accounts"`
+	Validators []Validator `json:"validators"`
+}
+
+// Consensus are the consensus parameters.
+type Consensus struct {
+	// Engine is the consensus engine.
+	Engine string `json:"engine"`
+
+	// BlockTime is the time between blocks.
+	BlockTime Duration `json:"block_time"`
+
+	// MaxBlockTxs is the maximum number of transactions per block. Blocks
+	// are also limited to chain.MaxBlockSize.
+	MaxBlockTxs int `json:"max_block_txs"`
+
+	// EpochLength is the number of blocks per epoch. Changes to the
+	// validator set take effect after the last block of an epoch.
+	EpochLength uint64 `json:"epoch_length"`
+
+	// UnbondingPeriod is the number of blocks after which unbonded stake
+	// is released, at the end of an epoch. Until then, it can be slashed.
+	UnbondingPeriod uint64 `json:"unbonding_period"`
+
+	// MaxValidators is the maximum number of validators, which are the
+	// validators with the most stake.
+	MaxValidators int `json:"max_validators"`
+
+	// SlashPercent is the percentage of the stake that's burned when a
+	// validator signs conflicting votes.
+	SlashPercent uint64 `json:"slash_percent"`
+}
+
+// Account is an initial account balance.
+type Account struct {
+	Address key.Address `json:"address"`
+	Balance uint64      `json:"balance"`
+}
+
+// Validator is an initial validator.
+type Validator struct {
+	Address   key.Address   `json:"address"`
+	PublicKey key.PublicKey `json:"public_key"`
+
+	// Power is the voting power of the validator. It's bonded as stake of
+	// the account of the validator's key.
+	Power uint64 `json:"power"`
+}
+
+// Duration is a time.Duration that's encoded as text, such as "5s".
+type Duration struct {
+	time.Duration
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// New returns a genesis for the chain ID, without accounts and validators,
+// with the current time and the default consensus parameters.
+func New(chainID string) Genesis {
+	return Genesis{
+		ChainID: chainID,
+		Time:    time.Now().UTC().Truncate(time.Second),
+		Consensus: Consensus{
+			Engine:          DefaultEngine,
+			BlockTime:       Duration{DefaultBlockTime},
+			MaxBlockTxs:     DefaultMaxBlockTxs,
+			EpochLength:     DefaultEpochLength,
+			UnbondingPeriod: DefaultUnbondingPeriod,
+			MaxValidators:   DefaultMaxValidators,
+			SlashPercent:    DefaultSlashPercent,
+		},
+	}
+}
+
+// Load reads and validates a genesis file.
+func Load(name string) (Genesis, error) {
+	g, err := Read(name)
+	if err != nil {
+		return Genesis{}, err
+	}
+
+	if err := g.Validate(); err != nil {
+		return Genesis{}, fmt.Errorf("file %s: %w", name, err)
+	}
+
+	return g, nil
+}
+
+// Read reads a genesis file without validating it, such as a genesis file
+// that's still being built.
+func Read(name string) (Genesis, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return Genesis{}, fmt.Errorf("file %s: %w", name, err)
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+
+	var g Genesis
+	if err := d.Decode(&g); err != nil {
+		return Genesis{}, fmt.Errorf("file %s: %w: %v", name, ErrInvalidGenesis, err)
+	}
+
+	return g, nil
+}
+
+// Save writes the genesis file.
+func (g Genesis) Save(name string) error {
+	b, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding genesis: %w", err)
+	}
+
+	if err := os.WriteFile(name, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("writing genesis: %w", err)
+	}
+
+	return nil
+}
+
+// AddAccount adds an initial account balance.
+func (g *Genesis) AddAccount(addr key.Address, balance uint64) error {
+	if err := addr.Validate(); err != nil || !addr.IsAccount() {
+		return fmt.Errorf("%w: %s is not an account address", ErrInvalidGenesis, addr)
+	}
+
+	for _, a := range g.Accounts {
+		if a.Address == addr {
+			return fmt.Errorf("%w: account %s already exists", ErrInvalidGenesis, addr)
+		}
+	}
+
+	g.Accounts = append(g.Accounts, Account{Address: addr, Balance: balance})
+
+	return nil
+}
+
+// AddValidator adds an initial validator with the node key.
+func (g *Genesis) AddValidator(pub key.PublicKey, power uint64) error {
+	addr, err := pub.Address(key.NodeAddress)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidGenesis, err)
+	}
+
+	if power == 0 {
+		return fmt.Errorf("%w: validator %s has no power", ErrInvalidGenesis, addr)
+	}
+
+	for _, v := range g.Validators {
+		if v.Address == addr {
+			return fmt.Errorf("%w: validator %s already exists", ErrInvalidGenesis, addr)
+		}
+	}
+
+	g.Validators = append(g.Validators, Validator{Address: addr, PublicKey: pub, Power: power})
+
+	return nil
+}
+
+// Validate validates the genesis.
+func (g Genesis) Validate() error {
+	if g.ChainID == "" {
+		return fmt.Errorf("%w: no chain id", ErrInvalidGenesis)
+	}
+
+	if g.Time.IsZero() {
+		return fmt.Errorf("%w: no genesis time", ErrInvalidGenesis)
+	}
+
+	switch g.Consensus.Engine {
+	case EnginePoA, EngineBFT:
+	default:
+		return fmt.Errorf("%w: unknown consensus engine %q", ErrInvalidGenesis, g.Consensus.Engine)
+	}
+
+	if g.Consensus.BlockTime.Duration <= 0 {
+		return fmt.Errorf("%w: block time must be positive", ErrInvalidGenesis)
+	}
+
+	if g.Consensus.MaxBlockTxs < 1 || g.Consensus.MaxBlockTxs > chain.MaxBlockTxs {
+		return fmt.Errorf("%w: max block txs must be between 1 and %d", ErrInvalidGenesis, chain.MaxBlockTxs)
+	}
+
+	if g.Consensus.EpochLength == 0 {
+		return fmt.Errorf("%w: epoch length must be positive", ErrInvalidGenesis)
+	}
+
+	// Stake must stay slashable for as long as the validator can be in the
+	// validator set.
+	if g.Consensus.UnbondingPeriod < g.Consensus.EpochLength {
+		return fmt.Errorf("%w: unbonding period must be at least the epoch length", ErrInvalidGenesis)
+	}
+
+	if g.Consensus.MaxValidators < 1 || g.Consensus.MaxValidators > chain.MaxValidators {
+		return fmt.Errorf("%w: max validators must be between 1 and %d", ErrInvalidGenesis, chain.MaxValidators)
+	}
+
+	if g.Consensus.SlashPercent > 100 {
+		return fmt.Errorf("%w: slash percent exceeds 100", ErrInvalidGenesis)
+	}
+
+	accounts := make(map[key.Address]bool)
+	var total uint64
+	for _, a := range g.Accounts {
+		if err := a.Address.Validate(); err != nil || !a.Address.IsAccount() {
+			return fmt.Errorf("%w: %s is not an account address", ErrInvalidGenesis, a.Address)
+		}
+		if accounts[a.Address] {
+			return fmt.Errorf("%w: duplicate account %s", ErrInvalidGenesis, a.Address)
+		}
+		accounts[a.Address] = true
+
+		if a.Balance > MaxTotalPower-total {
+			return fmt.Errorf("%w: total supply exceeds %d", ErrInvalidGenesis, uint64(MaxTotalPower))
+		}
+		total += a.Balance
+	}
+
+	if len(g.Validators) == 0 {
+		return fmt.Errorf("%w: no validators", ErrInvalidGenesis)
+	}
+
+	validators := make(map[key.Address]bool)
+	for _, v := range g.Validators {
+		addr, err := v.PublicKey.Address(key.NodeAddress)
+		if err != nil || addr != v.Address {
+			return fmt.Errorf("%w: validator %s doesn't match its public key", ErrInvalidGenesis, v.Address)
+		}
+		if validators[v.Address] {
+			return fmt.Errorf("%w: duplicate validator %s", ErrInvalidGenesis, v.Address)
+		}
+		validators[v.Address] = true
+
+		if v.Power == 0 {
+			return fmt.Errorf("%w: validator %s has no power", ErrInvalidGenesis, v.Address)
+		}
+
+		if v.Power > MaxTotalPower-total {
+			return fmt.Errorf("%w: total supply exceeds %d", ErrInvalidGenesis, uint64(MaxTotalPower))
+		}
+		total += v.Power
+	}
+
+	return nil
+}
+
+// Hash returns the hex encoded hash of the genesis.
+func (g Genesis) Hash() string {
+	g.Time = g.Time.UTC()
+
+	// Encoding the struct can't fail.
+	b, _ := json.Marshal(g)
+
+	return key.HashString([]byte(hashPrefix), b)
+}
+
+// =============================================================================
+
+// Apply credits the initial account balances to the batch, and bonds the
+// power of the initial validators to the accounts of their keys.
+func (g Genesis) Apply(b *state.Batch) error {
+	for _, a := range g.Accounts {
+		if err := b.Credit(a.Address, a.Balance); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range g.Validators {
+		operator, err := v.PublicKey.Address(key.AccountAddress)
+		if err != nil {
+			return err
+		}
+
+		if err := b.Bond(operator, v.Address, v.Power); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ValidatorSet returns the initial validator set.
+func (g Genesis) ValidatorSet() []chain.Validator {
+	vals := make([]chain.Validator, len(g.Validators))
+	for i, v := range g.Validators {
+		vals[i] = chain.Validator{Address: v.Address, Power: v.Power}
+	}
+	return vals
+}
+
+// Block returns the genesis block, with the state root after the initial
+// balances and stakes are applied.
+func (g Genesis) Block() (chain.Block, error) {
+	st, err := state.New(g.ChainID, state.NewMemoryStorage())
+	if err != nil {
+		return chain.Block{}, err
+	}
+
+	b := st.Begin(0)
+	if err := g.Apply(b); err != nil {
+		return chain.Block{}, fmt.Errorf("applying genesis: %w", err)
+	}
+
+	return chain.Block{
+		Header: chain.Header{
+			ChainID:    g.ChainID,
+			Height:     0,
+			ParentHash: g.Hash(),
+			Timestamp:  g.Time.UnixMilli(),
+			TxRoot:     chain.TxRoot(nil),
+			StateRoot:  b.Root(),
+		},
+	}, nil
+}
+
+// Init initializes the state and the chain with the genesis, or checks
+// that they start with the genesis if they have been initialized before.
+//
+// Returns ErrMismatch if the stored chain or state doesn't match the
+// genesis.
+func Init(g Genesis, st *state.State, store *chain.Store) (chain.Block, error) {
+	gb, err := g.Block()
+	if err != nil {
+		return chain.Block{}, err
+	}
+
+	if _, ok := store.Height(); ok {
+		stored, err := store.ByHeight(0)
+		if err != nil {
+			return chain.Block{}, fmt.Errorf("reading genesis block: %w", err)
+		}
+
+		if stored.Hash() != gb.Hash() {
+			return chain.Block{}, fmt.Errorf("%w: stored genesis %s, expected %s", ErrMismatch, stored.Hash(), gb.Hash())
+		}
+
+		return gb, nil
+	}
+
+	// The state may have been committed before the genesis block was
+	// stored, when the node stopped in between.
+	switch height, ok := st.Height(); {
+	case !ok:
+		b := st.Begin(0)
+		if err := g.Apply(b); err != nil {
+			return chain.Block{}, fmt.Errorf("applying genesis: %w", err)
+		}
+		if err := b.Commit(); err != nil {
+			return chain.Block{}, err
+		}
+	case height != 0 || st.Root() != gb.StateRoot:
+		return chain.Block{}, fmt.Errorf("%w: state at height %d has root %s, expected %s", ErrMismatch, height, st.Root(), gb.StateRoot)
+	}
+
+	if err := store.Append(gb); err != nil {
+		return chain.Block{}, fmt.Errorf("storing genesis block: %w", err)
+	}
+
+	return gb, nil
+}
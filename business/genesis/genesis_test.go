@@ -0,0 +1,97 @@
+package genesis_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/genesis"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/state"
+)
+
+// Success and failure markers.
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+func TestGenesis(t *testing.T) {
+	validator, _ := key.New()
+	account, _ := key.New()
+	addr, _ := account.Address(key.AccountAddress)
+
+	g := genesis.New("toqns-test")
+	if err := g.AddAccount(addr, 1000); err != nil {
+		t.Fatalf("adding account: %v", err)
+	}
+	if err := g.AddValidator(validator.PublicKey(), 1); err != nil {
+		t.Fatalf("adding validator: %v", err)
+	}
+
+	t.Log("Given the need to start a network from a genesis file.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen saving and loading a genesis file.", testID)
+		{
+			name := filepath.Join(t.TempDir(), "genesis.json")
+			if err := g.Save(name); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to save the genesis: %v.", failed, testID, err)
+			}
+
+			l, err := genesis.Load(name)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to load the genesis: %v.", failed, testID, err)
+			}
+			if l.Hash() != g.Hash() {
+				t.Fatalf("\t%s\tTest %d:\tShould get the same hash after loading.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the same hash after loading.", success, testID)
+
+			if err := g.AddAccount(addr, 1); !errors.Is(err, genesis.ErrInvalidGenesis) {
+				t.Fatalf("\t%s\tTest %d:\tShould reject a duplicate account, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould reject a duplicate account.", success, testID)
+
+			nv := genesis.New("toqns-test")
+			if err := nv.Validate(); !errors.Is(err, genesis.ErrInvalidGenesis) {
+				t.Fatalf("\t%s\tTest %d:\tShould reject a genesis without validators, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould reject a genesis without validators.", success, testID)
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen initializing the chain.", testID)
+		{
+			dir := t.TempDir()
+			st, _ := state.New(g.ChainID, state.NewMemoryStorage())
+			store, err := chain.Open(dir)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to open the store: %v.", failed, testID, err)
+			}
+			defer store.Close()
+
+			gb, err := genesis.Init(g, st, store)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to initialize the chain: %v.", failed, testID, err)
+			}
+			if st.Balance(addr) != 1000 || gb.StateRoot != st.Root() {
+				t.Fatalf("\t%s\tTest %d:\tShould apply the initial balances.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould apply the initial balances.", success, testID)
+
+			if _, err := genesis.Init(g, st, store); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould accept the same genesis again: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould accept the same genesis again.", success, testID)
+
+			other := g
+			other.ChainID = "toqns-other"
+			if _, err := genesis.Init(other, st, store); !errors.Is(err, genesis.ErrMismatch) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrMismatch for another genesis, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrMismatch for another genesis.", success, testID)
+		}
+	}
+}
@@ -1,25 +1,21 @@
 package key
 
 import (
-	"crypto/ecdsa"
-	"crypto/x509"
+	"crypto"
 	"encoding/hex"
 	"fmt"
 	"strings"
+
+	"github.com/toqns/toqns/foundation/address"
+	"github.com/toqns/toqns/foundation/multiaddr"
 )
 
 // Address is a custom type to support key derived addresses.
 type Address string
 
 // AddressFromKey returns an address from a private key.
-func AddressFromKey(d string, k *ecdsa.PrivateKey) (Address, error) {
-	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
-	if err != nil {
-		return "", fmt.Errorf("generating public key der: %w", err)
-	}
-	addressBytes := publicKeyBytes[len(publicKeyBytes)-20:]
-	address := d + hex.EncodeToString(addressBytes)
-	return Address(address), nil
+func AddressFromKey(d string, k crypto.Signer) (Address, error) {
+	return AddressFromPublicKey(d, k.Public())
 }
 
 // AddressFromString parses a string to an address.
@@ -33,6 +29,57 @@ func AddressFromString(v string) (Address, error) {
 	return a, nil
 }
 
+// ParseAddress parses a checksummed address, as returned by
+// Address.Checksummed.
+//
+// Returns ErrAddressChecksum when the address contains a typo, with the
+// position of the typo if it can be located.
+func ParseAddress(v string) (Address, error) {
+	hrp, data, err := bech32Decode(v)
+	if err != nil {
+		return "", err
+	}
+
+	if hrp != AccountAddress && hrp != NodeAddress {
+		return "", fmt.Errorf("%w: unknown prefix %q", ErrInvalidAddress, hrp)
+	}
+
+	b, err := convertBits(data, 5, 8, false)
+	if err != nil {
+		return "", err
+	}
+
+	a := Address(hrp + hex.EncodeToString(b))
+	if err := a.Validate(); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidAddress, err)
+	}
+
+	return a, nil
+}
+
+// Checksummed returns the checksummed encoding of the address.
+//
+// The encoding is bech32m with the designation as human-readable part,
+// such as ac1qg8c.... It detects typos, so it should be used whenever an
+// address is shown to or entered by users.
+func (a Address) Checksummed() (string, error) {
+	if err := a.Validate(); err != nil {
+		return "", err
+	}
+
+	b, err := hex.DecodeString(string(a[2:]))
+	if err != nil {
+		return "", err
+	}
+
+	data, err := convertBits(b, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+
+	return bech32Encode(string(a[:2]), data), nil
+}
+
 // String implements the stringer interface.
 func (a *Address) String() string {
 	return string(*a)
@@ -47,10 +94,16 @@ func (a Address) Validate() error {
 
 	// ac: Account
 	// nd: Node
-	if !strings.HasPrefix(str, "ac") || !strings.HasPrefix(str, "nd") {
+	if !strings.HasPrefix(str, AccountAddress) && !strings.HasPrefix(str, NodeAddress) {
 		return fmt.Errorf("invalid prefix")
 	}
 
+	// Addresses are compared as strings, so only the lowercase encoding is
+	// accepted to keep one address per key.
+	if strings.ToLower(str[2:]) != str[2:] {
+		return fmt.Errorf("invalid hex value: not lowercase")
+	}
+
 	b, err := hex.DecodeString(str[2:])
 	if err != nil {
 		return fmt.Errorf("invalid hex value")
@@ -63,6 +116,44 @@ func (a Address) Validate() error {
 	return nil
 }
 
+// IsNode reports whether the address is a node address.
+func (a Address) IsNode() bool {
+	return strings.HasPrefix(string(a), NodeAddress)
+}
+
+// IsAccount reports whether the address is an account address.
+func (a Address) IsAccount() bool {
+	return strings.HasPrefix(string(a), AccountAddress)
+}
+
+// ParseNodeAddress parses a network address string and validates that its
+// ID is a node address.
+//
+// The string can be in the id@ip/port/protocol[/destination] format, or
+// a multiaddr that can be represented in that format.
+func ParseNodeAddress(v string) (address.Address, error) {
+	m, err := multiaddr.ParseAny(v)
+	if err != nil {
+		return address.Address{}, err
+	}
+
+	a, err := m.Address()
+	if err != nil {
+		return address.Address{}, err
+	}
+
+	id := Address(a.ID)
+	if err := id.Validate(); err != nil {
+		return address.Address{}, fmt.Errorf("%w: %v", address.ErrInvalidID, err)
+	}
+
+	if !id.IsNode() {
+		return address.Address{}, fmt.Errorf("%w: not a node address", address.ErrInvalidID)
+	}
+
+	return a, nil
+}
+
 // IsValid is a wrapper around Validate.
 // Returns true or false respective of whether validation passed.
 func (a Address) IsValid() bool {
@@ -0,0 +1,102 @@
+package key
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// Algorithm is a signature algorithm of a key.
+type Algorithm string
+
+// Supported algorithms.
+const (
+	// P256 is ECDSA on the NIST P-256 curve over SHA-256 hashes.
+	P256 Algorithm = "p256"
+
+	// Ed25519 is EdDSA on Curve25519 as defined in RFC 8032.
+	Ed25519 Algorithm = "ed25519"
+)
+
+// ed25519Prefix is the first byte of encoded Ed25519 public keys.
+//
+// Encoded P-256 public keys are uncompressed points, which always start
+// with 0x04, so the first byte identifies the algorithm.
+const ed25519Prefix = 0xed
+
+// ErrUnknownAlgorithm is returned for keys of an unsupported algorithm.
+var ErrUnknownAlgorithm = errors.New("unknown key algorithm")
+
+// ParseAlgorithm parses the name of an algorithm.
+func ParseAlgorithm(v string) (Algorithm, error) {
+	switch a := Algorithm(v); a {
+	case P256, Ed25519:
+		return a, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownAlgorithm, v)
+}
+
+// Signer is implemented by keys that can sign data.
+type Signer interface {
+	Algorithm() Algorithm
+	PublicKey() PublicKey
+	Sign(data []byte) ([]byte, error)
+}
+
+// algorithmOf returns the algorithm of a private or public key.
+func algorithmOf(k any) Algorithm {
+	switch k.(type) {
+	case *ecdsa.PrivateKey, *ecdsa.PublicKey:
+		return P256
+	case ed25519.PrivateKey, ed25519.PublicKey:
+		return Ed25519
+	}
+	return ""
+}
+
+// marshalPrivateKey returns the DER encoding of the private key.
+//
+// P-256 keys are encoded in SEC 1 form for compatibility with existing key
+// files, other keys in PKCS #8 form.
+func marshalPrivateKey(k crypto.Signer) ([]byte, error) {
+	if ec, ok := k.(*ecdsa.PrivateKey); ok {
+		return x509.MarshalECPrivateKey(ec)
+	}
+	return x509.MarshalPKCS8PrivateKey(k)
+}
+
+// pemType returns the PEM block type of the private key.
+func pemType(k crypto.Signer) string {
+	if _, ok := k.(*ecdsa.PrivateKey); ok {
+		return "EC PRIVATE KEY"
+	}
+	return "PRIVATE KEY"
+}
+
+// parsePrivateKey parses a DER encoded private key as returned by
+// marshalPrivateKey.
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if ec, err := x509.ParseECPrivateKey(der); err == nil {
+		return ec, nil
+	}
+
+	k, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := k.(type) {
+	case ed25519.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve == elliptic.P256() {
+			return k, nil
+		}
+	}
+
+	return nil, ErrUnknownAlgorithm
+}
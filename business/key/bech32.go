@@ -0,0 +1,195 @@
+package key
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The checksummed address encoding follows bech32m as defined in BIP 350,
+// with the address designation as human-readable part.
+
+// bech32Charset maps 5 bit values to characters.
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// bech32mConst is the constant the checksum of a valid bech32m string
+// evaluates to.
+const bech32mConst = 0x2bc830a3
+
+// bech32ChecksumLen is the number of checksum characters.
+const bech32ChecksumLen = 6
+
+// bech32MaxLen is the maximum length of a bech32m string.
+const bech32MaxLen = 90
+
+var (
+	// ErrInvalidAddress is returned when an address can't be parsed.
+	ErrInvalidAddress = errors.New("invalid address")
+
+	// ErrAddressChecksum is returned when the checksum of an address
+	// doesn't match, which indicates a typo.
+	ErrAddressChecksum = errors.New("address checksum mismatch")
+)
+
+// bech32Polymod returns the BCH checksum of the values.
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+	chk := uint32(1)
+	for _, v := range values {
+		b := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (b>>i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+// bech32HRPExpand returns the values of the human-readable part that are
+// covered by the checksum.
+func bech32HRPExpand(hrp string) []byte {
+	v := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		v = append(v, hrp[i]>>5)
+	}
+	v = append(v, 0)
+	for i := 0; i < len(hrp); i++ {
+		v = append(v, hrp[i]&31)
+	}
+	return v
+}
+
+// bech32Valid reports whether the checksum of the data, which includes the
+// checksum values, is valid.
+func bech32Valid(hrp string, data []byte) bool {
+	return bech32Polymod(append(bech32HRPExpand(hrp), data...)) == bech32mConst
+}
+
+// bech32Encode encodes the 5 bit data values with a checksum.
+func bech32Encode(hrp string, data []byte) string {
+	values := append(bech32HRPExpand(hrp), data...)
+	values = append(values, make([]byte, bech32ChecksumLen)...)
+	mod := bech32Polymod(values) ^ bech32mConst
+
+	var b strings.Builder
+	b.WriteString(hrp)
+	b.WriteByte('1')
+	for _, v := range data {
+		b.WriteByte(bech32Charset[v])
+	}
+	for i := 0; i < bech32ChecksumLen; i++ {
+		b.WriteByte(bech32Charset[(mod>>uint(5*(5-i)))&31])
+	}
+	return b.String()
+}
+
+// bech32Decode decodes a bech32m string into its human-readable part and
+// 5 bit data values, without the checksum.
+//
+// Errors report the 1-based position of invalid characters, and of likely
+// typos when the checksum doesn't match.
+func bech32Decode(v string) (string, []byte, error) {
+	if len(v) > bech32MaxLen {
+		return "", nil, fmt.Errorf("%w: longer than %d characters", ErrInvalidAddress, bech32MaxLen)
+	}
+
+	if strings.ToLower(v) != v && strings.ToUpper(v) != v {
+		return "", nil, fmt.Errorf("%w: mixed case", ErrInvalidAddress)
+	}
+	v = strings.ToLower(v)
+
+	sep := strings.LastIndexByte(v, '1')
+	if sep < 1 || sep+bech32ChecksumLen+1 > len(v) {
+		return "", nil, fmt.Errorf("%w: missing separator", ErrInvalidAddress)
+	}
+	hrp := v[:sep]
+
+	for i := 0; i < len(hrp); i++ {
+		if hrp[i] < 33 || hrp[i] > 126 {
+			return "", nil, fmt.Errorf("%w: invalid character %q at position %d", ErrInvalidAddress, hrp[i], i+1)
+		}
+	}
+
+	data := make([]byte, 0, len(v)-sep-1)
+	for i := sep + 1; i < len(v); i++ {
+		d := strings.IndexByte(bech32Charset, v[i])
+		if d < 0 {
+			return "", nil, fmt.Errorf("%w: invalid character %q at position %d", ErrInvalidAddress, v[i], i+1)
+		}
+		data = append(data, byte(d))
+	}
+
+	if !bech32Valid(hrp, data) {
+		if pos := bech32LocateTypo(hrp, data); pos != "" {
+			return "", nil, fmt.Errorf("%w: likely typo at %s", ErrAddressChecksum, pos)
+		}
+		return "", nil, ErrAddressChecksum
+	}
+
+	return hrp, data[:len(data)-bech32ChecksumLen], nil
+}
+
+// bech32LocateTypo describes the position of a single mistyped character,
+// or of two swapped neighbouring characters, that explains the checksum
+// mismatch. Returns an empty string when the typo can't be located.
+func bech32LocateTypo(hrp string, data []byte) string {
+	offset := len(hrp) + 2
+	try := append([]byte(nil), data...)
+
+	for i := range try {
+		orig := try[i]
+		for c := byte(0); c < 32; c++ {
+			if c == orig {
+				continue
+			}
+			try[i] = c
+			if bech32Valid(hrp, try) {
+				return fmt.Sprintf("position %d", i+offset)
+			}
+		}
+		try[i] = orig
+	}
+
+	for i := 0; i+1 < len(try); i++ {
+		if try[i] == try[i+1] {
+			continue
+		}
+		try[i], try[i+1] = try[i+1], try[i]
+		if bech32Valid(hrp, try) {
+			return fmt.Sprintf("positions %d and %d, which are swapped", i+offset, i+offset+1)
+		}
+		try[i], try[i+1] = try[i+1], try[i]
+	}
+
+	return ""
+}
+
+// convertBits regroups the values of fromBits bits into values of toBits
+// bits. When pad is set, the remaining bits are padded with zeros,
+// otherwise they must be zero padding.
+func convertBits(data []byte, fromBits, toBits uint, pad bool) ([]byte, error) {
+	var acc, bits uint
+	maxv := uint(1)<<toBits - 1
+
+	out := make([]byte, 0, len(data)*int(fromBits)/int(toBits)+1)
+	for _, v := range data {
+		acc = acc<<fromBits | uint(v)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+
+	switch {
+	case pad && bits > 0:
+		out = append(out, byte(acc<<(toBits-bits)&maxv))
+	case !pad && (bits >= fromBits || acc<<(toBits-bits)&maxv != 0):
+		return nil, fmt.Errorf("%w: invalid padding", ErrInvalidAddress)
+	}
+
+	return out, nil
+}
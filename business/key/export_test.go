@@ -0,0 +1,8 @@
+package key
+
+// Bech32Encode and Bech32Decode export the bech32m encoding for the tests
+// with the reference vectors.
+var (
+	Bech32Encode = bech32Encode
+	Bech32Decode = bech32Decode
+)
@@ -0,0 +1,130 @@
+package key
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// HardenedOffset is added to an index for hardened derivation.
+const HardenedOffset = 1 << 31
+
+// CoinType is the coin type of Toqns in derivation paths.
+const CoinType = 7353
+
+// Purposes of derived keys, used as account level in derivation paths.
+const (
+	PurposeAccount = 0
+	PurposeNode    = 1
+)
+
+// ErrInvalidPath is returned when a derivation path can't be parsed.
+var ErrInvalidPath = errors.New("invalid derivation path")
+
+// AccountPath returns the derivation path of the account key with the
+// provided index.
+func AccountPath(index uint32) string {
+	return fmt.Sprintf("m/44'/%d'/%d'/0'/%d'", CoinType, PurposeAccount, index)
+}
+
+// NodePath returns the derivation path of the node key with the provided
+// index.
+func NodePath(index uint32) string {
+	return fmt.Sprintf("m/44'/%d'/%d'/0'/%d'", CoinType, PurposeNode, index)
+}
+
+// ParsePath parses a derivation path, such as m/44'/7353'/0'/0'/0', into
+// its indexes.
+//
+// Only hardened indexes are supported, marked with ' or h.
+func ParsePath(path string) ([]uint32, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) == 0 || parts[0] != "m" {
+		return nil, fmt.Errorf("%w: %q doesn't start with m", ErrInvalidPath, path)
+	}
+
+	indexes := make([]uint32, 0, len(parts)-1)
+	for _, p := range parts[1:] {
+		hardened := strings.HasSuffix(p, "'") || strings.HasSuffix(p, "h")
+		if !hardened {
+			return nil, fmt.Errorf("%w: %q is not hardened", ErrInvalidPath, p)
+		}
+
+		i, err := strconv.ParseUint(p[:len(p)-1], 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidPath, p)
+		}
+		indexes = append(indexes, uint32(i)+HardenedOffset)
+	}
+
+	return indexes, nil
+}
+
+// FromSeed derives the key for the derivation path from a seed, such as
+// returned by MnemonicToSeed.
+//
+// Derivation follows SLIP-0010 for the NIST P-256 curve, with hardened
+// derivation only.
+func FromSeed(seed []byte, path string) (Key, error) {
+	indexes, err := ParsePath(path)
+	if err != nil {
+		return Key{}, err
+	}
+
+	if len(seed) < 16 || len(seed) > 64 {
+		return Key{}, fmt.Errorf("invalid seed length %d", len(seed))
+	}
+
+	curve := elliptic.P256()
+	n := curve.Params().N
+
+	// Master key generation.
+	k, c := hmacSplit([]byte("Nist256p1 seed"), seed)
+	for k.Sign() == 0 || k.Cmp(n) >= 0 {
+		k, c = hmacSplit([]byte("Nist256p1 seed"), append(k.FillBytes(make([]byte, 32)), c...))
+	}
+
+	// Child key derivation.
+	for _, i := range indexes {
+		data := make([]byte, 37)
+		k.FillBytes(data[1:33])
+		binary.BigEndian.PutUint32(data[33:], i)
+
+		for {
+			il, ir := hmacSplit(c, data)
+			if il.Cmp(n) < 0 {
+				child := new(big.Int).Add(il, k)
+				child.Mod(child, n)
+				if child.Sign() != 0 {
+					k, c = child, ir
+					break
+				}
+			}
+
+			// The resulting key is invalid, so proceed with the next value.
+			data[0] = 1
+			copy(data[1:33], ir)
+		}
+	}
+
+	privateKey := ecdsa.PrivateKey{D: k}
+	privateKey.Curve = curve
+	privateKey.X, privateKey.Y = curve.ScalarBaseMult(k.FillBytes(make([]byte, 32)))
+
+	return Key{privateKey: &privateKey}, nil
+}
+
+// hmacSplit returns the left and right halves of HMAC-SHA512(key, data).
+func hmacSplit(key, data []byte) (*big.Int, []byte) {
+	h := hmac.New(sha512.New, key)
+	h.Write(data)
+	sum := h.Sum(nil)
+	return new(big.Int).SetBytes(sum[:32]), sum[32:]
+}
@@ -1,17 +1,22 @@
-// Package key provides functionality for working with EDCSA keys.
+// Package key provides functionality for working with keys.
+//
+// Keys use either ECDSA on the NIST P-256 curve or Ed25519. The algorithm
+// is encoded in public key strings, so signatures can be verified without
+// knowing the algorithm up front.
 package key
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/x509"
 	"encoding/hex"
 	"encoding/pem"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path/filepath"
+
+	"github.com/toqns/toqns/foundation/atomicfile"
 )
 
 const (
@@ -24,17 +29,33 @@ const (
 
 // Key represents a key for use on a Toqns network.
 type Key struct {
-	privateKey *ecdsa.PrivateKey
+	privateKey crypto.Signer
 }
 
-// New returns a newly initialized key.
+// New returns a newly initialized P-256 key.
 func New() (Key, error) {
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		return Key{}, fmt.Errorf("generating ecdsa key: %w", err)
+	return NewWithAlgorithm(P256)
+}
+
+// NewWithAlgorithm returns a newly initialized key for the algorithm.
+func NewWithAlgorithm(a Algorithm) (Key, error) {
+	switch a {
+	case P256:
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return Key{}, fmt.Errorf("generating ecdsa key: %w", err)
+		}
+		return Key{privateKey: privateKey}, nil
+
+	case Ed25519:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return Key{}, fmt.Errorf("generating ed25519 key: %w", err)
+		}
+		return Key{privateKey: privateKey}, nil
 	}
 
-	return Key{privateKey: privateKey}, nil
+	return Key{}, fmt.Errorf("%w: %q", ErrUnknownAlgorithm, a)
 }
 
 // Restore parses the provided private key string and returns a Key.
@@ -44,7 +65,7 @@ func Restore(privKey string) (Key, error) {
 		return Key{}, fmt.Errorf("decoding key string: %w", err)
 	}
 
-	key, err := x509.ParseECPrivateKey(h)
+	key, err := parsePrivateKey(h)
 	if err != nil {
 		return Key{}, fmt.Errorf("parsing key: %w", err)
 	}
@@ -54,44 +75,41 @@ func Restore(privKey string) (Key, error) {
 
 // RestoreFromFile reads the provided file and parses the content into a Key.
 func RestoreFromFile(name string) (Key, error) {
-	file, err := os.OpenFile(name, os.O_RDONLY, 0600)
+	b, err := os.ReadFile(name)
 	if err != nil {
 		return Key{}, fmt.Errorf("file %s: %w", name, err)
 	}
-	defer file.Close()
 
-	b, err := ioutil.ReadAll(file)
+	k, err := parsePEM(b)
 	if err != nil {
-		return Key{}, fmt.Errorf("reading file: %w", err)
+		return Key{}, fmt.Errorf("file %s: %w", name, err)
 	}
 
-	block, _ := pem.Decode(b)
-	privateKey, err := x509.ParseECPrivateKey(block.Bytes)
-	if err != nil {
-		return Key{}, fmt.Errorf("parsing key: %w", err)
-	}
+	return k, nil
+}
 
-	return Key{privateKey: privateKey}, nil
+// Algorithm returns the algorithm of the key.
+func (k Key) Algorithm() Algorithm {
+	return algorithmOf(k.privateKey)
 }
 
 // PrivateKeyString returns the key's private key string.
 func (k Key) PrivateKeyString() (string, error) {
-	b, err := x509.MarshalECPrivateKey(k.privateKey)
+	b, err := marshalPrivateKey(k.privateKey)
 	if err != nil {
 		return "", fmt.Errorf("marshalling key: %w", err)
 	}
 	return hex.EncodeToString(b), nil
 }
 
-// PublicKey returns the public key as ecdsa.
-func (k Key) PublicKey() ecdsa.PublicKey {
-	return k.privateKey.PublicKey
+// PublicKey returns the public key.
+func (k Key) PublicKey() PublicKey {
+	return PublicKey{key: k.privateKey.Public()}
 }
 
 // PublicKeyString returns the public key string.
 func (k Key) PublicKeyString() string {
-	b := elliptic.Marshal(elliptic.P256(), k.privateKey.PublicKey.X, k.privateKey.PublicKey.Y)
-	return hex.EncodeToString(b)
+	return k.PublicKey().String()
 }
 
 // Address returns the address of this key.
@@ -110,23 +128,10 @@ func (k Key) Address(d string) (Address, error) {
 //
 // Use RestoreFromFile to restore the key from the file.
 func (k Key) Save(name string) error {
-	dir, _ := filepath.Split(name)
-	os.MkdirAll(dir, 0700)
-
-	b, err := x509.MarshalECPrivateKey(k.privateKey)
+	b, err := marshalPrivateKey(k.privateKey)
 	if err != nil {
 		return fmt.Errorf("marshalling key: %w", err)
 	}
 
-	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return fmt.Errorf("creating file: %w", err)
-	}
-	defer file.Close()
-
-	if err := pem.Encode(file, &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}); err != nil {
-		return fmt.Errorf("encoding pem: %w", err)
-	}
-
-	return nil
+	return atomicfile.Write(name, pem.EncodeToMemory(&pem.Block{Type: pemType(k.privateKey), Bytes: b}))
 }
@@ -1,9 +1,12 @@
 package key_test
 
 import (
+	"errors"
+	"strings"
 	"testing"
 
 	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/foundation/address"
 )
 
 // Success and failure markers.
@@ -37,5 +40,140 @@ func TestKey(t *testing.T) {
 			}
 			t.Logf("\t%s\tTest %d:\tShould have matching private keys.", success, testID)
 		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen working with key addresses.", testID)
+		{
+			k, err := key.New()
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to create new key: %v.", failed, testID, err)
+			}
+
+			for _, d := range []string{key.NodeAddress, key.AccountAddress} {
+				a, err := k.Address(d)
+				if err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to get %s address: %v.", failed, testID, d, err)
+				}
+				if err := a.Validate(); err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to validate %s address: %v.", failed, testID, d, err)
+				}
+				t.Logf("\t%s\tTest %d:\tShould be able to validate %s address.", success, testID, d)
+			}
+
+			for _, v := range []string{"ac4E8F1B2A3C5D6E7F8091A2B3C4D5E6F708192A3B", "ac4e8f1b2a3c5d6e7f8091A2b3c4d5e6f708192a3b"} {
+				if err := key.Address(v).Validate(); err == nil {
+					t.Fatalf("\t%s\tTest %d:\tShould not be able to validate %q.", failed, testID, v)
+				}
+				if _, err := key.AddressFromString(v); err == nil {
+					t.Fatalf("\t%s\tTest %d:\tShould not be able to parse %q.", failed, testID, v)
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould not be able to validate addresses with uppercase hex.", success, testID)
+
+			id, _ := k.Address(key.NodeAddress)
+			if _, err := key.ParseNodeAddress(string(id) + "@8.8.8.8/3000/udp"); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to parse node address: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to parse node address.", success, testID)
+
+			ac, _ := k.Address(key.AccountAddress)
+			if _, err := key.ParseNodeAddress(string(ac) + "@8.8.8.8/3000/udp"); !errors.Is(err, address.ErrInvalidID) {
+				t.Fatalf("\t%s\tTest %d:\tShould not be able to parse account address as node address, got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not be able to parse account address as node address.", success, testID)
+		}
+
+		testID = 2
+		t.Logf("\tTest %d:\tWhen working with checksummed addresses.", testID)
+		{
+			a := key.Address("ac4e8f1b2a3c5d6e7f8091a2b3c4d5e6f708192a3b")
+
+			c, err := a.Checksummed()
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to encode the address: %v.", failed, testID, err)
+			}
+			if len(c) != 41 || !strings.HasPrefix(c, "ac1") {
+				t.Fatalf("\t%s\tTest %d:\tShould get a 41 character address with prefix ac1, but got %q.", failed, testID, c)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get a 41 character address with prefix ac1.", success, testID)
+
+			for _, v := range []string{c, strings.ToUpper(c)} {
+				p, err := key.ParseAddress(v)
+				if err != nil || p != a {
+					t.Fatalf("\t%s\tTest %d:\tShould parse %q as %s, but got %s: %v.", failed, testID, v, a, p, err)
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to parse the checksummed address.", success, testID)
+
+			typo := []byte(c)
+			typo[19] = 'q'
+			if c[19] == 'q' {
+				typo[19] = 'p'
+			}
+			if _, err := key.ParseAddress(string(typo)); !errors.Is(err, key.ErrAddressChecksum) || !strings.Contains(err.Error(), "position 20") {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrAddressChecksum at position 20, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrAddressChecksum at position 20.", success, testID)
+
+			tt := []string{
+				"ac4e8f1b2a3c5d6e7f8091a2b3c4d5e6f708192a3b",
+				c[:10] + "b" + c[11:],
+				"xy" + c[2:],
+				c[:10] + strings.ToUpper(c[10:]),
+			}
+			for _, v := range tt {
+				if _, err := key.ParseAddress(v); !errors.Is(err, key.ErrInvalidAddress) && !errors.Is(err, key.ErrAddressChecksum) {
+					t.Fatalf("\t%s\tTest %d:\tShould not be able to parse %q, but got: %v.", failed, testID, v, err)
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould not be able to parse invalid addresses.", success, testID)
+		}
+
+		testID = 3
+		t.Logf("\tTest %d:\tWhen decoding the bech32m reference vectors of BIP 350.", testID)
+		{
+			valid := []string{
+				"A1LQFN3A",
+				"a1lqfn3a",
+				"an83characterlonghumanreadablepartthatcontainsthetheexcludedcharactersbioandnumber11sg7hg6",
+				"abcdef1l7aum6echk45nj3s0wdvt2fg8x9yrzpqzd3ryx",
+				"11llllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllludsr8",
+				"split1checkupstagehandshakeupstreamerranterredcaperredlc445v",
+				"?1v759aa",
+			}
+			for _, v := range valid {
+				hrp, data, err := key.Bech32Decode(v)
+				if err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to decode %q: %v.", failed, testID, v, err)
+				}
+				if enc := key.Bech32Encode(hrp, data); enc != strings.ToLower(v) {
+					t.Fatalf("\t%s\tTest %d:\tShould encode %q again, but got %q.", failed, testID, v, enc)
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould decode and encode the valid vectors.", success, testID)
+
+			invalid := []string{
+				"\x201xj0phk",
+				"\x7f1g6xzxy",
+				"\x801vctc34",
+				"an84characterslonghumanreadablepartthatcontainsthetheexcludedcharactersbioandnumber11d6pts4",
+				"qyrz8wqd2c9m",
+				"1qyrz8wqd2c9m",
+				"y1b0jsk6g",
+				"lt1igcx5c0",
+				"in1muywd",
+				"mm1crxm3i",
+				"au1s5cgom",
+				"M1VUXWEZ",
+				"16plkw9",
+				"1p2gdwpf",
+			}
+			for _, v := range invalid {
+				if _, _, err := key.Bech32Decode(v); err == nil {
+					t.Fatalf("\t%s\tTest %d:\tShould not be able to decode %q.", failed, testID, v)
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould not be able to decode the invalid vectors.", success, testID)
+		}
 	}
 }
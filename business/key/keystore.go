@@ -0,0 +1,344 @@
+package key
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+
+	"github.com/toqns/toqns/foundation/atomicfile"
+)
+
+// Keystore versions and algorithms.
+const (
+	KeystoreVersion = 1
+	KeystoreCipher  = "aes-256-gcm"
+	KeystoreKDF     = "pbkdf2-sha256"
+
+	// KDFIterations is the number of PBKDF2 iterations for new keystores.
+	KDFIterations = 600_000
+
+	// MinKDFIterations and MaxKDFIterations limit the number of PBKDF2
+	// iterations of keystores that are read, so a keystore file can't
+	// weaken the encryption or make decrypting it take forever.
+	MinKDFIterations = 100_000
+	MaxKDFIterations = 10_000_000
+)
+
+var (
+	// ErrWrongPassphrase is returned when a keystore can't be decrypted
+	// with the provided passphrase.
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+
+	// ErrPassphraseRequired is returned when an encrypted keystore is
+	// loaded without passphrase.
+	ErrPassphraseRequired = errors.New("passphrase required")
+
+	// ErrInvalidKeyFile is returned when a key file is neither a valid
+	// keystore nor a valid PEM file, such as when it's corrupted.
+	ErrInvalidKeyFile = errors.New("invalid key file")
+)
+
+// Keystore is the encrypted file format for keys.
+type Keystore struct {
+	Version int            `json:"version"`
+	Address Address        `json:"address"`
+	Crypto  KeystoreCrypto `json:"crypto"`
+}
+
+// KeystoreCrypto holds the encrypted key and the parameters to decrypt it.
+type KeystoreCrypto struct {
+	Cipher     string    `json:"cipher"`
+	CipherText string    `json:"ciphertext"`
+	Nonce      string    `json:"nonce"`
+	KDF        string    `json:"kdf"`
+	KDFParams  KDFParams `json:"kdfparams"`
+}
+
+// KDFParams are the parameters of the key derivation function.
+type KDFParams struct {
+	Iterations int    `json:"iterations"`
+	Salt       string `json:"salt"`
+	KeyLen     int    `json:"keylen"`
+}
+
+// Encrypt encrypts the key with the passphrase into a keystore.
+//
+// The address for designation d is stored as metadata, so the keystore can
+// be identified without decrypting it.
+func (k Key) Encrypt(passphrase []byte, d string) (Keystore, error) {
+	addr, err := k.Address(d)
+	if err != nil {
+		return Keystore{}, err
+	}
+
+	plain, err := marshalPrivateKey(k.privateKey)
+	if err != nil {
+		return Keystore{}, fmt.Errorf("marshalling key: %w", err)
+	}
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return Keystore{}, fmt.Errorf("generating salt: %w", err)
+	}
+
+	params := KDFParams{Iterations: KDFIterations, Salt: hex.EncodeToString(salt), KeyLen: 32}
+	aead, err := keystoreAEAD(passphrase, salt, params)
+	if err != nil {
+		return Keystore{}, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return Keystore{}, fmt.Errorf("generating nonce: %w", err)
+	}
+
+	ks := Keystore{
+		Version: KeystoreVersion,
+		Address: addr,
+		Crypto: KeystoreCrypto{
+			Cipher:    KeystoreCipher,
+			Nonce:     hex.EncodeToString(nonce),
+			KDF:       KeystoreKDF,
+			KDFParams: params,
+		},
+	}
+
+	// The metadata is authenticated, so it can't be altered.
+	ct := aead.Seal(nil, nonce, plain, ks.additionalData())
+	ks.Crypto.CipherText = hex.EncodeToString(ct)
+
+	return ks, nil
+}
+
+// Decrypt decrypts the keystore with the passphrase.
+//
+// Returns ErrWrongPassphrase when the passphrase is incorrect or the
+// keystore has been altered.
+func (ks Keystore) Decrypt(passphrase []byte) (Key, error) {
+	if ks.Version != KeystoreVersion {
+		return Key{}, fmt.Errorf("unsupported keystore version %d", ks.Version)
+	}
+
+	if ks.Crypto.Cipher != KeystoreCipher || ks.Crypto.KDF != KeystoreKDF {
+		return Key{}, fmt.Errorf("unsupported keystore cipher %q or kdf %q", ks.Crypto.Cipher, ks.Crypto.KDF)
+	}
+
+	salt, err := hex.DecodeString(ks.Crypto.KDFParams.Salt)
+	if err != nil {
+		return Key{}, fmt.Errorf("decoding salt: %w", err)
+	}
+
+	nonce, err := hex.DecodeString(ks.Crypto.Nonce)
+	if err != nil {
+		return Key{}, fmt.Errorf("decoding nonce: %w", err)
+	}
+
+	ct, err := hex.DecodeString(ks.Crypto.CipherText)
+	if err != nil {
+		return Key{}, fmt.Errorf("decoding ciphertext: %w", err)
+	}
+
+	aead, err := keystoreAEAD(passphrase, salt, ks.Crypto.KDFParams)
+	if err != nil {
+		return Key{}, err
+	}
+
+	if len(nonce) != aead.NonceSize() {
+		return Key{}, fmt.Errorf("invalid nonce size %d", len(nonce))
+	}
+
+	plain, err := aead.Open(nil, nonce, ct, ks.additionalData())
+	if err != nil {
+		return Key{}, ErrWrongPassphrase
+	}
+
+	privateKey, err := parsePrivateKey(plain)
+	if err != nil {
+		return Key{}, fmt.Errorf("parsing key: %w", err)
+	}
+
+	return Key{privateKey: privateKey}, nil
+}
+
+// additionalData returns the metadata that is authenticated along with
+// the encrypted key.
+func (ks Keystore) additionalData() []byte {
+	return []byte(fmt.Sprintf("%d:%s:%s:%s:%d", ks.Version, ks.Address, ks.Crypto.Cipher, ks.Crypto.KDF, ks.Crypto.KDFParams.Iterations))
+}
+
+// keystoreAEAD derives the encryption key from the passphrase and returns
+// the AES-GCM cipher.
+func keystoreAEAD(passphrase, salt []byte, params KDFParams) (cipher.AEAD, error) {
+	if params.Iterations < MinKDFIterations || params.Iterations > MaxKDFIterations {
+		return nil, fmt.Errorf("%w: %d kdf iterations, expected %d to %d", ErrInvalidKeyFile, params.Iterations, MinKDFIterations, MaxKDFIterations)
+	}
+	if params.KeyLen != 32 {
+		return nil, fmt.Errorf("%w: kdf key length %d", ErrInvalidKeyFile, params.KeyLen)
+	}
+
+	dk := pbkdf2(sha256.New, passphrase, salt, params.Iterations, params.KeyLen)
+
+	block, err := aes.NewCipher(dk)
+	if err != nil {
+		return nil, fmt.Errorf("creating cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("creating gcm: %w", err)
+	}
+
+	return aead, nil
+}
+
+// pbkdf2 derives a key with PBKDF2 as defined in RFC 8018, using HMAC with
+// the provided hash function.
+func pbkdf2(h func() hash.Hash, password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(h, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var buf [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:4])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = u[:0]
+			u = prf.Sum(u)
+			for x := range u {
+				t[x] ^= u[x]
+			}
+		}
+	}
+
+	return dk[:keyLen]
+}
+
+// =============================================================================
+
+// SaveEncrypted stores the key as a keystore file encrypted with the
+// passphrase.
+//
+// Use Load to restore the key from the file.
+func (k Key) SaveEncrypted(name string, passphrase []byte, d string) error {
+	ks, err := k.Encrypt(passphrase, d)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(ks, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding keystore: %w", err)
+	}
+
+	return atomicfile.Write(name, b)
+}
+
+// Load reads a key file, which is either a keystore file or a plaintext
+// PEM file as written by Save.
+//
+// The passphrase is required for keystore files and ignored for
+// plaintext files.
+func Load(name string, passphrase []byte) (Key, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return Key{}, fmt.Errorf("file %s: %w", name, err)
+	}
+
+	if !isKeystore(b) {
+		k, err := parsePEM(b)
+		if err != nil {
+			return Key{}, fmt.Errorf("file %s: %w", name, err)
+		}
+		return k, nil
+	}
+
+	var ks Keystore
+	if err := json.Unmarshal(b, &ks); err != nil {
+		return Key{}, fmt.Errorf("file %s: %w: decoding keystore: %v", name, ErrInvalidKeyFile, err)
+	}
+
+	if len(passphrase) == 0 {
+		return Key{}, ErrPassphraseRequired
+	}
+
+	return ks.Decrypt(passphrase)
+}
+
+// IsEncrypted reports whether the key file is a keystore file.
+func IsEncrypted(name string) (bool, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return false, fmt.Errorf("file %s: %w", name, err)
+	}
+
+	return isKeystore(b), nil
+}
+
+// Migrate encrypts a plaintext PEM key file in place.
+//
+// The file is replaced atomically, so the key isn't lost when migration
+// fails halfway.
+func Migrate(name string, passphrase []byte, d string) error {
+	if len(passphrase) == 0 {
+		return ErrPassphraseRequired
+	}
+
+	enc, err := IsEncrypted(name)
+	if err != nil {
+		return err
+	}
+	if enc {
+		return fmt.Errorf("file %s is already encrypted", name)
+	}
+
+	k, err := Load(name, nil)
+	if err != nil {
+		return err
+	}
+
+	return k.SaveEncrypted(name, passphrase, d)
+}
+
+// isKeystore reports whether the data is a JSON keystore.
+func isKeystore(b []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(b), []byte("{"))
+}
+
+// parsePEM parses a plaintext PEM encoded private key.
+//
+// Returns ErrInvalidKeyFile if the data isn't a PEM encoded key.
+func parsePEM(b []byte) (Key, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return Key{}, fmt.Errorf("%w: no pem data found", ErrInvalidKeyFile)
+	}
+
+	privateKey, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		return Key{}, fmt.Errorf("%w: parsing key: %v", ErrInvalidKeyFile, err)
+	}
+
+	return Key{privateKey: privateKey}, nil
+}
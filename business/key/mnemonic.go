@@ -0,0 +1,142 @@
+package key
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	_ "embed"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// english.txt is the BIP39 English wordlist.
+//
+//go:embed english.txt
+var englishWordlist string
+
+// bitsPerWord is the number of bits encoded by a single word.
+const bitsPerWord = 11
+
+var (
+	wordlist  = strings.Fields(englishWordlist)
+	wordIndex = indexWords(wordlist)
+)
+
+var (
+	// ErrInvalidMnemonic is returned when a mnemonic isn't valid.
+	ErrInvalidMnemonic = errors.New("invalid mnemonic")
+
+	// ErrMnemonicChecksum is returned when the checksum of a mnemonic
+	// doesn't match, which indicates a wrong or misspelled word.
+	ErrMnemonicChecksum = errors.New("mnemonic checksum mismatch")
+)
+
+func indexWords(words []string) map[string]int {
+	m := make(map[string]int, len(words))
+	for i, w := range words {
+		m[w] = i
+	}
+	return m
+}
+
+// NewMnemonic returns a new BIP39 mnemonic with the provided entropy size
+// in bits.
+//
+// The entropy size must be a multiple of 32 between 128 and 256, resulting
+// in a mnemonic of 12 to 24 words.
+func NewMnemonic(bits int) (string, error) {
+	if bits < 128 || bits > 256 || bits%32 != 0 {
+		return "", fmt.Errorf("invalid entropy size %d", bits)
+	}
+
+	entropy := make([]byte, bits/8)
+	if _, err := rand.Read(entropy); err != nil {
+		return "", fmt.Errorf("generating entropy: %w", err)
+	}
+
+	return mnemonicFromEntropy(entropy), nil
+}
+
+// mnemonicFromEntropy encodes the entropy with its checksum as words.
+func mnemonicFromEntropy(entropy []byte) string {
+	bits := len(entropy) * 8
+	csBits := bits / 32
+
+	// The checksum is the first bits of the SHA-256 hash of the entropy.
+	h := sha256.Sum256(entropy)
+	v := new(big.Int).SetBytes(entropy)
+	v.Lsh(v, uint(csBits))
+	v.Or(v, big.NewInt(int64(h[0]>>(8-csBits))))
+
+	n := (bits + csBits) / bitsPerWord
+	words := make([]string, n)
+	mask := big.NewInt(1<<bitsPerWord - 1)
+	for i := n - 1; i >= 0; i-- {
+		idx := new(big.Int).And(v, mask)
+		words[i] = wordlist[idx.Int64()]
+		v.Rsh(v, uint(bitsPerWord))
+	}
+
+	return strings.Join(words, " ")
+}
+
+// ValidateMnemonic validates the words and checksum of a BIP39 mnemonic.
+//
+// Unknown words are reported with their position, starting at 1.
+func ValidateMnemonic(mnemonic string) error {
+	_, err := mnemonicEntropy(mnemonic)
+	return err
+}
+
+// mnemonicEntropy returns the entropy encoded in the mnemonic.
+func mnemonicEntropy(mnemonic string) ([]byte, error) {
+	words := strings.Fields(mnemonic)
+	switch len(words) {
+	case 12, 15, 18, 21, 24:
+	default:
+		return nil, fmt.Errorf("%w: got %d words, expected 12, 15, 18, 21 or 24", ErrInvalidMnemonic, len(words))
+	}
+
+	v := new(big.Int)
+	for i, w := range words {
+		idx, ok := wordIndex[strings.ToLower(w)]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown word %q at position %d", ErrInvalidMnemonic, w, i+1)
+		}
+		v.Lsh(v, uint(bitsPerWord))
+		v.Or(v, big.NewInt(int64(idx)))
+	}
+
+	total := len(words) * bitsPerWord
+	csBits := total / 33
+	bits := total - csBits
+
+	cs := new(big.Int).And(v, big.NewInt(1<<csBits-1))
+	v.Rsh(v, uint(csBits))
+
+	entropy := make([]byte, bits/8)
+	v.FillBytes(entropy)
+
+	h := sha256.Sum256(entropy)
+	if int64(h[0]>>(8-csBits)) != cs.Int64() {
+		return nil, ErrMnemonicChecksum
+	}
+
+	return entropy, nil
+}
+
+// MnemonicToSeed validates the mnemonic and returns the 64 byte BIP39
+// seed for the mnemonic and an optional passphrase.
+//
+// The passphrase isn't Unicode normalized, so it should be entered the
+// same way when restoring.
+func MnemonicToSeed(mnemonic, passphrase string) ([]byte, error) {
+	if err := ValidateMnemonic(mnemonic); err != nil {
+		return nil, err
+	}
+
+	normalized := strings.ToLower(strings.Join(strings.Fields(mnemonic), " "))
+	return pbkdf2(sha512.New, []byte(normalized), []byte("mnemonic"+passphrase), 2048, 64), nil
+}
@@ -0,0 +1,94 @@
+package key_test
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/toqns/toqns/business/key"
+)
+
+func TestMnemonic(t *testing.T) {
+	t.Log("Given the need to derive keys from a mnemonic.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen using the BIP39 test vector.", testID)
+		{
+			m := "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+			exp := "c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04"
+
+			seed, err := key.MnemonicToSeed(m, "TREZOR")
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to get the seed: %v.", failed, testID, err)
+			}
+			if got := hex.EncodeToString(seed); got != exp {
+				t.Fatalf("\t%s\tTest %d:\tShould get seed %s, but got %s.", failed, testID, exp, got)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the expected seed.", success, testID)
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen validating mnemonics.", testID)
+		{
+			m, err := key.NewMnemonic(256)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to create a mnemonic: %v.", failed, testID, err)
+			}
+			if len(strings.Fields(m)) != 24 {
+				t.Fatalf("\t%s\tTest %d:\tShould get 24 words, but got: %q.", failed, testID, m)
+			}
+			if err := key.ValidateMnemonic(m); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to validate the mnemonic: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to create and validate a mnemonic.", success, testID)
+
+			bad := "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon"
+			if err := key.ValidateMnemonic(bad); !errors.Is(err, key.ErrMnemonicChecksum) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrMnemonicChecksum, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrMnemonicChecksum.", success, testID)
+
+			typo := "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abuot"
+			if err := key.ValidateMnemonic(typo); !errors.Is(err, key.ErrInvalidMnemonic) || !strings.Contains(err.Error(), "position 12") {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInvalidMnemonic at position 12, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrInvalidMnemonic at position 12.", success, testID)
+		}
+
+		testID = 2
+		t.Logf("\tTest %d:\tWhen deriving keys using the SLIP-0010 test vector.", testID)
+		{
+			seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+			exp := "6939694369114c67917a182c59ddb8cafc3004e63ca5d3b84403ba8613debc0c"
+
+			k, err := key.FromSeed(seed, "m/0'")
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to derive the key: %v.", failed, testID, err)
+			}
+
+			// The private key string is DER encoded with the key at a fixed offset.
+			privKeyStr, _ := k.PrivateKeyString()
+			if !strings.Contains(privKeyStr, exp) {
+				t.Fatalf("\t%s\tTest %d:\tShould get private key %s, but got %s.", failed, testID, exp, privKeyStr)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the expected private key.", success, testID)
+
+			a0, _ := key.FromSeed(seed, key.AccountPath(0))
+			a1, _ := key.FromSeed(seed, key.AccountPath(1))
+			again, _ := key.FromSeed(seed, key.AccountPath(0))
+			s0, _ := a0.PrivateKeyString()
+			s1, _ := a1.PrivateKeyString()
+			sa, _ := again.PrivateKeyString()
+			if s0 == s1 || s0 != sa {
+				t.Fatalf("\t%s\tTest %d:\tShould derive distinct, deterministic account keys.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould derive distinct, deterministic account keys.", success, testID)
+
+			if _, err := key.FromSeed(seed, "m/44/0'"); !errors.Is(err, key.ErrInvalidPath) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInvalidPath for non-hardened paths, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrInvalidPath for non-hardened paths.", success, testID)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package key
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// MaxMultisigKeys is the maximum number of public keys of a multisig
+// account.
+const MaxMultisigKeys = 16
+
+var (
+	// ErrInvalidMultisig is returned for multisig accounts with an invalid
+	// threshold or set of public keys.
+	ErrInvalidMultisig = errors.New("invalid multisig")
+
+	// ErrNotMultisigMember is returned when a key isn't part of a multisig
+	// account.
+	ErrNotMultisigMember = errors.New("key is not a member of the multisig")
+
+	// ErrThresholdNotMet is returned when an authorization has fewer valid
+	// signatures than the threshold.
+	ErrThresholdNotMet = errors.New("multisig threshold not met")
+)
+
+// Multisig is an account that requires signatures of Threshold of its
+// public keys.
+type Multisig struct {
+	Threshold  int         `json:"threshold"`
+	PublicKeys []PublicKey `json:"public_keys"`
+}
+
+// NewMultisig returns a multisig account for M-of-N authorization, with
+// threshold M and the N public keys.
+//
+// The public keys are sorted, so the order in which they are provided
+// doesn't change the account.
+func NewMultisig(threshold int, keys ...PublicKey) (Multisig, error) {
+	m := Multisig{
+		Threshold:  threshold,
+		PublicKeys: append([]PublicKey(nil), keys...),
+	}
+
+	sort.Slice(m.PublicKeys, func(i, j int) bool {
+		return bytes.Compare(m.PublicKeys[i].Bytes(), m.PublicKeys[j].Bytes()) < 0
+	})
+
+	if err := m.Validate(); err != nil {
+		return Multisig{}, err
+	}
+
+	return m, nil
+}
+
+// Validate validates the threshold and public keys.
+//
+// The public keys must be sorted and unique, as returned by NewMultisig.
+func (m Multisig) Validate() error {
+	n := len(m.PublicKeys)
+	if n == 0 || n > MaxMultisigKeys {
+		return fmt.Errorf("%w: %d public keys, expected 1 to %d", ErrInvalidMultisig, n, MaxMultisigKeys)
+	}
+
+	if m.Threshold < 1 || m.Threshold > n {
+		return fmt.Errorf("%w: threshold %d of %d public keys", ErrInvalidMultisig, m.Threshold, n)
+	}
+
+	for i := 1; i < n; i++ {
+		switch bytes.Compare(m.PublicKeys[i-1].Bytes(), m.PublicKeys[i].Bytes()) {
+		case 0:
+			return fmt.Errorf("%w: duplicate public key %s", ErrInvalidMultisig, m.PublicKeys[i])
+		case 1:
+			return fmt.Errorf("%w: public keys aren't sorted", ErrInvalidMultisig)
+		}
+	}
+
+	return nil
+}
+
+// Address returns the account address of the multisig.
+//
+// The address is derived from the threshold and the sorted public keys.
+func (m Multisig) Address() (Address, error) {
+	if err := m.Validate(); err != nil {
+		return "", err
+	}
+
+	data := [][]byte{[]byte("toqns/multisig"), {byte(m.Threshold)}}
+	for _, k := range m.PublicKeys {
+		b := k.Bytes()
+		data = append(data, []byte{byte(len(b))}, b)
+	}
+
+	return Address(AccountAddress + hex.EncodeToString(Hash(data...)[:20])), nil
+}
+
+// index returns the index of the public key in the multisig, or -1.
+func (m Multisig) index(pub PublicKey) int {
+	for i, k := range m.PublicKeys {
+		if k.Equal(pub) {
+			return i
+		}
+	}
+	return -1
+}
+
+// =============================================================================
+
+// PartialSignature is the signature of a single key of a multisig.
+type PartialSignature struct {
+	PublicKey PublicKey `json:"public_key"`
+	Signature string    `json:"signature"`
+}
+
+// Authorization collects the partial signatures of a multisig for the
+// same data.
+type Authorization struct {
+	Multisig   Multisig           `json:"multisig"`
+	Signatures []PartialSignature `json:"signatures"`
+}
+
+// Sign signs the data with the key and adds the partial signature.
+//
+// Returns ErrNotMultisigMember if the key isn't part of the multisig.
+func (a *Authorization) Sign(k Signer, data []byte) error {
+	sig, err := k.Sign(data)
+	if err != nil {
+		return err
+	}
+
+	return a.Add(PartialSignature{
+		PublicKey: k.PublicKey(),
+		Signature: hex.EncodeToString(sig),
+	})
+}
+
+// Add adds a partial signature, replacing an earlier signature of the same
+// key.
+//
+// Returns ErrNotMultisigMember if the key isn't part of the multisig.
+func (a *Authorization) Add(ps PartialSignature) error {
+	if a.Multisig.index(ps.PublicKey) < 0 {
+		return ErrNotMultisigMember
+	}
+
+	for i := range a.Signatures {
+		if a.Signatures[i].PublicKey.Equal(ps.PublicKey) {
+			a.Signatures[i] = ps
+			return nil
+		}
+	}
+
+	a.Signatures = append(a.Signatures, ps)
+
+	// Keep the signatures in the order of the public keys.
+	sort.Slice(a.Signatures, func(i, j int) bool {
+		return a.Multisig.index(a.Signatures[i].PublicKey) < a.Multisig.index(a.Signatures[j].PublicKey)
+	})
+
+	return nil
+}
+
+// Verify verifies that the authorization has valid signatures of the data
+// for at least the threshold of keys.
+//
+// Returns ErrThresholdNotMet if there are too few signatures, and
+// ErrInvalidSignature if any of the signatures doesn't verify.
+func (a Authorization) Verify(data []byte) error {
+	if err := a.Multisig.Validate(); err != nil {
+		return err
+	}
+
+	signed := make(map[int]bool)
+	for _, ps := range a.Signatures {
+		i := a.Multisig.index(ps.PublicKey)
+		if i < 0 {
+			return fmt.Errorf("%w: %s", ErrNotMultisigMember, ps.PublicKey)
+		}
+
+		if signed[i] {
+			return fmt.Errorf("%w: duplicate signature of %s", ErrInvalidMultisig, ps.PublicKey)
+		}
+
+		sig, err := hex.DecodeString(ps.Signature)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+		}
+
+		if err := ps.PublicKey.Verify(data, sig); err != nil {
+			return fmt.Errorf("%w: signature of %s", err, ps.PublicKey)
+		}
+
+		signed[i] = true
+	}
+
+	if len(signed) < a.Multisig.Threshold {
+		return fmt.Errorf("%w: %d of %d signatures", ErrThresholdNotMet, len(signed), a.Multisig.Threshold)
+	}
+
+	return nil
+}
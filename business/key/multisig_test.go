@@ -0,0 +1,82 @@
+package key_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/toqns/toqns/business/key"
+)
+
+func TestMultisig(t *testing.T) {
+	t.Log("Given the need to authorize with multiple keys.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen using a 2-of-3 multisig.", testID)
+		{
+			var keys []key.Key
+			for _, alg := range []key.Algorithm{key.P256, key.Ed25519, key.P256} {
+				k, err := key.NewWithAlgorithm(alg)
+				if err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to create new key: %v.", failed, testID, err)
+				}
+				keys = append(keys, k)
+			}
+
+			m1, err := key.NewMultisig(2, keys[0].PublicKey(), keys[1].PublicKey(), keys[2].PublicKey())
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to create the multisig: %v.", failed, testID, err)
+			}
+			m2, _ := key.NewMultisig(2, keys[2].PublicKey(), keys[0].PublicKey(), keys[1].PublicKey())
+			m3, _ := key.NewMultisig(3, keys[2].PublicKey(), keys[0].PublicKey(), keys[1].PublicKey())
+
+			a1, _ := m1.Address()
+			a2, _ := m2.Address()
+			a3, _ := m3.Address()
+			if a1 != a2 || a1 == a3 || !a1.IsAccount() {
+				t.Fatalf("\t%s\tTest %d:\tShould derive the account address from the sorted keys and threshold.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould derive the account address from the sorted keys and threshold.", success, testID)
+
+			data := []byte("transfer 100 toqns")
+			auth := key.Authorization{Multisig: m1}
+			if err := auth.Sign(keys[1], data); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to sign: %v.", failed, testID, err)
+			}
+			if err := auth.Verify(data); !errors.Is(err, key.ErrThresholdNotMet) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrThresholdNotMet, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrThresholdNotMet.", success, testID)
+
+			other, _ := key.New()
+			if err := auth.Sign(other, data); !errors.Is(err, key.ErrNotMultisigMember) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrNotMultisigMember, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrNotMultisigMember.", success, testID)
+
+			// Co-sign a copy that went through the file format.
+			b, _ := json.Marshal(auth)
+			var cosigned key.Authorization
+			if err := json.Unmarshal(b, &cosigned); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to decode the authorization: %v.", failed, testID, err)
+			}
+			if err := cosigned.Sign(keys[2], data); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to co-sign: %v.", failed, testID, err)
+			}
+			if err := cosigned.Verify(data); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to verify the authorization: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to verify the authorization.", success, testID)
+
+			if err := cosigned.Verify([]byte("transfer 900 toqns")); !errors.Is(err, key.ErrInvalidSignature) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInvalidSignature for other data, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrInvalidSignature for other data.", success, testID)
+
+			if _, err := key.NewMultisig(2, keys[0].PublicKey(), keys[0].PublicKey()); !errors.Is(err, key.ErrInvalidMultisig) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInvalidMultisig for duplicate keys, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrInvalidMultisig for duplicate keys.", success, testID)
+		}
+	}
+}
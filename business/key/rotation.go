@@ -0,0 +1,142 @@
+package key
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/toqns/toqns/foundation/atomicfile"
+)
+
+// ErrInvalidRotation is returned when a rotation statement doesn't verify.
+var ErrInvalidRotation = errors.New("invalid key rotation")
+
+// Rotation is a statement that hands over a node ID to a new key.
+//
+// The statement is signed by the old key, which proves continuity, and by
+// the new key, which proves possession of the new key. Peers that accept
+// the statement replace the old node ID with the new one and revoke the
+// old ID.
+type Rotation struct {
+	OldID        Address   `json:"old_id"`
+	OldPublicKey PublicKey `json:"old_public_key"`
+	NewID        Address   `json:"new_id"`
+	NewPublicKey PublicKey `json:"new_public_key"`
+	Timestamp    int64     `json:"timestamp"`
+	OldSignature string    `json:"old_signature"`
+	NewSignature string    `json:"new_signature"`
+}
+
+// NewRotation returns a rotation statement from the old to the new node
+// key, signed by both keys.
+func NewRotation(oldKey, newKey Signer) (Rotation, error) {
+	oldID, err := oldKey.PublicKey().Address(NodeAddress)
+	if err != nil {
+		return Rotation{}, err
+	}
+
+	newID, err := newKey.PublicKey().Address(NodeAddress)
+	if err != nil {
+		return Rotation{}, err
+	}
+
+	r := Rotation{
+		OldID:        oldID,
+		OldPublicKey: oldKey.PublicKey(),
+		NewID:        newID,
+		NewPublicKey: newKey.PublicKey(),
+		Timestamp:    time.Now().Unix(),
+	}
+
+	oldSig, err := oldKey.Sign(r.signingData())
+	if err != nil {
+		return Rotation{}, err
+	}
+
+	newSig, err := newKey.Sign(r.signingData())
+	if err != nil {
+		return Rotation{}, err
+	}
+
+	r.OldSignature = hex.EncodeToString(oldSig)
+	r.NewSignature = hex.EncodeToString(newSig)
+
+	return r, nil
+}
+
+// signingData returns the data that is signed by both keys.
+func (r Rotation) signingData() []byte {
+	return []byte(fmt.Sprintf("toqns/rotation:%s:%s:%s:%s:%d", r.OldID, r.OldPublicKey, r.NewID, r.NewPublicKey, r.Timestamp))
+}
+
+// Verify verifies that the IDs belong to the public keys and that both
+// keys signed the statement.
+//
+// Returns ErrInvalidRotation if verification fails.
+func (r Rotation) Verify() error {
+	oldID, err := r.OldPublicKey.Address(NodeAddress)
+	if err != nil || oldID != r.OldID {
+		return fmt.Errorf("%w: old id doesn't match old public key", ErrInvalidRotation)
+	}
+
+	newID, err := r.NewPublicKey.Address(NodeAddress)
+	if err != nil || newID != r.NewID {
+		return fmt.Errorf("%w: new id doesn't match new public key", ErrInvalidRotation)
+	}
+
+	if r.OldID == r.NewID {
+		return fmt.Errorf("%w: old and new id are the same", ErrInvalidRotation)
+	}
+
+	for _, s := range []struct {
+		pub PublicKey
+		sig string
+		key string
+	}{
+		{r.OldPublicKey, r.OldSignature, "old"},
+		{r.NewPublicKey, r.NewSignature, "new"},
+	} {
+		sig, err := hex.DecodeString(s.sig)
+		if err != nil {
+			return fmt.Errorf("%w: decoding %s signature: %v", ErrInvalidRotation, s.key, err)
+		}
+
+		if err := s.pub.Verify(r.signingData(), sig); err != nil {
+			return fmt.Errorf("%w: %s signature: %v", ErrInvalidRotation, s.key, err)
+		}
+	}
+
+	return nil
+}
+
+// Save stores the rotation statement as a JSON file.
+func (r Rotation) Save(name string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding rotation: %w", err)
+	}
+
+	return atomicfile.Write(name, b)
+}
+
+// LoadRotation reads and verifies a rotation statement file.
+func LoadRotation(name string) (Rotation, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return Rotation{}, fmt.Errorf("file %s: %w", name, err)
+	}
+
+	var r Rotation
+	if err := json.Unmarshal(b, &r); err != nil {
+		return Rotation{}, fmt.Errorf("decoding rotation: %w", err)
+	}
+
+	if err := r.Verify(); err != nil {
+		return Rotation{}, err
+	}
+
+	return r, nil
+}
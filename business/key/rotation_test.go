@@ -0,0 +1,47 @@
+package key_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/toqns/toqns/business/key"
+)
+
+func TestRotation(t *testing.T) {
+	t.Log("Given the need to rotate node keys.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen handing over to a new key.", testID)
+		{
+			old, _ := key.New()
+			k, _ := key.NewWithAlgorithm(key.Ed25519)
+
+			r, err := key.NewRotation(old, k)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to create the rotation: %v.", failed, testID, err)
+			}
+			if err := r.Verify(); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to verify the rotation: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to verify the rotation.", success, testID)
+
+			name := t.TempDir() + "/rotation.json"
+			if err := r.Save(name); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to save the rotation: %v.", failed, testID, err)
+			}
+			if l, err := key.LoadRotation(name); err != nil || l.NewID != r.NewID {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to load the rotation: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to load the rotation.", success, testID)
+
+			other, _ := key.New()
+			forged := r
+			forged.NewPublicKey = other.PublicKey()
+			forged.NewID, _ = other.Address(key.NodeAddress)
+			if err := forged.Verify(); !errors.Is(err, key.ErrInvalidRotation) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInvalidRotation for a forged rotation, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrInvalidRotation for a forged rotation.", success, testID)
+		}
+	}
+}
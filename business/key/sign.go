@@ -0,0 +1,221 @@
+package key
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// SignatureSize is the size of a signature in bytes.
+const SignatureSize = 64
+
+// ErrInvalidSignature is returned when a signature doesn't verify.
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// Hash returns the SHA-256 hash of the concatenated data.
+func Hash(data ...[]byte) []byte {
+	h := sha256.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// HashString returns the hex encoded SHA-256 hash of the concatenated data.
+func HashString(data ...[]byte) string {
+	return hex.EncodeToString(Hash(data...))
+}
+
+// Sign signs the data.
+//
+// P-256 keys sign the SHA-256 hash of the data. The signature is the
+// fixed-size concatenation of r and s, with s in its lower form so
+// signatures can't be altered into another valid signature. Ed25519 keys
+// sign the data as is.
+func (k Key) Sign(data []byte) ([]byte, error) {
+	switch pk := k.privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		return signECDSA(pk, data)
+	case ed25519.PrivateKey:
+		return ed25519.Sign(pk, data), nil
+	}
+	return nil, ErrUnknownAlgorithm
+}
+
+// signECDSA signs the SHA-256 hash of the data with s in its lower form.
+func signECDSA(k *ecdsa.PrivateKey, data []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, k, Hash(data))
+	if err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+
+	n := k.Curve.Params().N
+	if s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		s.Sub(n, s)
+	}
+
+	sig := make([]byte, SignatureSize)
+	r.FillBytes(sig[:SignatureSize/2])
+	s.FillBytes(sig[SignatureSize/2:])
+
+	return sig, nil
+}
+
+// Verify verifies the signature of the data with the public key.
+//
+// Returns ErrInvalidSignature if the signature doesn't verify.
+func Verify(pub PublicKey, data, sig []byte) error {
+	return pub.Verify(data, sig)
+}
+
+// PublicKey is the public key of a Key.
+type PublicKey struct {
+	key crypto.PublicKey
+}
+
+// ParsePublicKey parses a public key string, as returned by
+// Key.PublicKeyString, into a PublicKey.
+func ParsePublicKey(v string) (PublicKey, error) {
+	b, err := hex.DecodeString(v)
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("decoding public key string: %w", err)
+	}
+
+	return ParsePublicKeyBytes(b)
+}
+
+// ParsePublicKeyBytes parses a public key as returned by PublicKey.Bytes.
+func ParsePublicKeyBytes(b []byte) (PublicKey, error) {
+	if len(b) == 1+ed25519.PublicKeySize && b[0] == ed25519Prefix {
+		return PublicKey{key: ed25519.PublicKey(append([]byte(nil), b[1:]...))}, nil
+	}
+
+	x, y := elliptic.Unmarshal(elliptic.P256(), b)
+	if x == nil {
+		return PublicKey{}, errors.New("invalid public key")
+	}
+
+	return PublicKey{key: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}}, nil
+}
+
+// Algorithm returns the algorithm of the public key.
+func (p PublicKey) Algorithm() Algorithm {
+	return algorithmOf(p.key)
+}
+
+// Bytes returns the encoded public key.
+//
+// P-256 keys are encoded as uncompressed elliptic curve point, Ed25519 keys
+// as the key prefixed with 0xed.
+func (p PublicKey) Bytes() []byte {
+	switch pk := p.key.(type) {
+	case *ecdsa.PublicKey:
+		return elliptic.Marshal(pk.Curve, pk.X, pk.Y)
+	case ed25519.PublicKey:
+		return append([]byte{ed25519Prefix}, pk...)
+	}
+	return nil
+}
+
+// String implements the stringer interface and returns the public key
+// string.
+func (p PublicKey) String() string {
+	return hex.EncodeToString(p.Bytes())
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (p PublicKey) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+//
+// An empty text results in the zero PublicKey.
+func (p *PublicKey) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*p = PublicKey{}
+		return nil
+	}
+
+	v, err := ParsePublicKey(string(text))
+	if err != nil {
+		return err
+	}
+	*p = v
+
+	return nil
+}
+
+// Equal reports whether both public keys are the same.
+func (p PublicKey) Equal(o PublicKey) bool {
+	if p.key == nil || o.key == nil {
+		return p.key == nil && o.key == nil
+	}
+
+	k, ok := p.key.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(o.key)
+}
+
+// Address returns the address of this public key.
+//
+// Requires a designation, such as NodeAddress or AccountAddress.
+func (p PublicKey) Address(d string) (Address, error) {
+	return AddressFromPublicKey(d, p.key)
+}
+
+// Verify verifies the signature of the data.
+//
+// Returns ErrInvalidSignature if the signature doesn't verify.
+func (p PublicKey) Verify(data, sig []byte) error {
+	if len(sig) != SignatureSize {
+		return ErrInvalidSignature
+	}
+
+	switch pk := p.key.(type) {
+	case *ecdsa.PublicKey:
+		return verifyECDSA(pk, data, sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pk, data, sig) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+
+	return ErrInvalidSignature
+}
+
+// verifyECDSA verifies a signature as returned by signECDSA.
+func verifyECDSA(k *ecdsa.PublicKey, data, sig []byte) error {
+	r := new(big.Int).SetBytes(sig[:SignatureSize/2])
+	s := new(big.Int).SetBytes(sig[SignatureSize/2:])
+
+	// Only accept signatures with s in its lower form.
+	if s.Cmp(new(big.Int).Rsh(k.Curve.Params().N, 1)) > 0 {
+		return ErrInvalidSignature
+	}
+
+	if !ecdsa.Verify(k, Hash(data), r, s) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// AddressFromPublicKey returns an address from a public key.
+func AddressFromPublicKey(d string, k crypto.PublicKey) (Address, error) {
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(k)
+	if err != nil {
+		return "", fmt.Errorf("generating public key der: %w", err)
+	}
+	addressBytes := publicKeyBytes[len(publicKeyBytes)-20:]
+	address := d + hex.EncodeToString(addressBytes)
+	return Address(address), nil
+}
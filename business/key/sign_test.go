@@ -0,0 +1,86 @@
+package key_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/toqns/toqns/business/key"
+)
+
+func TestSign(t *testing.T) {
+	t.Log("Given the need to sign and verify data.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen signing data with a key.", testID)
+		for _, alg := range []key.Algorithm{key.P256, key.Ed25519} {
+			t.Run(string(alg), func(t *testing.T) {
+				k, err := key.NewWithAlgorithm(alg)
+				if err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to create new key: %v.", failed, testID, err)
+				}
+
+				data := []byte("transfer 100 toqns")
+				sig, err := k.Sign(data)
+				if err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to sign: %v.", failed, testID, err)
+				}
+				t.Logf("\t%s\tTest %d:\tShould be able to sign.", success, testID)
+
+				if len(sig) != key.SignatureSize {
+					t.Fatalf("\t%s\tTest %d:\tShould get a signature of %d bytes, but got %d.", failed, testID, key.SignatureSize, len(sig))
+				}
+				t.Logf("\t%s\tTest %d:\tShould get a signature of %d bytes.", success, testID, key.SignatureSize)
+
+				pub, err := key.ParsePublicKey(k.PublicKeyString())
+				if err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to parse the public key: %v.", failed, testID, err)
+				}
+				t.Logf("\t%s\tTest %d:\tShould be able to parse the public key.", success, testID)
+
+				if err := key.Verify(pub, data, sig); err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to verify the signature: %v.", failed, testID, err)
+				}
+				t.Logf("\t%s\tTest %d:\tShould be able to verify the signature.", success, testID)
+
+				if err := key.Verify(pub, []byte("transfer 900 toqns"), sig); !errors.Is(err, key.ErrInvalidSignature) {
+					t.Fatalf("\t%s\tTest %d:\tShould not verify altered data, but got: %v.", failed, testID, err)
+				}
+				t.Logf("\t%s\tTest %d:\tShould not verify altered data.", success, testID)
+
+				sig[10] ^= 0xff
+				if err := key.Verify(pub, data, sig); !errors.Is(err, key.ErrInvalidSignature) {
+					t.Fatalf("\t%s\tTest %d:\tShould not verify an altered signature, but got: %v.", failed, testID, err)
+				}
+				t.Logf("\t%s\tTest %d:\tShould not verify an altered signature.", success, testID)
+
+				a1, _ := k.Address(key.AccountAddress)
+				a2, _ := pub.Address(key.AccountAddress)
+				if a1 != a2 {
+					t.Fatalf("\t%s\tTest %d:\tShould derive the same address from the public key, got %s and %s.", failed, testID, a1, a2)
+				}
+				t.Logf("\t%s\tTest %d:\tShould derive the same address from the public key.", success, testID)
+
+				if pub.Algorithm() != alg {
+					t.Fatalf("\t%s\tTest %d:\tShould get algorithm %s from the public key, but got %s.", failed, testID, alg, pub.Algorithm())
+				}
+				t.Logf("\t%s\tTest %d:\tShould get algorithm %s from the public key.", success, testID, alg)
+
+				r, err := key.Restore(mustPrivateKeyString(t, k))
+				if err != nil || !r.PublicKey().Equal(k.PublicKey()) {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to restore the key: %v.", failed, testID, err)
+				}
+				t.Logf("\t%s\tTest %d:\tShould be able to restore the key.", success, testID)
+			})
+		}
+	}
+}
+
+func mustPrivateKeyString(t *testing.T, k key.Key) string {
+	t.Helper()
+
+	v, err := k.PrivateKeyString()
+	if err != nil {
+		t.Fatalf("private key string: %v", err)
+	}
+	return v
+}
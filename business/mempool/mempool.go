@@ -0,0 +1,457 @@
+// Package mempool holds pending transactions until they are included in a
+// block.
+//
+// Transactions are kept in a queue per sending account, ordered by nonce.
+// Blocks are filled with the transactions that are ready to be applied,
+// which are the transactions with consecutive nonces starting at the
+// account's nonce, in the order of their fees.
+package mempool
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/tx"
+)
+
+// Default limits of the mempool.
+const (
+	DefaultMaxTxs        = 10_000
+	DefaultMaxBytes      = 32 << 20
+	DefaultMaxAge        = 3 * time.Hour
+	DefaultMaxPerAccount = 64
+	DefaultPriceBump     = 10
+)
+
+var (
+	// ErrAlreadyKnown is returned for transactions that are already in the
+	// mempool.
+	ErrAlreadyKnown = errors.New("transaction already known")
+
+	// ErrNonceTooLow is returned for transactions with a nonce that has
+	// already been used.
+	ErrNonceTooLow = errors.New("nonce too low")
+
+	// ErrNonceTooHigh is returned for transactions with a nonce too far
+	// ahead of the account's nonce.
+	ErrNonceTooHigh = errors.New("nonce too high")
+
+	// ErrInsufficientFunds is returned when the balance of the sender
+	// doesn't cover the transaction and the sender's queued transactions.
+	ErrInsufficientFunds = errors.New("insufficient funds")
+
+	// ErrReplacementUnderpriced is returned when a transaction replaces a
+	// queued transaction without paying enough of a higher fee.
+	ErrReplacementUnderpriced = errors.New("replacement transaction underpriced")
+
+	// ErrFull is returned when the mempool is full of transactions with
+	// higher fees.
+	ErrFull = errors.New("mempool full")
+)
+
+// State provides the account state that transactions are validated
+// against.
+type State interface {
+	// Nonce returns the nonce of the next transaction of the account.
+	Nonce(key.Address) uint64
+
+	// Balance returns the balance of the account.
+	Balance(key.Address) uint64
+}
+
+// Config contains the configuration of a mempool. Zero values are replaced
+// by the defaults.
+type Config struct {
+	ChainID string
+
+	// MaxTxs is the maximum number of transactions.
+	MaxTxs int
+
+	// MaxBytes is the maximum total size of the encoded transactions.
+	MaxBytes int
+
+	// MaxAge is the time after which transactions expire.
+	MaxAge time.Duration
+
+	// MaxPerAccount is the maximum number of transactions per account,
+	// which also limits how far nonces can be ahead of the account's nonce.
+	MaxPerAccount int
+
+	// PriceBump is the minimum fee increase in percent for a transaction
+	// to replace a queued transaction with the same nonce.
+	PriceBump int
+}
+
+// entry is a transaction in the mempool.
+type entry struct {
+	tx    tx.SignedTx
+	hash  string
+	size  int
+	added time.Time
+}
+
+// Mempool holds pending transactions.
+type Mempool struct {
+	cfg   Config
+	state State
+
+	mu       sync.Mutex
+	accounts map[key.Address]map[uint64]*entry
+	byHash   map[string]*entry
+	bytes    int
+	now      func() time.Time
+}
+
+// New returns a mempool that validates transactions against the state.
+//
+// Without state, only stateless validation is performed and transactions
+// of an account are ready starting at their lowest nonce.
+func New(cfg Config, state State) *Mempool {
+	if cfg.MaxTxs == 0 {
+		cfg.MaxTxs = DefaultMaxTxs
+	}
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = DefaultMaxBytes
+	}
+	if cfg.MaxAge == 0 {
+		cfg.MaxAge = DefaultMaxAge
+	}
+	if cfg.MaxPerAccount == 0 {
+		cfg.MaxPerAccount = DefaultMaxPerAccount
+	}
+	if cfg.PriceBump == 0 {
+		cfg.PriceBump = DefaultPriceBump
+	}
+
+	return &Mempool{
+		cfg:      cfg,
+		state:    state,
+		accounts: make(map[key.Address]map[uint64]*entry),
+		byHash:   make(map[string]*entry),
+		now:      time.Now,
+	}
+}
+
+// Add validates the transaction and adds it to the mempool.
+//
+// A transaction with the same sender and nonce as a queued transaction
+// replaces it if its fee is at least PriceBump percent higher. When the
+// mempool is full, the transactions with the lowest fees are evicted.
+func (m *Mempool) Add(stx tx.SignedTx) error {
+	if err := stx.Validate(m.cfg.ChainID); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(stx)
+	if err != nil {
+		return fmt.Errorf("encoding transaction: %w", err)
+	}
+	e := entry{tx: stx, hash: stx.Hash(), size: len(b)}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e.added = m.now()
+
+	if _, ok := m.byHash[e.hash]; ok {
+		return ErrAlreadyKnown
+	}
+
+	queue := m.accounts[stx.From]
+	old := queue[stx.Nonce]
+
+	if m.state != nil {
+		next := m.state.Nonce(stx.From)
+		switch {
+		case stx.Nonce < next:
+			return fmt.Errorf("%w: got %d, next is %d", ErrNonceTooLow, stx.Nonce, next)
+		case stx.Nonce >= next+uint64(m.cfg.MaxPerAccount):
+			return fmt.Errorf("%w: got %d, next is %d", ErrNonceTooHigh, stx.Nonce, next)
+		}
+	}
+
+	if old == nil && len(queue) >= m.cfg.MaxPerAccount {
+		return fmt.Errorf("%w: %d transactions queued for %s", ErrNonceTooHigh, len(queue), stx.From)
+	}
+
+	if old != nil {
+		min := old.tx.Fee + (old.tx.Fee*uint64(m.cfg.PriceBump)+99)/100
+		if stx.Fee <= old.tx.Fee || stx.Fee < min {
+			return fmt.Errorf("%w: fee %d, need at least %d", ErrReplacementUnderpriced, stx.Fee, min)
+		}
+	}
+
+	if m.state != nil {
+		cost := stx.Cost()
+		for n, qe := range queue {
+			if n >= stx.Nonce {
+				continue
+			}
+
+			// A cost above the maximum is more than any balance.
+			if qe.tx.Cost() > math.MaxUint64-cost {
+				return fmt.Errorf("%w: cost of queued transactions overflows", ErrInsufficientFunds)
+			}
+			cost += qe.tx.Cost()
+		}
+		if balance := m.state.Balance(stx.From); cost > balance {
+			return fmt.Errorf("%w: balance %d, cost %d", ErrInsufficientFunds, balance, cost)
+		}
+	}
+
+	if old != nil {
+		m.remove(old)
+	}
+	m.insert(&e)
+
+	// A transaction that doesn't make it leaves the mempool as it was, with
+	// the transaction it replaces and the ones evicted for it.
+	evicted := m.evict()
+	if _, ok := m.byHash[e.hash]; !ok {
+		for _, ev := range evicted {
+			if ev != &e {
+				m.insert(ev)
+			}
+		}
+		if old != nil {
+			m.insert(old)
+		}
+		return ErrFull
+	}
+
+	return nil
+}
+
+// baseNonce returns the nonce of the next transaction of the account. The
+// lock must be held.
+func (m *Mempool) baseNonce(addr key.Address, queue map[uint64]*entry) uint64 {
+	if m.state != nil {
+		return m.state.Nonce(addr)
+	}
+
+	first := true
+	var base uint64
+	for n := range queue {
+		if first || n < base {
+			base, first = n, false
+		}
+	}
+	return base
+}
+
+// insert adds the entry. The lock must be held.
+func (m *Mempool) insert(e *entry) {
+	queue := m.accounts[e.tx.From]
+	if queue == nil {
+		queue = make(map[uint64]*entry)
+		m.accounts[e.tx.From] = queue
+	}
+
+	queue[e.tx.Nonce] = e
+	m.byHash[e.hash] = e
+	m.bytes += e.size
+}
+
+// remove removes the entry. The lock must be held.
+func (m *Mempool) remove(e *entry) {
+	queue := m.accounts[e.tx.From]
+	delete(queue, e.tx.Nonce)
+	if len(queue) == 0 {
+		delete(m.accounts, e.tx.From)
+	}
+
+	delete(m.byHash, e.hash)
+	m.bytes -= e.size
+}
+
+// evict removes transactions with the lowest fees until the mempool is
+// within its limits, and returns them. Only the transaction with the
+// highest nonce of an account is evicted, so no nonce gaps are created. The
+// lock must be held.
+func (m *Mempool) evict() []*entry {
+	var evicted []*entry
+	for len(m.byHash) > m.cfg.MaxTxs || m.bytes > m.cfg.MaxBytes {
+		var lowest *entry
+		for _, queue := range m.accounts {
+			last := lastEntry(queue)
+			if lowest == nil || last.tx.Fee < lowest.tx.Fee {
+				lowest = last
+			}
+		}
+		m.remove(lowest)
+		evicted = append(evicted, lowest)
+	}
+	return evicted
+}
+
+// lastEntry returns the entry with the highest nonce.
+func lastEntry(queue map[uint64]*entry) *entry {
+	var last *entry
+	for _, e := range queue {
+		if last == nil || e.tx.Nonce > last.tx.Nonce {
+			last = e
+		}
+	}
+	return last
+}
+
+// Revalidate removes the transactions that are no longer valid against
+// the state, such as after a new block has been applied, and the
+// transactions that have expired.
+//
+// Transactions with a nonce that has been used are removed, as are
+// transactions the sender's balance no longer covers, together with the
+// transactions that follow them.
+func (m *Mempool) Revalidate() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expired := m.now().Add(-m.cfg.MaxAge)
+	for addr, queue := range m.accounts {
+		entries := sortedEntries(queue)
+
+		var nonce, balance, cost uint64
+		if m.state != nil {
+			nonce, balance = m.state.Nonce(addr), m.state.Balance(addr)
+		}
+
+		invalid := false
+		for _, e := range entries {
+			// Transactions after an expired transaction stay queued, as the
+			// nonce can be used by a new transaction.
+			if e.added.Before(expired) {
+				m.remove(e)
+				continue
+			}
+
+			if m.state == nil {
+				continue
+			}
+
+			if invalid || e.tx.Nonce < nonce {
+				m.remove(e)
+				continue
+			}
+
+			if e.tx.Cost() > math.MaxUint64-cost {
+				invalid = true
+				m.remove(e)
+				continue
+			}
+
+			cost += e.tx.Cost()
+			if cost > balance {
+				invalid = true
+				m.remove(e)
+			}
+		}
+	}
+}
+
+// sortedEntries returns the entries in the order of their nonces.
+func sortedEntries(queue map[uint64]*entry) []*entry {
+	entries := make([]*entry, 0, len(queue))
+	for _, e := range queue {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tx.Nonce < entries[j].tx.Nonce })
+	return entries
+}
+
+// Pick returns up to max transactions that are ready to be included in a
+// block, in the order to apply them.
+//
+// Transactions with higher fees are picked first, while the transactions
+// of an account are picked in the order of their nonces.
+func (m *Mempool) Pick(max int) []tx.SignedTx {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var h feeHeap
+	queues := make(map[key.Address][]*entry)
+	for addr, queue := range m.accounts {
+		entries := readyEntries(sortedEntries(queue), m.baseNonce(addr, queue))
+		if len(entries) == 0 {
+			continue
+		}
+		queues[addr] = entries[1:]
+		h = append(h, entries[0])
+	}
+	heap.Init(&h)
+
+	var txs []tx.SignedTx
+	for h.Len() > 0 && len(txs) < max {
+		e := heap.Pop(&h).(*entry)
+		txs = append(txs, e.tx)
+
+		if rest := queues[e.tx.From]; len(rest) > 0 {
+			queues[e.tx.From] = rest[1:]
+			heap.Push(&h, rest[0])
+		}
+	}
+
+	return txs
+}
+
+// readyEntries returns the entries with consecutive nonces starting at
+// the nonce.
+func readyEntries(entries []*entry, nonce uint64) []*entry {
+	for i, e := range entries {
+		if e.tx.Nonce != nonce+uint64(i) {
+			return entries[:i]
+		}
+	}
+	return entries
+}
+
+// Get returns the transaction with the hash.
+func (m *Mempool) Get(hash string) (tx.SignedTx, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.byHash[hash]
+	if !ok {
+		return tx.SignedTx{}, false
+	}
+	return e.tx, true
+}
+
+// Count returns the number of transactions.
+func (m *Mempool) Count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.byHash)
+}
+
+// =============================================================================
+
+// feeHeap orders entries by descending fee, and by age for equal fees.
+type feeHeap []*entry
+
+func (h feeHeap) Len() int { return len(h) }
+
+func (h feeHeap) Less(i, j int) bool {
+	if h[i].tx.Fee != h[j].tx.Fee {
+		return h[i].tx.Fee > h[j].tx.Fee
+	}
+	return h[i].added.Before(h[j].added)
+}
+
+func (h feeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *feeHeap) Push(x any) { *h = append(*h, x.(*entry)) }
+
+func (h *feeHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,206 @@
+package mempool_test
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/mempool"
+	"github.com/toqns/toqns/business/tx"
+)
+
+// Success and failure markers.
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+// state is a fixed account state.
+type state struct {
+	nonces   map[key.Address]uint64
+	balances map[key.Address]uint64
+}
+
+func (s state) Nonce(a key.Address) uint64   { return s.nonces[a] }
+func (s state) Balance(a key.Address) uint64 { return s.balances[a] }
+
+// account is a test account.
+type account struct {
+	key  key.Key
+	addr key.Address
+}
+
+func newAccount(t *testing.T) account {
+	k, err := key.New()
+	if err != nil {
+		t.Fatalf("creating key: %v", err)
+	}
+	addr, _ := k.Address(key.AccountAddress)
+	return account{key: k, addr: addr}
+}
+
+func (a account) tx(t *testing.T, nonce, fee uint64) tx.SignedTx {
+	stx, err := tx.Tx{ChainID: "testnet", Nonce: nonce, From: a.addr, To: a.addr, Amount: 10, Fee: fee}.Sign(a.key)
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+	return stx
+}
+
+func TestMempool(t *testing.T) {
+	t.Log("Given the need to hold pending transactions.")
+	{
+		a, b := newAccount(t), newAccount(t)
+		st := state{
+			nonces:   map[key.Address]uint64{a.addr: 5},
+			balances: map[key.Address]uint64{a.addr: 1000, b.addr: 25},
+		}
+
+		testID := 0
+		t.Logf("\tTest %d:\tWhen picking transactions for a block.", testID)
+		{
+			mp := mempool.New(mempool.Config{ChainID: "testnet"}, st)
+
+			for _, stx := range []tx.SignedTx{a.tx(t, 6, 9), a.tx(t, 5, 1), b.tx(t, 0, 5), a.tx(t, 8, 100)} {
+				if err := mp.Add(stx); err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to add the transaction: %v.", failed, testID, err)
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to add the transactions.", success, testID)
+
+			txs := mp.Pick(10)
+			var got []uint64
+			for _, stx := range txs {
+				got = append(got, stx.Fee)
+			}
+			if len(got) != 3 || got[0] != 5 || got[1] != 1 || got[2] != 9 {
+				t.Fatalf("\t%s\tTest %d:\tShould pick by fee in nonce order without the nonce gap, but got fees %v.", failed, testID, got)
+			}
+			t.Logf("\t%s\tTest %d:\tShould pick by fee in nonce order without the nonce gap.", success, testID)
+
+			tt := []struct {
+				stx tx.SignedTx
+				err error
+			}{
+				{a.tx(t, 6, 9), mempool.ErrAlreadyKnown},
+				{a.tx(t, 4, 1), mempool.ErrNonceTooLow},
+				{a.tx(t, 5+mempool.DefaultMaxPerAccount, 1), mempool.ErrNonceTooHigh},
+				{b.tx(t, 1, 5), mempool.ErrInsufficientFunds},
+				{a.tx(t, 8, 105), mempool.ErrReplacementUnderpriced},
+				{a.tx(t, 8, 110), nil},
+			}
+			for _, tc := range tt {
+				if err := mp.Add(tc.stx); !errors.Is(err, tc.err) {
+					t.Fatalf("\t%s\tTest %d:\tShould get error %v for nonce %d, but got: %v.", failed, testID, tc.err, tc.stx.Nonce, err)
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould validate nonces, funds and replacements.", success, testID)
+
+			if mp.Count() != 4 {
+				t.Fatalf("\t%s\tTest %d:\tShould have replaced the transaction, but got %d transactions.", failed, testID, mp.Count())
+			}
+			t.Logf("\t%s\tTest %d:\tShould have replaced the transaction.", success, testID)
+
+			st.nonces[a.addr] = 7
+			mp.Revalidate()
+			if mp.Count() != 2 {
+				t.Fatalf("\t%s\tTest %d:\tShould have removed the applied transactions, but got %d transactions.", failed, testID, mp.Count())
+			}
+			t.Logf("\t%s\tTest %d:\tShould have removed the applied transactions.", success, testID)
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen the mempool is full.", testID)
+		{
+			mp := mempool.New(mempool.Config{ChainID: "testnet", MaxTxs: 2}, st)
+
+			mp.Add(b.tx(t, 0, 5))
+			mp.Add(a.tx(t, 7, 1))
+			if err := mp.Add(a.tx(t, 8, 50)); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to add by evicting a lower fee: %v.", failed, testID, err)
+			}
+			if _, ok := mp.Get(b.tx(t, 0, 5).Hash()); ok {
+				t.Fatalf("\t%s\tTest %d:\tShould have evicted the lowest fee.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould have evicted the lowest fee.", success, testID)
+
+			if err := mp.Add(b.tx(t, 0, 0)); !errors.Is(err, mempool.ErrFull) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrFull, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrFull.", success, testID)
+		}
+
+		testID = 4
+		t.Logf("\tTest %d:\tWhen a replacement doesn't fit in the mempool.", testID)
+		{
+			old, other := a.tx(t, 7, 1), b.tx(t, 0, 5)
+			var size int
+			for _, stx := range []tx.SignedTx{old, other} {
+				b, _ := json.Marshal(stx)
+				size += len(b)
+			}
+			mp := mempool.New(mempool.Config{ChainID: "testnet", MaxBytes: size + 10}, st)
+
+			mp.Add(old)
+			mp.Add(other)
+
+			large, _ := tx.Tx{ChainID: "testnet", Nonce: 7, From: a.addr, To: a.addr, Amount: 10, Fee: 2, Memo: strings.Repeat("x", 200)}.Sign(a.key)
+			if err := mp.Add(large); !errors.Is(err, mempool.ErrFull) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrFull, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrFull.", success, testID)
+
+			for _, stx := range []tx.SignedTx{old, other} {
+				if _, ok := mp.Get(stx.Hash()); !ok {
+					t.Fatalf("\t%s\tTest %d:\tShould keep the transaction with nonce %d of %s.", failed, testID, stx.Nonce, stx.From)
+				}
+			}
+			if mp.Count() != 2 {
+				t.Fatalf("\t%s\tTest %d:\tShould keep 2 transactions, but got %d.", failed, testID, mp.Count())
+			}
+			t.Logf("\t%s\tTest %d:\tShould keep the transaction it would replace.", success, testID)
+		}
+
+		testID = 2
+		t.Logf("\tTest %d:\tWhen transactions expire.", testID)
+		{
+			mp := mempool.New(mempool.Config{ChainID: "testnet", MaxAge: time.Nanosecond}, st)
+
+			mp.Add(b.tx(t, 0, 5))
+			time.Sleep(time.Millisecond)
+			mp.Revalidate()
+			if mp.Count() != 0 {
+				t.Fatalf("\t%s\tTest %d:\tShould have removed the expired transaction.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould have removed the expired transaction.", success, testID)
+		}
+
+		testID = 3
+		t.Logf("\tTest %d:\tWhen the cost of queued transactions overflows.", testID)
+		{
+			c := newAccount(t)
+			st := state{balances: map[key.Address]uint64{c.addr: math.MaxUint64}}
+			mp := mempool.New(mempool.Config{ChainID: "testnet"}, st)
+
+			large := func(nonce uint64) tx.SignedTx {
+				stx, err := tx.Tx{ChainID: "testnet", Nonce: nonce, From: c.addr, To: c.addr, Amount: math.MaxUint64 - 10, Fee: 5}.Sign(c.key)
+				if err != nil {
+					t.Fatalf("signing: %v", err)
+				}
+				return stx
+			}
+
+			if err := mp.Add(large(0)); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to add a transaction within the balance: %v.", failed, testID, err)
+			}
+			if err := mp.Add(large(1)); !errors.Is(err, mempool.ErrInsufficientFunds) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInsufficientFunds, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrInsufficientFunds.", success, testID)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/consensus"
+	"github.com/toqns/toqns/business/consensus/bft"
+	"github.com/toqns/toqns/business/consensus/poa"
+	"github.com/toqns/toqns/business/genesis"
+	"github.com/toqns/toqns/foundation/p2p"
+)
+
+// ConsensusPath is the path to gossip consensus messages.
+const ConsensusPath = "consensus/message"
+
+// newEngine returns the consensus engine of the genesis.
+func newEngine(cfg consensus.Config) (consensus.Engine, error) {
+	switch cfg.Genesis.Consensus.Engine {
+	case genesis.EnginePoA:
+		return poa.New(cfg)
+	case genesis.EngineBFT:
+		return bft.New(cfg)
+	}
+	return nil, fmt.Errorf("unknown consensus engine %q", cfg.Genesis.Consensus.Engine)
+}
+
+// serveConsensus passes a consensus message to the engine and forwards it
+// to the other peers. Messages are rejected while the node syncs, or if it
+// has no genesis.
+func (n *Node) serveConsensus(w p2p.ResponseWriter, r *p2p.Request) error {
+	var m consensus.Message
+	if err := json.Unmarshal(r.Payload, &m); err != nil {
+		return p2p.NewError(p2p.StatusBadRequest, fmt.Sprintf("decoding message: %v", err))
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if n.engine == nil {
+		return p2p.NewError(p2p.StatusBusy, "consensus isn't running")
+	}
+
+	if err := n.engine.Receive(m); err != nil {
+		switch {
+		case errors.Is(err, consensus.ErrKnown):
+			return p2p.NewError(p2p.StatusConflict, err.Error())
+		case errors.Is(err, consensus.ErrUnknownParent):
+			return p2p.NewError(p2p.StatusNotFound, err.Error())
+		case errors.Is(err, consensus.ErrInvalidMessage), errors.Is(err, chain.ErrInvalidBlock):
+			return p2p.NewError(p2p.StatusBadRequest, err.Error())
+		default:
+			return err
+		}
+	}
+
+	n.gossipConsensus(m, r.From.ID)
+
+	return nil
+}
+
+// gossipConsensus sends the message to all peers, except the peer with
+// the provided ID.
+func (n *Node) gossipConsensus(m consensus.Message, except string) {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		n.log.Errorw("consensus", "status", "encoding message failed", "ERROR", err)
+		return
+	}
+
+	n.gossip("consensus", ConsensusPath, payload, except)
+}
@@ -0,0 +1,15 @@
+package node
+
+import (
+	"context"
+
+	"github.com/toqns/toqns/business/chain"
+)
+
+// Exports for the tests.
+var TxError = txError
+
+// Blocks requests blocks of the peer's chain in the range, as the sync does.
+func (n *Node) Blocks(ctx context.Context, id string, from, to uint64) ([]chain.Block, error) {
+	return peerNetwork{n}.Blocks(ctx, id, from, to)
+}
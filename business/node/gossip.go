@@ -0,0 +1,141 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toqns/toqns/foundation/address"
+	"github.com/toqns/toqns/foundation/p2p"
+)
+
+// Limits of the gossip of messages to peers.
+const (
+	// gossipQueueSize is the number of messages waiting to be gossiped.
+	// Messages are dropped when the queue is full, peers get them from
+	// other peers or by syncing.
+	gossipQueueSize = 256
+
+	// gossipWorkers is the number of messages gossiped at the same time.
+	gossipWorkers = 4
+
+	// gossipPeers is the number of peers a message is sent to at the same
+	// time.
+	gossipPeers = 8
+
+	// gossipTimeout is the time to wait for a peer to accept a message.
+	gossipTimeout = 5 * time.Second
+)
+
+// gossipMessage is a message to send to the peers.
+type gossipMessage struct {
+	topic   string
+	path    string
+	payload []byte
+	except  []string
+}
+
+// gossip queues the payload to be sent to the path of all peers, except
+// the peers with the provided IDs. The topic names the message in logs.
+func (n *Node) gossip(topic, path string, payload []byte, except ...string) {
+	select {
+	case n.gossipQueue <- gossipMessage{topic: topic, path: path, payload: payload, except: except}:
+	default:
+		n.log.Debugw(topic, "status", "gossip queue full, message dropped", "path", path)
+	}
+}
+
+// runGossip starts the workers that send the queued messages to the peers
+// until the node is shut down.
+func (n *Node) runGossip() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	n.wg.Add(gossipWorkers + 1)
+	go func() {
+		defer n.wg.Done()
+		<-n.stop
+		cancel()
+	}()
+
+	for i := 0; i < gossipWorkers; i++ {
+		go func() {
+			defer n.wg.Done()
+
+			for {
+				select {
+				case <-n.stop:
+					return
+				case m := <-n.gossipQueue:
+					n.sendGossip(ctx, m)
+				}
+			}
+		}()
+	}
+}
+
+// sendGossip sends the message to the peers, to at most gossipPeers at
+// the same time, and returns when all sends are done.
+func (n *Node) sendGossip(ctx context.Context, m gossipMessage) {
+	sem := make(chan struct{}, gossipPeers)
+	var wg sync.WaitGroup
+
+	for _, p := range n.Peers() {
+		if contains(m.except, p.Address.ID) {
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(p p2p.Peer) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			ctx, cancel := context.WithTimeout(ctx, gossipTimeout)
+			_, err := n.Send(ctx, p.Address, m.path, m.payload)
+
+			// Messages that don't fit in a datagram, such as the commits
+			// of blocks with many validators, are sent over TCP.
+			if errors.Is(err, p2p.ErrTooLarge) {
+				_, err = n.sendTCP(ctx, p, m.path, m.payload)
+			}
+			cancel()
+
+			// Peers that already know the message stop the gossip.
+			if err != nil && !errors.Is(err, p2p.ErrConflict) {
+				n.log.Debugw(m.topic, "status", "gossip failed", "path", m.path, "peer", p.Address.String(), "ERROR", err)
+			}
+		}(p)
+	}
+
+	wg.Wait()
+}
+
+// sendTCP sends the request to a TCP address the peer listens on, for
+// messages that don't fit in a datagram. It fails if the node doesn't
+// listen on TCP itself.
+func (n *Node) sendTCP(ctx context.Context, p p2p.Peer, path string, payload []byte) (*p2p.Response, error) {
+	for _, s := range p.Handshake.ListenAddrs {
+		a, err := address.Parse(s)
+		if err != nil || !strings.EqualFold(a.Proto, "tcp") {
+			continue
+		}
+		return n.Send(ctx, a, path, payload)
+	}
+
+	return nil, fmt.Errorf("peer doesn't listen on tcp: %w", p2p.ErrTooLarge)
+}
+
+// contains reports whether the ID is in the list.
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package node
+
+import (
+	"fmt"
+
+	"github.com/toqns/toqns/business/key"
+)
+
+// identityPrefix separates the signatures of handshakes from signatures of
+// other messages with the node key.
+const identityPrefix = "toqns/handshake:"
+
+// identity proves the node's ID to peers during handshakes with the node
+// key. It implements the p2p.Identity interface.
+type identity struct {
+	signer key.Signer
+}
+
+// Sign implements the p2p.Identity interface.
+func (i identity) Sign(data []byte) ([]byte, []byte, error) {
+	sig, err := i.signer.Sign(append([]byte(identityPrefix), data...))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return i.signer.PublicKey().Bytes(), sig, nil
+}
+
+// Verify implements the p2p.Identity interface. The ID must be the node
+// address of the public key.
+func (identity) Verify(id string, publicKey, data, signature []byte) error {
+	pub, err := key.ParsePublicKeyBytes(publicKey)
+	if err != nil {
+		return fmt.Errorf("parsing public key: %w", err)
+	}
+
+	addr, err := pub.Address(key.NodeAddress)
+	if err != nil {
+		return fmt.Errorf("getting node ID: %w", err)
+	}
+	if string(addr) != id {
+		return fmt.Errorf("public key of %s, expected %s", addr, id)
+	}
+
+	return pub.Verify(append([]byte(identityPrefix), data...), signature)
+}
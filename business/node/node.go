@@ -2,39 +2,175 @@
 package node
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/consensus"
+	"github.com/toqns/toqns/business/genesis"
 	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/mempool"
+	"github.com/toqns/toqns/business/signer"
+	"github.com/toqns/toqns/business/snapshot"
+	"github.com/toqns/toqns/business/state"
 	"github.com/toqns/toqns/foundation/address"
 	"github.com/toqns/toqns/foundation/p2p"
 	"go.uber.org/zap"
 )
 
+// handshakeTimeout is the time to wait for a peer's handshake.
+const handshakeTimeout = 5 * time.Second
+
+// revalidateInterval is the interval to remove expired and invalid
+// transactions from the mempool.
+const revalidateInterval = time.Minute
+
 // NodeConfig contains configuration details for nodes.
 type NodeConfig struct {
+	Version     string
+	ChainID     string
 	Address     string
 	Port        int
 	Protocol    string
 	NodeKeyFile string
+
+	// NodeKeyPassphrase is the passphrase of an encrypted node key file.
+	NodeKeyPassphrase []byte
+
+	// ListenAddrs are additional addresses to listen on in the format
+	// ip/port/protocol.
+	ListenAddrs []string
+
+	// AnnounceAddrs are the addresses to advertise to peers in the format
+	// ip/port/protocol. When empty, the listen addresses are advertised.
+	AnnounceAddrs []string
+
+	// Seeds are the addresses of bootstrap nodes in the format
+	// id@host/port/protocol, or as multiaddr.
+	Seeds []string
+
+	// DNSSeeds are DNS names whose records list bootstrap nodes.
+	DNSSeeds []string
+
+	// SignerAddress is the address of a remote signer that holds the node
+	// key, as unix:///path/to/socket or tcp://host:port. When set, the
+	// node key file isn't used.
+	SignerAddress string
+
+	// SignerCertFile, SignerKeyFile and SignerCAFile are the certificate
+	// the node authenticates with to a remote signer over TCP, its key and
+	// the CA certificate that signs the signer's certificate.
+	SignerCertFile string
+	SignerKeyFile  string
+	SignerCAFile   string
+
+	// NodeKeyRotationFile is the rotation statement that hands over the
+	// node's previous ID to the node key. The statement is announced to
+	// peers during bootstrap. It's ignored if the file doesn't exist.
+	NodeKeyRotationFile string
+
+	// DataDir is the directory where the node stores the chain data.
+	DataDir string
+
+	// GenesisFile is the genesis file of the network. The node refuses to
+	// start when the stored chain doesn't start with the genesis.
+	GenesisFile string
+
+	// SnapshotEpochs is the number of epochs between snapshots of the
+	// state, which are taken at the end of an epoch. Zero disables them.
+	SnapshotEpochs uint64
+
+	// SnapshotKeep is the number of snapshots to keep.
+	SnapshotKeep int
+
+	// TrustedHeight and TrustedHash are the height and hash of a block
+	// that peers have a snapshot of. A node without blocks after the
+	// genesis block restores the snapshot and syncs the blocks after it,
+	// instead of all blocks. The height must be the end of an epoch.
+	TrustedHeight uint64
+	TrustedHash   string
 }
 
 // Node repersents a node on the Toqns network.
 type Node struct {
 	*p2p.Node
-	log *zap.SugaredLogger
+	log      *zap.SugaredLogger
+	seeds    []address.Address
+	dnsSeeds []string
+	rotation *key.Rotation
+	signer   key.Signer
+	remote   *signer.Remote
+	state    *state.State
+	chain    *chain.Store
+	genesis  *genesis.Genesis
+	mempool  *mempool.Mempool
+	stop     chan struct{}
+	wg       sync.WaitGroup
+
+	// gossipQueue holds the messages to gossip to the peers.
+	gossipQueue chan gossipMessage
+
+	// consensusDir is the data directory of the consensus engine.
+	consensusDir string
+
+	// snapshots are taken every snapshotInterval blocks, if it isn't
+	// zero, and restored at the trusted height.
+	snapshots        *snapshot.Store
+	snapshotInterval uint64
+	pendingSnapshots chan pendingSnapshot
+	trustedHeight    uint64
+	trustedHash      string
+
+	// mu guards the engine, which runs once the node is synced.
+	mu     sync.RWMutex
+	engine consensus.Engine
 }
 
 // New returns an initialized Node based on the provided configuration.
 func New(log *zap.SugaredLogger, cfg NodeConfig) (*Node, error) {
-	k, err := key.RestoreFromFile(cfg.NodeKeyFile)
+	if cfg.SignerAddress == "" {
+		k, err := loadOrCreateKey(log, cfg.NodeKeyFile, cfg.NodeKeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		return newNode(log, cfg, k)
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.SignerCertFile != "" {
+		var err error
+		if tlsConfig, err = signer.ClientTLSConfig(cfg.SignerCertFile, cfg.SignerKeyFile, cfg.SignerCAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	r, err := signer.Dial(cfg.SignerAddress, tlsConfig)
 	if err != nil {
-		// TODO: Create key if not exists.
-		return nil, fmt.Errorf("reading node key: %w", err)
+		return nil, err
 	}
 
+	n, err := newNode(log, cfg, r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	n.remote = r
+
+	return n, nil
+}
+
+// newNode returns a Node that signs with the signer.
+func newNode(log *zap.SugaredLogger, cfg NodeConfig, k key.Signer) (*Node, error) {
 	// Node IDs are the key addresses.
-	id, err := k.Address(key.NodeAddress)
+	id, err := k.PublicKey().Address(key.NodeAddress)
 	if err != nil {
 		return nil, fmt.Errorf("getting node ID: %w", err)
 	}
@@ -44,12 +180,72 @@ func New(log *zap.SugaredLogger, cfg NodeConfig) (*Node, error) {
 		return nil, fmt.Errorf("parsing address: %w", err)
 	}
 
-	return &Node{
+	listenAddrs, err := parseAddrs(id, cfg.ListenAddrs)
+	if err != nil {
+		return nil, fmt.Errorf("parsing listen addresses: %w", err)
+	}
+	if len(listenAddrs) > 0 {
+		listenAddrs = append([]address.Address{addr}, listenAddrs...)
+	}
+
+	announceAddrs, err := parseAddrs(id, cfg.AnnounceAddrs)
+	if err != nil {
+		return nil, fmt.Errorf("parsing announce addresses: %w", err)
+	}
+
+	rotation, err := loadRotation(cfg.NodeKeyRotationFile, id)
+	if err != nil {
+		return nil, fmt.Errorf("reading node key rotation: %w", err)
+	}
+
+	var seeds []address.Address
+	for _, v := range cfg.Seeds {
+		a, err := key.ParseNodeAddress(v)
+		if err != nil {
+			return nil, fmt.Errorf("parsing seed %s: %w", v, err)
+		}
+		seeds = append(seeds, a)
+	}
+
+	storage, err := state.OpenFileStorage(filepath.Join(cfg.DataDir, "state"))
+	if err != nil {
+		return nil, fmt.Errorf("opening state: %w", err)
+	}
+
+	st, err := state.New(cfg.ChainID, storage)
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	store, err := chain.Open(filepath.Join(cfg.DataDir, "chain"))
+	if err != nil {
+		st.Close()
+		return nil, fmt.Errorf("opening chain: %w", err)
+	}
+
+	g, genesisHash, err := initGenesis(cfg, st, store)
+	if err != nil {
+		store.Close()
+		st.Close()
+		return nil, err
+	}
+
+	mux := p2p.NewServeMux()
+
+	n := Node{
 		Node: &p2p.Node{
-			Address: addr,
-			Decoder: p2p.RequestDecoderFunc(json.Unmarshal),
-			Encoder: p2p.RequestEncoderFunc(json.Marshal),
-			Handler: p2p.HandleFunc(tmpHandler),
+			Address:       addr,
+			ListenAddrs:   listenAddrs,
+			AnnounceAddrs: announceAddrs,
+			Decoder:       p2p.RequestDecoderFunc(json.Unmarshal),
+			Encoder:       p2p.RequestEncoderFunc(json.Marshal),
+			Handler:       mux,
+			Version:       cfg.Version,
+			NetworkID:     cfg.ChainID,
+			GenesisHash:   genesisHash,
+			Encodings:     []string{"json"},
+			Identity:      identity{signer: k},
 			Log: func(l p2p.LogLevel, msg string, kv ...any) {
 				kv = append(kv, "message", msg)
 				switch l {
@@ -64,12 +260,315 @@ func New(log *zap.SugaredLogger, cfg NodeConfig) (*Node, error) {
 				}
 			},
 		},
-		log: log,
-	}, nil
+		log:      log,
+		seeds:    seeds,
+		dnsSeeds: cfg.DNSSeeds,
+		rotation: rotation,
+		signer:   k,
+		state:    st,
+		chain:    store,
+		genesis:  g,
+		mempool:  mempool.New(mempool.Config{ChainID: cfg.ChainID}, st),
+		stop:     make(chan struct{}),
+
+		gossipQueue: make(chan gossipMessage, gossipQueueSize),
+
+		consensusDir: filepath.Join(cfg.DataDir, "consensus"),
+
+		trustedHeight: cfg.TrustedHeight,
+		trustedHash:   cfg.TrustedHash,
+	}
+
+	// Revoked IDs of rotated node keys stay revoked after a restart.
+	if err := n.LoadRevoked(filepath.Join(cfg.DataDir, "revoked.json")); err != nil {
+		store.Close()
+		st.Close()
+		return nil, err
+	}
+
+	if g != nil {
+		if err := n.initSnapshots(cfg, *g); err != nil {
+			store.Close()
+			st.Close()
+			return nil, err
+		}
+
+		// Blocks that were stored before the node stopped are applied, so
+		// the state matches the chain to sync on top of.
+		if err := consensus.Replay(st, store, g.Consensus); err != nil {
+			store.Close()
+			st.Close()
+			return nil, err
+		}
+
+		if n.snapshotInterval > 0 {
+			n.pendingSnapshots = make(chan pendingSnapshot, 1)
+			st.OnCommit(n.takeSnapshot)
+
+			n.wg.Add(1)
+			go n.writeSnapshots()
+		}
+	}
+
+	mux.HandleFunc(RotationPath, n.serveRotation)
+	mux.HandleFunc(TxSubmitPath, n.serveTxSubmit)
+	mux.HandleFunc(ConsensusPath, n.serveConsensus)
+	mux.HandleFunc(ChainStatusPath, n.serveChainStatus)
+	mux.HandleFunc(ChainBlocksPath, n.serveChainBlocks)
+	mux.HandleFunc(SnapshotManifestPath, n.serveSnapshotManifest)
+	mux.HandleFunc(SnapshotChunkPath, n.serveSnapshotChunk)
+
+	return &n, nil
+}
+
+// Signer returns the signer of the node key.
+func (n *Node) Signer() key.Signer {
+	return n.signer
+}
+
+// State returns the account state of the node.
+func (n *Node) State() *state.State {
+	return n.state
+}
+
+// Chain returns the block store of the node.
+func (n *Node) Chain() *chain.Store {
+	return n.chain
+}
+
+// Mempool returns the pending transactions of the node.
+func (n *Node) Mempool() *mempool.Mempool {
+	return n.mempool
 }
 
-// TODO: Handlers should probably not return an error.
-func tmpHandler(w p2p.ResponseWriter, r *p2p.Request) error {
-	fmt.Println("request received!")
+// ListenAndServe starts listening and serving requests, and starts the
+// gossip to peers and the periodic revalidation of the mempool. The
+// consensus engine is started by Sync.
+func (n *Node) ListenAndServe() error {
+	if err := n.Node.ListenAndServe(); err != nil {
+		return err
+	}
+
+	n.runGossip()
+	go n.revalidate()
+
 	return nil
 }
+
+// Shutdown gracefully stops the node. Calling it again has no effect.
+func (n *Node) Shutdown(ctx context.Context) error {
+	// The stop is guarded by the lock, so a sync that starts in the
+	// meantime is either waited for or doesn't start.
+	n.mu.Lock()
+	select {
+	case <-n.stop:
+		n.mu.Unlock()
+		return nil
+	default:
+	}
+	close(n.stop)
+	n.mu.Unlock()
+
+	n.stopEngine()
+	n.wg.Wait()
+
+	err := n.Node.Shutdown(ctx)
+
+	if cerr := n.chain.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if cerr := n.state.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if n.remote != nil {
+		if cerr := n.remote.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// revalidate periodically removes expired and invalid transactions from
+// the mempool until the node is shut down.
+func (n *Node) revalidate() {
+	t := time.NewTicker(revalidateInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-t.C:
+			n.mempool.Revalidate()
+		}
+	}
+}
+
+// Bootstrap performs a handshake with the configured seeds and the nodes
+// listed by the DNS seeds. Failures are logged and don't stop the
+// bootstrap.
+func (n *Node) Bootstrap(ctx context.Context) {
+	seeds := n.seeds
+	for _, name := range n.dnsSeeds {
+		addrs, err := address.LookupSeeds(ctx, n.Resolver, name, n.Address.Port, n.Address.Proto)
+		switch {
+		case len(addrs) > 0 && err != nil:
+			n.log.Warnw("bootstrap", "status", "skipped invalid dns seed addresses", "seed", name, "ERROR", err)
+		case err != nil:
+			n.log.Warnw("bootstrap", "status", "looking up dns seed failed", "seed", name, "ERROR", err)
+			continue
+		}
+		seeds = append(seeds, addrs...)
+	}
+
+	for _, a := range seeds {
+		if a.ID == n.Address.ID {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+		p, err := n.Handshake(ctx, a)
+		cancel()
+		if err != nil {
+			n.log.Warnw("bootstrap", "status", "handshake failed", "seed", a.String(), "ERROR", err)
+			continue
+		}
+		n.log.Infow("bootstrap", "status", "peer added", "peer", p.Address.String(), "version", p.Handshake.Version)
+	}
+
+	if n.rotation != nil {
+		n.announceRotation(*n.rotation, "")
+	}
+}
+
+// parseAddrs parses addresses in the format ip/port/protocol into
+// addresses with the provided ID.
+func parseAddrs(id key.Address, addrs []string) ([]address.Address, error) {
+	var as []address.Address
+	for _, v := range addrs {
+		if v == "" {
+			continue
+		}
+
+		a, err := address.Parse(fmt.Sprintf("%s@%s", id, v))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", v, err)
+		}
+		as = append(as, a)
+	}
+
+	return as, nil
+}
+
+// loadOrCreateKey reads the node key file, or creates a new node key if
+// the file doesn't exist. New keys are encrypted if a passphrase is
+// provided.
+func loadOrCreateKey(log *zap.SugaredLogger, name string, passphrase []byte) (key.Key, error) {
+	k, err := key.Load(name, passphrase)
+	switch {
+	case err == nil:
+		return k, nil
+	case !errors.Is(err, fs.ErrNotExist):
+		return key.Key{}, fmt.Errorf("reading node key: %w", err)
+	}
+
+	if k, err = key.New(); err != nil {
+		return key.Key{}, fmt.Errorf("creating node key: %w", err)
+	}
+
+	if len(passphrase) > 0 {
+		err = k.SaveEncrypted(name, passphrase, key.NodeAddress)
+	} else {
+		err = k.Save(name)
+	}
+	if err != nil {
+		return key.Key{}, fmt.Errorf("storing node key: %w", err)
+	}
+
+	id, _ := k.Address(key.NodeAddress)
+	addr, _ := id.Checksummed()
+	log.Infow("startup", "status", "node key created", "file", name, "encrypted", len(passphrase) > 0, "id", id, "address", addr)
+
+	return k, nil
+}
+
+// initGenesis initializes the chain with the genesis file, or checks that
+// the stored chain starts with it. It returns the genesis, if configured,
+// and the hash of the genesis block.
+func initGenesis(cfg NodeConfig, st *state.State, store *chain.Store) (*genesis.Genesis, string, error) {
+	if cfg.GenesisFile == "" {
+		b, err := store.ByHeight(0)
+		switch {
+		case errors.Is(err, chain.ErrNotFound):
+			return nil, "", nil
+		case err != nil:
+			return nil, "", fmt.Errorf("reading genesis block: %w", err)
+		}
+		return nil, b.Hash(), nil
+	}
+
+	g, err := genesis.Load(cfg.GenesisFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading genesis: %w", err)
+	}
+
+	if g.ChainID != cfg.ChainID {
+		return nil, "", fmt.Errorf("genesis is for chain %q, but chain id is %q", g.ChainID, cfg.ChainID)
+	}
+
+	b, err := genesis.Init(g, st, store)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &g, b.Hash(), nil
+}
+
+// initSnapshots opens the snapshot store and checks the snapshot settings
+// against the genesis. Snapshots are taken at the end of epochs, so the
+// validator set of the blocks after them is known. The state is restored
+// if the node stopped while it restored a snapshot.
+func (n *Node) initSnapshots(cfg NodeConfig, g genesis.Genesis) error {
+	if cfg.TrustedHeight > 0 {
+		if cfg.TrustedHash == "" {
+			return errors.New("trusted height without trusted hash")
+		}
+		if cfg.TrustedHeight%g.Consensus.EpochLength != 0 {
+			return fmt.Errorf("trusted height %d isn't the end of an epoch of %d blocks", cfg.TrustedHeight, g.Consensus.EpochLength)
+		}
+	}
+
+	snapshots, err := snapshot.OpenStore(filepath.Join(cfg.DataDir, "snapshots"), cfg.SnapshotKeep)
+	if err != nil {
+		return fmt.Errorf("opening snapshots: %w", err)
+	}
+
+	n.snapshots = snapshots
+	n.snapshotInterval = cfg.SnapshotEpochs * g.Consensus.EpochLength
+
+	return n.recoverRestore()
+}
+
+// loadRotation reads the rotation statement file, if it exists, and checks
+// that it hands over to the node's ID.
+func loadRotation(name string, id key.Address) (*key.Rotation, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	if _, err := os.Stat(name); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	r, err := key.LoadRotation(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.NewID != id {
+		return nil, fmt.Errorf("rotation hands over to %s, but node id is %s", r.NewID, id)
+	}
+
+	return &r, nil
+}
@@ -0,0 +1,330 @@
+package node_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/genesis"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/mempool"
+	"github.com/toqns/toqns/business/node"
+	"github.com/toqns/toqns/business/state"
+	"github.com/toqns/toqns/business/tx"
+	"github.com/toqns/toqns/foundation/p2p"
+	"go.uber.org/zap"
+)
+
+// Success and failure markers.
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+const chainID = "toqns-test"
+
+func TestServeChainBlocks(t *testing.T) {
+	t.Log("Given the need to serve blocks that don't fit in a datagram.")
+	{
+		k, _ := key.New()
+		g := newGenesis(k)
+
+		a := newNode(t, t.TempDir(), g, k)
+
+		genesisBlock, _ := a.Chain().ByHeight(0)
+		small, _ := chain.New(genesisBlock.Header, nil, genesisBlock.StateRoot, k)
+		large, _ := chain.New(small.Header, nil, small.StateRoot, k)
+		large.Justification = json.RawMessage(fmt.Sprintf("%q", strings.Repeat("x", 64<<10)))
+		for _, b := range []chain.Block{small, large} {
+			if err := a.Chain().Append(b); err != nil {
+				t.Fatalf("\t%s\tShould be able to store block %d: %v.", failed, b.Height, err)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		testID := 0
+		t.Logf("\tTest %d:\tWhen requesting a range of blocks over UDP.", testID)
+		{
+			bk, _ := key.New()
+			b := newNode(t, t.TempDir(), g, bk)
+			if _, err := b.Handshake(ctx, a.Address); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to complete a handshake: %v.", failed, testID, err)
+			}
+
+			blocks, err := b.Blocks(ctx, a.Address.ID, 1, 2)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to get the blocks: %v.", failed, testID, err)
+			}
+			if len(blocks) != 1 || blocks[0].Hash() != small.Hash() {
+				t.Fatalf("\t%s\tTest %d:\tShould get the blocks that fit in a datagram, but got %d blocks.", failed, testID, len(blocks))
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the blocks that fit in a datagram.", success, testID)
+
+			blocks, err = b.Blocks(ctx, a.Address.ID, 2, 2)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to get the large block over TCP: %v.", failed, testID, err)
+			}
+			if len(blocks) != 1 || blocks[0].Hash() != large.Hash() || len(blocks[0].Justification) != len(large.Justification) {
+				t.Fatalf("\t%s\tTest %d:\tShould get the large block with its justification, but got %d blocks.", failed, testID, len(blocks))
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the large block over TCP.", success, testID)
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen requesting a large block without listening on TCP.", testID)
+		{
+			bk, _ := key.New()
+			b := newNode(t, t.TempDir(), g, bk, func(cfg *node.NodeConfig) { cfg.ListenAddrs = nil })
+			if _, err := b.Handshake(ctx, a.Address); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to complete a handshake: %v.", failed, testID, err)
+			}
+
+			if _, err := b.Blocks(ctx, a.Address.ID, 2, 2); err == nil {
+				t.Fatalf("\t%s\tTest %d:\tShould fail to get the large block.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould fail to get the large block.", success, testID)
+		}
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	t.Log("Given the need to restore the state from a snapshot.")
+	{
+		k, _ := key.New()
+		g := newGenesis(k)
+
+		// The validator takes a snapshot at the end of every epoch.
+		a := newNode(t, t.TempDir(), g, k, func(cfg *node.NodeConfig) {
+			cfg.SnapshotEpochs = 1
+			cfg.SnapshotKeep = 10
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := a.Sync(ctx); err != nil {
+			t.Fatalf("\t%s\tShould be able to start the validator: %v.", failed, err)
+		}
+
+		trustedHeight := 2 * g.Consensus.EpochLength
+		if !waitFor(ctx, func() bool {
+			height, _ := a.Chain().Height()
+			return height >= trustedHeight+g.Consensus.EpochLength
+		}) {
+			t.Fatalf("\t%s\tShould produce blocks.", failed)
+		}
+		trusted, _ := a.Chain().ByHeight(trustedHeight)
+
+		bk, _ := key.New()
+		dir := t.TempDir()
+		trust := func(cfg *node.NodeConfig) {
+			cfg.TrustedHeight = trusted.Height
+			cfg.TrustedHash = trusted.Hash()
+		}
+
+		testID := 0
+		t.Logf("\tTest %d:\tWhen a node syncs from the trusted height.", testID)
+		{
+			b := newNode(t, dir, g, bk, trust)
+			if _, err := b.Handshake(ctx, a.Address); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to complete a handshake: %v.", failed, testID, err)
+			}
+
+			if err := b.Sync(ctx); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to sync: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to sync.", success, testID)
+
+			if base := b.Chain().Base(); base != trusted.Height {
+				t.Fatalf("\t%s\tTest %d:\tShould start the chain at the trusted height %d, but got %d.", failed, testID, trusted.Height, base)
+			}
+			t.Logf("\t%s\tTest %d:\tShould start the chain at the trusted height.", success, testID)
+
+			checkState(t, testID, b)
+
+			b.Shutdown(context.Background())
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen a node stopped before the state was restored.", testID)
+		{
+			// The chain is restored, but the state is still at the genesis.
+			stateDir := filepath.Join(dir, "data", "state")
+			if err := os.RemoveAll(stateDir); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to remove the state: %v.", failed, testID, err)
+			}
+			if err := genesisState(g, stateDir); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to store the state of the genesis: %v.", failed, testID, err)
+			}
+
+			b := newNode(t, dir, g, bk, trust)
+			checkState(t, testID, b)
+		}
+	}
+}
+
+func TestTxError(t *testing.T) {
+	t.Log("Given the need to report why a transaction is refused.")
+	{
+		tt := []struct {
+			name string
+			err  error
+			code int
+		}{
+			{name: "invalid", err: tx.ErrInvalidTx, code: p2p.StatusBadRequest},
+			{name: "signature", err: fmt.Errorf("verifying: %w", tx.ErrInvalidSignature), code: p2p.StatusBadRequest},
+			{name: "full", err: mempool.ErrFull, code: p2p.StatusBusy},
+			{name: "funds", err: mempool.ErrInsufficientFunds, code: p2p.StatusPaymentRequired},
+			{name: "other", err: errors.New("known transaction"), code: p2p.StatusConflict},
+		}
+
+		for testID, test := range tt {
+			t.Logf("\tTest %d:\tWhen the error is %s.", testID, test.name)
+			{
+				err := node.TxError(test.err)
+				if err.Code != test.code {
+					t.Fatalf("\t%s\tTest %d:\tShould get status %d, but got %d.", failed, testID, test.code, err.Code)
+				}
+				t.Logf("\t%s\tTest %d:\tShould get status %d.", success, testID, test.code)
+
+				if err.Message != test.err.Error() {
+					t.Fatalf("\t%s\tTest %d:\tShould keep the message, but got %q.", failed, testID, err.Message)
+				}
+				t.Logf("\t%s\tTest %d:\tShould keep the message.", success, testID)
+			}
+		}
+	}
+}
+
+// =============================================================================
+
+// newGenesis returns a proof of authority genesis with the validator and
+// short epochs.
+func newGenesis(validator key.Key) genesis.Genesis {
+	g := genesis.New(chainID)
+	g.Consensus.BlockTime = genesis.Duration{Duration: 10 * time.Millisecond}
+	g.Consensus.EpochLength = 4
+	g.Consensus.UnbondingPeriod = 4
+	g.AddValidator(validator.PublicKey(), 1)
+
+	return g
+}
+
+// newNode returns a node with the key and its data in the directory, that
+// listens on UDP and TCP. The node is shut down when the test ends.
+func newNode(t *testing.T, dir string, g genesis.Genesis, k key.Key, options ...func(*node.NodeConfig)) *node.Node {
+	genesisFile := filepath.Join(dir, "genesis.json")
+	if err := g.Save(genesisFile); err != nil {
+		t.Fatalf("storing genesis: %v", err)
+	}
+
+	keyFile := filepath.Join(dir, "node.key")
+	if err := k.Save(keyFile); err != nil {
+		t.Fatalf("storing node key: %v", err)
+	}
+
+	cfg := node.NodeConfig{
+		Version:     "v1.0.0",
+		ChainID:     g.ChainID,
+		Address:     "127.0.0.1",
+		Port:        freePort(t, "udp"),
+		Protocol:    "udp",
+		ListenAddrs: []string{fmt.Sprintf("127.0.0.1/%d/tcp", freePort(t, "tcp"))},
+		NodeKeyFile: keyFile,
+		DataDir:     filepath.Join(dir, "data"),
+		GenesisFile: genesisFile,
+	}
+	for _, option := range options {
+		option(&cfg)
+	}
+
+	n, err := node.New(zap.NewNop().Sugar(), cfg)
+	if err != nil {
+		t.Fatalf("creating node: %v", err)
+	}
+	if err := n.ListenAndServe(); err != nil {
+		n.Shutdown(context.Background())
+		t.Fatalf("starting node: %v", err)
+	}
+	t.Cleanup(func() { n.Shutdown(context.Background()) })
+
+	return n
+}
+
+// genesisState stores the state of the genesis in the directory.
+func genesisState(g genesis.Genesis, dir string) error {
+	storage, err := state.OpenFileStorage(dir)
+	if err != nil {
+		return err
+	}
+
+	st, err := state.New(g.ChainID, storage)
+	if err != nil {
+		storage.Close()
+		return err
+	}
+	defer st.Close()
+
+	b := st.Begin(0)
+	if err := g.Apply(b); err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// freePort returns a port of the protocol that's free on the loopback
+// address.
+func freePort(t *testing.T, proto string) int {
+	if proto == "udp" {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("finding free port: %v", err)
+		}
+		defer c.Close()
+		return c.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("finding free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// checkState checks that the state of the node is the state of its head
+// block.
+func checkState(t *testing.T, testID int, n *node.Node) {
+	head, err := n.Chain().Head()
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to read the head: %v.", failed, testID, err)
+	}
+
+	height, _ := n.State().Height()
+	if height != head.Height || n.State().Root() != head.StateRoot {
+		t.Fatalf("\t%s\tTest %d:\tShould have the state of block %d, but got the state of height %d.", failed, testID, head.Height, height)
+	}
+	t.Logf("\t%s\tTest %d:\tShould have the state of the head block.", success, testID)
+}
+
+// waitFor reports whether the condition holds before the context is done.
+func waitFor(ctx context.Context, cond func() bool) bool {
+	for !cond() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return true
+}
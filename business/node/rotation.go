@@ -0,0 +1,55 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/foundation/p2p"
+)
+
+// RotationPath is the path for key rotation statements.
+const RotationPath = "node/rotate"
+
+// serveRotation handles key rotation statements of peers. Valid statements
+// rotate the peer to its new ID and revoke its old ID.
+//
+// Statements that haven't been seen before are forwarded to the other
+// peers, so they spread through the network.
+func (n *Node) serveRotation(w p2p.ResponseWriter, r *p2p.Request) error {
+	var rot key.Rotation
+	if err := json.Unmarshal(r.Payload, &rot); err != nil {
+		return p2p.NewError(p2p.StatusBadRequest, fmt.Sprintf("decoding rotation: %v", err))
+	}
+
+	if err := rot.Verify(); err != nil {
+		return p2p.NewError(p2p.StatusBadRequest, err.Error())
+	}
+
+	oldID, newID := string(rot.OldID), string(rot.NewID)
+	if newID == n.Address.ID || n.IsRevoked(oldID) {
+		return nil
+	}
+
+	if _, ok := n.RotatePeer(oldID, newID); ok {
+		n.log.Infow("rotation", "status", "peer rotated", "old", oldID, "new", newID)
+	} else {
+		n.log.Infow("rotation", "status", "id revoked", "old", oldID, "new", newID)
+	}
+
+	n.announceRotation(rot, r.From.ID)
+
+	return nil
+}
+
+// announceRotation sends the rotation statement to all peers, except the
+// peer with the provided ID.
+func (n *Node) announceRotation(rot key.Rotation, except string) {
+	b, err := json.Marshal(rot)
+	if err != nil {
+		n.log.Errorw("rotation", "status", "encoding rotation failed", "ERROR", err)
+		return
+	}
+
+	n.gossip("rotation", RotationPath, b, except, string(rot.OldID))
+}
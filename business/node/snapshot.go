@@ -0,0 +1,322 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/snapshot"
+	"github.com/toqns/toqns/business/state"
+	"github.com/toqns/toqns/foundation/p2p"
+)
+
+// Paths of the snapshot protocol.
+const (
+	// SnapshotManifestPath is the path to request the manifest of a
+	// snapshot.
+	SnapshotManifestPath = "snapshot/manifest"
+
+	// SnapshotChunkPath is the path to request a chunk of a snapshot.
+	SnapshotChunkPath = "snapshot/chunk"
+)
+
+// snapshotRequest is the payload of a request for a manifest or a chunk.
+type snapshotRequest struct {
+	Height uint64 `json:"height"`
+	Index  int    `json:"index,omitempty"`
+}
+
+// serveSnapshotManifest responds with the manifest of the snapshot at the
+// requested height. A manifest that doesn't fit in a response is refused
+// with StatusTooLarge, so the requester can request it over TCP.
+func (n *Node) serveSnapshotManifest(w p2p.ResponseWriter, r *p2p.Request) error {
+	var req snapshotRequest
+	if err := json.Unmarshal(r.Payload, &req); err != nil {
+		return p2p.NewError(p2p.StatusBadRequest, fmt.Sprintf("decoding request: %v", err))
+	}
+
+	if n.snapshots == nil {
+		return p2p.NewError(p2p.StatusNotFound, snapshot.ErrNotFound.Error())
+	}
+
+	m, err := n.snapshots.Manifest(req.Height)
+	switch {
+	case errors.Is(err, snapshot.ErrNotFound):
+		return p2p.Errorf(p2p.StatusNotFound, "no snapshot at height %d", req.Height)
+	case err != nil:
+		return err
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("encoding manifest: %w", err)
+	}
+
+	if max := maxResponseSizeFor(r); len(b) > max {
+		return p2p.Errorf(p2p.StatusTooLarge, "manifest of %d bytes exceeds %d", len(b), max)
+	}
+
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("writing response: %w", err)
+	}
+
+	return nil
+}
+
+// serveSnapshotChunk responds with the requested chunk of the snapshot at
+// the requested height. A chunk that doesn't fit in a response is refused
+// with StatusTooLarge, so the requester can request it over TCP.
+func (n *Node) serveSnapshotChunk(w p2p.ResponseWriter, r *p2p.Request) error {
+	var req snapshotRequest
+	if err := json.Unmarshal(r.Payload, &req); err != nil {
+		return p2p.NewError(p2p.StatusBadRequest, fmt.Sprintf("decoding request: %v", err))
+	}
+
+	if n.snapshots == nil {
+		return p2p.NewError(p2p.StatusNotFound, snapshot.ErrNotFound.Error())
+	}
+
+	chunk, err := n.snapshots.Chunk(req.Height, req.Index)
+	switch {
+	case errors.Is(err, snapshot.ErrNotFound):
+		return p2p.Errorf(p2p.StatusNotFound, "no chunk %d of snapshot at height %d", req.Index, req.Height)
+	case err != nil:
+		return err
+	}
+
+	if max := maxResponseSizeFor(r); len(chunk) > max {
+		return p2p.Errorf(p2p.StatusTooLarge, "chunk %d of %d bytes exceeds %d", req.Index, len(chunk), max)
+	}
+
+	if _, err := w.Write(chunk); err != nil {
+		return fmt.Errorf("writing response: %w", err)
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// pendingSnapshot is the state to write a snapshot of.
+type pendingSnapshot struct {
+	height   uint64
+	root     string
+	accounts map[key.Address]state.Account
+}
+
+// takeSnapshot takes a snapshot of the state at heights that are multiples
+// of the snapshot interval. It's called when the state commits a batch,
+// and hands the state to writeSnapshots. The snapshot is skipped when the
+// previous one is still being written.
+func (n *Node) takeSnapshot(height uint64) {
+	if height%n.snapshotInterval != 0 {
+		return
+	}
+
+	// The state can't change before this returns, as it's called by the
+	// goroutine that commits.
+	h, root, accounts := n.state.Snapshot()
+	if h != height {
+		return
+	}
+
+	select {
+	case n.pendingSnapshots <- pendingSnapshot{height: height, root: root, accounts: accounts}:
+	default:
+		n.log.Warnw("snapshot", "status", "snapshot skipped, previous snapshot is still being written", "height", height)
+	}
+}
+
+// writeSnapshots writes the snapshots that are taken until the node is
+// shut down.
+func (n *Node) writeSnapshots() {
+	defer n.wg.Done()
+
+	for {
+		var p pendingSnapshot
+		select {
+		case <-n.stop:
+			return
+		case p = <-n.pendingSnapshots:
+		}
+
+		m, chunks, err := snapshot.New(p.height, p.root, p.accounts)
+		if err == nil {
+			err = n.snapshots.Save(m, chunks)
+		}
+		if err != nil {
+			n.log.Errorw("snapshot", "status", "taking snapshot failed", "height", p.height, "ERROR", err)
+			continue
+		}
+
+		n.log.Infow("snapshot", "status", "snapshot taken", "height", p.height, "accounts", len(p.accounts), "chunks", len(chunks))
+	}
+}
+
+// fastSync restores the state from the peers' snapshot at the trusted
+// height, if it's configured and the chain has no blocks after the
+// genesis block yet. The blocks after it are synced afterwards.
+func (n *Node) fastSync(ctx context.Context) error {
+	if n.trustedHeight == 0 {
+		return nil
+	}
+	if head, _ := n.chain.Height(); head != 0 {
+		return nil
+	}
+
+	b, err := n.trustedBlock(ctx)
+	if err != nil {
+		return err
+	}
+
+	snap, err := snapshot.Fetch(ctx, snapshot.Config{
+		Network: peerNetwork{n},
+		Height:  b.Height,
+		Root:    b.StateRoot,
+		Log:     n.log,
+	})
+	if err != nil {
+		return fmt.Errorf("fetching snapshot: %w", err)
+	}
+
+	if err := n.snapshots.Save(snap.Manifest, snap.Chunks); err != nil {
+		return fmt.Errorf("storing snapshot: %w", err)
+	}
+
+	if err := n.restore(b, snap.Accounts); err != nil {
+		return err
+	}
+
+	n.log.Infow("sync", "status", "state restored from snapshot", "height", b.Height, "accounts", len(snap.Accounts))
+
+	return nil
+}
+
+// trustedBlock requests the block at the trusted height from the peers,
+// until a peer serves the block with the trusted hash.
+func (n *Node) trustedBlock(ctx context.Context) (chain.Block, error) {
+	net := peerNetwork{n}
+	for _, p := range net.Peers() {
+		rctx, cancel := context.WithTimeout(ctx, snapshot.RequestTimeout)
+		blocks, err := net.Blocks(rctx, p, n.trustedHeight, n.trustedHeight)
+		cancel()
+
+		switch {
+		case err != nil:
+			n.log.Debugw("sync", "status", "requesting trusted block failed", "peer", p, "ERROR", err)
+			continue
+		case len(blocks) == 0 || blocks[0].Hash() != n.trustedHash:
+			n.log.Warnw("sync", "status", "peer served another trusted block", "peer", p)
+			continue
+		}
+
+		b := blocks[0]
+		if err := b.Verify(n.genesis.ChainID); err != nil {
+			n.log.Warnw("sync", "status", "peer served an invalid trusted block", "peer", p, "ERROR", err)
+			continue
+		}
+
+		return b, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return chain.Block{}, err
+	}
+
+	return chain.Block{}, fmt.Errorf("no peer served the block %s at trusted height %d", n.trustedHash, n.trustedHeight)
+}
+
+// restore restores the chain with the block and the state with the
+// accounts of the snapshot at the block's height. The snapshot must be
+// stored, so the state can be restored again when the node stops before
+// it's restored.
+func (n *Node) restore(b chain.Block, accounts map[key.Address]state.Account) error {
+	if err := n.chain.Restore(b); err != nil {
+		return fmt.Errorf("restoring chain: %w", err)
+	}
+
+	if err := n.state.Restore(b.Height, b.StateRoot, accounts); err != nil {
+		return fmt.Errorf("restoring state: %w", err)
+	}
+
+	return nil
+}
+
+// recoverRestore restores the state from the stored snapshot at the base
+// of the chain, when the node stopped after restoring the chain but before
+// restoring the state.
+func (n *Node) recoverRestore() error {
+	base := n.chain.Base()
+	if height, _ := n.state.Height(); base == 1 || height != 0 {
+		return nil
+	}
+
+	b, err := n.chain.ByHeight(base)
+	if err != nil {
+		return fmt.Errorf("reading base block: %w", err)
+	}
+
+	m, err := n.snapshots.Manifest(base)
+	if err != nil {
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	chunks := make([][]byte, len(m.Chunks))
+	for i := range chunks {
+		if chunks[i], err = n.snapshots.Chunk(base, i); err != nil {
+			return fmt.Errorf("reading snapshot: %w", err)
+		}
+	}
+
+	accounts, err := snapshot.Restore(m, chunks)
+	if err != nil {
+		return fmt.Errorf("restoring snapshot: %w", err)
+	}
+
+	if err := n.state.Restore(base, b.StateRoot, accounts); err != nil {
+		return fmt.Errorf("restoring state: %w", err)
+	}
+
+	return nil
+}
+
+// =============================================================================
+
+// Manifest returns the manifest of the peer's snapshot at the height.
+func (net peerNetwork) Manifest(ctx context.Context, id string, height uint64) (snapshot.Manifest, error) {
+	payload, err := json.Marshal(snapshotRequest{Height: height})
+	if err != nil {
+		return snapshot.Manifest{}, fmt.Errorf("encoding request: %w", err)
+	}
+
+	resp, err := net.request(ctx, id, SnapshotManifestPath, payload)
+	if err != nil {
+		return snapshot.Manifest{}, err
+	}
+
+	var m snapshot.Manifest
+	if err := json.Unmarshal(resp.Payload, &m); err != nil {
+		return snapshot.Manifest{}, fmt.Errorf("decoding manifest: %w", err)
+	}
+
+	return m, nil
+}
+
+// Chunk returns the chunk at the index of the peer's snapshot at the
+// height.
+func (net peerNetwork) Chunk(ctx context.Context, id string, height uint64, index int) ([]byte, error) {
+	payload, err := json.Marshal(snapshotRequest{Height: height, Index: index})
+	if err != nil {
+		return nil, fmt.Errorf("encoding request: %w", err)
+	}
+
+	resp, err := net.request(ctx, id, SnapshotChunkPath, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Payload, nil
+}
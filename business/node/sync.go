@@ -0,0 +1,437 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/toqns/toqns/business/blocksync"
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/consensus"
+	"github.com/toqns/toqns/business/consensus/bft"
+	"github.com/toqns/toqns/business/consensus/poa"
+	"github.com/toqns/toqns/business/genesis"
+	"github.com/toqns/toqns/foundation/p2p"
+)
+
+// Paths of the sync protocol.
+const (
+	// ChainStatusPath is the path to request the head of a node's chain.
+	ChainStatusPath = "chain/status"
+
+	// ChainBlocksPath is the path to request a range of blocks.
+	ChainBlocksPath = "chain/blocks"
+)
+
+// syncInterval is the interval to check whether peers are ahead while
+// the consensus engine runs.
+const syncInterval = 30 * time.Second
+
+// syncLag is the number of blocks a peer may be ahead before the node
+// stops the consensus engine to sync.
+const syncLag = 10
+
+// Maximum sizes of the payload of a response. Responses over UDP are
+// limited by the size of a datagram, with room for the encoding of the
+// payload. Payloads that exceed it, such as blocks with a large commit or
+// large snapshot manifests, are requested over TCP instead.
+const (
+	maxResponseSize    = 8 << 20
+	maxResponseSizeUDP = 40 << 10
+)
+
+// blocksRequest is the payload of a request for blocks.
+type blocksRequest struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+// serveChainStatus responds with the height and hash of the head of the
+// chain.
+func (n *Node) serveChainStatus(w p2p.ResponseWriter, r *p2p.Request) error {
+	head, err := n.chain.Head()
+	if err != nil {
+		return p2p.NewError(p2p.StatusNotFound, err.Error())
+	}
+
+	st := blocksync.Status{Height: head.Height, Hash: head.Hash()}
+	if base := n.chain.Base(); base > 1 {
+		st.Base = base
+	}
+
+	b, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("encoding status: %w", err)
+	}
+
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("writing response: %w", err)
+	}
+
+	return nil
+}
+
+// serveChainBlocks responds with the requested range of blocks. The range
+// is cut short to at most blocksync.RangeSize blocks, and to the blocks
+// that fit in a response, but has at least one block. A first block that
+// doesn't fit in a response on its own is refused with StatusTooLarge, so
+// the requester can request it over TCP.
+func (n *Node) serveChainBlocks(w p2p.ResponseWriter, r *p2p.Request) error {
+	var req blocksRequest
+	if err := json.Unmarshal(r.Payload, &req); err != nil {
+		return p2p.NewError(p2p.StatusBadRequest, fmt.Sprintf("decoding request: %v", err))
+	}
+
+	if req.To < req.From {
+		return p2p.Errorf(p2p.StatusBadRequest, "range %d to %d is empty", req.From, req.To)
+	}
+	if req.To-req.From >= blocksync.RangeSize {
+		req.To = req.From + blocksync.RangeSize - 1
+	}
+
+	blocks, err := n.chain.Range(req.From, req.To)
+	if err != nil && !errors.Is(err, chain.ErrNotFound) {
+		return fmt.Errorf("reading blocks: %w", err)
+	}
+	if len(blocks) == 0 {
+		return p2p.Errorf(p2p.StatusNotFound, "no block at height %d", req.From)
+	}
+
+	max := maxResponseSizeFor(r)
+
+	var size int
+	for i, b := range blocks {
+		bb, err := json.Marshal(b)
+		if err != nil {
+			return fmt.Errorf("encoding block %d: %w", b.Height, err)
+		}
+
+		size += len(bb)
+		if size > max {
+			if i == 0 {
+				return p2p.Errorf(p2p.StatusTooLarge, "block %d of %d bytes exceeds %d", b.Height, len(bb), max)
+			}
+			blocks = blocks[:i]
+			break
+		}
+	}
+
+	b, err := json.Marshal(blocks)
+	if err != nil {
+		return fmt.Errorf("encoding blocks: %w", err)
+	}
+
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("writing response: %w", err)
+	}
+
+	return nil
+}
+
+// maxResponseSizeFor returns the maximum size of the payload of the
+// response to the request.
+func maxResponseSizeFor(r *p2p.Request) int {
+	if r.From.Proto == "udp" {
+		return maxResponseSizeUDP
+	}
+	return maxResponseSize
+}
+
+// =============================================================================
+
+// Sync catches the chain up with the chains of the peers, and then starts
+// the consensus engine. A node with a trusted height restores the state
+// from the peers' snapshot at that height first. While the engine runs,
+// the node checks its peers periodically, and stops the engine to sync
+// again when it falls behind.
+//
+// Nodes without genesis don't sync, as they have no chain to verify the
+// blocks against.
+func (n *Node) Sync(ctx context.Context) error {
+	if n.genesis == nil {
+		return nil
+	}
+
+	// The shutdown waits for the sync once it has started.
+	n.mu.Lock()
+	select {
+	case <-n.stop:
+		n.mu.Unlock()
+		return nil
+	default:
+	}
+	n.wg.Add(1)
+	n.mu.Unlock()
+	defer n.wg.Done()
+
+	ctx, cancel := n.untilStop(ctx)
+	defer cancel()
+
+	if err := n.fastSync(ctx); err != nil {
+		return err
+	}
+
+	if err := n.syncBlocks(ctx); err != nil {
+		return err
+	}
+
+	if err := n.startEngine(); err != nil {
+		return err
+	}
+
+	n.wg.Add(1)
+	go n.follow()
+
+	return nil
+}
+
+// untilStop returns a context that's canceled when the node is shut down.
+func (n *Node) untilStop(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-n.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// follow periodically checks whether peers are ahead, and syncs with them
+// when they are, until the node is shut down.
+func (n *Node) follow() {
+	defer n.wg.Done()
+
+	ctx, cancel := n.untilStop(context.Background())
+	defer cancel()
+
+	t := time.NewTicker(syncInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-t.C:
+		}
+
+		if !n.behind(ctx) {
+			continue
+		}
+
+		n.log.Infow("sync", "status", "fell behind, stopping consensus")
+		n.stopEngine()
+
+		if err := n.syncBlocks(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			n.log.Errorw("sync", "status", "syncing failed", "ERROR", err)
+		}
+
+		if err := n.startEngine(); err != nil {
+			n.log.Errorw("sync", "status", "starting consensus failed", "ERROR", err)
+			return
+		}
+	}
+}
+
+// behind reports whether a peer is more than syncLag blocks ahead.
+func (n *Node) behind(ctx context.Context) bool {
+	height, _ := n.chain.Height()
+
+	net := peerNetwork{n}
+	for _, p := range net.Peers() {
+		ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+		st, err := net.Status(ctx, p)
+		cancel()
+
+		if err == nil && st.Height > height+syncLag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// syncBlocks syncs the blocks of the peers.
+func (n *Node) syncBlocks(ctx context.Context) error {
+	cfg := blocksync.Config{
+		Genesis: *n.genesis,
+		State:   n.state,
+		Store:   n.chain,
+		Network: peerNetwork{n},
+		Verify:  n.verifyBlock,
+		Log:     n.log,
+	}
+
+	// Proof of authority blocks carry no votes, so they are only final
+	// with the blocks on top of them.
+	if g := *n.genesis; g.Consensus.Engine == genesis.EnginePoA {
+		cfg.Final = func(blocks []chain.Block) int {
+			return poa.Final(g, blocks)
+		}
+	}
+
+	applied, err := blocksync.Sync(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("syncing blocks: %w", err)
+	}
+
+	if applied > 0 {
+		n.mempool.Revalidate()
+
+		height, _ := n.chain.Height()
+		n.log.Infow("sync", "status", "caught up", "applied", applied, "height", height)
+	}
+
+	return nil
+}
+
+// verifyBlock verifies a synced block on top of the parent against the
+// rules of the consensus engine. Proof of authority blocks aren't final
+// when they pass, which the sync checks with poa.Final.
+func (n *Node) verifyBlock(parent, b chain.Block) error {
+	g := *n.genesis
+
+	switch g.Consensus.Engine {
+	case genesis.EnginePoA:
+		return poa.Verify(g, parent, b)
+
+	case genesis.EngineBFT:
+		vals, err := consensus.Validators(n.chain, g, b.Height)
+		if err != nil {
+			return err
+		}
+		return bft.VerifyBlock(g, vals, parent, b)
+	}
+
+	return fmt.Errorf("unknown consensus engine %q", g.Consensus.Engine)
+}
+
+// startEngine starts a consensus engine that continues the stored chain.
+func (n *Node) startEngine() error {
+	e, err := newEngine(consensus.Config{
+		Genesis:   *n.genesis,
+		State:     n.state,
+		Store:     n.chain,
+		Mempool:   n.mempool,
+		Signer:    n.signer,
+		Broadcast: func(m consensus.Message) { n.gossipConsensus(m, "") },
+		DataDir:   n.consensusDir,
+		Log:       n.log,
+	})
+	if err != nil {
+		return fmt.Errorf("starting consensus: %w", err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// The node may have been shut down in the meantime.
+	select {
+	case <-n.stop:
+		return nil
+	default:
+	}
+
+	n.engine = e
+	n.engine.Start()
+
+	return nil
+}
+
+// stopEngine stops the consensus engine, if it runs. Messages that are
+// received while it's stopped are rejected.
+func (n *Node) stopEngine() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.engine != nil {
+		n.engine.Stop()
+		n.engine = nil
+	}
+}
+
+// =============================================================================
+
+// peerNetwork requests the chain status and blocks of the node's peers.
+type peerNetwork struct {
+	n *Node
+}
+
+// Peers returns the IDs of the peers.
+func (net peerNetwork) Peers() []string {
+	peers := net.n.Peers()
+
+	ids := make([]string, len(peers))
+	for i, p := range peers {
+		ids[i] = p.Address.ID
+	}
+
+	return ids
+}
+
+// Status returns the head of the peer's chain.
+func (net peerNetwork) Status(ctx context.Context, id string) (blocksync.Status, error) {
+	resp, err := net.send(ctx, id, ChainStatusPath, nil)
+	if err != nil {
+		return blocksync.Status{}, err
+	}
+
+	var st blocksync.Status
+	if err := json.Unmarshal(resp.Payload, &st); err != nil {
+		return blocksync.Status{}, fmt.Errorf("decoding status: %w", err)
+	}
+
+	return st, nil
+}
+
+// Blocks returns blocks of the peer's chain in the range.
+func (net peerNetwork) Blocks(ctx context.Context, id string, from, to uint64) ([]chain.Block, error) {
+	payload, err := json.Marshal(blocksRequest{From: from, To: to})
+	if err != nil {
+		return nil, fmt.Errorf("encoding request: %w", err)
+	}
+
+	resp, err := net.request(ctx, id, ChainBlocksPath, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []chain.Block
+	if err := json.Unmarshal(resp.Payload, &blocks); err != nil {
+		return nil, fmt.Errorf("decoding blocks: %w", err)
+	}
+
+	return blocks, nil
+}
+
+// send sends the request to the peer.
+func (net peerNetwork) send(ctx context.Context, id, path string, payload []byte) (*p2p.Response, error) {
+	p, ok := net.n.Peer(id)
+	if !ok {
+		return nil, errors.New("unknown peer")
+	}
+
+	return net.n.Send(ctx, p.Address, path, payload)
+}
+
+// request sends the request to the peer, and sends it again over TCP when
+// the response doesn't fit in a datagram.
+func (net peerNetwork) request(ctx context.Context, id, path string, payload []byte) (*p2p.Response, error) {
+	resp, err := net.send(ctx, id, path, payload)
+	if !errors.Is(err, p2p.ErrTooLarge) {
+		return resp, err
+	}
+
+	p, ok := net.n.Peer(id)
+	if !ok {
+		return nil, errors.New("unknown peer")
+	}
+
+	return net.n.sendTCP(ctx, p, path, payload)
+}
@@ -0,0 +1,80 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/toqns/toqns/business/mempool"
+	"github.com/toqns/toqns/business/tx"
+	"github.com/toqns/toqns/foundation/p2p"
+)
+
+// TxSubmitPath is the path to submit transactions to a node. Nodes gossip
+// new transactions to their peers via the same path.
+const TxSubmitPath = "tx/submit"
+
+// serveTxSubmit adds a submitted transaction to the mempool and gossips it
+// to the other peers. The response payload is the transaction hash.
+func (n *Node) serveTxSubmit(w p2p.ResponseWriter, r *p2p.Request) error {
+	var stx tx.SignedTx
+	if err := json.Unmarshal(r.Payload, &stx); err != nil {
+		return p2p.NewError(p2p.StatusBadRequest, fmt.Sprintf("decoding transaction: %v", err))
+	}
+
+	if err := n.submitTx(stx, r.From.ID); err != nil {
+		return txError(err)
+	}
+
+	if _, err := w.Write([]byte(stx.Hash())); err != nil {
+		return fmt.Errorf("writing response: %w", err)
+	}
+
+	return nil
+}
+
+// SubmitTx adds the transaction to the mempool and gossips it to the peers.
+func (n *Node) SubmitTx(stx tx.SignedTx) error {
+	return n.submitTx(stx, "")
+}
+
+// submitTx adds the transaction to the mempool and gossips it to the peers
+// except the peer with the provided ID.
+func (n *Node) submitTx(stx tx.SignedTx, from string) error {
+	if err := n.mempool.Add(stx); err != nil {
+		return err
+	}
+
+	n.log.Debugw("mempool", "status", "transaction added", "hash", stx.Hash(), "from", from)
+
+	n.gossipTx(stx, from)
+
+	return nil
+}
+
+// gossipTx sends the transaction to all peers, except the peer with the
+// provided ID.
+func (n *Node) gossipTx(stx tx.SignedTx, except string) {
+	b, err := json.Marshal(stx)
+	if err != nil {
+		n.log.Errorw("mempool", "status", "encoding transaction failed", "ERROR", err)
+		return
+	}
+
+	n.gossip("mempool", TxSubmitPath, b, except)
+}
+
+// txError converts an error of adding a transaction to the mempool to a
+// p2p error.
+func txError(err error) *p2p.StatusError {
+	switch {
+	case errors.Is(err, tx.ErrInvalidTx), errors.Is(err, tx.ErrInvalidSignature):
+		return p2p.NewError(p2p.StatusBadRequest, err.Error())
+	case errors.Is(err, mempool.ErrFull):
+		return p2p.NewError(p2p.StatusBusy, err.Error())
+	case errors.Is(err, mempool.ErrInsufficientFunds):
+		return p2p.NewError(p2p.StatusPaymentRequired, err.Error())
+	default:
+		return p2p.NewError(p2p.StatusConflict, err.Error())
+	}
+}
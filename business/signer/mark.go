@@ -0,0 +1,193 @@
+package signer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/toqns/toqns/foundation/atomicfile"
+	"github.com/toqns/toqns/foundation/canonical"
+)
+
+// Steps of consensus messages, in the order they are signed in a round.
+const (
+	stepProposal  = 1
+	stepPrevote   = 2
+	stepPrecommit = 3
+)
+
+// Vote types in the signed data of votes.
+const (
+	votePrevote   = 1
+	votePrecommit = 2
+)
+
+// position is the height, round and step of a consensus message.
+type position struct {
+	Height uint64 `json:"height"`
+	Round  uint64 `json:"round"`
+	Step   uint8  `json:"step"`
+}
+
+// after reports whether the position comes after the other position.
+func (p position) after(o position) bool {
+	switch {
+	case p.Height != o.Height:
+		return p.Height > o.Height
+	case p.Round != o.Round:
+		return p.Round > o.Round
+	default:
+		return p.Step > o.Step
+	}
+}
+
+// mark is the high-water mark of signed messages. The signer only signs
+// consensus messages after the last signed one, and blocks above the last
+// signed block. A block at the same height is only signed once a later
+// round has started, which is when a proposer builds a new block.
+type mark struct {
+	Consensus   position `json:"consensus"`
+	BlockHeight uint64   `json:"block_height"`
+
+	// BlockConsensus is the consensus mark when the last block was signed.
+	BlockConsensus position `json:"block_consensus"`
+}
+
+// loadMark reads the mark from the file. A missing file is a signer that
+// hasn't signed anything yet.
+func loadMark(name string) (mark, error) {
+	if name == "" {
+		return mark{}, nil
+	}
+
+	b, err := os.ReadFile(name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return mark{}, nil
+	case err != nil:
+		return mark{}, fmt.Errorf("reading sign state: %w", err)
+	}
+
+	var m mark
+	if err := json.Unmarshal(b, &m); err != nil {
+		return mark{}, fmt.Errorf("decoding sign state: %w", err)
+	}
+
+	return m, nil
+}
+
+// save writes the mark to the file, if there is one.
+func (m mark) save(name string) error {
+	if name == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	if err := atomicfile.Write(name, b); err != nil {
+		return fmt.Errorf("writing sign state: %w", err)
+	}
+	return nil
+}
+
+// next returns the mark after signing the message of the type, or
+// ErrPolicy if the message doesn't come after the mark. Other types of
+// messages don't change the mark.
+func (m mark) next(typ string, data []byte) (mark, error) {
+	switch typ {
+	case "block":
+		height, err := blockHeight(data)
+		if err != nil {
+			return mark{}, fmt.Errorf("%w: %v", ErrPolicy, err)
+		}
+
+		if height < m.BlockHeight || (height == m.BlockHeight && !m.Consensus.after(m.BlockConsensus)) {
+			return mark{}, fmt.Errorf("%w: block at height %d after signing height %d", ErrPolicy, height, m.BlockHeight)
+		}
+
+		m.BlockHeight = height
+		m.BlockConsensus = m.Consensus
+
+	case "proposal", "vote":
+		p, err := consensusPosition(typ, data)
+		if err != nil {
+			return mark{}, fmt.Errorf("%w: %v", ErrPolicy, err)
+		}
+
+		if !p.after(m.Consensus) {
+			return mark{}, fmt.Errorf("%w: %s at height %d round %d step %d after signing height %d round %d step %d",
+				ErrPolicy, typ, p.Height, p.Round, p.Step, m.Consensus.Height, m.Consensus.Round, m.Consensus.Step)
+		}
+
+		m.Consensus = p
+	}
+
+	return m, nil
+}
+
+// blockHeight returns the height of the signed data of a block header,
+// which is the domain prefix, the encoding version, the chain ID and the
+// height.
+func blockHeight(data []byte) (uint64, error) {
+	b := data[strings.IndexByte(string(data), ':')+1:]
+	if len(b) == 0 {
+		return 0, errors.New("invalid block")
+	}
+
+	_, b, err := canonical.ReadString(b[1:])
+	if err != nil {
+		return 0, fmt.Errorf("invalid block: %w", err)
+	}
+
+	height, _, err := canonical.ReadUint64(b)
+	if err != nil {
+		return 0, fmt.Errorf("invalid block: %w", err)
+	}
+
+	return height, nil
+}
+
+// consensusPosition returns the position of the signed data of a proposal
+// or vote. Proposals encode the chain ID, height and round after the
+// domain prefix, and votes encode the chain ID, vote type, height and
+// round.
+func consensusPosition(typ string, data []byte) (position, error) {
+	b := data[strings.IndexByte(string(data), ':')+1:]
+
+	_, b, err := canonical.ReadString(b)
+	if err != nil {
+		return position{}, fmt.Errorf("invalid %s: %w", typ, err)
+	}
+
+	p := position{Step: stepProposal}
+	if typ == "vote" {
+		if len(b) == 0 {
+			return position{}, fmt.Errorf("invalid %s: %w", typ, canonical.ErrShortData)
+		}
+
+		switch b[0] {
+		case votePrevote:
+			p.Step = stepPrevote
+		case votePrecommit:
+			p.Step = stepPrecommit
+		default:
+			return position{}, fmt.Errorf("invalid %s: unknown vote type %d", typ, b[0])
+		}
+		b = b[1:]
+	}
+
+	if p.Height, b, err = canonical.ReadUint64(b); err != nil {
+		return position{}, fmt.Errorf("invalid %s: %w", typ, err)
+	}
+	if p.Round, _, err = canonical.ReadUint64(b); err != nil {
+		return position{}, fmt.Errorf("invalid %s: %w", typ, err)
+	}
+
+	return p, nil
+}
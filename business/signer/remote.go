@@ -0,0 +1,193 @@
+package signer
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toqns/toqns/business/key"
+)
+
+// defaultTimeout is the default time to wait for the signer.
+const defaultTimeout = 5 * time.Second
+
+// Remote is a key.Signer that forwards signing requests to a Server.
+type Remote struct {
+	network string
+	address string
+	timeout time.Duration
+	tls     *tls.Config
+	pub     key.PublicKey
+
+	mu   sync.Mutex
+	conn net.Conn
+	dec  *json.Decoder
+}
+
+// Dial connects to the signer at the address and fetches its public key.
+//
+// The address is either a path to a Unix socket, prefixed with unix://,
+// or a host and port, optionally prefixed with tcp://. TCP connections
+// require a TLS configuration with a client certificate, as returned by
+// ClientTLSConfig, and return ErrInsecure without one. The configuration
+// isn't used for Unix sockets.
+func Dial(address string, tlsConfig *tls.Config) (*Remote, error) {
+	if strings.HasPrefix(address, "unix://") {
+		r := &Remote{network: "unix", address: strings.TrimPrefix(address, "unix://"), timeout: defaultTimeout}
+		return r.init()
+	}
+
+	if tlsConfig == nil || len(tlsConfig.Certificates) == 0 {
+		return nil, ErrInsecure
+	}
+
+	addr := strings.TrimPrefix(address, "tcp://")
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing signer address: %w", err)
+	}
+
+	// The signer's certificate is verified for the host it's dialed at.
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+
+	r := &Remote{network: "tcp", address: addr, timeout: defaultTimeout, tls: tlsConfig}
+	return r.init()
+}
+
+// init fetches the public key of the signer.
+func (r *Remote) init() (*Remote, error) {
+	resp, err := r.call(request{Method: methodPublicKey})
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := key.ParsePublicKey(resp.PublicKey)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("parsing public key of signer: %w", err)
+	}
+	r.pub = pub
+
+	return r, nil
+}
+
+// Algorithm implements the key.Signer interface.
+func (r *Remote) Algorithm() key.Algorithm {
+	return r.pub.Algorithm()
+}
+
+// PublicKey implements the key.Signer interface.
+func (r *Remote) PublicKey() key.PublicKey {
+	return r.pub
+}
+
+// Sign implements the key.Signer interface and requests the signer to
+// sign the data.
+//
+// Returns ErrPolicy or ErrRateLimited if the signer refuses to sign.
+func (r *Remote) Sign(data []byte) ([]byte, error) {
+	resp, err := r.call(request{Method: methodSign, Data: data})
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't trust the signer blindly, a wrong signature would only be
+	// noticed by peers.
+	if err := r.pub.Verify(data, resp.Signature); err != nil {
+		return nil, fmt.Errorf("signature of signer: %w", err)
+	}
+
+	return resp.Signature, nil
+}
+
+// Close closes the connection to the signer.
+func (r *Remote) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.closeLocked()
+}
+
+// closeLocked closes the connection. The lock must be held.
+func (r *Remote) closeLocked() error {
+	if r.conn == nil {
+		return nil
+	}
+
+	err := r.conn.Close()
+	r.conn, r.dec = nil, nil
+	return err
+}
+
+// call sends the request and waits for the response. It connects to the
+// signer if there is no connection, such as after a failed request.
+func (r *Remote) call(req request) (response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conn == nil {
+		conn, err := r.dial()
+		if err != nil {
+			return response{}, fmt.Errorf("connecting to signer: %w", err)
+		}
+		r.conn, r.dec = conn, json.NewDecoder(bufio.NewReader(conn))
+	}
+
+	r.conn.SetDeadline(time.Now().Add(r.timeout))
+
+	var resp response
+	if err := json.NewEncoder(r.conn).Encode(req); err != nil {
+		r.closeLocked()
+		return response{}, fmt.Errorf("sending request to signer: %w", err)
+	}
+	if err := r.dec.Decode(&resp); err != nil {
+		r.closeLocked()
+		return response{}, fmt.Errorf("reading response of signer: %w", err)
+	}
+
+	switch {
+	case resp.Code == codePolicy:
+		return response{}, remoteError{msg: resp.Error, err: ErrPolicy}
+	case resp.Code == codeRateLimited:
+		return response{}, remoteError{msg: resp.Error, err: ErrRateLimited}
+	case resp.Error != "":
+		return response{}, remoteError{msg: resp.Error}
+	}
+
+	return resp, nil
+}
+
+// dial connects to the signer.
+func (r *Remote) dial() (net.Conn, error) {
+	if r.tls == nil {
+		return net.DialTimeout(r.network, r.address, r.timeout)
+	}
+
+	d := net.Dialer{Timeout: r.timeout}
+	return tls.DialWithDialer(&d, r.network, r.address, r.tls)
+}
+
+// remoteError is an error returned by the signer. It matches the package's
+// error for its code with errors.Is.
+type remoteError struct {
+	msg string
+	err error
+}
+
+// Error implements the error interface.
+func (e remoteError) Error() string {
+	return "signer: " + e.msg
+}
+
+// Unwrap returns the package's error for the code of the error.
+func (e remoteError) Unwrap() error {
+	return e.err
+}
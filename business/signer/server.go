@@ -0,0 +1,256 @@
+package signer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/toqns/toqns/business/key"
+	"go.uber.org/zap"
+)
+
+// Policy restricts what a Server signs.
+type Policy struct {
+	// AllowedTypes are the message types that may be signed, as returned
+	// by MessageType. When empty, every message type may be signed.
+	AllowedTypes []string
+
+	// MaxSignatures is the maximum number of signatures per Interval. When
+	// zero, the number of signatures isn't limited.
+	MaxSignatures int
+	Interval      time.Duration
+
+	// StateFile keeps the high-water mark of signed blocks and consensus
+	// messages, so a restarted signer doesn't sign a message that
+	// conflicts with one it signed before. When empty, the mark is only
+	// kept in memory.
+	StateFile string
+}
+
+// Server signs messages for remote signers with its key.
+type Server struct {
+	Signer key.Signer
+	Policy Policy
+	Log    *zap.SugaredLogger
+
+	// signMu serializes signing, so the high-water mark is checked and
+	// advanced for one message at a time.
+	signMu sync.Mutex
+
+	mu          sync.Mutex
+	mark        mark
+	loaded      bool
+	windowStart time.Time
+	signed      int
+	listeners   map[net.Listener]struct{}
+	conns       map[net.Conn]struct{}
+	wg          sync.WaitGroup
+	closed      bool
+}
+
+// Serve accepts connections on the listener and serves their requests.
+//
+// Serve blocks until the listener fails or the server is closed, and
+// returns nil after Close.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.New("server closed")
+	}
+	if !s.loaded {
+		m, err := loadMark(s.Policy.StateFile)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.mark, s.loaded = m, true
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return fmt.Errorf("accepting connection: %w", err)
+		}
+
+		// TCP connections must be authenticated by a TLS listener.
+		if _, ok := conn.(*net.TCPConn); ok {
+			s.log("connection refused", "remote", conn.RemoteAddr().String(), "ERROR", ErrInsecure)
+			conn.Close()
+			continue
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// Close closes the listeners and connections and waits for the requests
+// in progress.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// serveConn serves the requests of a single connection.
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+
+		conn.Close()
+		s.wg.Done()
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	enc := json.NewEncoder(conn)
+
+	for {
+		var req request
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+
+		if err := enc.Encode(s.handle(req)); err != nil {
+			return
+		}
+	}
+}
+
+// handle returns the response to a request.
+func (s *Server) handle(req request) response {
+	switch req.Method {
+	case methodPublicKey:
+		return response{PublicKey: s.Signer.PublicKey().String()}
+
+	case methodSign:
+		typ := MessageType(req.Data)
+		if err := s.allow(typ); err != nil {
+			s.log("signing denied", "type", typ, "ERROR", err)
+
+			code := codePolicy
+			if errors.Is(err, ErrRateLimited) {
+				code = codeRateLimited
+			}
+			return response{Error: err.Error(), Code: code}
+		}
+
+		sig, err := s.sign(typ, req.Data)
+		if err != nil {
+			s.log("signing denied", "type", typ, "ERROR", err)
+
+			if errors.Is(err, ErrPolicy) {
+				return response{Error: err.Error(), Code: codePolicy}
+			}
+			return response{Error: err.Error()}
+		}
+
+		s.log("signed", "type", typ)
+		return response{Signature: sig}
+	}
+
+	return response{Error: fmt.Sprintf("unknown method %q", req.Method)}
+}
+
+// allow checks the policy for a message of the type, and counts the
+// signature towards the rate limit if it's allowed.
+func (s *Server) allow(typ string) error {
+	if len(s.Policy.AllowedTypes) > 0 {
+		allowed := false
+		for _, t := range s.Policy.AllowedTypes {
+			if t == typ {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%w: message type %q", ErrPolicy, typ)
+		}
+	}
+
+	if s.Policy.MaxSignatures == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.windowStart) >= s.Policy.Interval {
+		s.windowStart = now
+		s.signed = 0
+	}
+
+	if s.signed >= s.Policy.MaxSignatures {
+		return fmt.Errorf("%w: %d per %s", ErrRateLimited, s.Policy.MaxSignatures, s.Policy.Interval)
+	}
+	s.signed++
+
+	return nil
+}
+
+// sign advances the high-water mark and signs the data. The mark is stored
+// before the data is signed, so a crash in between loses a signature
+// rather than risking a conflicting one.
+func (s *Server) sign(typ string, data []byte) ([]byte, error) {
+	s.signMu.Lock()
+	defer s.signMu.Unlock()
+
+	s.mu.Lock()
+	m := s.mark
+	s.mu.Unlock()
+
+	next, err := m.next(typ, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if next != m {
+		if err := next.save(s.Policy.StateFile); err != nil {
+			return nil, err
+		}
+
+		s.mu.Lock()
+		s.mark = next
+		s.mu.Unlock()
+	}
+
+	return s.Signer.Sign(data)
+}
+
+func (s *Server) log(msg string, kv ...any) {
+	if s.Log != nil {
+		s.Log.Infow("signer", append([]any{"status", msg}, kv...)...)
+	}
+}
@@ -0,0 +1,76 @@
+// Package signer provides a remote signer, so keys can be kept in a
+// separate, hardened signing process instead of the node process.
+//
+// The Remote signer implements key.Signer and forwards signing requests to
+// a Server over a Unix socket or TCP connection. The Server signs with its
+// key according to its Policy, which limits the types of messages it signs
+// and the rate at which it signs them.
+//
+// Requests and responses are JSON values, one per line.
+package signer
+
+import (
+	"errors"
+	"strings"
+)
+
+// Methods of requests.
+const (
+	methodPublicKey = "public_key"
+	methodSign      = "sign"
+)
+
+var (
+	// ErrPolicy is returned when the signer refuses to sign a message
+	// because of its policy.
+	ErrPolicy = errors.New("denied by signing policy")
+
+	// ErrRateLimited is returned when the signer refuses to sign because
+	// its rate limit has been reached.
+	ErrRateLimited = errors.New("signing rate limit reached")
+)
+
+// request is a request to the signer.
+type request struct {
+	Method string `json:"method"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+// response is the signer's response to a request.
+type response struct {
+	PublicKey string `json:"public_key,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"`
+}
+
+// Error codes of responses, so errors can be matched on the client side.
+const (
+	codePolicy      = "policy"
+	codeRateLimited = "rate_limited"
+)
+
+// MessageType returns the type of a message to sign, which is the name in
+// its "toqns/<type>:" domain prefix. Returns an empty string for messages
+// without a domain prefix.
+func MessageType(data []byte) string {
+	const prefix = "toqns/"
+
+	s := string(data[:min(len(data), 64)])
+	if !strings.HasPrefix(s, prefix) {
+		return ""
+	}
+
+	typ, _, ok := strings.Cut(s[len(prefix):], ":")
+	if !ok {
+		return ""
+	}
+	return typ
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
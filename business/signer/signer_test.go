@@ -0,0 +1,321 @@
+package signer_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/toqns/toqns/business/chain"
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/signer"
+	"github.com/toqns/toqns/foundation/canonical"
+)
+
+// Success and failure markers.
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+func TestRemote(t *testing.T) {
+	t.Log("Given the need to sign with a key in another process.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen signing via a Unix socket.", testID)
+		{
+			k, _ := key.NewWithAlgorithm(key.Ed25519)
+			srv := signer.Server{
+				Signer: k,
+				Policy: signer.Policy{
+					AllowedTypes:  []string{"rotation"},
+					MaxSignatures: 2,
+					Interval:      time.Hour,
+				},
+			}
+
+			name := filepath.Join(t.TempDir(), "signer.sock")
+			l, err := net.Listen("unix", name)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to listen: %v.", failed, testID, err)
+			}
+			go srv.Serve(l)
+			t.Cleanup(func() { srv.Close() })
+
+			r, err := signer.Dial("unix://"+name, nil)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to connect to the signer: %v.", failed, testID, err)
+			}
+			defer r.Close()
+
+			if !r.PublicKey().Equal(k.PublicKey()) || r.Algorithm() != key.Ed25519 {
+				t.Fatalf("\t%s\tTest %d:\tShould get the public key of the signer.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the public key of the signer.", success, testID)
+
+			other, _ := key.New()
+			rot, err := key.NewRotation(r, other)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to sign a rotation: %v.", failed, testID, err)
+			}
+			if err := rot.Verify(); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to verify the rotation: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to sign a rotation.", success, testID)
+
+			if _, err := r.Sign([]byte("toqns/tx:transfer")); !errors.Is(err, signer.ErrPolicy) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrPolicy for other message types, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrPolicy for other message types.", success, testID)
+
+			if _, err := r.Sign([]byte("toqns/rotation:1")); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to sign within the rate limit: %v.", failed, testID, err)
+			}
+			if _, err := r.Sign([]byte("toqns/rotation:2")); !errors.Is(err, signer.ErrRateLimited) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrRateLimited, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrRateLimited.", success, testID)
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen signing via TCP.", testID)
+		{
+			k, _ := key.NewWithAlgorithm(key.Ed25519)
+			srv := signer.Server{Signer: k}
+			t.Cleanup(func() { srv.Close() })
+
+			dir := t.TempDir()
+			files := writeCerts(t, dir)
+
+			if _, err := signer.Listen("tcp://127.0.0.1:0", nil); !errors.Is(err, signer.ErrInsecure) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInsecure listening without TLS, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrInsecure listening without TLS.", success, testID)
+
+			srvTLS, err := signer.ServerTLSConfig(files["signer.crt"], files["signer.key"], files["ca.crt"])
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to load the server TLS configuration: %v.", failed, testID, err)
+			}
+			l, err := signer.Listen("tcp://127.0.0.1:0", srvTLS)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to listen with TLS: %v.", failed, testID, err)
+			}
+			go srv.Serve(l)
+			address := "tcp://" + l.Addr().String()
+
+			plain, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to listen: %v.", failed, testID, err)
+			}
+			go srv.Serve(plain)
+
+			if _, err := signer.Dial(address, nil); !errors.Is(err, signer.ErrInsecure) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInsecure dialing without TLS, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrInsecure dialing without TLS.", success, testID)
+
+			clientTLS, err := signer.ClientTLSConfig(files["node.crt"], files["node.key"], files["ca.crt"])
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to load the client TLS configuration: %v.", failed, testID, err)
+			}
+
+			r, err := signer.Dial(address, clientTLS)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to connect with a client certificate: %v.", failed, testID, err)
+			}
+			defer r.Close()
+
+			if _, err := r.Sign([]byte("toqns/rotation:1")); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to sign over TLS: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to sign over TLS.", success, testID)
+
+			// A client with a certificate of another CA is refused.
+			other := writeCerts(t, t.TempDir())
+			otherTLS, _ := signer.ClientTLSConfig(other["node.crt"], other["node.key"], files["ca.crt"])
+			if _, err := signer.Dial(address, otherTLS); err == nil {
+				t.Fatalf("\t%s\tTest %d:\tShould refuse a client certificate of another CA.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould refuse a client certificate of another CA.", success, testID)
+
+			// Plain TCP connections are refused, also on a listener
+			// without TLS.
+			conn, err := net.Dial("tcp", plain.Addr().String())
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to connect: %v.", failed, testID, err)
+			}
+			defer conn.Close()
+			conn.Write([]byte(`{"method":"public_key"}` + "\n"))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if n, err := conn.Read(make([]byte, 512)); err == nil {
+				t.Fatalf("\t%s\tTest %d:\tShould refuse plain TCP connections, but got %d bytes.", failed, testID, n)
+			}
+			t.Logf("\t%s\tTest %d:\tShould refuse plain TCP connections.", success, testID)
+		}
+	}
+}
+
+func TestHighWaterMark(t *testing.T) {
+	t.Log("Given the need to never sign conflicting messages.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen signing consensus messages and blocks.", testID)
+		{
+			k, _ := key.NewWithAlgorithm(key.Ed25519)
+			dir := t.TempDir()
+			stateFile := filepath.Join(dir, "sign_state.json")
+
+			serve := func() (*signer.Server, *signer.Remote) {
+				srv := signer.Server{Signer: k, Policy: signer.Policy{StateFile: stateFile}}
+				name := filepath.Join(dir, "signer.sock")
+				l, err := signer.Listen("unix://"+name, nil)
+				if err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to listen: %v.", failed, testID, err)
+				}
+				go srv.Serve(l)
+
+				r, err := signer.Dial("unix://"+name, nil)
+				if err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to connect to the signer: %v.", failed, testID, err)
+				}
+				return &srv, r
+			}
+
+			srv, r := serve()
+
+			tt := []struct {
+				name string
+				data []byte
+				ok   bool
+			}{
+				{"a block at height 1", blockData(1), true},
+				{"the block again", blockData(1), false},
+				{"a proposal at height 1 round 0", proposalData(1, 0), true},
+				{"a prevote at height 1 round 0", voteData(1, 1, 0), true},
+				{"a conflicting prevote at height 1 round 0", voteData(1, 1, 0), false},
+				{"a precommit at height 1 round 0", voteData(2, 1, 0), true},
+				{"a prevote of an earlier step", voteData(1, 1, 0), false},
+				{"a new block at height 1 after the votes", blockData(1), true},
+				{"another block before the mark advanced", blockData(1), false},
+				{"a proposal at height 1 round 1", proposalData(1, 1), true},
+				{"a block at an earlier height", blockData(0), false},
+				{"a truncated vote", []byte("toqns/vote:"), false},
+			}
+
+			for _, tc := range tt {
+				_, err := r.Sign(tc.data)
+				switch {
+				case tc.ok && err != nil:
+					t.Fatalf("\t%s\tTest %d:\tShould sign %s: %v.", failed, testID, tc.name, err)
+				case !tc.ok && !errors.Is(err, signer.ErrPolicy):
+					t.Fatalf("\t%s\tTest %d:\tShould get ErrPolicy signing %s, but got: %v.", failed, testID, tc.name, err)
+				}
+				t.Logf("\t%s\tTest %d:\tShould sign %s: %v.", success, testID, tc.name, tc.ok)
+			}
+
+			r.Close()
+			srv.Close()
+
+			// The mark is kept after a restart.
+			srv, r = serve()
+			defer srv.Close()
+			defer r.Close()
+
+			if _, err := r.Sign(voteData(2, 1, 0)); !errors.Is(err, signer.ErrPolicy) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrPolicy for a signed step after a restart, but got: %v.", failed, testID, err)
+			}
+			if _, err := r.Sign(voteData(1, 1, 1)); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould sign the next step after a restart: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould keep the mark after a restart.", success, testID)
+		}
+	}
+}
+
+// =============================================================================
+
+// blockData returns the signed data of a block header at the height.
+func blockData(height uint64) []byte {
+	h := chain.Header{ChainID: "test", Height: height, Timestamp: time.Now().UnixNano()}
+	return h.SigningBytes()
+}
+
+// proposalData returns the signed data of a proposal.
+func proposalData(height, round uint64) []byte {
+	b := []byte("toqns/proposal:")
+	b = canonical.AppendString(b, "test")
+	b = canonical.AppendUint64(b, height)
+	b = canonical.AppendUint64(b, round)
+	b = canonical.AppendUint64(b, ^uint64(0))
+	return canonical.AppendString(b, "hash")
+}
+
+// voteData returns the signed data of a vote of the type.
+func voteData(typ byte, height, round uint64) []byte {
+	b := []byte("toqns/vote:")
+	b = canonical.AppendString(b, "test")
+	b = append(b, typ)
+	b = canonical.AppendUint64(b, height)
+	b = canonical.AppendUint64(b, round)
+	return canonical.AppendString(b, "hash")
+}
+
+// writeCerts writes a CA certificate and certificates of the signer and a
+// node signed by it to the directory, and returns the files by name.
+func writeCerts(t *testing.T, dir string) map[string]string {
+	files := make(map[string]string)
+	write := func(name, typ string, der []byte) {
+		files[name] = filepath.Join(dir, name)
+		if err := os.WriteFile(files[name], pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "toqns test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &ca, &ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("creating CA certificate: %v", err)
+	}
+	write("ca.crt", "CERTIFICATE", der)
+
+	for i, name := range []string{"signer", "node"} {
+		k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		cert := x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &cert, &ca, &k.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("creating certificate: %v", err)
+		}
+		write(name+".crt", "CERTIFICATE", der)
+
+		kb, _ := x509.MarshalECPrivateKey(k)
+		write(name+".key", "EC PRIVATE KEY", kb)
+	}
+
+	return files
+}
@@ -0,0 +1,114 @@
+package signer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrInsecure is returned for TCP connections without mutual TLS. Anyone
+// who can connect to the signer can have it sign, so TCP connections must
+// authenticate both sides.
+var ErrInsecure = errors.New("tcp connections to the signer require mutual TLS")
+
+// ServerTLSConfig returns the TLS configuration of a Server that only
+// accepts clients with a certificate signed by the CA.
+func ServerTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, pool, err := loadTLSFiles(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}
+	return &cfg, nil
+}
+
+// ClientTLSConfig returns the TLS configuration of a Remote that
+// authenticates with the certificate and only accepts a signer with a
+// certificate signed by the CA.
+func ClientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, pool, err := loadTLSFiles(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS13,
+	}
+	return &cfg, nil
+}
+
+// loadTLSFiles loads the PEM encoded certificate, its key and the CA
+// certificates.
+func loadTLSFiles(certFile, keyFile, caFile string) (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("loading certificate: %w", err)
+	}
+
+	b, err := os.ReadFile(caFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("reading CA certificate: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return tls.Certificate{}, nil, fmt.Errorf("no CA certificates in %s", caFile)
+	}
+
+	return cert, pool, nil
+}
+
+// Listen listens on the address for a Server.
+//
+// The address is either a path to a Unix socket, prefixed with unix://,
+// or a host and port, optionally prefixed with tcp://. Unix sockets are
+// only accessible by the owner. TCP listeners require a TLS configuration
+// that verifies client certificates, as returned by ServerTLSConfig.
+func Listen(address string, tlsConfig *tls.Config) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix://") {
+		if tlsConfig == nil || tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+			return nil, ErrInsecure
+		}
+
+		l, err := net.Listen("tcp", strings.TrimPrefix(address, "tcp://"))
+		if err != nil {
+			return nil, fmt.Errorf("listening: %w", err)
+		}
+		return tls.NewListener(l, tlsConfig), nil
+	}
+
+	name := strings.TrimPrefix(address, "unix://")
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return nil, fmt.Errorf("creating socket directory: %w", err)
+	}
+
+	// Remove a stale socket of a previous run.
+	if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("removing socket: %w", err)
+	}
+
+	l, err := net.Listen("unix", name)
+	if err != nil {
+		return nil, fmt.Errorf("listening: %w", err)
+	}
+
+	if err := os.Chmod(name, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("setting socket permissions: %w", err)
+	}
+
+	return l, nil
+}
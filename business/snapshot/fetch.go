@@ -0,0 +1,262 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/state"
+	"go.uber.org/zap"
+)
+
+// Limits of a fetch.
+const (
+	// MaxRequests is the maximum number of requests in flight, each to a
+	// different peer.
+	MaxRequests = 8
+
+	// RequestTimeout is the time a peer has to answer a request.
+	RequestTimeout = 10 * time.Second
+)
+
+// errNoPeers is returned when no peer is left to request chunks from.
+var errNoPeers = errors.New("no peer left to request chunks from")
+
+// Network requests the snapshots of peers.
+type Network interface {
+	// Peers returns the IDs of the peers.
+	Peers() []string
+
+	// Manifest returns the manifest of the peer's snapshot at the height.
+	Manifest(ctx context.Context, peer string, height uint64) (Manifest, error)
+
+	// Chunk returns the chunk at the index of the peer's snapshot at the
+	// height.
+	Chunk(ctx context.Context, peer string, height uint64, index int) ([]byte, error)
+}
+
+// Config contains the dependencies of a fetch.
+type Config struct {
+	Network Network
+
+	// Height and Root are the height and the state root of the snapshot,
+	// which must be trusted, such as from a block with a trusted hash.
+	Height uint64
+	Root   string
+
+	Log *zap.SugaredLogger
+}
+
+// Snapshot is a fetched snapshot.
+type Snapshot struct {
+	Manifest Manifest
+	Chunks   [][]byte
+	Accounts map[key.Address]state.Account
+}
+
+// Fetch requests the snapshot at the height with the state root from the
+// peers.
+//
+// Peers are grouped by the manifest they serve, and the chunks of the
+// manifest that most peers serve are requested first, from its peers in
+// parallel. Peers that serve a chunk that doesn't match the manifest are
+// dropped. When the chunks of a manifest can't be fetched, or their
+// accounts don't have the state root, the next manifest is tried.
+func Fetch(ctx context.Context, cfg Config) (Snapshot, error) {
+	groups, err := manifests(ctx, cfg)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	for _, g := range groups {
+		cfg.Log.Infow("snapshot", "status", "fetching snapshot", "height", cfg.Height, "chunks", len(g.manifest.Chunks), "peers", len(g.peers))
+
+		chunks, err := fetchChunks(ctx, cfg, g)
+		if err != nil {
+			if ctx.Err() != nil {
+				return Snapshot{}, ctx.Err()
+			}
+			cfg.Log.Warnw("snapshot", "status", "fetching chunks failed", "manifest", g.manifest.Hash(), "ERROR", err)
+			continue
+		}
+
+		accounts, err := Restore(g.manifest, chunks)
+		if err != nil {
+			cfg.Log.Warnw("snapshot", "status", "restoring snapshot failed", "manifest", g.manifest.Hash(), "ERROR", err)
+			continue
+		}
+
+		return Snapshot{Manifest: g.manifest, Chunks: chunks, Accounts: accounts}, nil
+	}
+
+	return Snapshot{}, fmt.Errorf("%w: no peer served the snapshot at height %d", ErrNotFound, cfg.Height)
+}
+
+// =============================================================================
+
+// group is a manifest with the peers that serve it.
+type group struct {
+	manifest Manifest
+	peers    []string
+}
+
+// manifests requests the manifests of the snapshot from the peers, and
+// returns the manifests with the height and state root of the snapshot,
+// the manifest that most peers serve first.
+func manifests(ctx context.Context, cfg Config) ([]*group, error) {
+	type reply struct {
+		peer     string
+		manifest Manifest
+		err      error
+	}
+
+	peers := cfg.Network.Peers()
+
+	replies := make(chan reply, len(peers))
+	for _, p := range peers {
+		p := p
+		go func() {
+			ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+			defer cancel()
+
+			m, err := cfg.Network.Manifest(ctx, p, cfg.Height)
+			replies <- reply{peer: p, manifest: m, err: err}
+		}()
+	}
+
+	byHash := make(map[string]*group)
+	for range peers {
+		r := <-replies
+		switch {
+		case r.err != nil:
+			cfg.Log.Debugw("snapshot", "status", "requesting manifest failed", "peer", r.peer, "ERROR", r.err)
+			continue
+
+		case r.manifest.Height != cfg.Height || r.manifest.Root != cfg.Root || len(r.manifest.Chunks) == 0:
+			cfg.Log.Warnw("snapshot", "status", "peer served another snapshot", "peer", r.peer, "height", r.manifest.Height, "root", r.manifest.Root)
+			continue
+		}
+
+		hash := r.manifest.Hash()
+		g, ok := byHash[hash]
+		if !ok {
+			g = &group{manifest: r.manifest}
+			byHash[hash] = g
+		}
+		g.peers = append(g.peers, r.peer)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	groups := make([]*group, 0, len(byHash))
+	for _, g := range byHash {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return len(groups[i].peers) > len(groups[j].peers) })
+
+	return groups, nil
+}
+
+// fetchChunks requests the chunks of the manifest from the group's peers,
+// until all chunks are fetched or no peer is left.
+func fetchChunks(ctx context.Context, cfg Config, g *group) ([][]byte, error) {
+	type result struct {
+		peer  string
+		index int
+		chunk []byte
+		err   error
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		m       = g.manifest
+		chunks  = make([][]byte, len(m.Chunks))
+		pending = make([]int, len(m.Chunks))
+		peers   = append([]string(nil), g.peers...)
+		busy    = make(map[string]bool)
+		results = make(chan result)
+	)
+	for i := range pending {
+		pending[i] = i
+	}
+
+	for {
+		for len(pending) > 0 && len(busy) < MaxRequests {
+			peer, ok := idle(peers, busy)
+			if !ok {
+				break
+			}
+
+			index := pending[0]
+			pending = pending[1:]
+
+			busy[peer] = true
+			go func() {
+				rctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+				defer cancel()
+
+				chunk, err := cfg.Network.Chunk(rctx, peer, m.Height, index)
+
+				select {
+				case results <- result{peer: peer, index: index, chunk: chunk, err: err}:
+				case <-ctx.Done():
+				}
+			}()
+		}
+
+		if len(busy) == 0 {
+			if len(pending) > 0 {
+				return nil, errNoPeers
+			}
+			return chunks, nil
+		}
+
+		var r result
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case r = <-results:
+		}
+		delete(busy, r.peer)
+
+		if r.err == nil {
+			r.err = VerifyChunk(m, r.index, r.chunk)
+		}
+
+		if r.err != nil {
+			cfg.Log.Warnw("snapshot", "status", "peer dropped", "peer", r.peer, "chunk", r.index, "ERROR", r.err)
+			peers = remove(peers, r.peer)
+			pending = append(pending, r.index)
+			continue
+		}
+
+		chunks[r.index] = r.chunk
+	}
+}
+
+// idle returns a peer that has no request in flight.
+func idle(peers []string, busy map[string]bool) (string, bool) {
+	for _, p := range peers {
+		if !busy[p] {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// remove returns the peers without the peer.
+func remove(peers []string, peer string) []string {
+	for i, p := range peers {
+		if p == peer {
+			return append(peers[:i:i], peers[i+1:]...)
+		}
+	}
+	return peers
+}
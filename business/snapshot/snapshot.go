@@ -0,0 +1,167 @@
+// Package snapshot splits the account state at a height into chunks, so
+// new nodes can restore the state from peers instead of applying every
+// block since the genesis.
+//
+// A snapshot has a manifest with the height, the state root and the hash
+// of every chunk. Chunks hold the accounts ordered by address. Each chunk
+// can be checked against the manifest as soon as it's received, and the
+// restored accounts against the state root, which is trusted through the
+// hash of the block at the snapshot's height.
+package snapshot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/state"
+)
+
+// MaxChunkSize is the maximum size of a chunk with more than one account.
+// Chunks fit in a response over UDP.
+const MaxChunkSize = 32 << 10
+
+var (
+	// ErrNotFound is returned for snapshots and chunks that don't exist.
+	ErrNotFound = errors.New("snapshot not found")
+
+	// ErrInvalidChunk is returned for chunks that don't match the
+	// manifest, or that can't be decoded.
+	ErrInvalidChunk = errors.New("invalid chunk")
+)
+
+// Manifest describes a snapshot.
+type Manifest struct {
+	Height uint64 `json:"height"`
+
+	// Root is the state root of the accounts at the height.
+	Root string `json:"root"`
+
+	// Chunks are the hex encoded SHA-256 hashes of the chunks.
+	Chunks []string `json:"chunks"`
+}
+
+// Hash returns the hex encoded hash of the manifest.
+func (m Manifest) Hash() string {
+	h := sha256.New()
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], m.Height)
+	h.Write(buf[:])
+
+	for _, v := range append([]string{m.Root}, m.Chunks...) {
+		h.Write([]byte{byte(len(v))})
+		h.Write([]byte(v))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Entry is an account in a chunk.
+type Entry struct {
+	Address key.Address   `json:"address"`
+	Account state.Account `json:"account"`
+}
+
+// New splits the accounts of the state at the height into chunks, and
+// returns the manifest and the chunks.
+func New(height uint64, root string, accounts map[key.Address]state.Account) (Manifest, [][]byte, error) {
+	addrs := make([]key.Address, 0, len(accounts))
+	for addr := range accounts {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+	var (
+		chunks [][]byte
+		chunk  = []byte{'['}
+	)
+	for _, addr := range addrs {
+		e, err := json.Marshal(Entry{Address: addr, Account: accounts[addr]})
+		if err != nil {
+			return Manifest{}, nil, fmt.Errorf("encoding account %s: %w", addr, err)
+		}
+
+		if len(chunk) > 1 && len(chunk)+len(e)+1 > MaxChunkSize {
+			chunks = append(chunks, append(chunk, ']'))
+			chunk = []byte{'['}
+		}
+		if len(chunk) > 1 {
+			chunk = append(chunk, ',')
+		}
+		chunk = append(chunk, e...)
+	}
+	chunks = append(chunks, append(chunk, ']'))
+
+	m := Manifest{Height: height, Root: root}
+	for _, c := range chunks {
+		m.Chunks = append(m.Chunks, hashOf(c))
+	}
+
+	return m, chunks, nil
+}
+
+// VerifyChunk checks that the chunk is the chunk at the index of the
+// manifest.
+func VerifyChunk(m Manifest, index int, chunk []byte) error {
+	if index < 0 || index >= len(m.Chunks) {
+		return fmt.Errorf("%w: index %d of %d chunks", ErrInvalidChunk, index, len(m.Chunks))
+	}
+
+	if hash := hashOf(chunk); hash != m.Chunks[index] {
+		return fmt.Errorf("%w: chunk %d has hash %s, expected %s", ErrInvalidChunk, index, hash, m.Chunks[index])
+	}
+
+	return nil
+}
+
+// Restore returns the accounts of the chunks of the manifest. It checks
+// the chunks against the manifest, and the accounts against the state
+// root.
+func Restore(m Manifest, chunks [][]byte) (map[key.Address]state.Account, error) {
+	if len(chunks) != len(m.Chunks) {
+		return nil, fmt.Errorf("%w: %d chunks, manifest has %d", ErrInvalidChunk, len(chunks), len(m.Chunks))
+	}
+
+	accounts := make(map[key.Address]state.Account)
+
+	var last key.Address
+	for i, c := range chunks {
+		if err := VerifyChunk(m, i, c); err != nil {
+			return nil, err
+		}
+
+		var entries []Entry
+		d := json.NewDecoder(bytes.NewReader(c))
+		d.DisallowUnknownFields()
+		if err := d.Decode(&entries); err != nil {
+			return nil, fmt.Errorf("%w: decoding chunk %d: %v", ErrInvalidChunk, i, err)
+		}
+
+		for _, e := range entries {
+			if e.Address <= last {
+				return nil, fmt.Errorf("%w: account %s in chunk %d is out of order", ErrInvalidChunk, e.Address, i)
+			}
+			accounts[e.Address] = e.Account
+			last = e.Address
+		}
+	}
+
+	if root := state.RootOf(accounts); root != m.Root {
+		return nil, fmt.Errorf("%w: got %s, manifest has %s", state.ErrRootMismatch, root, m.Root)
+	}
+
+	return accounts, nil
+}
+
+// hashOf returns the hex encoded hash of the chunk.
+func hashOf(chunk []byte) string {
+	h := sha256.Sum256(chunk)
+	return hex.EncodeToString(h[:])
+}
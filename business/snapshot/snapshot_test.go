@@ -0,0 +1,208 @@
+package snapshot_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/snapshot"
+	"github.com/toqns/toqns/business/state"
+	"go.uber.org/zap"
+)
+
+// Success and failure markers.
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+func TestSnapshot(t *testing.T) {
+	accounts := make(map[key.Address]state.Account)
+	for i := 0; i < 2000; i++ {
+		accounts[key.Address(fmt.Sprintf("account%04d", i))] = state.Account{Balance: uint64(i), Nonce: uint64(i % 7)}
+	}
+	root := state.RootOf(accounts)
+
+	t.Log("Given the need to snapshot the state.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen splitting and restoring the accounts.", testID)
+		{
+			m, chunks, err := snapshot.New(100, root, accounts)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to create the snapshot: %v.", failed, testID, err)
+			}
+			if len(chunks) < 2 {
+				t.Fatalf("\t%s\tTest %d:\tShould split the accounts into chunks, but got %d.", failed, testID, len(chunks))
+			}
+			for i, c := range chunks {
+				if len(c) > snapshot.MaxChunkSize {
+					t.Fatalf("\t%s\tTest %d:\tShould limit the size of chunk %d, but got %d bytes.", failed, testID, i, len(c))
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould split the accounts into %d chunks.", success, testID, len(chunks))
+
+			restored, err := snapshot.Restore(m, chunks)
+			if err != nil || len(restored) != len(accounts) {
+				t.Fatalf("\t%s\tTest %d:\tShould restore all accounts: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould restore all accounts.", success, testID)
+
+			tampered := append([][]byte(nil), chunks...)
+			tampered[1] = append([]byte(nil), chunks[1]...)
+			tampered[1][10] ^= 1
+			if _, err := snapshot.Restore(m, tampered); !errors.Is(err, snapshot.ErrInvalidChunk) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInvalidChunk for a tampered chunk, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrInvalidChunk for a tampered chunk.", success, testID)
+
+			st, _ := state.New("toqns-test", state.NewMemoryStorage())
+			st.Begin(0).Commit()
+			if err := st.Restore(m.Height, "00", restored); !errors.Is(err, state.ErrRootMismatch) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrRootMismatch for another root, but got: %v.", failed, testID, err)
+			}
+			if err := st.Restore(m.Height, root, restored); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to restore the state: %v.", failed, testID, err)
+			}
+			if h, _ := st.Height(); h != 100 || st.Root() != root {
+				t.Fatalf("\t%s\tTest %d:\tShould have the height and root of the snapshot, but got %d %s.", failed, testID, h, st.Root())
+			}
+			t.Logf("\t%s\tTest %d:\tShould restore the state with the root of the snapshot.", success, testID)
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen storing snapshots.", testID)
+		{
+			s, err := snapshot.OpenStore(t.TempDir(), 2)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to open the store: %v.", failed, testID, err)
+			}
+
+			for _, h := range []uint64{100, 200, 300} {
+				m, chunks, _ := snapshot.New(h, root, accounts)
+				if err := s.Save(m, chunks); err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to save the snapshot at %d: %v.", failed, testID, h, err)
+				}
+			}
+
+			heights, err := s.Heights()
+			if err != nil || len(heights) != 2 || heights[0] != 300 || heights[1] != 200 {
+				t.Fatalf("\t%s\tTest %d:\tShould keep the 2 most recent snapshots, but got %v: %v.", failed, testID, heights, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould keep the 2 most recent snapshots.", success, testID)
+
+			m, err := s.Manifest(300)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould read the manifest: %v.", failed, testID, err)
+			}
+			c, err := s.Chunk(300, 1)
+			if err != nil || snapshot.VerifyChunk(m, 1, c) != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould read the chunks of the manifest: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould read the manifest and its chunks.", success, testID)
+
+			if _, err := s.Manifest(100); !errors.Is(err, snapshot.ErrNotFound) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrNotFound for a removed snapshot, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrNotFound for a removed snapshot.", success, testID)
+		}
+
+		testID = 2
+		t.Logf("\tTest %d:\tWhen fetching from peers that lie.", testID)
+		{
+			m, chunks, _ := snapshot.New(100, root, accounts)
+
+			// The forger serves a manifest with the trusted root but other
+			// accounts, which it serves consistently.
+			forged := make(map[key.Address]state.Account)
+			for addr, a := range accounts {
+				forged[addr] = a
+			}
+			forged["account0000"] = state.Account{Balance: 1_000_000}
+			fm, fchunks, _ := snapshot.New(100, "", forged)
+			fm.Root = root
+
+			liar := &peer{manifest: m, chunks: chunks, tamper: true}
+			net := network{
+				"forger1": &peer{manifest: fm, chunks: fchunks},
+				"forger2": &peer{manifest: fm, chunks: fchunks},
+				"forger3": &peer{manifest: fm, chunks: fchunks},
+				"liar":    liar,
+				"honest":  &peer{manifest: m, chunks: chunks},
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			snap, err := snapshot.Fetch(ctx, snapshot.Config{
+				Network: net,
+				Height:  100,
+				Root:    root,
+				Log:     zap.NewNop().Sugar(),
+			})
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to fetch the snapshot: %v.", failed, testID, err)
+			}
+			if snap.Manifest.Hash() != m.Hash() || state.RootOf(snap.Accounts) != root {
+				t.Fatalf("\t%s\tTest %d:\tShould fetch the snapshot with the trusted root.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould fetch the snapshot with the trusted root.", success, testID)
+
+			_, err = snapshot.Fetch(ctx, snapshot.Config{
+				Network: network{"forger": &peer{manifest: fm, chunks: fchunks}},
+				Height:  100,
+				Root:    root,
+				Log:     zap.NewNop().Sugar(),
+			})
+			if !errors.Is(err, snapshot.ErrNotFound) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrNotFound when only forged snapshots are served, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrNotFound when only forged snapshots are served.", success, testID)
+		}
+	}
+}
+
+// =============================================================================
+
+// peer serves a snapshot, possibly misbehaving.
+type peer struct {
+	manifest snapshot.Manifest
+	chunks   [][]byte
+
+	// tamper makes the peer serve altered chunks.
+	tamper bool
+}
+
+type network map[string]*peer
+
+func (net network) Peers() []string {
+	var ids []string
+	for id := range net {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (net network) Manifest(ctx context.Context, id string, height uint64) (snapshot.Manifest, error) {
+	p := net[id]
+	if p.manifest.Height != height {
+		return snapshot.Manifest{}, snapshot.ErrNotFound
+	}
+	return p.manifest, nil
+}
+
+func (net network) Chunk(ctx context.Context, id string, height uint64, index int) ([]byte, error) {
+	p := net[id]
+	if p.manifest.Height != height || index >= len(p.chunks) {
+		return nil, snapshot.ErrNotFound
+	}
+
+	c := append([]byte(nil), p.chunks[index]...)
+	if p.tamper {
+		c[len(c)/2] ^= 1
+	}
+	return c, nil
+}
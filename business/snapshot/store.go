@@ -0,0 +1,219 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// manifestName is the name of the manifest file in a snapshot directory.
+const manifestName = "manifest.json"
+
+// tempPrefix is the prefix of the directories of snapshots that are being
+// written.
+const tempPrefix = ".snapshot-"
+
+// Store keeps the most recent snapshots on disk.
+//
+// Each snapshot is a directory named after its height, with the manifest
+// and the chunks. Snapshots are written to a temporary directory that's
+// renamed once all files are synced, so a crash never leaves a partial
+// snapshot behind.
+type Store struct {
+	dir  string
+	keep int
+
+	mu sync.RWMutex
+}
+
+// OpenStore opens the store in the directory, which is created if it
+// doesn't exist. The store keeps the provided number of snapshots, at
+// least one.
+func OpenStore(dir string, keep int) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading directory: %w", err)
+	}
+
+	// Snapshots that were being written when the process stopped are
+	// removed.
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), tempPrefix) {
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				return nil, fmt.Errorf("removing partial snapshot: %w", err)
+			}
+		}
+	}
+
+	if keep < 1 {
+		keep = 1
+	}
+
+	return &Store{dir: dir, keep: keep}, nil
+}
+
+// Save stores the snapshot, and removes the oldest snapshots beyond the
+// number to keep.
+func (s *Store) Save(m Manifest, chunks [][]byte) error {
+	if len(chunks) != len(m.Chunks) {
+		return fmt.Errorf("%w: %d chunks, manifest has %d", ErrInvalidChunk, len(chunks), len(m.Chunks))
+	}
+
+	tmp, err := os.MkdirTemp(s.dir, tempPrefix)
+	if err != nil {
+		return fmt.Errorf("creating snapshot directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("encoding manifest: %w", err)
+	}
+
+	if err := writeFile(filepath.Join(tmp, manifestName), b); err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+
+	for i, c := range chunks {
+		if err := writeFile(filepath.Join(tmp, chunkName(i)), c); err != nil {
+			return fmt.Errorf("writing chunk %d: %w", i, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := s.snapshotDir(m.Height)
+	if err := os.RemoveAll(name); err != nil {
+		return fmt.Errorf("removing previous snapshot: %w", err)
+	}
+
+	if err := os.Rename(tmp, name); err != nil {
+		return fmt.Errorf("renaming snapshot directory: %w", err)
+	}
+
+	heights, err := s.heights()
+	if err != nil {
+		return err
+	}
+
+	for len(heights) > s.keep {
+		if err := os.RemoveAll(s.snapshotDir(heights[len(heights)-1])); err != nil {
+			return fmt.Errorf("removing snapshot: %w", err)
+		}
+		heights = heights[:len(heights)-1]
+	}
+
+	return nil
+}
+
+// Heights returns the heights of the stored snapshots, the most recent
+// first.
+func (s *Store) Heights() ([]uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.heights()
+}
+
+// Manifest returns the manifest of the snapshot at the height.
+func (s *Store) Manifest(height uint64) (Manifest, error) {
+	b, err := s.read(height, manifestName)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return Manifest{}, fmt.Errorf("decoding manifest: %w", err)
+	}
+
+	return m, nil
+}
+
+// Chunk returns the chunk at the index of the snapshot at the height.
+func (s *Store) Chunk(height uint64, index int) ([]byte, error) {
+	if index < 0 {
+		return nil, ErrNotFound
+	}
+
+	return s.read(height, chunkName(index))
+}
+
+// read returns the contents of the file of the snapshot at the height.
+func (s *Store) read(height uint64, name string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, err := os.ReadFile(filepath.Join(s.snapshotDir(height), name))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil, ErrNotFound
+	case err != nil:
+		return nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	return b, nil
+}
+
+// heights returns the heights of the stored snapshots, the most recent
+// first. The caller must hold the lock.
+func (s *Store) heights() ([]uint64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading directory: %w", err)
+	}
+
+	var heights []uint64
+	for _, e := range entries {
+		h, err := strconv.ParseUint(e.Name(), 10, 64)
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		heights = append(heights, h)
+	}
+
+	sort.Slice(heights, func(i, j int) bool { return heights[i] > heights[j] })
+
+	return heights, nil
+}
+
+// snapshotDir returns the directory of the snapshot at the height.
+func (s *Store) snapshotDir(height uint64) string {
+	return filepath.Join(s.dir, strconv.FormatUint(height, 10))
+}
+
+// chunkName returns the file name of the chunk at the index.
+func chunkName(index int) string {
+	return fmt.Sprintf("chunk-%06d", index)
+}
+
+// writeFile writes the file and syncs it.
+func writeFile(name string, b []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,289 @@
+package state
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/foundation/atomicfile"
+)
+
+// journalName is the name of the journal file in the storage directory.
+const journalName = "state.journal"
+
+// compactEvery is the number of records after which the journal is
+// compacted into a single record.
+const compactEvery = 1000
+
+// recordHeaderSize is the size of the length and checksum that precede the
+// data of a journal record.
+const recordHeaderSize = 4 + sha256.Size
+
+// ErrCorrupted is returned when the journal has an invalid record before
+// its end, which can't be the result of an interrupted write.
+var ErrCorrupted = errors.New("state journal corrupted")
+
+// record is a journal record with the changes of a commit.
+type record struct {
+	Height   uint64                  `json:"height"`
+	Accounts map[key.Address]Account `json:"accounts"`
+}
+
+// FileStorage is a storage that keeps the state in a journal file.
+//
+// Each commit appends a record with the changed accounts and syncs the
+// file, so committed state survives crashes. A record that was partially
+// written when the process crashed is removed when the storage is opened.
+// The journal is periodically compacted into a single record with all
+// accounts.
+type FileStorage struct {
+	dir string
+
+	mu        sync.Mutex
+	f         *os.File
+	accounts  map[key.Address]Account
+	height    uint64
+	committed bool
+	records   int
+	size      int64
+	stale     bool
+}
+
+// OpenFileStorage opens the storage in the directory, which is created if
+// it doesn't exist.
+func OpenFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating directory: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, journalName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening journal: %w", err)
+	}
+
+	fs := FileStorage{
+		dir:      dir,
+		f:        f,
+		accounts: make(map[key.Address]Account),
+	}
+
+	if err := fs.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &fs, nil
+}
+
+// replay reads the journal and truncates a partially written record at its
+// end.
+func (fs *FileStorage) replay() error {
+	b, err := io.ReadAll(fs.f)
+	if err != nil {
+		return fmt.Errorf("reading journal: %w", err)
+	}
+
+	var offset int
+	for offset < len(b) {
+		r, n, err := decodeRecord(b[offset:])
+		if err != nil {
+			if offset+n < len(b) {
+				return fmt.Errorf("%w: record at offset %d: %v", ErrCorrupted, offset, err)
+			}
+
+			// The last record is incomplete, so the write of the commit
+			// was interrupted and it was never acknowledged.
+			if err := fs.f.Truncate(int64(offset)); err != nil {
+				return fmt.Errorf("truncating journal: %w", err)
+			}
+			if err := fs.f.Sync(); err != nil {
+				return fmt.Errorf("syncing journal: %w", err)
+			}
+			break
+		}
+
+		for addr, a := range r.Accounts {
+			fs.accounts[addr] = a
+		}
+		fs.height = r.Height
+		fs.committed = true
+		fs.records++
+
+		offset += n
+	}
+
+	if _, err := fs.f.Seek(int64(offset), io.SeekStart); err != nil {
+		return fmt.Errorf("seeking journal: %w", err)
+	}
+	fs.size = int64(offset)
+
+	return nil
+}
+
+// Load implements the Storage interface.
+func (fs *FileStorage) Load() (uint64, map[key.Address]Account, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.committed {
+		return 0, nil, ErrNoState
+	}
+
+	accounts := make(map[key.Address]Account, len(fs.accounts))
+	for addr, a := range fs.accounts {
+		accounts[addr] = a
+	}
+
+	return fs.height, accounts, nil
+}
+
+// Commit implements the Storage interface.
+func (fs *FileStorage) Commit(height uint64, changes map[key.Address]Account) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.stale {
+		if err := fs.reopen(); err != nil {
+			return err
+		}
+	}
+
+	b, err := encodeRecord(record{Height: height, Accounts: changes})
+	if err != nil {
+		return err
+	}
+
+	if _, err := fs.f.Write(b); err != nil {
+		fs.rewind()
+		return fmt.Errorf("writing journal: %w", err)
+	}
+
+	if err := fs.f.Sync(); err != nil {
+		fs.rewind()
+		return fmt.Errorf("syncing journal: %w", err)
+	}
+	fs.size += int64(len(b))
+
+	for addr, a := range changes {
+		fs.accounts[addr] = a
+	}
+	fs.height = height
+	fs.committed = true
+	fs.records++
+
+	// A failed compaction leaves the journal intact or has replaced it by
+	// one with this commit, so the commit still succeeded. A replaced
+	// journal that couldn't be reopened is reopened by the next commit.
+	if fs.records >= compactEvery {
+		fs.compact()
+	}
+
+	return nil
+}
+
+// rewind removes a partially written record, so the next record isn't
+// appended to it. The caller must hold the lock.
+func (fs *FileStorage) rewind() {
+	fs.f.Truncate(fs.size)
+	fs.f.Seek(fs.size, io.SeekStart)
+}
+
+// compact replaces the journal by a journal with a single record of all
+// accounts. The caller must hold the lock.
+func (fs *FileStorage) compact() error {
+	b, err := encodeRecord(record{Height: fs.height, Accounts: fs.accounts})
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Join(fs.dir, journalName)
+	if err := atomicfile.Write(name, b); err != nil {
+		return err
+	}
+
+	// The open file is the replaced journal now, so records can't be
+	// appended to it until the new journal is open.
+	fs.stale = true
+	fs.records = 1
+
+	return fs.reopen()
+}
+
+// reopen opens the journal after it was replaced by a compaction. The
+// caller must hold the lock.
+func (fs *FileStorage) reopen() error {
+	f, err := os.OpenFile(filepath.Join(fs.dir, journalName), os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("reopening journal: %w", err)
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("seeking journal: %w", err)
+	}
+
+	fs.f.Close()
+	fs.f = f
+	fs.size = size
+	fs.stale = false
+
+	return nil
+}
+
+// Close implements the Storage interface.
+func (fs *FileStorage) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.f.Close()
+}
+
+// encodeRecord returns the record prefixed with its length and checksum.
+func encodeRecord(r record) ([]byte, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("encoding record: %w", err)
+	}
+
+	b := make([]byte, recordHeaderSize, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	sum := sha256.Sum256(data)
+	copy(b[4:], sum[:])
+
+	return append(b, data...), nil
+}
+
+// decodeRecord decodes the record at the start of the data and returns its
+// size. On failure, the size is the size the record claims to have, which
+// may exceed the data.
+func decodeRecord(b []byte) (record, int, error) {
+	if len(b) < recordHeaderSize {
+		return record{}, len(b), errors.New("short header")
+	}
+
+	n := recordHeaderSize + int(binary.BigEndian.Uint32(b))
+	if n > len(b) {
+		return record{}, n, errors.New("short data")
+	}
+
+	data := b[recordHeaderSize:n]
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(sum[:], b[4:recordHeaderSize]) {
+		return record{}, n, errors.New("checksum mismatch")
+	}
+
+	var r record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return record{}, n, fmt.Errorf("decoding record: %w", err)
+	}
+
+	return r, n, nil
+}
@@ -0,0 +1,722 @@
+// Package state maintains the account state of the chain: the balance and
+// nonce of each account, and the stake of the validators that accounts
+// operate.
+//
+// Blocks are applied as a Batch, which holds the changes of the block's
+// transactions until it's committed. A batch that fails, such as for a
+// block with an invalid transaction, is discarded and leaves the state
+// unchanged. Committed changes are written to the Storage atomically.
+//
+// Batches can be stacked on top of uncommitted batches, which allows
+// blocks to be applied on top of blocks that aren't final yet.
+//
+// The state root commits to all accounts. It's the Merkle root of the
+// accounts ordered by address, so nodes that applied the same blocks have
+// the same root.
+package state
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/tx"
+	"github.com/toqns/toqns/foundation/canonical"
+	"github.com/toqns/toqns/foundation/merkle"
+)
+
+var (
+	// ErrNoState is returned by storages that have no committed state.
+	ErrNoState = errors.New("no committed state")
+
+	// ErrInvalidNonce is returned for transactions with a nonce other than
+	// the account's nonce.
+	ErrInvalidNonce = errors.New("invalid nonce")
+
+	// ErrInsufficientFunds is returned for transactions that cost more
+	// than the balance of the sender.
+	ErrInsufficientFunds = errors.New("insufficient funds")
+
+	// ErrBalanceOverflow is returned when a credit overflows the balance
+	// of an account.
+	ErrBalanceOverflow = errors.New("balance overflow")
+
+	// ErrInvalidHeight is returned when a batch is committed at a height
+	// that doesn't follow the committed height.
+	ErrInvalidHeight = errors.New("invalid height")
+
+	// ErrNotCommitted is returned when a batch is committed before the
+	// batch it's stacked on.
+	ErrNotCommitted = errors.New("parent batch not committed")
+
+	// ErrNotValidator is returned for staking transactions of accounts
+	// that haven't registered a validator.
+	ErrNotValidator = errors.New("account has no validator")
+
+	// ErrValidatorExists is returned when registering a validator that's
+	// already registered, or an account that already has a validator.
+	ErrValidatorExists = errors.New("validator already registered")
+
+	// ErrInsufficientStake is returned when unbonding more than the
+	// stake.
+	ErrInsufficientStake = errors.New("insufficient stake")
+
+	// ErrJailed is returned for validators that were removed for
+	// misbehaving.
+	ErrJailed = errors.New("validator is jailed")
+
+	// ErrRootMismatch is returned when restored accounts don't have the
+	// expected state root.
+	ErrRootMismatch = errors.New("state root mismatch")
+)
+
+// Account is the state of an account.
+type Account struct {
+	Balance uint64 `json:"balance"`
+
+	// Nonce is the nonce of the account's next transaction.
+	Nonce uint64 `json:"nonce"`
+
+	// Validator is the node address of the validator that the account
+	// operates.
+	Validator key.Address `json:"validator,omitempty"`
+
+	// Stake is the balance that's bonded to the validator.
+	Stake uint64 `json:"stake,omitempty"`
+
+	// Unbonding is the stake that's released to the balance once the
+	// unbonding period after the last unbond at UnbondHeight has passed.
+	Unbonding    uint64 `json:"unbonding,omitempty"`
+	UnbondHeight uint64 `json:"unbond_height,omitempty"`
+
+	// Jailed is set for validators that were slashed for misbehaving,
+	// which can't validate anymore.
+	Jailed bool `json:"jailed,omitempty"`
+}
+
+// staking reports whether the account has any staking state.
+func (a Account) staking() bool {
+	return a.Validator != "" || a.Stake != 0 || a.Unbonding != 0 || a.UnbondHeight != 0 || a.Jailed
+}
+
+// leafHash returns the hash of the account as leaf of the state root. The
+// staking state is only encoded for accounts that have any, so accounts
+// without stake hash the same as before staking existed.
+func leafHash(addr key.Address, a Account) []byte {
+	b := make([]byte, 0, 1+len(addr)+16)
+	b = append(b, byte(len(addr)))
+	b = append(b, addr...)
+	b = canonical.AppendUint64(b, a.Balance)
+	b = canonical.AppendUint64(b, a.Nonce)
+	if a.staking() {
+		b = append(b, byte(len(a.Validator)))
+		b = append(b, a.Validator...)
+		b = canonical.AppendUint64(b, a.Stake)
+		b = canonical.AppendUint64(b, a.Unbonding)
+		b = canonical.AppendUint64(b, a.UnbondHeight)
+		if a.Jailed {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+	}
+	return merkle.LeafHash(b)
+}
+
+// RootOf returns the hex encoded state root of the accounts.
+func RootOf(accounts map[key.Address]Account) string {
+	addrs := make([]key.Address, 0, len(accounts))
+	for addr := range accounts {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+	hashes := make([][]byte, len(addrs))
+	for i, addr := range addrs {
+		hashes[i] = leafHash(addr, accounts[addr])
+	}
+
+	return hex.EncodeToString(merkle.RootOfHashes(hashes))
+}
+
+// =============================================================================
+
+// State is the account state.
+type State struct {
+	chainID string
+	storage Storage
+
+	mu        sync.RWMutex
+	accounts  map[key.Address]Account
+	leaves    map[key.Address][]byte
+	operators map[key.Address]key.Address
+	height    uint64
+	committed bool
+	root      string
+	onCommit  []func(height uint64)
+}
+
+// New returns the state that's committed to the storage.
+//
+// Transactions are validated for the provided chain ID.
+func New(chainID string, storage Storage) (*State, error) {
+	height, accounts, err := storage.Load()
+	switch {
+	case errors.Is(err, ErrNoState):
+		accounts = make(map[key.Address]Account)
+	case err != nil:
+		return nil, fmt.Errorf("loading state: %w", err)
+	}
+
+	s := State{
+		chainID:   chainID,
+		storage:   storage,
+		accounts:  accounts,
+		leaves:    make(map[key.Address][]byte, len(accounts)),
+		operators: make(map[key.Address]key.Address),
+		height:    height,
+		committed: err == nil,
+	}
+
+	for addr, a := range accounts {
+		s.leaves[addr] = leafHash(addr, a)
+		if a.Validator != "" {
+			s.operators[a.Validator] = addr
+		}
+	}
+	s.root = hex.EncodeToString(s.rootOf(nil))
+
+	return &s, nil
+}
+
+// Account returns the state of the account. Accounts that don't exist have
+// a zero balance and nonce.
+func (s *State) Account(addr key.Address) Account {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.accounts[addr]
+}
+
+// Nonce returns the nonce of the account's next transaction.
+func (s *State) Nonce(addr key.Address) uint64 {
+	return s.Account(addr).Nonce
+}
+
+// Balance returns the balance of the account.
+func (s *State) Balance(addr key.Address) uint64 {
+	return s.Account(addr).Balance
+}
+
+// Operator returns the address of the account that operates the validator.
+// The bool is false if the validator isn't registered.
+func (s *State) Operator(validator key.Address) (key.Address, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	addr, ok := s.operators[validator]
+	return addr, ok
+}
+
+// Height returns the height of the last committed batch. The bool is
+// false if nothing has been committed yet.
+func (s *State) Height() (uint64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.height, s.committed
+}
+
+// Root returns the hex encoded state root.
+func (s *State) Root() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.root
+}
+
+// Accounts returns a copy of all accounts.
+func (s *State) Accounts() map[key.Address]Account {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m := make(map[key.Address]Account, len(s.accounts))
+	for addr, a := range s.accounts {
+		m[addr] = a
+	}
+	return m
+}
+
+// Snapshot returns the committed height, the state root and a copy of all
+// accounts, which are consistent with each other.
+func (s *State) Snapshot() (uint64, string, map[key.Address]Account) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m := make(map[key.Address]Account, len(s.accounts))
+	for addr, a := range s.accounts {
+		m[addr] = a
+	}
+	return s.height, s.root, m
+}
+
+// OnCommit registers a function that's called with the height of every
+// committed batch. It's called after the commit, by the goroutine that
+// committed the batch, so no other batch is committed by that goroutine
+// before it returns.
+func (s *State) OnCommit(f func(height uint64)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onCommit = append(s.onCommit, f)
+}
+
+// Restore replaces the state at the genesis height with the accounts of a
+// snapshot at the provided height, which must have the provided state
+// root. The accounts must include the accounts of the genesis, as
+// accounts are never removed.
+func (s *State) Restore(height uint64, root string, accounts map[key.Address]Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.committed || s.height != 0 {
+		return fmt.Errorf("%w: restoring state at height %d", ErrInvalidHeight, s.height)
+	}
+	if height == 0 {
+		return fmt.Errorf("%w: restoring snapshot at genesis", ErrInvalidHeight)
+	}
+
+	for addr := range s.accounts {
+		if _, ok := accounts[addr]; !ok {
+			return fmt.Errorf("snapshot misses account %s", addr)
+		}
+	}
+
+	if got := RootOf(accounts); got != root {
+		return fmt.Errorf("%w: got %s, expected %s", ErrRootMismatch, got, root)
+	}
+
+	m := make(map[key.Address]Account, len(accounts))
+	for addr, a := range accounts {
+		m[addr] = a
+	}
+
+	if err := s.storage.Commit(height, m); err != nil {
+		return fmt.Errorf("committing state: %w", err)
+	}
+
+	s.accounts = m
+	s.leaves = make(map[key.Address][]byte, len(m))
+	s.operators = make(map[key.Address]key.Address)
+	for addr, a := range m {
+		s.leaves[addr] = leafHash(addr, a)
+		if a.Validator != "" {
+			s.operators[a.Validator] = addr
+		}
+	}
+	s.height = height
+	s.root = root
+
+	return nil
+}
+
+// Close closes the storage.
+func (s *State) Close() error {
+	return s.storage.Close()
+}
+
+// rootOf returns the state root with the changes applied. The caller must
+// hold the lock.
+func (s *State) rootOf(changes map[key.Address]Account) []byte {
+	addrs := make([]key.Address, 0, len(s.accounts)+len(changes))
+	for addr := range s.accounts {
+		addrs = append(addrs, addr)
+	}
+	for addr := range changes {
+		if _, ok := s.accounts[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+	hashes := make([][]byte, len(addrs))
+	for i, addr := range addrs {
+		if a, ok := changes[addr]; ok {
+			hashes[i] = leafHash(addr, a)
+			continue
+		}
+		hashes[i] = s.leaves[addr]
+	}
+
+	return merkle.RootOfHashes(hashes)
+}
+
+// Begin starts a batch of changes for the block at the provided height.
+func (s *State) Begin(height uint64) *Batch {
+	return &Batch{
+		state:     s,
+		height:    height,
+		changes:   make(map[key.Address]Account),
+		operators: make(map[key.Address]key.Address),
+	}
+}
+
+// =============================================================================
+
+// Batch holds changes to the state until they're committed.
+//
+// A batch isn't safe for concurrent use, also not with the batches stacked
+// on it.
+type Batch struct {
+	state     *State
+	parent    *Batch
+	height    uint64
+	changes   map[key.Address]Account
+	committed bool
+
+	// operators are the accounts of the validators registered in the
+	// batch, by validator.
+	operators map[key.Address]key.Address
+}
+
+// Begin starts a batch stacked on top of this batch, for the block at the
+// provided height. The new batch sees the changes of this batch, and can
+// only be committed after this batch.
+func (b *Batch) Begin(height uint64) *Batch {
+	return &Batch{
+		state:     b.state,
+		parent:    b,
+		height:    height,
+		changes:   make(map[key.Address]Account),
+		operators: make(map[key.Address]key.Address),
+	}
+}
+
+// pending returns the uncommitted batches that this batch is stacked on,
+// oldest first, including this batch.
+func (b *Batch) pending() []*Batch {
+	var bs []*Batch
+	for p := b; p != nil && !p.committed; p = p.parent {
+		bs = append(bs, p)
+	}
+
+	for i, j := 0, len(bs)-1; i < j; i, j = i+1, j-1 {
+		bs[i], bs[j] = bs[j], bs[i]
+	}
+
+	return bs
+}
+
+// merged returns the changes of the uncommitted batches up to and
+// including this batch.
+func (b *Batch) merged() map[key.Address]Account {
+	bs := b.pending()
+	if len(bs) == 1 {
+		return b.changes
+	}
+
+	m := make(map[key.Address]Account)
+	for _, p := range bs {
+		for addr, a := range p.changes {
+			m[addr] = a
+		}
+	}
+	return m
+}
+
+// Height returns the height of the batch.
+func (b *Batch) Height() uint64 {
+	return b.height
+}
+
+// Account returns the state of the account with the changes of the batch.
+func (b *Batch) Account(addr key.Address) Account {
+	for p := b; p != nil && !p.committed; p = p.parent {
+		if a, ok := p.changes[addr]; ok {
+			return a
+		}
+	}
+	return b.state.Account(addr)
+}
+
+// Apply validates the transaction and applies it.
+//
+// The transaction's nonce must be the nonce of the sender and the sender's
+// balance must cover its cost. The fee is deducted from the sender and
+// credited to the fee recipient, if any. The batch is unchanged when the
+// transaction fails.
+func (b *Batch) Apply(stx tx.SignedTx, feeRecipient key.Address) error {
+	if err := stx.Validate(b.state.chainID); err != nil {
+		return err
+	}
+
+	from := b.Account(stx.From)
+	if stx.Nonce != from.Nonce {
+		return fmt.Errorf("%w: got %d, expected %d", ErrInvalidNonce, stx.Nonce, from.Nonce)
+	}
+
+	if from.Balance < stx.Cost() {
+		return fmt.Errorf("%w: balance %d, cost %d", ErrInsufficientFunds, from.Balance, stx.Cost())
+	}
+
+	from.Balance -= stx.Cost()
+	from.Nonce++
+
+	switch stx.Type {
+	case tx.TypeRegister:
+		if from.Validator != "" {
+			return fmt.Errorf("%w: account operates %s", ErrValidatorExists, from.Validator)
+		}
+		if _, ok := b.Operator(stx.Validator); ok {
+			return fmt.Errorf("%w: %s", ErrValidatorExists, stx.Validator)
+		}
+		from.Validator = stx.Validator
+
+	case tx.TypeBond:
+		switch {
+		case from.Validator == "":
+			return ErrNotValidator
+		case from.Jailed:
+			return fmt.Errorf("%w: %s", ErrJailed, from.Validator)
+		case from.Stake > math.MaxUint64-stx.Amount:
+			return fmt.Errorf("%w: stake of %s", ErrBalanceOverflow, stx.From)
+		}
+		from.Stake += stx.Amount
+
+	case tx.TypeUnbond:
+		switch {
+		case from.Stake < stx.Amount:
+			return fmt.Errorf("%w: stake %d, unbonding %d", ErrInsufficientStake, from.Stake, stx.Amount)
+		case from.Unbonding > math.MaxUint64-stx.Amount:
+			return fmt.Errorf("%w: unbonding stake of %s", ErrBalanceOverflow, stx.From)
+		}
+		from.Stake -= stx.Amount
+		from.Unbonding += stx.Amount
+		from.UnbondHeight = b.height
+	}
+
+	// Credits are checked on a copy, so a failing credit leaves the batch
+	// unchanged.
+	changes := map[key.Address]Account{stx.From: from}
+	credit := func(addr key.Address, amount uint64) error {
+		a, ok := changes[addr]
+		if !ok {
+			a = b.Account(addr)
+		}
+		if a.Balance > math.MaxUint64-amount {
+			return fmt.Errorf("%w: %s", ErrBalanceOverflow, addr)
+		}
+		a.Balance += amount
+		changes[addr] = a
+		return nil
+	}
+
+	if stx.Type == tx.TypeTransfer {
+		if err := credit(stx.To, stx.Amount); err != nil {
+			return err
+		}
+	}
+
+	if feeRecipient != "" && stx.Fee > 0 {
+		if err := credit(feeRecipient, stx.Fee); err != nil {
+			return err
+		}
+	}
+
+	for addr, a := range changes {
+		b.changes[addr] = a
+	}
+	if stx.Type == tx.TypeRegister {
+		b.operators[stx.Validator] = stx.From
+	}
+
+	return nil
+}
+
+// Credit adds the amount to the balance of the account, such as for
+// genesis allocations and rewards.
+func (b *Batch) Credit(addr key.Address, amount uint64) error {
+	if err := addr.Validate(); err != nil || !addr.IsAccount() {
+		return fmt.Errorf("%s is not an account address", addr)
+	}
+
+	a := b.Account(addr)
+	if a.Balance > math.MaxUint64-amount {
+		return fmt.Errorf("%w: %s", ErrBalanceOverflow, addr)
+	}
+	a.Balance += amount
+	b.changes[addr] = a
+
+	return nil
+}
+
+// Accounts returns all accounts with the changes of the batch.
+func (b *Batch) Accounts() map[key.Address]Account {
+	m := b.state.Accounts()
+	for addr, a := range b.merged() {
+		m[addr] = a
+	}
+	return m
+}
+
+// Operator returns the address of the account that operates the validator.
+// The bool is false if the validator isn't registered.
+func (b *Batch) Operator(validator key.Address) (key.Address, bool) {
+	for p := b; p != nil && !p.committed; p = p.parent {
+		if addr, ok := p.operators[validator]; ok {
+			return addr, true
+		}
+	}
+	return b.state.Operator(validator)
+}
+
+// Bond registers the validator to the account, unless it already operates
+// it, and adds the amount to its stake without taking it from the balance,
+// such as for genesis validators.
+func (b *Batch) Bond(addr, validator key.Address, amount uint64) error {
+	if err := addr.Validate(); err != nil || !addr.IsAccount() {
+		return fmt.Errorf("%s is not an account address", addr)
+	}
+
+	a := b.Account(addr)
+	if a.Validator != validator {
+		if a.Validator != "" {
+			return fmt.Errorf("%w: account operates %s", ErrValidatorExists, a.Validator)
+		}
+		if _, ok := b.Operator(validator); ok {
+			return fmt.Errorf("%w: %s", ErrValidatorExists, validator)
+		}
+		a.Validator = validator
+	}
+
+	if a.Stake > math.MaxUint64-amount {
+		return fmt.Errorf("%w: stake of %s", ErrBalanceOverflow, addr)
+	}
+	a.Stake += amount
+	b.changes[addr] = a
+	b.operators[validator] = addr
+
+	return nil
+}
+
+// Slash burns the percentage of the stake of the validator, including the
+// stake that's unbonding, and jails it. Returns ErrJailed if the validator
+// is already jailed, so it's only slashed once.
+func (b *Batch) Slash(validator key.Address, percent uint64) error {
+	addr, ok := b.Operator(validator)
+	if !ok {
+		return fmt.Errorf("%w: %s isn't registered", ErrNotValidator, validator)
+	}
+
+	a := b.Account(addr)
+	if a.Jailed {
+		return fmt.Errorf("%w: %s", ErrJailed, validator)
+	}
+
+	a.Stake -= portion(a.Stake, percent)
+	a.Unbonding -= portion(a.Unbonding, percent)
+	a.Jailed = true
+	b.changes[addr] = a
+
+	return nil
+}
+
+// Release releases the unbonding stake of which the unbonding period has
+// passed to the balances.
+func (b *Batch) Release(period uint64) {
+	for addr, a := range b.Accounts() {
+		if a.Unbonding == 0 || b.height < a.UnbondHeight+period {
+			continue
+		}
+
+		// The balance can't overflow, as the stake was part of it.
+		a.Balance += a.Unbonding
+		a.Unbonding = 0
+		a.UnbondHeight = 0
+		b.changes[addr] = a
+	}
+}
+
+// portion returns the percentage of the amount, without overflowing.
+func portion(amount, percent uint64) uint64 {
+	if percent >= 100 {
+		return amount
+	}
+	return amount/100*percent + amount%100*percent/100
+}
+
+// Root returns the hex encoded state root with the changes of the batch
+// applied.
+func (b *Batch) Root() string {
+	b.state.mu.RLock()
+	defer b.state.mu.RUnlock()
+
+	return hex.EncodeToString(b.state.rootOf(b.merged()))
+}
+
+// Commit writes the changes to the storage and applies them to the state.
+//
+// The height must follow the committed height, or be any height if
+// nothing has been committed yet. A stacked batch can only be committed
+// after the batch it's stacked on. The state is unchanged when the commit
+// fails.
+func (b *Batch) Commit() error {
+	if b.committed {
+		return errors.New("batch already committed")
+	}
+
+	if b.parent != nil && !b.parent.committed {
+		return ErrNotCommitted
+	}
+
+	onCommit, err := b.commit()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range onCommit {
+		f(b.height)
+	}
+
+	return nil
+}
+
+// commit applies the changes to the storage and the state, and returns the
+// functions to call for the commit.
+func (b *Batch) commit() ([]func(uint64), error) {
+	s := b.state
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.committed && b.height != s.height+1 {
+		return nil, fmt.Errorf("%w: got %d, expected %d", ErrInvalidHeight, b.height, s.height+1)
+	}
+
+	if err := s.storage.Commit(b.height, b.changes); err != nil {
+		return nil, fmt.Errorf("committing state: %w", err)
+	}
+
+	root := s.rootOf(b.changes)
+	for addr, a := range b.changes {
+		s.accounts[addr] = a
+		s.leaves[addr] = leafHash(addr, a)
+		if a.Validator != "" {
+			s.operators[a.Validator] = addr
+		}
+	}
+	s.height = b.height
+	s.committed = true
+	s.root = hex.EncodeToString(root)
+
+	// The changes are kept, as they're part of the state now, but stacked
+	// batches no longer read them from this batch.
+	b.committed = true
+	b.parent = nil
+
+	return s.onCommit, nil
+}
@@ -0,0 +1,403 @@
+package state_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/state"
+	"github.com/toqns/toqns/business/tx"
+)
+
+// Success and failure markers.
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+const chainID = "toqns-test"
+
+func TestState(t *testing.T) {
+	alice, aliceAddr := newAccount(t)
+	_, bobAddr := newAccount(t)
+	_, feeAddr := newAccount(t)
+
+	t.Log("Given the need to apply transactions to the account state.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen applying a block of transactions.", testID)
+		{
+			s, err := state.New(chainID, state.NewMemoryStorage())
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to create the state: %v.", failed, testID, err)
+			}
+			emptyRoot := s.Root()
+
+			genesis := s.Begin(0)
+			if err := genesis.Credit(aliceAddr, 1000); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to credit the account: %v.", failed, testID, err)
+			}
+			if err := genesis.Commit(); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to commit genesis: %v.", failed, testID, err)
+			}
+			if s.Root() == emptyRoot {
+				t.Fatalf("\t%s\tTest %d:\tShould get a new root after commit.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get a new root after commit.", success, testID)
+
+			b := s.Begin(1)
+			if err := b.Apply(transfer(t, alice, aliceAddr, bobAddr, 0, 100, 10), feeAddr); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to apply the transaction: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to apply the transaction.", success, testID)
+
+			if err := b.Apply(transfer(t, alice, aliceAddr, bobAddr, 0, 100, 10), feeAddr); !errors.Is(err, state.ErrInvalidNonce) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInvalidNonce for a reused nonce, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrInvalidNonce for a reused nonce.", success, testID)
+
+			if err := b.Apply(transfer(t, alice, aliceAddr, bobAddr, 1, 900, 10), feeAddr); !errors.Is(err, state.ErrInsufficientFunds) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInsufficientFunds, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrInsufficientFunds.", success, testID)
+
+			if s.Balance(bobAddr) != 0 {
+				t.Fatalf("\t%s\tTest %d:\tShould not change the state before commit.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not change the state before commit.", success, testID)
+
+			root := b.Root()
+			if err := b.Commit(); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to commit the block: %v.", failed, testID, err)
+			}
+			if s.Root() != root {
+				t.Fatalf("\t%s\tTest %d:\tShould get the root of the batch, got %s, expected %s.", failed, testID, s.Root(), root)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the root of the batch.", success, testID)
+
+			want := map[key.Address]state.Account{
+				aliceAddr: {Balance: 890, Nonce: 1},
+				bobAddr:   {Balance: 100},
+				feeAddr:   {Balance: 10},
+			}
+			for addr, a := range want {
+				if got := s.Account(addr); got != a {
+					t.Fatalf("\t%s\tTest %d:\tShould get %+v for %s, but got %+v.", failed, testID, a, addr, got)
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the updated balances and nonces.", success, testID)
+
+			if err := s.Begin(3).Commit(); !errors.Is(err, state.ErrInvalidHeight) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInvalidHeight for a skipped height, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrInvalidHeight for a skipped height.", success, testID)
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen computing the state root.", testID)
+		{
+			// The same accounts credited in a different order.
+			s1, _ := state.New(chainID, state.NewMemoryStorage())
+			b1 := s1.Begin(0)
+			b1.Credit(aliceAddr, 1)
+			b1.Credit(bobAddr, 2)
+
+			s2, _ := state.New(chainID, state.NewMemoryStorage())
+			b2 := s2.Begin(0)
+			b2.Credit(bobAddr, 2)
+			b2.Credit(aliceAddr, 1)
+
+			if b1.Root() != b2.Root() {
+				t.Fatalf("\t%s\tTest %d:\tShould get the same root regardless of order.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the same root regardless of order.", success, testID)
+
+			b2.Credit(aliceAddr, 1)
+			if b1.Root() == b2.Root() {
+				t.Fatalf("\t%s\tTest %d:\tShould get a different root for different balances.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get a different root for different balances.", success, testID)
+		}
+
+		testID = 2
+		t.Logf("\tTest %d:\tWhen storing the state in a file.", testID)
+		{
+			dir := t.TempDir()
+
+			fs, err := state.OpenFileStorage(dir)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to open the storage: %v.", failed, testID, err)
+			}
+			s, _ := state.New(chainID, fs)
+
+			b := s.Begin(0)
+			b.Credit(aliceAddr, 1000)
+			b.Commit()
+
+			b = s.Begin(1)
+			b.Apply(transfer(t, alice, aliceAddr, bobAddr, 0, 100, 10), feeAddr)
+			b.Commit()
+
+			root := s.Root()
+			s.Close()
+
+			// Simulate a crash while writing the next record.
+			f, err := os.OpenFile(filepath.Join(dir, "state.journal"), os.O_WRONLY|os.O_APPEND, 0600)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to open the journal: %v.", failed, testID, err)
+			}
+			f.Write([]byte{0, 0, 1, 0, 42, 42})
+			f.Close()
+
+			fs, err = state.OpenFileStorage(dir)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to reopen the storage with a partial record: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to reopen the storage with a partial record.", success, testID)
+
+			s, _ = state.New(chainID, fs)
+			defer s.Close()
+
+			if h, _ := s.Height(); h != 1 || s.Root() != root {
+				t.Fatalf("\t%s\tTest %d:\tShould restore height 1 and root %s, but got %d and %s.", failed, testID, root, h, s.Root())
+			}
+			t.Logf("\t%s\tTest %d:\tShould restore the committed height and root.", success, testID)
+
+			b = s.Begin(2)
+			if err := b.Apply(transfer(t, alice, aliceAddr, bobAddr, 1, 100, 10), feeAddr); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to apply the next transaction: %v.", failed, testID, err)
+			}
+			if err := b.Commit(); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to commit after recovery: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to commit after recovery.", success, testID)
+		}
+	}
+}
+
+func TestStackedBatches(t *testing.T) {
+	alice, aliceAddr := newAccount(t)
+	_, bobAddr := newAccount(t)
+
+	t.Log("Given the need to apply blocks on top of blocks that aren't final.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen stacking batches.", testID)
+		{
+			s, _ := state.New(chainID, state.NewMemoryStorage())
+			genesis := s.Begin(0)
+			genesis.Credit(aliceAddr, 1000)
+			genesis.Commit()
+
+			b1 := s.Begin(1)
+			b1.Apply(transfer(t, alice, aliceAddr, bobAddr, 0, 100, 0), "")
+
+			b2 := b1.Begin(2)
+			if err := b2.Apply(transfer(t, alice, aliceAddr, bobAddr, 1, 100, 0), ""); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould see the changes of the batch below: %v.", failed, testID, err)
+			}
+			if b2.Account(bobAddr).Balance != 200 {
+				t.Fatalf("\t%s\tTest %d:\tShould get balance 200, but got %d.", failed, testID, b2.Account(bobAddr).Balance)
+			}
+			t.Logf("\t%s\tTest %d:\tShould see the changes of the batch below.", success, testID)
+
+			if err := b2.Commit(); !errors.Is(err, state.ErrNotCommitted) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrNotCommitted before the batch below is committed, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrNotCommitted before the batch below is committed.", success, testID)
+
+			root := b2.Root()
+			if err := b1.Commit(); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to commit the batch below: %v.", failed, testID, err)
+			}
+			if b2.Root() != root {
+				t.Fatalf("\t%s\tTest %d:\tShould keep the root of the stacked batch after the commit below.", failed, testID)
+			}
+			if err := b2.Commit(); err != nil || s.Root() != root {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to commit the stacked batch: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to commit the stacked batch.", success, testID)
+		}
+	}
+}
+
+func TestStaking(t *testing.T) {
+	alice, aliceAddr := newAccount(t)
+	node, _ := key.New()
+	validator, _ := node.Address(key.NodeAddress)
+
+	t.Log("Given the need to bond stake to validators.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen registering, bonding and unbonding.", testID)
+		{
+			s, _ := state.New(chainID, state.NewMemoryStorage())
+			genesis := s.Begin(0)
+			genesis.Credit(aliceAddr, 1000)
+			genesis.Commit()
+
+			b := s.Begin(1)
+			if err := b.Apply(staking(t, alice, aliceAddr, tx.TypeBond, 0, 100), ""); !errors.Is(err, state.ErrNotValidator) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrNotValidator before registering, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrNotValidator before registering.", success, testID)
+
+			if err := b.Apply(register(t, alice, aliceAddr, node, 0), ""); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to register the validator: %v.", failed, testID, err)
+			}
+			if addr, ok := b.Operator(validator); !ok || addr != aliceAddr {
+				t.Fatalf("\t%s\tTest %d:\tShould get the account as operator, but got %s.", failed, testID, addr)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to register the validator.", success, testID)
+
+			if err := b.Apply(staking(t, alice, aliceAddr, tx.TypeBond, 1, 600), ""); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to bond stake: %v.", failed, testID, err)
+			}
+			if a := b.Account(aliceAddr); a.Balance != 400 || a.Stake != 600 {
+				t.Fatalf("\t%s\tTest %d:\tShould move the amount to the stake, but got balance %d and stake %d.", failed, testID, a.Balance, a.Stake)
+			}
+			t.Logf("\t%s\tTest %d:\tShould move the amount to the stake.", success, testID)
+
+			if err := b.Apply(staking(t, alice, aliceAddr, tx.TypeUnbond, 2, 700), ""); !errors.Is(err, state.ErrInsufficientStake) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInsufficientStake, but got: %v.", failed, testID, err)
+			}
+			if err := b.Apply(staking(t, alice, aliceAddr, tx.TypeUnbond, 2, 200), ""); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to unbond stake: %v.", failed, testID, err)
+			}
+			b.Commit()
+			t.Logf("\t%s\tTest %d:\tShould be able to unbond stake.", success, testID)
+
+			b = s.Begin(5)
+			b.Release(10)
+			if a := b.Account(aliceAddr); a.Balance != 400 || a.Unbonding != 200 {
+				t.Fatalf("\t%s\tTest %d:\tShould not release stake before the unbonding period, but got balance %d.", failed, testID, a.Balance)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not release stake before the unbonding period.", success, testID)
+
+			b = s.Begin(11)
+			b.Release(10)
+			if a := b.Account(aliceAddr); a.Balance != 600 || a.Unbonding != 0 || a.Stake != 400 {
+				t.Fatalf("\t%s\tTest %d:\tShould release stake after the unbonding period, but got balance %d.", failed, testID, a.Balance)
+			}
+			t.Logf("\t%s\tTest %d:\tShould release stake after the unbonding period.", success, testID)
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen slashing a validator.", testID)
+		{
+			s, _ := state.New(chainID, state.NewMemoryStorage())
+			genesis := s.Begin(0)
+			if err := genesis.Bond(aliceAddr, validator, 1000); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to bond genesis stake: %v.", failed, testID, err)
+			}
+			genesis.Commit()
+
+			b := s.Begin(1)
+			if err := b.Slash(validator, 5); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to slash the validator: %v.", failed, testID, err)
+			}
+			if a := b.Account(aliceAddr); a.Stake != 950 || !a.Jailed {
+				t.Fatalf("\t%s\tTest %d:\tShould burn 5%% of the stake and jail, but got stake %d.", failed, testID, a.Stake)
+			}
+			t.Logf("\t%s\tTest %d:\tShould burn 5%% of the stake and jail.", success, testID)
+
+			if err := b.Slash(validator, 5); !errors.Is(err, state.ErrJailed) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrJailed when slashing twice, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrJailed when slashing twice.", success, testID)
+		}
+
+		testID = 2
+		t.Logf("\tTest %d:\tWhen looking up the operators of validators.", testID)
+		{
+			bob, bobAddr := newAccount(t)
+			carol, carolAddr := newAccount(t)
+			other, _ := key.New()
+			otherValidator, _ := other.Address(key.NodeAddress)
+
+			storage := state.NewMemoryStorage()
+			s, _ := state.New(chainID, storage)
+			genesis := s.Begin(0)
+			genesis.Bond(aliceAddr, validator, 1000)
+			genesis.Commit()
+
+			b := s.Begin(1)
+			if err := b.Apply(register(t, bob, bobAddr, other, 0), ""); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to register the validator: %v.", failed, testID, err)
+			}
+
+			stacked := b.Begin(2)
+			if addr, ok := stacked.Operator(otherValidator); !ok || addr != bobAddr {
+				t.Fatalf("\t%s\tTest %d:\tShould get the operator of the batch below, but got %s.", failed, testID, addr)
+			}
+			if err := stacked.Apply(register(t, carol, carolAddr, other, 0), ""); !errors.Is(err, state.ErrValidatorExists) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrValidatorExists, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the operators of the batches below.", success, testID)
+
+			if _, ok := s.Begin(1).Operator(otherValidator); ok {
+				t.Fatalf("\t%s\tTest %d:\tShould not get operators of other batches.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not get operators of other batches.", success, testID)
+
+			b.Commit()
+			if addr, ok := s.Operator(otherValidator); !ok || addr != bobAddr {
+				t.Fatalf("\t%s\tTest %d:\tShould get the operator once committed, but got %s.", failed, testID, addr)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the operator once committed.", success, testID)
+
+			s, _ = state.New(chainID, storage)
+			if addr, ok := s.Operator(validator); !ok || addr != aliceAddr {
+				t.Fatalf("\t%s\tTest %d:\tShould get the operator of the stored state, but got %s.", failed, testID, addr)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the operator of the stored state.", success, testID)
+		}
+	}
+}
+
+func newAccount(t *testing.T) (key.Key, key.Address) {
+	k, err := key.New()
+	if err != nil {
+		t.Fatalf("creating key: %v", err)
+	}
+
+	addr, err := k.Address(key.AccountAddress)
+	if err != nil {
+		t.Fatalf("getting address: %v", err)
+	}
+
+	return k, addr
+}
+
+func transfer(t *testing.T, k key.Key, from, to key.Address, nonce, amount, fee uint64) tx.SignedTx {
+	stx, err := tx.Tx{ChainID: chainID, Nonce: nonce, From: from, To: to, Amount: amount, Fee: fee}.Sign(k)
+	if err != nil {
+		t.Fatalf("signing transaction: %v", err)
+	}
+	return stx
+}
+
+func staking(t *testing.T, k key.Key, from key.Address, typ string, nonce, amount uint64) tx.SignedTx {
+	stx, err := tx.Tx{Type: typ, ChainID: chainID, Nonce: nonce, From: from, Amount: amount}.Sign(k)
+	if err != nil {
+		t.Fatalf("signing transaction: %v", err)
+	}
+	return stx
+}
+
+// register returns a registration of the validator with the node key, signed
+// by the operator.
+func register(t *testing.T, k key.Key, from key.Address, node key.Key, nonce uint64) tx.SignedTx {
+	reg, err := tx.Tx{Type: tx.TypeRegister, ChainID: chainID, Nonce: nonce, From: from}.SignValidator(node)
+	if err != nil {
+		t.Fatalf("signing registration: %v", err)
+	}
+
+	stx, err := reg.Sign(k)
+	if err != nil {
+		t.Fatalf("signing transaction: %v", err)
+	}
+	return stx
+}
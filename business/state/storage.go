@@ -0,0 +1,71 @@
+package state
+
+import (
+	"sync"
+
+	"github.com/toqns/toqns/business/key"
+)
+
+// Storage persists the committed account state.
+type Storage interface {
+	// Load returns the committed height and accounts. It returns
+	// ErrNoState if nothing has been committed yet.
+	Load() (uint64, map[key.Address]Account, error)
+
+	// Commit atomically stores the changed accounts of the batch at the
+	// provided height. Either all changes are stored, or none.
+	Commit(height uint64, changes map[key.Address]Account) error
+
+	// Close releases the resources of the storage.
+	Close() error
+}
+
+// MemoryStorage is a storage that keeps the state in memory, which is lost
+// when the process exits. It's meant for tests.
+type MemoryStorage struct {
+	mu        sync.Mutex
+	accounts  map[key.Address]Account
+	height    uint64
+	committed bool
+}
+
+// NewMemoryStorage returns an empty memory storage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{accounts: make(map[key.Address]Account)}
+}
+
+// Load implements the Storage interface.
+func (m *MemoryStorage) Load() (uint64, map[key.Address]Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.committed {
+		return 0, nil, ErrNoState
+	}
+
+	accounts := make(map[key.Address]Account, len(m.accounts))
+	for addr, a := range m.accounts {
+		accounts[addr] = a
+	}
+
+	return m.height, accounts, nil
+}
+
+// Commit implements the Storage interface.
+func (m *MemoryStorage) Commit(height uint64, changes map[key.Address]Account) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for addr, a := range changes {
+		m.accounts[addr] = a
+	}
+	m.height = height
+	m.committed = true
+
+	return nil
+}
+
+// Close implements the Storage interface.
+func (m *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,314 @@
+// Package tx provides the transactions that transfer Toqns between
+// accounts and that manage the stake of validators.
+package tx
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/foundation/canonical"
+)
+
+// MaxMemoSize is the maximum size of a memo in bytes.
+const MaxMemoSize = 256
+
+// Types of transactions.
+const (
+	// TypeTransfer transfers the amount to the receiving account.
+	TypeTransfer = ""
+
+	// TypeRegister registers the validator node address to the sending
+	// account, which operates the validator. The node key of the validator
+	// signs the registration, see SignValidator.
+	TypeRegister = "register_validator"
+
+	// TypeBond bonds the amount from the balance of the sending account
+	// as stake of its validator.
+	TypeBond = "bond"
+
+	// TypeUnbond unbonds the amount of stake, which is released to the
+	// balance after the unbonding period.
+	TypeUnbond = "unbond"
+)
+
+// signingPrefix is the domain prefix of the signed data of transactions.
+const signingPrefix = "toqns/tx:"
+
+// registerPrefix is the domain prefix of the data the node key of a
+// validator signs to be registered.
+const registerPrefix = "toqns/register:"
+
+// encodingVersion is the version of the canonical encoding.
+const encodingVersion = 1
+
+var (
+	// ErrInvalidTx is returned when a transaction fails validation.
+	ErrInvalidTx = errors.New("invalid transaction")
+
+	// ErrInvalidSignature is returned when the signature of a transaction
+	// doesn't verify or isn't made by the sender.
+	ErrInvalidSignature = errors.New("invalid transaction signature")
+)
+
+// Tx is a transfer of an amount of Toqns from one account to another, or
+// a staking operation of the sending account.
+//
+// Amounts and fees are in the smallest unit of Toqns.
+type Tx struct {
+	Type    string      `json:"type,omitempty"`
+	ChainID string      `json:"chain_id"`
+	Nonce   uint64      `json:"nonce"`
+	From    key.Address `json:"from"`
+	To      key.Address `json:"to,omitempty"`
+	Amount  uint64      `json:"amount"`
+	Fee     uint64      `json:"fee"`
+	Memo    string      `json:"memo,omitempty"`
+
+	// Validator is the node address of the validator to register.
+	Validator key.Address `json:"validator,omitempty"`
+
+	// ValidatorKey is the public key of the validator to register, and
+	// ValidatorSignature its signature of RegisterBytes. They prove that
+	// the validator agrees to be operated by the sending account.
+	ValidatorKey       *key.PublicKey `json:"validator_key,omitempty"`
+	ValidatorSignature string         `json:"validator_signature,omitempty"`
+}
+
+// Bytes returns the canonical encoding of the transaction.
+//
+// Fields are encoded in a fixed order, with integers as big endian uint64
+// and strings prefixed with their length as unsigned varint. The type and
+// validator of staking transactions follow the memo, so transfers encode
+// the same as before staking existed. Registrations end with the key and
+// signature of the validator.
+func (tx Tx) Bytes() []byte {
+	b := make([]byte, 0, 128+len(tx.Memo))
+	b = append(b, encodingVersion)
+	b = canonical.AppendString(b, tx.ChainID)
+	b = canonical.AppendUint64(b, tx.Nonce)
+	b = canonical.AppendString(b, string(tx.From))
+	b = canonical.AppendString(b, string(tx.To))
+	b = canonical.AppendUint64(b, tx.Amount)
+	b = canonical.AppendUint64(b, tx.Fee)
+	b = canonical.AppendString(b, tx.Memo)
+	if tx.Type != TypeTransfer {
+		b = canonical.AppendString(b, tx.Type)
+		b = canonical.AppendString(b, string(tx.Validator))
+	}
+	if tx.Type == TypeRegister {
+		var pub string
+		if tx.ValidatorKey != nil {
+			pub = tx.ValidatorKey.String()
+		}
+		b = canonical.AppendString(b, pub)
+		b = canonical.AppendString(b, tx.ValidatorSignature)
+	}
+	return b
+}
+
+// RegisterBytes returns the data that the node key of a validator signs to
+// be registered to the operator account on the chain.
+func RegisterBytes(chainID string, operator key.Address) []byte {
+	b := []byte(registerPrefix)
+	b = canonical.AppendString(b, chainID)
+	b = canonical.AppendString(b, string(operator))
+	return b
+}
+
+// SigningBytes returns the data that is signed by the sender, which is the
+// canonical encoding with a domain prefix.
+func (tx Tx) SigningBytes() []byte {
+	return append([]byte(signingPrefix), tx.Bytes()...)
+}
+
+// Hash returns the hex encoded hash of the transaction, which identifies
+// it.
+func (tx Tx) Hash() string {
+	return key.HashString(tx.SigningBytes())
+}
+
+// Sign signs the transaction.
+func (tx Tx) Sign(s key.Signer) (SignedTx, error) {
+	sig, err := s.Sign(tx.SigningBytes())
+	if err != nil {
+		return SignedTx{}, fmt.Errorf("signing transaction: %w", err)
+	}
+
+	return SignedTx{
+		Tx:        tx,
+		PublicKey: s.PublicKey(),
+		Signature: hex.EncodeToString(sig),
+	}, nil
+}
+
+// SignValidator returns the registration with the validator set to the
+// node address of the signer, and signed by it.
+func (tx Tx) SignValidator(s key.Signer) (Tx, error) {
+	pub := s.PublicKey()
+	validator, err := pub.Address(key.NodeAddress)
+	if err != nil {
+		return Tx{}, err
+	}
+
+	sig, err := s.Sign(RegisterBytes(tx.ChainID, tx.From))
+	if err != nil {
+		return Tx{}, fmt.Errorf("signing registration: %w", err)
+	}
+
+	tx.Validator = validator
+	tx.ValidatorKey = &pub
+	tx.ValidatorSignature = hex.EncodeToString(sig)
+
+	return tx, nil
+}
+
+// Validate performs the validation that doesn't depend on account state:
+// the chain ID, type, addresses, amount and memo, and the signature of the
+// validator of a registration.
+func (tx Tx) Validate(chainID string) error {
+	if tx.ChainID != chainID {
+		return fmt.Errorf("%w: chain id %q, expected %q", ErrInvalidTx, tx.ChainID, chainID)
+	}
+
+	if err := tx.From.Validate(); err != nil || !tx.From.IsAccount() {
+		return fmt.Errorf("%w: from is not an account address", ErrInvalidTx)
+	}
+
+	switch tx.Type {
+	case TypeTransfer:
+		if err := tx.To.Validate(); err != nil || !tx.To.IsAccount() {
+			return fmt.Errorf("%w: to is not an account address", ErrInvalidTx)
+		}
+		if tx.Validator != "" {
+			return fmt.Errorf("%w: transfer with validator", ErrInvalidTx)
+		}
+		if tx.Amount == 0 {
+			return fmt.Errorf("%w: zero amount", ErrInvalidTx)
+		}
+
+	case TypeRegister:
+		if err := tx.Validator.Validate(); err != nil || !tx.Validator.IsNode() {
+			return fmt.Errorf("%w: validator is not a node address", ErrInvalidTx)
+		}
+		if tx.To != "" || tx.Amount != 0 {
+			return fmt.Errorf("%w: register with receiver or amount", ErrInvalidTx)
+		}
+		if err := tx.verifyValidator(); err != nil {
+			return err
+		}
+
+	case TypeBond, TypeUnbond:
+		if tx.To != "" || tx.Validator != "" {
+			return fmt.Errorf("%w: %s with receiver or validator", ErrInvalidTx, tx.Type)
+		}
+		if tx.Amount == 0 {
+			return fmt.Errorf("%w: zero amount", ErrInvalidTx)
+		}
+
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidTx, tx.Type)
+	}
+
+	if tx.Type != TypeRegister && (tx.ValidatorKey != nil || tx.ValidatorSignature != "") {
+		return fmt.Errorf("%w: validator signature without registration", ErrInvalidTx)
+	}
+
+	if tx.Amount > math.MaxUint64-tx.Fee {
+		return fmt.Errorf("%w: amount and fee overflow", ErrInvalidTx)
+	}
+
+	if len(tx.Memo) > MaxMemoSize {
+		return fmt.Errorf("%w: memo of %d bytes exceeds %d", ErrInvalidTx, len(tx.Memo), MaxMemoSize)
+	}
+
+	return nil
+}
+
+// verifyValidator verifies that the validator of a registration signed it
+// with its node key.
+func (tx Tx) verifyValidator() error {
+	if tx.ValidatorKey == nil {
+		return fmt.Errorf("%w: register without validator key", ErrInvalidSignature)
+	}
+
+	addr, err := tx.ValidatorKey.Address(key.NodeAddress)
+	if err != nil || addr != tx.Validator {
+		return fmt.Errorf("%w: validator key is not the validator", ErrInvalidSignature)
+	}
+
+	sig, err := hex.DecodeString(tx.ValidatorSignature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	if err := tx.ValidatorKey.Verify(RegisterBytes(tx.ChainID, tx.From), sig); err != nil {
+		return fmt.Errorf("%w: validator: %v", ErrInvalidSignature, err)
+	}
+
+	return nil
+}
+
+// Cost returns what the transaction takes from the sender's balance: the
+// amount plus the fee for transfers and bonds, and the fee otherwise.
+func (tx Tx) Cost() uint64 {
+	switch tx.Type {
+	case TypeTransfer, TypeBond:
+		return tx.Amount + tx.Fee
+	}
+	return tx.Fee
+}
+
+// =============================================================================
+
+// SignedTx is a transaction with the authorization of the sender.
+//
+// The sender is authorized either by the signature of its key, or by the
+// authorization of a multisig account.
+type SignedTx struct {
+	Tx
+	PublicKey key.PublicKey      `json:"public_key,omitempty"`
+	Signature string             `json:"signature,omitempty"`
+	Multisig  *key.Authorization `json:"multisig,omitempty"`
+}
+
+// Validate validates the transaction and verifies that it's authorized by
+// the sender.
+func (stx SignedTx) Validate(chainID string) error {
+	if err := stx.Tx.Validate(chainID); err != nil {
+		return err
+	}
+
+	if stx.Multisig != nil {
+		addr, err := stx.Multisig.Multisig.Address()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+		}
+		if addr != stx.From {
+			return fmt.Errorf("%w: multisig is not the sender", ErrInvalidSignature)
+		}
+
+		if err := stx.Multisig.Verify(stx.SigningBytes()); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+		}
+		return nil
+	}
+
+	addr, err := stx.PublicKey.Address(key.AccountAddress)
+	if err != nil || addr != stx.From {
+		return fmt.Errorf("%w: public key is not the sender", ErrInvalidSignature)
+	}
+
+	sig, err := hex.DecodeString(stx.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	if err := stx.PublicKey.Verify(stx.SigningBytes(), sig); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package tx_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/toqns/toqns/business/key"
+	"github.com/toqns/toqns/business/tx"
+)
+
+// Success and failure markers.
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+func TestTx(t *testing.T) {
+	t.Log("Given the need to transfer Toqns between accounts.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen signing and validating a transaction.", testID)
+		{
+			k, _ := key.New()
+			to, _ := key.New()
+			from, _ := k.Address(key.AccountAddress)
+			toAddr, _ := to.Address(key.AccountAddress)
+
+			t1 := tx.Tx{ChainID: "testnet", Nonce: 1, From: from, To: toAddr, Amount: 100, Fee: 1, Memo: "rent"}
+
+			stx, err := t1.Sign(k)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to sign: %v.", failed, testID, err)
+			}
+			if err := stx.Validate("testnet"); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to validate: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to sign and validate.", success, testID)
+
+			altered := stx
+			altered.Amount = 900
+			if err := altered.Validate("testnet"); !errors.Is(err, tx.ErrInvalidSignature) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInvalidSignature for an altered amount, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrInvalidSignature for an altered amount.", success, testID)
+
+			if t1.Hash() == altered.Hash() {
+				t.Fatalf("\t%s\tTest %d:\tShould get a different hash for an altered amount.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get a different hash for an altered amount.", success, testID)
+
+			stolen, _ := tx.Tx{ChainID: "testnet", Nonce: 1, From: toAddr, To: from, Amount: 100}.Sign(k)
+			if err := stolen.Validate("testnet"); !errors.Is(err, tx.ErrInvalidSignature) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInvalidSignature when not signed by the sender, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrInvalidSignature when not signed by the sender.", success, testID)
+
+			if err := stx.Validate("mainnet"); !errors.Is(err, tx.ErrInvalidTx) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInvalidTx for another chain, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrInvalidTx for another chain.", success, testID)
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen validating transaction fields.", testID)
+		{
+			k, _ := key.New()
+			from, _ := k.Address(key.AccountAddress)
+			node, _ := k.Address(key.NodeAddress)
+
+			tt := []struct {
+				name string
+				tx   tx.Tx
+			}{
+				{"zeroAmount", tx.Tx{ChainID: "testnet", From: from, To: from}},
+				{"nodeAddress", tx.Tx{ChainID: "testnet", From: from, To: node, Amount: 1}},
+				{"badAddress", tx.Tx{ChainID: "testnet", From: from, To: "ac1234", Amount: 1}},
+				{"overflow", tx.Tx{ChainID: "testnet", From: from, To: from, Amount: 1 << 63, Fee: 1 << 63}},
+				{"memo", tx.Tx{ChainID: "testnet", From: from, To: from, Amount: 1, Memo: string(make([]byte, tx.MaxMemoSize+1))}},
+				{"unknownType", tx.Tx{Type: "mint", ChainID: "testnet", From: from, Amount: 1}},
+				{"registerAccount", tx.Tx{Type: tx.TypeRegister, ChainID: "testnet", From: from, Validator: from}},
+				{"registerAmount", tx.Tx{Type: tx.TypeRegister, ChainID: "testnet", From: from, Validator: node, Amount: 1}},
+				{"bondReceiver", tx.Tx{Type: tx.TypeBond, ChainID: "testnet", From: from, To: from, Amount: 1}},
+				{"unbondZero", tx.Tx{Type: tx.TypeUnbond, ChainID: "testnet", From: from}},
+			}
+
+			for _, tc := range tt {
+				t.Run(tc.name, func(t *testing.T) {
+					if err := tc.tx.Validate("testnet"); !errors.Is(err, tx.ErrInvalidTx) {
+						t.Fatalf("\t%s\tTest %d:\tShould get ErrInvalidTx, but got: %v.", failed, testID, err)
+					}
+					t.Logf("\t%s\tTest %d:\tShould get ErrInvalidTx.", success, testID)
+				})
+			}
+		}
+
+		testID = 2
+		t.Logf("\tTest %d:\tWhen sending from a multisig account.", testID)
+		{
+			k1, _ := key.New()
+			k2, _ := key.NewWithAlgorithm(key.Ed25519)
+			m, _ := key.NewMultisig(2, k1.PublicKey(), k2.PublicKey())
+			from, _ := m.Address()
+			to, _ := k1.Address(key.AccountAddress)
+
+			stx := tx.SignedTx{
+				Tx:       tx.Tx{ChainID: "testnet", From: from, To: to, Amount: 5},
+				Multisig: &key.Authorization{Multisig: m},
+			}
+			stx.Multisig.Sign(k1, stx.SigningBytes())
+			if err := stx.Validate("testnet"); !errors.Is(err, tx.ErrInvalidSignature) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInvalidSignature below the threshold, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrInvalidSignature below the threshold.", success, testID)
+
+			stx.Multisig.Sign(k2, stx.SigningBytes())
+			if err := stx.Validate("testnet"); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to validate: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to validate.", success, testID)
+		}
+
+		testID = 3
+		t.Logf("\tTest %d:\tWhen registering a validator.", testID)
+		{
+			k, _ := key.New()
+			from, _ := k.Address(key.AccountAddress)
+			node, _ := key.New()
+			other, _ := key.New()
+			otherAddr, _ := other.Address(key.AccountAddress)
+
+			reg, err := tx.Tx{Type: tx.TypeRegister, ChainID: "testnet", From: from}.SignValidator(node)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to sign the registration with the node key: %v.", failed, testID, err)
+			}
+			if validator, _ := node.Address(key.NodeAddress); reg.Validator != validator {
+				t.Fatalf("\t%s\tTest %d:\tShould register the node address %s, got %s.", failed, testID, validator, reg.Validator)
+			}
+			if err := reg.Validate("testnet"); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to validate: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to validate a registration signed by the node key.", success, testID)
+
+			unsigned := reg
+			unsigned.ValidatorKey = nil
+			unsigned.ValidatorSignature = ""
+			stolen := reg
+			stolen.From = otherAddr
+			otherChain := reg
+			otherChain.ChainID = "mainnet"
+			otherNode, _ := key.New()
+			otherValidator, _ := otherNode.Address(key.NodeAddress)
+			swapped := reg
+			swapped.Validator = otherValidator
+
+			tt := []struct {
+				name string
+				tx   tx.Tx
+			}{
+				{"unsigned", unsigned},
+				{"otherOperator", stolen},
+				{"otherValidator", swapped},
+				{"otherChain", otherChain},
+			}
+			for _, tc := range tt {
+				if err := tc.tx.Validate(tc.tx.ChainID); !errors.Is(err, tx.ErrInvalidSignature) {
+					t.Fatalf("\t%s\tTest %d:\tShould get ErrInvalidSignature for the %s registration, but got: %v.", failed, testID, tc.name, err)
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould reject registrations the node key didn't sign.", success, testID)
+
+			bond := tx.Tx{Type: tx.TypeBond, ChainID: "testnet", From: from, Amount: 1, ValidatorKey: reg.ValidatorKey, ValidatorSignature: reg.ValidatorSignature}
+			if err := bond.Validate("testnet"); !errors.Is(err, tx.ErrInvalidTx) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInvalidTx for a validator signature on a bond, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrInvalidTx for a validator signature on a bond.", success, testID)
+		}
+	}
+}
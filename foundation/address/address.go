@@ -1,17 +1,39 @@
-// Package address provides functiona;ity for global network addresses.
+// Package address provides functionality for global network addresses.
+//
+// Addresses are encoded as strings in the following format, in ABNF
+// (RFC 5234) notation:
+//
+//	address     = id "@" host "/" port "/" proto [ "/" destination ]
+//	id          = 1*( ALPHA / DIGIT )
+//	host        = IPv4address / IPv6address / hostname
+//	port        = nz-digit *4DIGIT            ; 1-65535
+//	proto       = 1*( %x61-7A / DIGIT )       ; lowercase, e.g. "udp"
+//	destination = 1*( ALPHA / DIGIT / "-" / "." / "_" / "~" / ":" )
+//	nz-digit    = %x31-39
+//
+// IPv6 addresses are not enclosed in brackets and hostnames are as defined
+// by RFC 1123, but with a top level label that isn't all-numeric.
+//
+// The canonical encoding, as returned by String, uses the shortest form of
+// IP addresses and lowercase hostnames. Parsing the canonical encoding
+// results in an equal address.
 package address
 
 import (
 	"errors"
 	"fmt"
 	"net"
-	"regexp"
 	"strconv"
+	"strings"
 )
 
 // Address represents a general address with and ID, IP, port, protocol and optional destination.
+//
+// Instead of an IP, an address can have a hostname in Host, which is
+// resolved with Resolve.
 type Address struct {
 	ID          string
+	Host        string
 	ExtIP       *net.IP
 	LocIP       *net.IP
 	Port        uint
@@ -26,68 +48,137 @@ var (
 	// ErrInvalidPortNumber is an error to indicate that the port of an address is incorrect.
 	ErrInvalidPortNumber = errors.New("invalid port number in address")
 
-	// ErrInvalidIPAddr is an error to indicate that the IP of and address is incorrect.
-	ErrInvalidIPAddr = errors.New("invalid ip in address")
+	// ErrInvalidIPAddr is an error to indicate that the IP or hostname of an address is incorrect.
+	ErrInvalidIPAddr = errors.New("invalid ip or hostname in address")
+
+	// ErrInvalidID is an error to indicate that the ID of an address is incorrect.
+	ErrInvalidID = errors.New("invalid id in address")
 
-	// ErrInvalidIPAddr is an error to indicate that the ID of an address is incorrect.
-	// ErrInvalidID = errors.New("invalid id")
+	// ErrInvalidProtocol is an error to indicate that the protocol of an address is incorrect.
+	ErrInvalidProtocol = errors.New("invalid protocol in address")
+
+	// ErrInvalidDestination is an error to indicate that the destination of an address is incorrect.
+	ErrInvalidDestination = errors.New("invalid destination in address")
 )
 
 // Parse parses an address string to an Address.
 //
-// The address string should be in the format: id@ip/port.
-// IP can be IPv4 or IPv6.
+// The address string should be in the format: id@ip/port/protocol[/destination].
+// IP can be IPv4 or IPv6, or a hostname that can be resolved with Resolve.
+// See the package documentation for the full grammar.
 func Parse(v string) (Address, error) {
-	re, err := regexp.Compile(`(?P<id>.+)@(?P<ip>\S+)/(?P<port>\d+)/(?P<proto>.+)/?(?P<dest>.+)?`)
-	if err != nil {
-		return Address{}, fmt.Errorf("regex compilation failed: %v", err)
+	i := strings.IndexByte(v, '@')
+	if i <= 0 {
+		return Address{}, ErrMalformedAddressString
 	}
+	id, rest := v[:i], v[i+1:]
 
-	res := re.FindStringSubmatch(v)
-	if len(res) < 5 {
+	parts := strings.Split(rest, "/")
+	if len(parts) != 3 && len(parts) != 4 {
 		return Address{}, ErrMalformedAddressString
 	}
-	id := res[1]
-	ipStr := res[2]
-	portStr := res[3]
-	proto := res[4]
-	dest := ""
-	if len(res) == 6 {
-		dest = res[5]
+	for _, p := range parts {
+		if p == "" {
+			return Address{}, ErrMalformedAddressString
+		}
 	}
+	host, portStr, proto := parts[0], parts[1], parts[2]
 
-	port, err := strconv.Atoi(portStr)
-	if err != nil {
-		return Address{}, ErrInvalidPortNumber
+	if !isDigits(portStr) {
+		return Address{}, ErrMalformedAddressString
 	}
-	if port <= 0 {
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 || portStr[0] == '0' {
 		return Address{}, ErrInvalidPortNumber
 	}
 
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		return Address{}, ErrInvalidIPAddr
-	}
-
 	addr := Address{
-		ID:          id,
-		Port:        uint(port),
-		Proto:       proto,
-		Destination: dest,
+		ID:    id,
+		Port:  uint(port),
+		Proto: proto,
+	}
+	if len(parts) == 4 {
+		addr.Destination = parts[3]
 	}
 
-	if ip.IsPrivate() || ip.IsUnspecified() {
-		addr.LocIP = &ip
+	if ip := net.ParseIP(host); ip != nil {
+		addr.setIP(ip)
 	} else {
-		addr.ExtIP = &ip
+		if !IsHostname(host) || strings.HasSuffix(host, ".") {
+			return Address{}, ErrInvalidIPAddr
+		}
+		addr.Host = strings.ToLower(host)
+	}
+
+	if err := addr.Validate(); err != nil {
+		return Address{}, err
 	}
 
 	return addr, nil
 }
 
+// Validate checks whether the address conforms to the address grammar.
+func (a Address) Validate() error {
+	if !IsID(a.ID) {
+		return ErrInvalidID
+	}
+
+	if !a.HasIP() && !IsHostname(a.Host) {
+		return ErrInvalidIPAddr
+	}
+
+	if a.Port == 0 || a.Port > 65535 {
+		return ErrInvalidPortNumber
+	}
+
+	if a.Proto == "" {
+		return ErrInvalidProtocol
+	}
+	for _, c := range a.Proto {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') {
+			return ErrInvalidProtocol
+		}
+	}
+
+	if a.Destination != "" && !IsDestination(a.Destination) {
+		return ErrInvalidDestination
+	}
+
+	return nil
+}
+
+// IsID reports whether v is a valid address ID.
+func IsID(v string) bool {
+	return v != "" && isAlnum(v)
+}
+
+// IsDestination reports whether v is a valid address destination.
+func IsDestination(v string) bool {
+	if v == "" {
+		return false
+	}
+	for _, c := range v {
+		if !isAlnumRune(c) && !strings.ContainsRune("-._~:", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// setIP sets the IP as external or local IP depending on its range.
+func (a *Address) setIP(ip net.IP) {
+	a.ExtIP = nil
+	a.LocIP = nil
+	if ip.IsPrivate() || ip.IsUnspecified() || ip.IsLoopback() {
+		a.LocIP = &ip
+	} else {
+		a.ExtIP = &ip
+	}
+}
+
 // IP returns the external IP address if set, or else the local IP address.
 //
-// Panics is no external or local IP address is set.
+// Returns nil if no external or local IP address is set.
 func (a Address) IP() net.IP {
 	if a.ExtIP != nil {
 		return *a.ExtIP
@@ -97,20 +188,136 @@ func (a Address) IP() net.IP {
 		return *a.LocIP
 	}
 
-	panic("nil ips")
+	return nil
+}
+
+// HasIP reports whether an external or local IP address is set.
+func (a Address) HasIP() bool {
+	return a.ExtIP != nil || a.LocIP != nil
 }
 
-// String implements the stringer interface and returns the address string.
+// String implements the stringer interface and returns the address string
+// in its canonical encoding.
+//
+// The hostname is used when the address has one, even if it has been
+// resolved.
 func (a Address) String() string {
-	return fmt.Sprintf("%s@%s/%d/%s", a.ID, a.IP().String(), a.Port, a.Proto)
+	host := a.Host
+	if host == "" && a.HasIP() {
+		host = a.IP().String()
+	}
+
+	s := fmt.Sprintf("%s@%s/%d/%s", a.ID, host, a.Port, a.Proto)
+	if a.Destination != "" {
+		s += "/" + a.Destination
+	}
+
+	return s
 }
 
 // Addr returns a host address string as in the format ip:port.
+//
+// For addresses with a hostname that haven't been resolved, the format is
+// host:port.
 func (a Address) Addr() string {
-	ip := a.IP()
+	if !a.HasIP() {
+		return net.JoinHostPort(a.Host, strconv.Itoa(int(a.Port)))
+	}
+	return net.JoinHostPort(a.IP().String(), strconv.Itoa(int(a.Port)))
+}
+
+// IsZero reports whether the address is the zero value.
+func (a Address) IsZero() bool {
+	return a.ID == "" && a.Host == "" && !a.HasIP() && a.Port == 0 && a.Proto == "" && a.Destination == ""
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+//
+// The zero address is encoded as an empty string. Other addresses must be
+// valid.
+func (a Address) MarshalText() ([]byte, error) {
+	if a.IsZero() {
+		return []byte{}, nil
+	}
+
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+//
+// An empty string is decoded as the zero address.
+func (a *Address) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*a = Address{}
+		return nil
+	}
 
-	if v4 := ip.To4(); v4 != nil {
-		return fmt.Sprintf("%s:%d", a.IP().String(), a.Port)
+	addr, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*a = addr
+
+	return nil
+}
+
+// IsHostname reports whether v is a valid hostname as defined by RFC 1123.
+//
+// Hostnames with an all-numeric top level label are rejected, so
+// malformed IPv4 addresses aren't mistaken for hostnames.
+func IsHostname(v string) bool {
+	v = strings.TrimSuffix(v, ".")
+	if len(v) == 0 || len(v) > 253 {
+		return false
+	}
+
+	labels := strings.Split(v, ".")
+	for _, l := range labels {
+		if len(l) == 0 || len(l) > 63 {
+			return false
+		}
+		if l[0] == '-' || l[len(l)-1] == '-' {
+			return false
+		}
+		for _, c := range l {
+			if !isAlnumRune(c) && c != '-' {
+				return false
+			}
+		}
+	}
+
+	if isDigits(labels[len(labels)-1]) {
+		return false
+	}
+
+	return true
+}
+
+func isAlnumRune(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func isAlnum(v string) bool {
+	for _, c := range v {
+		if !isAlnumRune(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigits(v string) bool {
+	if v == "" {
+		return false
+	}
+	for _, c := range v {
+		if c < '0' || c > '9' {
+			return false
+		}
 	}
-	return fmt.Sprintf("[%s]:%d", a.IP().String(), a.Port)
+	return true
 }
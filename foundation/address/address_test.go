@@ -1,6 +1,8 @@
 package address_test
 
 import (
+	"encoding/json"
+	"errors"
 	"net"
 	"testing"
 
@@ -100,5 +102,121 @@ func TestAddress(t *testing.T) {
 				})
 			}
 		}
+
+		testID = 2
+		t.Logf("\tTest %d:\tWhen parsing strict address strings.", testID)
+		{
+			tt := []struct {
+				name string
+				val  string
+				err  error
+			}{
+				{"invalidID", "12-34@8.8.8.8/3000/udp", address.ErrInvalidID},
+				{"portTooLarge", "1234@8.8.8.8/65536/udp", address.ErrInvalidPortNumber},
+				{"portZero", "1234@8.8.8.8/0/udp", address.ErrInvalidPortNumber},
+				{"portLeadingZero", "1234@8.8.8.8/03000/udp", address.ErrInvalidPortNumber},
+				{"upperProto", "1234@8.8.8.8/3000/UDP", address.ErrInvalidProtocol},
+				{"emptyDest", "1234@8.8.8.8/3000/udp/", address.ErrMalformedAddressString},
+				{"tooManyParts", "1234@8.8.8.8/3000/udp/a/b", address.ErrMalformedAddressString},
+				{"invalidDest", "1234@8.8.8.8/3000/udp/a$b", address.ErrInvalidDestination},
+				{"validDest", "1234@8.8.8.8/3000/udp/nd5678", nil},
+				{"validHostDest", "1234@seed1.example.org/3000/tcp/service.v1", nil},
+			}
+
+			for _, tc := range tt {
+				t.Run(tc.name, func(t *testing.T) {
+					addr, err := address.Parse(tc.val)
+					if !errors.Is(err, tc.err) {
+						t.Fatalf("\t%s\tTest %d:\tShould get error \"%v\", but got \"%v\".", failed, testID, tc.err, err)
+					}
+					t.Logf("\t%s\tTest %d:\tShould get error \"%v\".", success, testID, tc.err)
+
+					if tc.err == nil && addr.String() != tc.val {
+						t.Fatalf("\t%s\tTest %d:\tShould round-trip to %q, but got %q.", failed, testID, tc.val, addr.String())
+					}
+				})
+			}
+		}
+
+		testID = 3
+		t.Logf("\tTest %d:\tWhen encoding addresses as JSON.", testID)
+		{
+			v := struct {
+				To   address.Address
+				From address.Address
+			}{}
+			v.To, _ = address.Parse("1234@2001:4860:4802:32::a/3000/udp/dest")
+
+			b, err := json.Marshal(v)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to marshal: %v.", failed, testID, err)
+			}
+			exp := `{"To":"1234@2001:4860:4802:32::a/3000/udp/dest","From":""}`
+			if string(b) != exp {
+				t.Fatalf("\t%s\tTest %d:\tShould get %s, but got %s.", failed, testID, exp, b)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get %s.", success, testID, exp)
+
+			var got struct {
+				To   address.Address
+				From address.Address
+			}
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to unmarshal: %v.", failed, testID, err)
+			}
+			if got.To.String() != v.To.String() || !got.From.IsZero() {
+				t.Fatalf("\t%s\tTest %d:\tShould get the original addresses, but got %v and %v.", failed, testID, got.To, got.From)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the original addresses.", success, testID)
+
+			if _, err := json.Marshal(address.Address{ID: "1234", Port: 3000, Proto: "udp"}); err == nil {
+				t.Fatalf("\t%s\tTest %d:\tShould not be able to marshal an address without ip.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not be able to marshal an address without ip.", success, testID)
+		}
+
+		testID = 4
+		t.Logf("\tTest %d:\tWhen working with an address without ip.", testID)
+		{
+			var a address.Address
+			if a.IP() != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould get a nil ip.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get a nil ip.", success, testID)
+
+			if err := a.Validate(); err == nil {
+				t.Fatalf("\t%s\tTest %d:\tShould get a validation error.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get a validation error.", success, testID)
+		}
 	}
 }
+
+func FuzzParse(f *testing.F) {
+	f.Add("1234@8.8.8.8/3000/udp")
+	f.Add("1234@2001:4860:4802:32::a/3000/udp/dest")
+	f.Add("nd0123456789abcdef0123456789abcdef01234567@seed1.example.org/3000/tcp")
+	f.Add("1234@::ffff:1.2.3.4/1/udp")
+	f.Add("@/0//")
+
+	f.Fuzz(func(t *testing.T, v string) {
+		a, err := address.Parse(v)
+		if err != nil {
+			return
+		}
+
+		if err := a.Validate(); err != nil {
+			t.Fatalf("parsed address %q doesn't validate: %v", v, err)
+		}
+
+		s := a.String()
+		b, err := address.Parse(s)
+		if err != nil {
+			t.Fatalf("canonical encoding %q of %q doesn't parse: %v", s, v, err)
+		}
+
+		if b.String() != s || !b.IP().Equal(a.IP()) || b.Destination != a.Destination {
+			t.Fatalf("canonical encoding %q of %q doesn't round-trip: got %q", s, v, b.String())
+		}
+	})
+}
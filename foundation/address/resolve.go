@@ -0,0 +1,115 @@
+package address
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	// ErrNoHost is returned when resolving an address without a hostname.
+	ErrNoHost = errors.New("address has no hostname")
+
+	// ErrInvalidSeed is returned when a DNS seed lists invalid addresses.
+	ErrInvalidSeed = errors.New("invalid seed address")
+)
+
+// Resolver looks up DNS records.
+//
+// *net.Resolver implements this interface. Tests can provide their own
+// implementation so no real network is needed.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DefaultResolver is the resolver used when nil is passed as Resolver.
+var DefaultResolver Resolver = net.DefaultResolver
+
+// Resolve returns a copy of the address with the IP of its hostname set.
+//
+// IPv4 addresses are preferred over IPv6 addresses. The hostname is kept,
+// so the address can be resolved again, for example when the IP has
+// become unreachable.
+func (a Address) Resolve(ctx context.Context, r Resolver) (Address, error) {
+	if a.Host == "" {
+		return Address{}, ErrNoHost
+	}
+
+	if r == nil {
+		r = DefaultResolver
+	}
+
+	ips, err := r.LookupIPAddr(ctx, a.Host)
+	if err != nil {
+		return Address{}, fmt.Errorf("resolving %s: %w", a.Host, err)
+	}
+	if len(ips) == 0 {
+		return Address{}, fmt.Errorf("resolving %s: no addresses", a.Host)
+	}
+
+	ip := ips[0].IP
+	for _, v := range ips {
+		if v.IP.To4() != nil {
+			ip = v.IP
+			break
+		}
+	}
+
+	a.setIP(ip)
+
+	return a, nil
+}
+
+// LookupSeeds returns the bootstrap nodes listed by a DNS seed.
+//
+// The TXT records of name are parsed as address strings, with multiple
+// addresses in a single record separated by whitespace. When name has no
+// TXT records, its A and AAAA records are used instead with the provided
+// port and protocol. These addresses have no ID, which is learned from
+// the node during the handshake.
+//
+// Invalid addresses in the TXT records are skipped. The valid addresses
+// are returned together with an error wrapping ErrInvalidSeed that lists
+// the invalid ones, which fails the lookup only when no address is valid.
+func LookupSeeds(ctx context.Context, r Resolver, name string, port uint, proto string) ([]Address, error) {
+	if r == nil {
+		r = DefaultResolver
+	}
+
+	txts, err := r.LookupTXT(ctx, name)
+	if err == nil && len(txts) > 0 {
+		var addrs []Address
+		var invalid []string
+		for _, txt := range txts {
+			for _, v := range strings.Fields(txt) {
+				a, err := Parse(v)
+				if err != nil {
+					invalid = append(invalid, fmt.Sprintf("%q: %v", v, err))
+					continue
+				}
+				addrs = append(addrs, a)
+			}
+		}
+
+		if len(invalid) > 0 {
+			return addrs, fmt.Errorf("%w: %s lists %s", ErrInvalidSeed, name, strings.Join(invalid, ", "))
+		}
+		return addrs, nil
+	}
+
+	ips, err := r.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("looking up seed %s: %w", name, err)
+	}
+
+	addrs := make([]Address, len(ips))
+	for i, v := range ips {
+		addrs[i] = Address{Port: port, Proto: proto}
+		addrs[i].setIP(v.IP)
+	}
+
+	return addrs, nil
+}
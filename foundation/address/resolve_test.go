@@ -0,0 +1,145 @@
+package address_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/toqns/toqns/foundation/address"
+)
+
+// resolver is a Resolver with fixed records.
+type resolver struct {
+	ips  map[string][]net.IPAddr
+	txts map[string][]string
+}
+
+func (r resolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r.ips[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return ips, nil
+}
+
+func (r resolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	txts, ok := r.txts[name]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return txts, nil
+}
+
+func TestResolve(t *testing.T) {
+	r := resolver{
+		ips: map[string][]net.IPAddr{
+			"seed1.example.org": {{IP: net.ParseIP("2001:4860:4802:32::a")}, {IP: net.ParseIP("8.8.8.8")}},
+			"seed2.example.org": {{IP: net.ParseIP("8.8.4.4")}, {IP: net.ParseIP("192.168.0.100")}},
+		},
+		txts: map[string][]string{
+			"seeds.example.org": {"1234@seed1.example.org/3000/udp 5678@8.8.4.4/3001/udp", "9abc@1.1.1.1/3000/tcp"},
+			"mixed.example.org": {"1234@seed1.example.org/3000/udp bad@entry", "5678@8.8.4.4/99999/udp"},
+			"bad.example.org":   {"bad@entry"},
+		},
+	}
+
+	t.Log("Given the need to work with hostnames in addresses.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen parsing and resolving an address with a hostname.", testID)
+		{
+			addr, err := address.Parse("1234@Seed1.example.org/3000/udp")
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to parse the address: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to parse the address.", success, testID)
+
+			if addr.HasIP() || addr.Host != "seed1.example.org" {
+				t.Fatalf("\t%s\tTest %d:\tShould have an unresolved hostname, but got: %+v.", failed, testID, addr)
+			}
+			t.Logf("\t%s\tTest %d:\tShould have an unresolved hostname.", success, testID)
+
+			res, err := addr.Resolve(context.Background(), r)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to resolve the address: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to resolve the address.", success, testID)
+
+			if res.Addr() != "8.8.8.8:3000" {
+				t.Fatalf("\t%s\tTest %d:\tShould prefer the IPv4 address %q, but got: %q.", failed, testID, "8.8.8.8:3000", res.Addr())
+			}
+			t.Logf("\t%s\tTest %d:\tShould prefer the IPv4 address %q.", success, testID, "8.8.8.8:3000")
+
+			if res.String() != "1234@seed1.example.org/3000/udp" {
+				t.Fatalf("\t%s\tTest %d:\tShould keep the hostname in the string, but got: %q.", failed, testID, res.String())
+			}
+			t.Logf("\t%s\tTest %d:\tShould keep the hostname in the string.", success, testID)
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen resolving an unknown hostname.", testID)
+		{
+			addr, _ := address.Parse("1234@unknown.example.org/3000/udp")
+			if _, err := addr.Resolve(context.Background(), r); err == nil {
+				t.Fatalf("\t%s\tTest %d:\tShould get an error.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get an error.", success, testID)
+		}
+
+		testID = 2
+		t.Logf("\tTest %d:\tWhen looking up a DNS seed with TXT records.", testID)
+		{
+			addrs, err := address.LookupSeeds(context.Background(), r, "seeds.example.org", 3000, "udp")
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to look up seeds: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to look up seeds.", success, testID)
+
+			exp := []string{"1234@seed1.example.org/3000/udp", "5678@8.8.4.4/3001/udp", "9abc@1.1.1.1/3000/tcp"}
+			if len(addrs) != len(exp) {
+				t.Fatalf("\t%s\tTest %d:\tShould get %d seeds, but got %d.", failed, testID, len(exp), len(addrs))
+			}
+			for i, a := range addrs {
+				if a.String() != exp[i] {
+					t.Fatalf("\t%s\tTest %d:\tShould get seed %q, but got %q.", failed, testID, exp[i], a.String())
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould get %d seeds.", success, testID, len(exp))
+		}
+
+		testID = 3
+		t.Logf("\tTest %d:\tWhen looking up a DNS seed with A records.", testID)
+		{
+			addrs, err := address.LookupSeeds(context.Background(), r, "seed2.example.org", 3000, "udp")
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to look up seeds: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to look up seeds.", success, testID)
+
+			if len(addrs) != 2 || addrs[0].Addr() != "8.8.4.4:3000" || addrs[1].LocIP == nil {
+				t.Fatalf("\t%s\tTest %d:\tShould get addresses for the A records, but got: %v.", failed, testID, addrs)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get addresses for the A records.", success, testID)
+		}
+
+		testID = 4
+		t.Logf("\tTest %d:\tWhen looking up a DNS seed with invalid TXT records.", testID)
+		{
+			addrs, err := address.LookupSeeds(context.Background(), r, "mixed.example.org", 3000, "udp")
+			if !errors.Is(err, address.ErrInvalidSeed) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrInvalidSeed, but got: %v.", failed, testID, err)
+			}
+			if len(addrs) != 1 || addrs[0].String() != "1234@seed1.example.org/3000/udp" {
+				t.Fatalf("\t%s\tTest %d:\tShould get the valid seed, but got: %v.", failed, testID, addrs)
+			}
+			t.Logf("\t%s\tTest %d:\tShould skip the invalid seeds and get the valid seed.", success, testID)
+
+			addrs, err = address.LookupSeeds(context.Background(), r, "bad.example.org", 3000, "udp")
+			if !errors.Is(err, address.ErrInvalidSeed) || len(addrs) != 0 {
+				t.Fatalf("\t%s\tTest %d:\tShould fail when no seed is valid, but got %v: %v.", failed, testID, addrs, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould fail when no seed is valid.", success, testID)
+		}
+	}
+}
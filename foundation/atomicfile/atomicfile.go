@@ -0,0 +1,50 @@
+// Package atomicfile writes files atomically, so a file is either replaced
+// completely or not at all, even when the process crashes while writing.
+package atomicfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Write writes the data to a temporary file with owner-only permissions,
+// syncs it and renames it to name. The directory is created if it doesn't
+// exist.
+func Write(name string, b []byte) error {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("creating directory: %w", err)
+	}
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(name)+"-*")
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return fmt.Errorf("setting permissions: %w", err)
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("writing file: %w", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("syncing file: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing file: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), name); err != nil {
+		return fmt.Errorf("renaming file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package atomicfile_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/toqns/toqns/foundation/atomicfile"
+)
+
+// Success and failure markers.
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+func TestWrite(t *testing.T) {
+	t.Log("Given the need to write files atomically.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen writing a file in a new directory.", testID)
+		{
+			dir := filepath.Join(t.TempDir(), "data")
+			name := filepath.Join(dir, "file.json")
+
+			if err := atomicfile.Write(name, []byte("first")); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to write the file: %v", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to write the file.", success, testID)
+
+			if err := atomicfile.Write(name, []byte("second")); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to replace the file: %v", failed, testID, err)
+			}
+			b, err := os.ReadFile(name)
+			if err != nil || string(b) != "second" {
+				t.Fatalf("\t%s\tTest %d:\tShould read the replaced data, but got %q: %v", failed, testID, b, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould read the replaced data.", success, testID)
+
+			fi, err := os.Stat(name)
+			if err != nil || fi.Mode().Perm() != 0600 {
+				t.Fatalf("\t%s\tTest %d:\tShould have owner-only permissions: %v", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould have owner-only permissions.", success, testID)
+
+			entries, err := os.ReadDir(dir)
+			if err != nil || len(entries) != 1 {
+				t.Fatalf("\t%s\tTest %d:\tShould leave no temporary files, but got %d entries: %v", failed, testID, len(entries), err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould leave no temporary files.", success, testID)
+		}
+	}
+}
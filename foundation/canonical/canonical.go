@@ -0,0 +1,50 @@
+// Package canonical provides the building blocks of the canonical binary
+// encodings that are hashed and signed, so equal values always encode to
+// the same bytes.
+//
+// Integers are encoded as 8 byte big endian values, and strings are
+// prefixed with their length as uvarint.
+package canonical
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrShortData is returned when the data ends before the value.
+var ErrShortData = errors.New("data too short")
+
+// AppendUint64 appends the big endian encoding of the value.
+func AppendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// AppendString appends the string prefixed with its length.
+func AppendString(b []byte, s string) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(s)))
+	b = append(b, buf[:n]...)
+	return append(b, s...)
+}
+
+// ReadUint64 reads a value encoded by AppendUint64 and returns it with the
+// remaining data.
+func ReadUint64(b []byte) (uint64, []byte, error) {
+	if len(b) < 8 {
+		return 0, nil, ErrShortData
+	}
+	return binary.BigEndian.Uint64(b), b[8:], nil
+}
+
+// ReadString reads a value encoded by AppendString and returns it with the
+// remaining data.
+func ReadString(b []byte) (string, []byte, error) {
+	n, l := binary.Uvarint(b)
+	if l <= 0 || uint64(len(b)-l) < n {
+		return "", nil, ErrShortData
+	}
+	b = b[l:]
+	return string(b[:n]), b[n:], nil
+}
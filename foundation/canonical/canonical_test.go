@@ -0,0 +1,69 @@
+package canonical_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/toqns/toqns/foundation/canonical"
+)
+
+// Success and failure markers.
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+func TestAppend(t *testing.T) {
+	t.Log("Given the need to encode values canonically.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen appending integers and strings.", testID)
+		{
+			b := canonical.AppendUint64([]byte{0xff}, 0x0102030405060708)
+			exp := []byte{0xff, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+			if !bytes.Equal(b, exp) {
+				t.Fatalf("\t%s\tTest %d:\tShould append the big endian integer, but got %x.", failed, testID, b)
+			}
+			t.Logf("\t%s\tTest %d:\tShould append the big endian integer.", success, testID)
+
+			b = canonical.AppendString(nil, "toqns")
+			exp = append([]byte{5}, "toqns"...)
+			if !bytes.Equal(b, exp) {
+				t.Fatalf("\t%s\tTest %d:\tShould prefix the string with its length, but got %x.", failed, testID, b)
+			}
+			t.Logf("\t%s\tTest %d:\tShould prefix the string with its length.", success, testID)
+
+			b = canonical.AppendString(nil, string(make([]byte, 300)))
+			if len(b) != 302 || b[0] != 0xac || b[1] != 0x02 {
+				t.Fatalf("\t%s\tTest %d:\tShould prefix long strings with a uvarint length, but got %x.", failed, testID, b[:2])
+			}
+			t.Logf("\t%s\tTest %d:\tShould prefix long strings with a uvarint length.", success, testID)
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen reading appended values.", testID)
+		{
+			b := canonical.AppendString(nil, "toqns")
+			b = canonical.AppendUint64(b, 42)
+
+			s, rest, err := canonical.ReadString(b)
+			if err != nil || s != "toqns" {
+				t.Fatalf("\t%s\tTest %d:\tShould read the string, but got %q: %v.", failed, testID, s, err)
+			}
+			v, rest, err := canonical.ReadUint64(rest)
+			if err != nil || v != 42 || len(rest) != 0 {
+				t.Fatalf("\t%s\tTest %d:\tShould read the integer, but got %d: %v.", failed, testID, v, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould read the appended values.", success, testID)
+
+			if _, _, err := canonical.ReadString(b[:3]); !errors.Is(err, canonical.ErrShortData) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrShortData for a truncated string, but got: %v.", failed, testID, err)
+			}
+			if _, _, err := canonical.ReadUint64(b[:7]); !errors.Is(err, canonical.ErrShortData) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrShortData for a truncated integer, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrShortData for truncated data.", success, testID)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Package merkle computes Merkle tree roots of ordered lists of data.
+//
+// The tree follows RFC 6962: leaves are hashed as SHA-256(0x00 || data) and
+// inner nodes as SHA-256(0x01 || left || right), so a leaf can't be passed
+// off as an inner node. A list of n leaves is split at the largest power
+// of two smaller than n, which keeps the tree balanced without duplicating
+// leaves. The root of an empty list is the hash of no data.
+package merkle
+
+import "crypto/sha256"
+
+// Size is the size of a root in bytes.
+const Size = sha256.Size
+
+// Prefixes that separate leaf hashes from inner node hashes.
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// Root returns the root of the Merkle tree of the leaves.
+func Root(leaves [][]byte) []byte {
+	hashes := make([][]byte, len(leaves))
+	for i, l := range leaves {
+		hashes[i] = LeafHash(l)
+	}
+	return RootOfHashes(hashes)
+}
+
+// RootOfHashes returns the root of the Merkle tree of leaves that have
+// been hashed with LeafHash already. This allows leaf hashes to be cached.
+func RootOfHashes(hashes [][]byte) []byte {
+	switch len(hashes) {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		return hashes[0]
+	}
+
+	k := split(len(hashes))
+	return nodeHash(RootOfHashes(hashes[:k]), RootOfHashes(hashes[k:]))
+}
+
+// LeafHash returns the hash of a leaf.
+func LeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// nodeHash returns the hash of an inner node.
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// split returns the largest power of two smaller than n, for n > 1.
+func split(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
@@ -0,0 +1,76 @@
+package merkle_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/toqns/toqns/foundation/merkle"
+)
+
+// Success and failure markers.
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+func TestRoot(t *testing.T) {
+	t.Log("Given the need to compute Merkle roots.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen computing the roots of known lists.", testID)
+		{
+			// Roots of the RFC 6962 reference test vectors.
+			leaves := [][]byte{
+				{},
+				{0x00},
+				{0x10},
+				{0x20, 0x21},
+				{0x30, 0x31},
+				{0x40, 0x41, 0x42, 0x43},
+				{0x50, 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57},
+				{0x60, 0x61, 0x62, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0x6a, 0x6b, 0x6c, 0x6d, 0x6e, 0x6f},
+			}
+
+			tt := []struct {
+				n    int
+				root string
+			}{
+				{0, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+				{1, "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d"},
+				{2, "fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125"},
+				{3, "aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77"},
+				{8, "5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328"},
+			}
+
+			for _, tc := range tt {
+				root := hex.EncodeToString(merkle.Root(leaves[:tc.n]))
+				if root != tc.root {
+					t.Fatalf("\t%s\tTest %d:\tShould get root %s for %d leaves, but got %s.", failed, testID, tc.root, tc.n, root)
+				}
+				t.Logf("\t%s\tTest %d:\tShould get root %s for %d leaves.", success, testID, tc.root, tc.n)
+			}
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen computing roots of cached leaf hashes.", testID)
+		{
+			leaves := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")}
+			hashes := make([][]byte, len(leaves))
+			for i, l := range leaves {
+				hashes[i] = merkle.LeafHash(l)
+			}
+
+			if !bytes.Equal(merkle.Root(leaves), merkle.RootOfHashes(hashes)) {
+				t.Fatalf("\t%s\tTest %d:\tShould get the same root from the leaf hashes.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the same root from the leaf hashes.", success, testID)
+
+			leaves[2], leaves[3] = leaves[3], leaves[2]
+			if bytes.Equal(merkle.Root(leaves), merkle.RootOfHashes(hashes)) {
+				t.Fatalf("\t%s\tTest %d:\tShould get a different root for reordered leaves.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get a different root for reordered leaves.", success, testID)
+		}
+	}
+}
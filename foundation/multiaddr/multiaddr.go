@@ -0,0 +1,378 @@
+// Package multiaddr provides composable, self-describing network addresses.
+//
+// A multiaddr is a path of components, each consisting of a protocol and
+// an optional value. In the text encoding, components are written as
+// /protocol/value, for example:
+//
+//	/ip4/8.8.8.8/udp/3000/node/nd1234
+//	/dns/seed1.example.org/tcp/3000/node/nd1234/relay/node/nd5678/service/wallet
+//
+// The second address reaches node nd5678 via relay node nd1234 over TCP,
+// and addresses its wallet service.
+//
+// In the binary encoding, each component is the protocol code as an
+// unsigned varint, followed by the value. Values with a variable size are
+// prefixed with their length as an unsigned varint.
+//
+// Multiaddrs convert to and from address.Address when they consist of a
+// host, a transport with a port, a node and an optional service.
+package multiaddr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/toqns/toqns/foundation/address"
+)
+
+var (
+	// ErrMalformed is returned when a multiaddr can't be decoded.
+	ErrMalformed = errors.New("malformed multiaddr")
+
+	// ErrUnknownProtocol is returned for components with an unknown protocol.
+	ErrUnknownProtocol = errors.New("unknown protocol")
+
+	// ErrNotAddress is returned when a multiaddr can't be converted to an
+	// address.Address.
+	ErrNotAddress = errors.New("multiaddr can't be represented as address")
+)
+
+// Component is a single protocol and value of a multiaddr.
+type Component struct {
+	Protocol Protocol
+	Value    []byte
+}
+
+// NewComponent returns a component for the protocol with the provided name
+// and the text encoding of its value.
+func NewComponent(name, value string) (Component, error) {
+	p, ok := ProtocolWithName(name)
+	if !ok {
+		return Component{}, fmt.Errorf("%w: %s", ErrUnknownProtocol, name)
+	}
+
+	if p.Size == 0 {
+		if value != "" {
+			return Component{}, fmt.Errorf("%w: %s has no value", ErrMalformed, name)
+		}
+		return Component{Protocol: p}, nil
+	}
+
+	b, err := p.toBytes(value)
+	if err != nil {
+		return Component{}, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	return Component{Protocol: p, Value: b}, nil
+}
+
+// ValueString returns the text encoding of the component's value.
+func (c Component) ValueString() string {
+	if c.Protocol.Size == 0 {
+		return ""
+	}
+
+	v, err := c.Protocol.toString(c.Value)
+	if err != nil {
+		return ""
+	}
+	return v
+}
+
+// String implements the stringer interface.
+func (c Component) String() string {
+	if c.Protocol.Size == 0 {
+		return "/" + c.Protocol.Name
+	}
+	return "/" + c.Protocol.Name + "/" + c.ValueString()
+}
+
+// Multiaddr is a composable network address.
+type Multiaddr []Component
+
+// Parse parses the text encoding of a multiaddr.
+func Parse(v string) (Multiaddr, error) {
+	if !strings.HasPrefix(v, "/") || strings.HasSuffix(v, "/") {
+		return nil, ErrMalformed
+	}
+
+	parts := strings.Split(v[1:], "/")
+
+	var m Multiaddr
+	for i := 0; i < len(parts); i++ {
+		p, ok := ProtocolWithName(parts[i])
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownProtocol, parts[i])
+		}
+
+		var value string
+		if p.Size != 0 {
+			i++
+			if i >= len(parts) {
+				return nil, fmt.Errorf("%w: %s has no value", ErrMalformed, p.Name)
+			}
+			value = parts[i]
+		}
+
+		c, err := NewComponent(p.Name, value)
+		if err != nil {
+			return nil, err
+		}
+		m = append(m, c)
+	}
+
+	return m, nil
+}
+
+// ParseAny parses either the text encoding of a multiaddr or an address
+// string in the id@ip/port/protocol[/destination] format.
+func ParseAny(v string) (Multiaddr, error) {
+	if strings.HasPrefix(v, "/") {
+		return Parse(v)
+	}
+
+	a, err := address.Parse(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return FromAddress(a)
+}
+
+// Decode decodes the binary encoding of a multiaddr.
+func Decode(b []byte) (Multiaddr, error) {
+	var m Multiaddr
+	for len(b) > 0 {
+		code, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: invalid protocol code", ErrMalformed)
+		}
+		b = b[n:]
+
+		p, ok := ProtocolWithCode(code)
+		if !ok {
+			return nil, fmt.Errorf("%w: code %d", ErrUnknownProtocol, code)
+		}
+
+		size := p.Size
+		if size < 0 {
+			s, n := binary.Uvarint(b)
+			if n <= 0 || s > uint64(len(b)-n) {
+				return nil, fmt.Errorf("%w: invalid length of %s", ErrMalformed, p.Name)
+			}
+			b = b[n:]
+			size = int(s)
+		}
+
+		if size > len(b) {
+			return nil, fmt.Errorf("%w: short value of %s", ErrMalformed, p.Name)
+		}
+
+		c := Component{Protocol: p}
+		if p.Size != 0 {
+			c.Value = append([]byte(nil), b[:size]...)
+			if _, err := p.toString(c.Value); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+			}
+		}
+		b = b[size:]
+
+		m = append(m, c)
+	}
+
+	return m, nil
+}
+
+// Bytes returns the binary encoding of the multiaddr.
+func (m Multiaddr) Bytes() []byte {
+	var buf bytes.Buffer
+	var v [binary.MaxVarintLen64]byte
+
+	for _, c := range m {
+		n := binary.PutUvarint(v[:], c.Protocol.Code)
+		buf.Write(v[:n])
+
+		if c.Protocol.Size < 0 {
+			n := binary.PutUvarint(v[:], uint64(len(c.Value)))
+			buf.Write(v[:n])
+		}
+		buf.Write(c.Value)
+	}
+
+	return buf.Bytes()
+}
+
+// String implements the stringer interface and returns the text encoding
+// of the multiaddr.
+func (m Multiaddr) String() string {
+	var b strings.Builder
+	for _, c := range m {
+		b.WriteString(c.String())
+	}
+	return b.String()
+}
+
+// Equal reports whether both multiaddrs have the same components.
+func (m Multiaddr) Equal(o Multiaddr) bool {
+	return bytes.Equal(m.Bytes(), o.Bytes())
+}
+
+// Encapsulate returns a new multiaddr with the components of o appended.
+func (m Multiaddr) Encapsulate(o Multiaddr) Multiaddr {
+	r := make(Multiaddr, 0, len(m)+len(o))
+	r = append(r, m...)
+	return append(r, o...)
+}
+
+// ValueForProtocol returns the text encoding of the value of the first
+// component with the provided protocol code.
+func (m Multiaddr) ValueForProtocol(code uint64) (string, bool) {
+	for _, c := range m {
+		if c.Protocol.Code == code {
+			return c.ValueString(), true
+		}
+	}
+	return "", false
+}
+
+// SplitRelay splits the multiaddr at its first relay component.
+//
+// It returns the address of the relay and the address to reach via the
+// relay. If the multiaddr has no relay component, the relay address is
+// the full multiaddr and the target is nil.
+func (m Multiaddr) SplitRelay() (relay Multiaddr, target Multiaddr) {
+	for i, c := range m {
+		if c.Protocol.Code == CodeRelay {
+			return m[:i], m[i+1:]
+		}
+	}
+	return m, nil
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (m Multiaddr) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (m *Multiaddr) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*m = nil
+		return nil
+	}
+
+	v, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*m = v
+
+	return nil
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.
+func (m Multiaddr) MarshalBinary() ([]byte, error) {
+	return m.Bytes(), nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
+func (m *Multiaddr) UnmarshalBinary(b []byte) error {
+	v, err := Decode(b)
+	if err != nil {
+		return err
+	}
+	*m = v
+
+	return nil
+}
+
+// =============================================================================
+
+// FromAddress converts an address to a multiaddr in the form
+// /host/transport/port/node/id[/service/destination].
+func FromAddress(a address.Address) (Multiaddr, error) {
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+
+	var host Component
+	var err error
+	switch {
+	case a.Host != "":
+		host, err = NewComponent("dns", a.Host)
+	case a.IP().To4() != nil:
+		host, err = NewComponent("ip4", a.IP().String())
+	default:
+		host, err = NewComponent("ip6", a.IP().String())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := NewComponent(a.Proto, fmt.Sprint(a.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := NewComponent("node", a.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	m := Multiaddr{host, transport, node}
+
+	if a.Destination != "" {
+		service, err := NewComponent("service", a.Destination)
+		if err != nil {
+			return nil, err
+		}
+		m = append(m, service)
+	}
+
+	return m, nil
+}
+
+// Address converts the multiaddr to an address.
+//
+// Returns ErrNotAddress if the multiaddr isn't in the form
+// /host/transport/port/node/id[/service/destination], such as for
+// multiaddrs with a relay.
+func (m Multiaddr) Address() (address.Address, error) {
+	if len(m) != 3 && len(m) != 4 {
+		return address.Address{}, ErrNotAddress
+	}
+
+	var s strings.Builder
+
+	if m[2].Protocol.Code != CodeNode {
+		return address.Address{}, ErrNotAddress
+	}
+	s.WriteString(m[2].ValueString())
+	s.WriteString("@")
+
+	switch m[0].Protocol.Code {
+	case CodeIP4, CodeIP6, CodeDNS:
+		s.WriteString(m[0].ValueString())
+	default:
+		return address.Address{}, ErrNotAddress
+	}
+
+	switch m[1].Protocol.Code {
+	case CodeTCP, CodeUDP:
+		fmt.Fprintf(&s, "/%s/%s", m[1].ValueString(), m[1].Protocol.Name)
+	default:
+		return address.Address{}, ErrNotAddress
+	}
+
+	if len(m) == 4 {
+		if m[3].Protocol.Code != CodeService {
+			return address.Address{}, ErrNotAddress
+		}
+		fmt.Fprintf(&s, "/%s", m[3].ValueString())
+	}
+
+	return address.Parse(s.String())
+}
@@ -0,0 +1,144 @@
+package multiaddr_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/toqns/toqns/foundation/address"
+	"github.com/toqns/toqns/foundation/multiaddr"
+)
+
+// Success and failure markers.
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+func TestMultiaddr(t *testing.T) {
+	t.Log("Given the need to work with multiaddrs.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen encoding and decoding multiaddrs.", testID)
+		{
+			tt := []struct {
+				name string
+				val  string
+				err  error
+			}{
+				{"ip4udp", "/ip4/8.8.8.8/udp/3000/node/nd1234", nil},
+				{"ip6tcp", "/ip6/2001:4860:4802:32::a/tcp/3000/node/nd1234", nil},
+				{"relay", "/dns/seed1.example.org/tcp/3000/node/nd1234/relay/node/nd5678/service/wallet", nil},
+				{"unknown", "/ip4/8.8.8.8/sctp/3000", multiaddr.ErrUnknownProtocol},
+				{"noValue", "/ip4/8.8.8.8/udp", multiaddr.ErrMalformed},
+				{"badIP", "/ip4/2001:4860:4802:32::a/udp/3000", multiaddr.ErrMalformed},
+				{"badPort", "/ip4/8.8.8.8/udp/0", multiaddr.ErrMalformed},
+				{"noSlash", "ip4/8.8.8.8", multiaddr.ErrMalformed},
+				{"trailingSlash", "/ip4/8.8.8.8/", multiaddr.ErrMalformed},
+			}
+
+			for _, tc := range tt {
+				t.Run(tc.name, func(t *testing.T) {
+					m, err := multiaddr.Parse(tc.val)
+					if !errors.Is(err, tc.err) {
+						t.Fatalf("\t%s\tTest %d:\tShould get error \"%v\", but got \"%v\".", failed, testID, tc.err, err)
+					}
+					t.Logf("\t%s\tTest %d:\tShould get error \"%v\".", success, testID, tc.err)
+
+					if tc.err != nil {
+						return
+					}
+
+					if m.String() != tc.val {
+						t.Fatalf("\t%s\tTest %d:\tShould get text %q, but got %q.", failed, testID, tc.val, m.String())
+					}
+					t.Logf("\t%s\tTest %d:\tShould get text %q.", success, testID, tc.val)
+
+					d, err := multiaddr.Decode(m.Bytes())
+					if err != nil {
+						t.Fatalf("\t%s\tTest %d:\tShould be able to decode the binary encoding: %v.", failed, testID, err)
+					}
+					if !d.Equal(m) || d.String() != tc.val {
+						t.Fatalf("\t%s\tTest %d:\tShould get the same multiaddr from the binary encoding, but got %q.", failed, testID, d.String())
+					}
+					t.Logf("\t%s\tTest %d:\tShould get the same multiaddr from the binary encoding.", success, testID)
+				})
+			}
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen converting addresses.", testID)
+		{
+			tt := []struct {
+				addr  string
+				multi string
+			}{
+				{"nd1234@8.8.8.8/3000/udp", "/ip4/8.8.8.8/udp/3000/node/nd1234"},
+				{"nd1234@2001:4860:4802:32::a/3000/tcp/wallet", "/ip6/2001:4860:4802:32::a/tcp/3000/node/nd1234/service/wallet"},
+				{"nd1234@seed1.example.org/3000/udp", "/dns/seed1.example.org/udp/3000/node/nd1234"},
+			}
+
+			for _, tc := range tt {
+				m, err := multiaddr.ParseAny(tc.addr)
+				if err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to parse %q: %v.", failed, testID, tc.addr, err)
+				}
+				if m.String() != tc.multi {
+					t.Fatalf("\t%s\tTest %d:\tShould get %q, but got %q.", failed, testID, tc.multi, m.String())
+				}
+				t.Logf("\t%s\tTest %d:\tShould get %q.", success, testID, tc.multi)
+
+				a, err := m.Address()
+				if err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to convert back to an address: %v.", failed, testID, err)
+				}
+				if a.String() != tc.addr {
+					t.Fatalf("\t%s\tTest %d:\tShould get %q, but got %q.", failed, testID, tc.addr, a.String())
+				}
+				t.Logf("\t%s\tTest %d:\tShould get %q.", success, testID, tc.addr)
+			}
+
+			m, _ := multiaddr.Parse("/ip4/8.8.8.8/tcp/3000/node/nd1234/relay/node/nd5678")
+			if _, err := m.Address(); !errors.Is(err, multiaddr.ErrNotAddress) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrNotAddress for a relayed multiaddr, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrNotAddress for a relayed multiaddr.", success, testID)
+
+			relay, target := m.SplitRelay()
+			if relay.String() != "/ip4/8.8.8.8/tcp/3000/node/nd1234" || target.String() != "/node/nd5678" {
+				t.Fatalf("\t%s\tTest %d:\tShould split at the relay, but got %q and %q.", failed, testID, relay, target)
+			}
+			t.Logf("\t%s\tTest %d:\tShould split at the relay.", success, testID)
+
+			if _, err := relay.Address(); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to convert the relay to an address: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to convert the relay to an address.", success, testID)
+
+			if _, err := multiaddr.ParseAny("1234@8.8.8.8/proto"); !errors.Is(err, address.ErrMalformedAddressString) {
+				t.Fatalf("\t%s\tTest %d:\tShould get the address error, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the address error.", success, testID)
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	m, _ := multiaddr.Parse("/dns/seed1.example.org/tcp/3000/node/nd1234/relay/node/nd5678/service/wallet")
+	f.Add(m.Bytes())
+	f.Add([]byte{0x04, 0x08, 0x08, 0x08, 0x08})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := multiaddr.Decode(b)
+		if err != nil {
+			return
+		}
+
+		p, err := multiaddr.Parse(m.String())
+		if len(m) > 0 && err != nil {
+			t.Fatalf("text encoding %q doesn't parse: %v", m.String(), err)
+		}
+		if len(m) > 0 && !p.Equal(m) {
+			t.Fatalf("text encoding %q doesn't round-trip", m.String())
+		}
+	})
+}
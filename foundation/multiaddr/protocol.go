@@ -0,0 +1,168 @@
+package multiaddr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/toqns/toqns/foundation/address"
+)
+
+// Protocol codes. Where available, the codes are the same as the ones of
+// the multicodec table.
+const (
+	CodeIP4     = 4
+	CodeTCP     = 6
+	CodeIP6     = 41
+	CodeDNS     = 53
+	CodeUDP     = 273
+	CodeRelay   = 290
+	CodeNode    = 421
+	CodeService = 777
+)
+
+// Protocol describes a component of a multiaddr.
+type Protocol struct {
+	// Name is the name of the protocol in the text encoding.
+	Name string
+
+	// Code is the code of the protocol in the binary encoding.
+	Code uint64
+
+	// Size is the size of the value in bytes. A size of -1 means the value
+	// has a variable size and is prefixed with its length. A size of 0
+	// means the protocol has no value.
+	Size int
+
+	// toBytes converts the text encoding of a value to its binary encoding.
+	toBytes func(string) ([]byte, error)
+
+	// toString converts the binary encoding of a value to its text encoding.
+	toString func([]byte) (string, error)
+}
+
+// Protocols is the set of supported protocols.
+var Protocols = []Protocol{
+	{Name: "ip4", Code: CodeIP4, Size: net.IPv4len, toBytes: ip4ToBytes, toString: ipToString},
+	{Name: "ip6", Code: CodeIP6, Size: net.IPv6len, toBytes: ip6ToBytes, toString: ip6ToString},
+	{Name: "dns", Code: CodeDNS, Size: -1, toBytes: dnsToBytes, toString: dnsToString},
+	{Name: "tcp", Code: CodeTCP, Size: 2, toBytes: portToBytes, toString: portToString},
+	{Name: "udp", Code: CodeUDP, Size: 2, toBytes: portToBytes, toString: portToString},
+	{Name: "node", Code: CodeNode, Size: -1, toBytes: idToBytes, toString: idToString},
+	{Name: "relay", Code: CodeRelay, Size: 0},
+	{Name: "service", Code: CodeService, Size: -1, toBytes: serviceToBytes, toString: serviceToString},
+}
+
+// ProtocolWithName returns the protocol with the provided name.
+func ProtocolWithName(name string) (Protocol, bool) {
+	for _, p := range Protocols {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Protocol{}, false
+}
+
+// ProtocolWithCode returns the protocol with the provided code.
+func ProtocolWithCode(code uint64) (Protocol, bool) {
+	for _, p := range Protocols {
+		if p.Code == code {
+			return p, true
+		}
+	}
+	return Protocol{}, false
+}
+
+// =============================================================================
+
+func ip4ToBytes(v string) ([]byte, error) {
+	ip := net.ParseIP(v).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip4 %q", v)
+	}
+	return ip, nil
+}
+
+func ip6ToBytes(v string) ([]byte, error) {
+	ip := net.ParseIP(v)
+	if ip == nil || ip.To4() != nil {
+		return nil, fmt.Errorf("invalid ip6 %q", v)
+	}
+	return ip.To16(), nil
+}
+
+func ipToString(b []byte) (string, error) {
+	return net.IP(b).String(), nil
+}
+
+func ip6ToString(b []byte) (string, error) {
+	ip := net.IP(b)
+	if ip.To4() != nil {
+		return "", fmt.Errorf("invalid ip6 %s", ip)
+	}
+	return ip.String(), nil
+}
+
+func dnsToBytes(v string) ([]byte, error) {
+	if !address.IsHostname(v) {
+		return nil, fmt.Errorf("invalid hostname %q", v)
+	}
+	return []byte(v), nil
+}
+
+func dnsToString(b []byte) (string, error) {
+	v := string(b)
+	if !address.IsHostname(v) {
+		return "", fmt.Errorf("invalid hostname %q", v)
+	}
+	return v, nil
+}
+
+func portToBytes(v string) ([]byte, error) {
+	p, err := strconv.ParseUint(v, 10, 16)
+	if err != nil || p == 0 {
+		return nil, fmt.Errorf("invalid port %q", v)
+	}
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(p))
+	return b, nil
+}
+
+func portToString(b []byte) (string, error) {
+	p := binary.BigEndian.Uint16(b)
+	if p == 0 {
+		return "", fmt.Errorf("invalid port 0")
+	}
+	return strconv.Itoa(int(p)), nil
+}
+
+func idToBytes(v string) ([]byte, error) {
+	if !address.IsID(v) {
+		return nil, fmt.Errorf("invalid node id %q", v)
+	}
+	return []byte(v), nil
+}
+
+func idToString(b []byte) (string, error) {
+	v := string(b)
+	if !address.IsID(v) {
+		return "", fmt.Errorf("invalid node id %q", v)
+	}
+	return v, nil
+}
+
+func serviceToBytes(v string) ([]byte, error) {
+	if !address.IsDestination(v) {
+		return nil, fmt.Errorf("invalid service %q", v)
+	}
+	return []byte(v), nil
+}
+
+func serviceToString(b []byte) (string, error) {
+	v := string(b)
+	if !address.IsDestination(v) {
+		return "", fmt.Errorf("invalid service %q", v)
+	}
+	return v, nil
+}
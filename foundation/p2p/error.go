@@ -0,0 +1,66 @@
+package p2p
+
+import "fmt"
+
+// StatusError is an error with a status code.
+//
+// Handlers can return a StatusError to control the status code and text of the
+// response. Any other error returned by a handler results in
+// StatusInternalServerError.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+// Errors for each of the non-OK status codes.
+//
+// Use errors.Is to check an error against these, the comparison is done on
+// the status code only.
+var (
+	ErrBadRequest          = &StatusError{Code: StatusBadRequest, Message: StatusText(StatusBadRequest)}
+	ErrUnauthorized        = &StatusError{Code: StatusUnauthorized, Message: StatusText(StatusUnauthorized)}
+	ErrPaymentRequired     = &StatusError{Code: StatusPaymentRequired, Message: StatusText(StatusPaymentRequired)}
+	ErrForbidden           = &StatusError{Code: StatusForbidden, Message: StatusText(StatusForbidden)}
+	ErrNotFound            = &StatusError{Code: StatusNotFound, Message: StatusText(StatusNotFound)}
+	ErrTimeout             = &StatusError{Code: StatusTimeout, Message: StatusText(StatusTimeout)}
+	ErrConflict            = &StatusError{Code: StatusConflict, Message: StatusText(StatusConflict)}
+	ErrGone                = &StatusError{Code: StatusGone, Message: StatusText(StatusGone)}
+	ErrTooLarge            = &StatusError{Code: StatusTooLarge, Message: StatusText(StatusTooLarge)}
+	ErrTooManyRequests     = &StatusError{Code: StatusTooManyRequests, Message: StatusText(StatusTooManyRequests)}
+	ErrInternalServerError = &StatusError{Code: StatusInternalServerError, Message: StatusText(StatusInternalServerError)}
+	ErrBusy                = &StatusError{Code: StatusBusy, Message: StatusText(StatusBusy)}
+	ErrVersionMismatch     = &StatusError{Code: StatusVersionMismatch, Message: StatusText(StatusVersionMismatch)}
+)
+
+// NewError returns a StatusError for the provided status code.
+//
+// If msg is empty, the default status text is used.
+func NewError(code int, msg string) *StatusError {
+	if msg == "" {
+		msg = StatusText(code)
+	}
+	return &StatusError{Code: code, Message: msg}
+}
+
+// Errorf returns a StatusError for the provided status code with a formatted
+// message.
+func Errorf(code int, format string, a ...any) *StatusError {
+	return NewError(code, fmt.Sprintf(format, a...))
+}
+
+// Error implements the error interface.
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("status %d", e.Code)
+	}
+	return fmt.Sprintf("status %d: %s", e.Code, e.Message)
+}
+
+// Is reports whether target is a *StatusError with the same status code.
+func (e *StatusError) Is(target error) bool {
+	t, ok := target.(*StatusError)
+	if !ok {
+		return false
+	}
+	return t.Code == e.Code
+}
@@ -0,0 +1,70 @@
+package p2p_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/toqns/toqns/foundation/p2p"
+)
+
+// Success and failure markers.
+const (
+	success = "\u2713"
+	failed  = "\u2717"
+)
+
+func TestError(t *testing.T) {
+	t.Log("Given the need to work with p2p errors.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen checking a response with a non-OK status.", testID)
+		{
+			r := p2p.Response{}
+			r.WriteStatusWithExplanation(p2p.StatusTooManyRequests, "slow down")
+
+			err := r.Err()
+			if !errors.Is(err, p2p.ErrTooManyRequests) {
+				t.Fatalf("\t%s\tTest %d:\tShould match ErrTooManyRequests, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould match ErrTooManyRequests.", success, testID)
+
+			if errors.Is(err, p2p.ErrBusy) {
+				t.Fatalf("\t%s\tTest %d:\tShould not match ErrBusy.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not match ErrBusy.", success, testID)
+
+			var e *p2p.StatusError
+			if !errors.As(fmt.Errorf("wrapped: %w", err), &e) || e.Message != "slow down" {
+				t.Fatalf("\t%s\tTest %d:\tShould unwrap to *p2p.StatusError with message %q, but got: %v.", failed, testID, "slow down", e)
+			}
+			t.Logf("\t%s\tTest %d:\tShould unwrap to *p2p.StatusError with message %q.", success, testID, "slow down")
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen checking a response with an OK status.", testID)
+		{
+			r := p2p.Response{}
+			r.Write([]byte("data"))
+			if err := r.Err(); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould get nil error, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get nil error.", success, testID)
+		}
+
+		testID = 2
+		t.Logf("\tTest %d:\tWhen getting status texts.", testID)
+		{
+			codes := []int{
+				p2p.StatusPaymentRequired, p2p.StatusTimeout, p2p.StatusConflict, p2p.StatusGone,
+				p2p.StatusTooLarge, p2p.StatusTooManyRequests, p2p.StatusBusy, p2p.StatusVersionMismatch,
+			}
+			for _, c := range codes {
+				if p2p.StatusText(c) == "" {
+					t.Fatalf("\t%s\tTest %d:\tShould get status text for %d.", failed, testID, c)
+				}
+			}
+			t.Logf("\t%s\tTest %d:\tShould get status text for all codes.", success, testID)
+		}
+	}
+}
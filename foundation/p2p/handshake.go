@@ -0,0 +1,472 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toqns/toqns/foundation/address"
+)
+
+// Request paths of the handshake.
+const (
+	// HandshakePath is the request path for handshakes.
+	HandshakePath = "p2p/handshake"
+
+	// HandshakeAuthPath is the request path to answer the challenge of a
+	// handshake.
+	HandshakeAuthPath = "p2p/handshake/auth"
+)
+
+// Limits of the handshake.
+const (
+	// nonceSize is the size of the nonces peers sign during a handshake.
+	nonceSize = 32
+
+	// challengeTimeout is the time a peer has to answer a challenge.
+	challengeTimeout = 30 * time.Second
+
+	// maxChallenges is the maximum number of unanswered challenges.
+	maxChallenges = 1024
+)
+
+var (
+	// ErrNetworkMismatch is returned when a peer belongs to a different network.
+	ErrNetworkMismatch = errors.New("network mismatch")
+
+	// ErrGenesisMismatch is returned when a peer has a different genesis.
+	ErrGenesisMismatch = errors.New("genesis mismatch")
+
+	// ErrIncompatibleVersion is returned when a peer runs an incompatible version.
+	ErrIncompatibleVersion = errors.New("incompatible version")
+
+	// ErrPeerIDMismatch is returned when a peer's ID differs from the ID
+	// in its address.
+	ErrPeerIDMismatch = errors.New("peer id mismatch")
+
+	// ErrUnauthenticated is returned when a peer fails to prove that it
+	// holds the key of its ID.
+	ErrUnauthenticated = errors.New("peer not authenticated")
+)
+
+// Identity proves that nodes hold the keys of their IDs.
+//
+// Implementations must keep the signatures apart from signatures of other
+// messages with the same key, such as with a domain prefix.
+type Identity interface {
+	// Sign signs the data with the key of the node, and returns the
+	// public key and the signature.
+	Sign(data []byte) (publicKey, signature []byte, err error)
+
+	// Verify verifies that the public key belongs to the ID, and that the
+	// signature of the data is made with it.
+	Verify(id string, publicKey, data, signature []byte) error
+}
+
+// Handshake is the message nodes exchange when they first talk to each
+// other.
+type Handshake struct {
+	// ID is the ID of the node.
+	ID string
+
+	// Version is the software version of the node.
+	Version string
+
+	// Protocols are the application protocols the node supports.
+	Protocols []string
+
+	// Encodings are the payload encodings the node supports.
+	Encodings []string
+
+	// ListenAddrs are the addresses the node can be reached at.
+	ListenAddrs []string
+
+	// NetworkID identifies the network or chain of the node.
+	NetworkID string
+
+	// GenesisHash is the hash of the network's genesis.
+	GenesisHash string
+
+	// Nonce is the nonce the peer has to sign to complete the handshake.
+	Nonce []byte `json:",omitempty"`
+}
+
+// HandshakeAuth proves that a node holds the key of its ID, by signing the
+// nonce of its peer's handshake.
+type HandshakeAuth struct {
+	Nonce     []byte
+	PublicKey []byte `json:",omitempty"`
+	Signature []byte `json:",omitempty"`
+}
+
+// challenge is a handshake that waits for the peer to sign the nonce of
+// the node's response.
+type challenge struct {
+	handshake Handshake
+	from      address.Address
+	ip        net.IP
+	expires   time.Time
+}
+
+// handshake returns the node's own handshake message.
+func (n *Node) handshake() Handshake {
+	addrs := n.announceAddrs()
+	listenAddrs := make([]string, len(addrs))
+	for i, a := range addrs {
+		listenAddrs[i] = a.String()
+	}
+
+	return Handshake{
+		ID:          n.Address.ID,
+		Version:     n.Version,
+		Protocols:   n.Protocols,
+		Encodings:   n.Encodings,
+		ListenAddrs: listenAddrs,
+		NetworkID:   n.NetworkID,
+		GenesisHash: n.GenesisHash,
+	}
+}
+
+// checkHandshake validates a peer's handshake against the node's own.
+func (n *Node) checkHandshake(h Handshake) error {
+	if n.IsRevoked(h.ID) {
+		return fmt.Errorf("%w: %s", ErrRevokedID, h.ID)
+	}
+
+	if h.NetworkID != n.NetworkID {
+		return fmt.Errorf("%w: got %q, expected %q", ErrNetworkMismatch, h.NetworkID, n.NetworkID)
+	}
+
+	if n.GenesisHash != "" && h.GenesisHash != n.GenesisHash {
+		return fmt.Errorf("%w: got %q, expected %q", ErrGenesisMismatch, h.GenesisHash, n.GenesisHash)
+	}
+
+	compatible := n.VersionCompatible
+	if compatible == nil {
+		compatible = CompatibleVersions
+	}
+	if !compatible(n.Version, h.Version) {
+		return fmt.Errorf("%w: got %q, running %q", ErrIncompatibleVersion, h.Version, n.Version)
+	}
+
+	return nil
+}
+
+// handshakeError converts a handshake validation error to a *StatusError.
+func handshakeError(err error) *StatusError {
+	switch {
+	case errors.Is(err, ErrIncompatibleVersion):
+		return NewError(StatusVersionMismatch, err.Error())
+	default:
+		return NewError(StatusForbidden, err.Error())
+	}
+}
+
+// serveHandshake handles incoming handshakes. It validates the peer's
+// handshake and responds with the node's own handshake, with a nonce the
+// peer has to sign to prove its ID.
+func (n *Node) serveHandshake(w ResponseWriter, r *Request) error {
+	var h Handshake
+	if err := n.Decoder.Unmarshal(r.Payload, &h); err != nil {
+		return NewError(StatusBadRequest, fmt.Sprintf("decoding handshake: %v", err))
+	}
+
+	if err := n.checkHandshake(h); err != nil {
+		n.log(Info, "serveHandshake", "status", "peer rejected", "peer", r.From.ID, "ERROR", err)
+		return handshakeError(err)
+	}
+
+	if r.From.ID != "" && r.From.ID != h.ID {
+		return NewError(StatusForbidden, fmt.Sprintf("%v: got %q, expected %q", ErrPeerIDMismatch, h.ID, r.From.ID))
+	}
+
+	if len(h.Nonce) != nonceSize {
+		return NewError(StatusBadRequest, "handshake without nonce")
+	}
+
+	from := r.From
+	from.ID = h.ID
+
+	resp := n.handshake()
+	nonce, err := n.addChallenge(challenge{handshake: h, from: from, ip: ipOf(r.remote)})
+	if err != nil {
+		return err
+	}
+	resp.Nonce = nonce
+
+	b, err := n.Encoder.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("encoding handshake: %w", err)
+	}
+
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("writing handshake: %w", err)
+	}
+
+	return nil
+}
+
+// serveHandshakeAuth handles the answers to the challenges of handshakes.
+// When the peer signed the nonce with the key of its ID, the peer is
+// stored and the node responds with its signature of the peer's nonce.
+func (n *Node) serveHandshakeAuth(w ResponseWriter, r *Request) error {
+	var auth HandshakeAuth
+	if err := n.Decoder.Unmarshal(r.Payload, &auth); err != nil {
+		return NewError(StatusBadRequest, fmt.Sprintf("decoding handshake auth: %v", err))
+	}
+
+	c, ok := n.takeChallenge(auth.Nonce)
+	switch {
+	case !ok:
+		return NewError(StatusUnauthorized, fmt.Sprintf("%v: unknown or expired challenge", ErrUnauthenticated))
+	case c.handshake.ID != r.From.ID || !c.ip.Equal(ipOf(r.remote)):
+		return NewError(StatusUnauthorized, fmt.Sprintf("%v: challenge of another peer", ErrUnauthenticated))
+	}
+
+	h := c.handshake
+	if err := n.verifyAuth(h.ID, auth, n.authData(auth.Nonce, h.ID, n.Address.ID)); err != nil {
+		n.log(Info, "serveHandshakeAuth", "status", "peer rejected", "peer", h.ID, "ERROR", err)
+		return NewError(StatusUnauthorized, err.Error())
+	}
+
+	if n.IsRevoked(h.ID) {
+		return NewError(StatusForbidden, fmt.Sprintf("%v: %s", ErrRevokedID, h.ID))
+	}
+
+	resp, err := n.signAuth(h.Nonce, n.authData(h.Nonce, n.Address.ID, h.ID))
+	if err != nil {
+		return fmt.Errorf("signing handshake: %w", err)
+	}
+
+	b, err := n.Encoder.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("encoding handshake auth: %w", err)
+	}
+
+	h.Nonce = nil
+	n.addPeer(c.from, h, c.ip)
+
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("writing handshake auth: %w", err)
+	}
+
+	return nil
+}
+
+// Handshake performs a handshake with the node with the provided address.
+//
+// The address may have an empty ID, such as for nodes found via DNS seeds,
+// in which case the ID of the peer's handshake is used. A hostname is
+// resolved first, as the peer is stored with the IP its requests must come
+// from. Both nodes sign the nonce of the other's handshake with the key of
+// their ID, if the node has an Identity. On success the peer is stored and
+// returned. An error is returned if the peer rejects the node, or if the
+// node rejects the peer's handshake or signature.
+func (n *Node) Handshake(ctx context.Context, to address.Address) (Peer, error) {
+	to, err := n.resolve(ctx, to)
+	if err != nil {
+		return Peer{}, err
+	}
+
+	nonce, err := newNonce()
+	if err != nil {
+		return Peer{}, err
+	}
+
+	own := n.handshake()
+	own.Nonce = nonce
+
+	b, err := n.Encoder.Marshal(own)
+	if err != nil {
+		return Peer{}, fmt.Errorf("encoding handshake: %w", err)
+	}
+
+	resp, err := n.Send(ctx, to, HandshakePath, b)
+	if err != nil {
+		return Peer{}, fmt.Errorf("sending handshake: %w", err)
+	}
+
+	var h Handshake
+	if err := n.Decoder.Unmarshal(resp.Payload, &h); err != nil {
+		return Peer{}, fmt.Errorf("decoding handshake: %w", err)
+	}
+
+	if err := n.checkHandshake(h); err != nil {
+		return Peer{}, err
+	}
+
+	switch {
+	case to.ID == "":
+		to.ID = h.ID
+	case to.ID != h.ID:
+		return Peer{}, fmt.Errorf("%w: got %q, expected %q", ErrPeerIDMismatch, h.ID, to.ID)
+	}
+
+	if len(h.Nonce) != nonceSize {
+		return Peer{}, fmt.Errorf("%w: handshake without nonce", ErrUnauthenticated)
+	}
+
+	auth, err := n.signAuth(h.Nonce, n.authData(h.Nonce, n.Address.ID, to.ID))
+	if err != nil {
+		return Peer{}, fmt.Errorf("signing handshake: %w", err)
+	}
+
+	if b, err = n.Encoder.Marshal(auth); err != nil {
+		return Peer{}, fmt.Errorf("encoding handshake auth: %w", err)
+	}
+
+	if resp, err = n.Send(ctx, to, HandshakeAuthPath, b); err != nil {
+		return Peer{}, fmt.Errorf("sending handshake auth: %w", err)
+	}
+
+	var peerAuth HandshakeAuth
+	if err := n.Decoder.Unmarshal(resp.Payload, &peerAuth); err != nil {
+		return Peer{}, fmt.Errorf("decoding handshake auth: %w", err)
+	}
+
+	if !bytes.Equal(peerAuth.Nonce, nonce) {
+		return Peer{}, fmt.Errorf("%w: signature of another nonce", ErrUnauthenticated)
+	}
+	if err := n.verifyAuth(to.ID, peerAuth, n.authData(nonce, to.ID, n.Address.ID)); err != nil {
+		return Peer{}, err
+	}
+
+	h.Nonce = nil
+	return n.addPeer(to, h, to.IP()), nil
+}
+
+// authData returns the data a node signs to prove to a peer that it holds
+// the key of its ID.
+func (n *Node) authData(nonce []byte, id, peerID string) []byte {
+	return []byte(fmt.Sprintf("%x:%s:%s:%s", nonce, id, peerID, n.NetworkID))
+}
+
+// signAuth signs the data with the node's Identity. Without an Identity,
+// the nonce is returned without a signature.
+func (n *Node) signAuth(nonce, data []byte) (HandshakeAuth, error) {
+	auth := HandshakeAuth{Nonce: nonce}
+	if n.Identity == nil {
+		return auth, nil
+	}
+
+	pub, sig, err := n.Identity.Sign(data)
+	if err != nil {
+		return HandshakeAuth{}, err
+	}
+	auth.PublicKey, auth.Signature = pub, sig
+
+	return auth, nil
+}
+
+// verifyAuth verifies the peer's signature of the data with the node's
+// Identity. Without an Identity, peers aren't authenticated.
+func (n *Node) verifyAuth(id string, auth HandshakeAuth, data []byte) error {
+	if n.Identity == nil {
+		return nil
+	}
+
+	if err := n.Identity.Verify(id, auth.PublicKey, data, auth.Signature); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+
+	return nil
+}
+
+// addChallenge stores the challenge under a new nonce, and returns the
+// nonce. Expired challenges are removed.
+func (n *Node) addChallenge(c challenge) ([]byte, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	c.expires = now.Add(challengeTimeout)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.challenges == nil {
+		n.challenges = make(map[string]challenge)
+	}
+
+	if len(n.challenges) >= maxChallenges {
+		for k, c := range n.challenges {
+			if now.After(c.expires) {
+				delete(n.challenges, k)
+			}
+		}
+		if len(n.challenges) >= maxChallenges {
+			return nil, NewError(StatusBusy, "too many handshakes in progress")
+		}
+	}
+
+	n.challenges[string(nonce)] = c
+
+	return nonce, nil
+}
+
+// takeChallenge removes and returns the challenge with the nonce, if it
+// hasn't expired.
+func (n *Node) takeChallenge(nonce []byte) (challenge, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	c, ok := n.challenges[string(nonce)]
+	if !ok {
+		return challenge{}, false
+	}
+	delete(n.challenges, string(nonce))
+
+	return c, time.Now().Before(c.expires)
+}
+
+// newNonce returns a random nonce.
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+	return nonce, nil
+}
+
+// CompatibleVersions is the default version compatibility check.
+//
+// Versions in the semantic versioning format are compatible when their
+// major versions match. Versions that aren't in that format aren't
+// compatible with any version.
+func CompatibleVersions(local, remote string) bool {
+	lm, ok := majorVersion(local)
+	if !ok {
+		return false
+	}
+
+	rm, ok := majorVersion(remote)
+	if !ok {
+		return false
+	}
+
+	return lm == rm
+}
+
+// majorVersion returns the major version of a semantic version string.
+func majorVersion(v string) (int, bool) {
+	v = strings.TrimPrefix(v, "v")
+	parts := strings.SplitN(v, ".", 3)
+	if len(parts) != 3 {
+		return 0, false
+	}
+
+	m, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, false
+	}
+
+	return m, true
+}
@@ -0,0 +1,311 @@
+package p2p_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/toqns/toqns/foundation/address"
+	"github.com/toqns/toqns/foundation/p2p"
+)
+
+// newTestNode returns a listening node. The options configure the node
+// before it listens, as its fields can't be changed while it serves.
+func newTestNode(t *testing.T, id, networkID, version string, options ...func(*p2p.Node)) *p2p.Node {
+	ip := net.ParseIP("127.0.0.1")
+	n := p2p.Node{
+		Address:   address.Address{ID: id, LocIP: &ip, Proto: "udp"},
+		Encoder:   p2p.RequestEncoderFunc(json.Marshal),
+		Decoder:   p2p.RequestDecoderFunc(json.Unmarshal),
+		Handler:   p2p.HandleFunc(func(p2p.ResponseWriter, *p2p.Request) error { return nil }),
+		Version:   version,
+		NetworkID: networkID,
+	}
+	for _, o := range options {
+		o(&n)
+	}
+
+	if err := n.ListenAndServe(); err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	t.Cleanup(func() { n.Shutdown(context.Background()) })
+
+	return &n
+}
+
+// testIdentity is an identity with an ed25519 key, whose ID is the hex
+// encoded public key.
+type testIdentity struct {
+	key ed25519.PrivateKey
+}
+
+func newTestIdentity(t *testing.T) testIdentity {
+	_, k, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	return testIdentity{key: k}
+}
+
+func (i testIdentity) id() string {
+	return hex.EncodeToString(i.key.Public().(ed25519.PublicKey))
+}
+
+func (i testIdentity) Sign(data []byte) ([]byte, []byte, error) {
+	return i.key.Public().(ed25519.PublicKey), ed25519.Sign(i.key, data), nil
+}
+
+func (testIdentity) Verify(id string, pub, data, sig []byte) error {
+	if hex.EncodeToString(pub) != id {
+		return fmt.Errorf("public key of another id")
+	}
+	if len(pub) != ed25519.PublicKeySize || !ed25519.Verify(pub, data, sig) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+func TestHandshake(t *testing.T) {
+	t.Log("Given the need to perform handshakes between nodes.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen both nodes are on the same network.", testID)
+		{
+			a := newTestNode(t, "a", "testnet", "v1.2.0")
+			b := newTestNode(t, "b", "testnet", "v1.3.1")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			p, err := a.Handshake(ctx, b.Address)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to complete the handshake: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to complete the handshake.", success, testID)
+
+			if p.Handshake.Version != "v1.3.1" {
+				t.Fatalf("\t%s\tTest %d:\tShould get peer version %q, but got %q.", failed, testID, "v1.3.1", p.Handshake.Version)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get peer version %q.", success, testID, "v1.3.1")
+
+			if _, ok := b.Peer("a"); !ok {
+				t.Fatalf("\t%s\tTest %d:\tShould have stored the peer on the receiving node.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould have stored the peer on the receiving node.", success, testID)
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen the nodes are on different networks.", testID)
+		{
+			a := newTestNode(t, "a", "testnet", "v1.2.0")
+			b := newTestNode(t, "b", "mainnet", "v1.2.0")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			_, err := a.Handshake(ctx, b.Address)
+			if !errors.Is(err, p2p.ErrForbidden) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrForbidden, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrForbidden.", success, testID)
+
+			if _, ok := b.Peer("a"); ok {
+				t.Fatalf("\t%s\tTest %d:\tShould not have stored the peer on the receiving node.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould not have stored the peer on the receiving node.", success, testID)
+		}
+
+		testID = 2
+		t.Logf("\tTest %d:\tWhen the nodes run incompatible versions.", testID)
+		{
+			a := newTestNode(t, "a", "testnet", "v1.2.0")
+			b := newTestNode(t, "b", "testnet", "v2.0.0")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			_, err := a.Handshake(ctx, b.Address)
+			if !errors.Is(err, p2p.ErrVersionMismatch) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrVersionMismatch, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrVersionMismatch.", success, testID)
+		}
+
+		testID = 3
+		t.Logf("\tTest %d:\tWhen a peer's ID has been rotated.", testID)
+		{
+			a := newTestNode(t, "a", "testnet", "v1.2.0")
+			b := newTestNode(t, "b", "testnet", "v1.2.0")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			if _, err := a.Handshake(ctx, b.Address); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to complete the handshake: %v.", failed, testID, err)
+			}
+
+			p, ok := b.RotatePeer("a", "a2")
+			if !ok || p.Address.ID != "a2" {
+				t.Fatalf("\t%s\tTest %d:\tShould have rotated the peer to its new ID.", failed, testID)
+			}
+			if _, ok := b.Peer("a"); ok {
+				t.Fatalf("\t%s\tTest %d:\tShould have removed the peer with the old ID.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould have rotated the peer to its new ID.", success, testID)
+
+			_, err := a.Handshake(ctx, b.Address)
+			if !errors.Is(err, p2p.ErrForbidden) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrForbidden for the revoked ID, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrForbidden for the revoked ID.", success, testID)
+		}
+
+		testID = 4
+		t.Logf("\tTest %d:\tWhen a node claims the ID of another node.", testID)
+		{
+			ka, kb, km := newTestIdentity(t), newTestIdentity(t), newTestIdentity(t)
+
+			a := newTestNode(t, ka.id(), "testnet", "v1.2.0", func(n *p2p.Node) { n.Identity = ka })
+			b := newTestNode(t, kb.id(), "testnet", "v1.2.0", func(n *p2p.Node) { n.Identity = kb })
+			m := newTestNode(t, ka.id(), "testnet", "v1.2.0", func(n *p2p.Node) { n.Identity = km })
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			if _, err := a.Handshake(ctx, b.Address); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to complete the handshake with the node key: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to complete the handshake with the node key.", success, testID)
+
+			b.RemovePeer(ka.id())
+
+			_, err := m.Handshake(ctx, b.Address)
+			if !errors.Is(err, p2p.ErrUnauthorized) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrUnauthorized for a handshake with another key, but got: %v.", failed, testID, err)
+			}
+			if _, ok := b.Peer(ka.id()); ok {
+				t.Fatalf("\t%s\tTest %d:\tShould not have stored the impersonated peer.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould reject a handshake with another key.", success, testID)
+
+			_, err = m.Send(ctx, b.Address, "test", nil)
+			if !errors.Is(err, p2p.ErrUnauthorized) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrUnauthorized for a request without handshake, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould reject requests without handshake.", success, testID)
+
+			if _, err := a.Handshake(ctx, b.Address); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to complete the handshake again: %v.", failed, testID, err)
+			}
+			if _, err := a.Send(ctx, b.Address, "test", nil); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould serve requests after the handshake: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould serve requests after the handshake.", success, testID)
+		}
+
+		testID = 5
+		t.Logf("\tTest %d:\tWhen the revoked IDs are stored in a file.", testID)
+		{
+			name := filepath.Join(t.TempDir(), "revoked.json")
+
+			b := newTestNode(t, "b", "testnet", "v1.2.0")
+			if err := b.LoadRevoked(name); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to load a missing file: %v.", failed, testID, err)
+			}
+			b.RotatePeer("a", "a2")
+			b.Revoke("c")
+
+			restarted := newTestNode(t, "b", "testnet", "v1.2.0")
+			if err := restarted.LoadRevoked(name); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to load the revoked IDs: %v.", failed, testID, err)
+			}
+			if !restarted.IsRevoked("a") || !restarted.IsRevoked("c") || restarted.IsRevoked("a2") {
+				t.Fatalf("\t%s\tTest %d:\tShould keep the revoked IDs after a restart.", failed, testID)
+			}
+			t.Logf("\t%s\tTest %d:\tShould keep the revoked IDs after a restart.", success, testID)
+
+			a := newTestNode(t, "a", "testnet", "v1.2.0")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			if _, err := a.Handshake(ctx, restarted.Address); !errors.Is(err, p2p.ErrForbidden) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrForbidden for the revoked ID after a restart, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrForbidden for the revoked ID after a restart.", success, testID)
+		}
+
+		testID = 6
+		t.Logf("\tTest %d:\tWhen the peer is addressed by hostname without ID.", testID)
+		{
+			a := newTestNode(t, "a", "testnet", "v1.2.0", func(n *p2p.Node) { n.Resolver = hostResolver{"seed.test": "127.0.0.1"} })
+			b := newTestNode(t, "b", "testnet", "v1.2.0")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			seed := address.Address{Host: "seed.test", Port: b.Address.Port, Proto: "udp"}
+			if _, err := a.Handshake(ctx, seed); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to complete the handshake: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to complete the handshake.", success, testID)
+
+			if _, err := b.Send(ctx, a.Address, "test", nil); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould serve requests of the peer: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould serve requests of the peer.", success, testID)
+		}
+
+		testID = 7
+		t.Logf("\tTest %d:\tWhen the peer has no genesis hash.", testID)
+		{
+			a := newTestNode(t, "a", "testnet", "v1.2.0")
+			b := newTestNode(t, "b", "testnet", "v1.2.0", func(n *p2p.Node) { n.GenesisHash = "genesis" })
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			if _, err := a.Handshake(ctx, b.Address); !errors.Is(err, p2p.ErrForbidden) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrForbidden, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrForbidden.", success, testID)
+		}
+
+		testID = 8
+		t.Logf("\tTest %d:\tWhen the peer's version isn't a semantic version.", testID)
+		{
+			a := newTestNode(t, "a", "testnet", "develop")
+			b := newTestNode(t, "b", "testnet", "v1.2.0")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			if _, err := a.Handshake(ctx, b.Address); !errors.Is(err, p2p.ErrVersionMismatch) {
+				t.Fatalf("\t%s\tTest %d:\tShould get ErrVersionMismatch, but got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get ErrVersionMismatch.", success, testID)
+		}
+	}
+}
+
+// hostResolver resolves hostnames to fixed IPs.
+type hostResolver map[string]string
+
+func (r hostResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	ip, ok := r[host]
+	if !ok {
+		return nil, fmt.Errorf("unknown host %s", host)
+	}
+	return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+}
+
+func (hostResolver) LookupTXT(context.Context, string) ([]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,51 @@
+package p2p
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ServeMux dispatches requests to the handler registered for their path.
+type ServeMux struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+// NewServeMux returns a new ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{handlers: make(map[string]Handler)}
+}
+
+// Handle registers the handler for the path.
+//
+// Panics if a handler for the path has already been registered.
+func (m *ServeMux) Handle(path string, h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.handlers[path]; ok {
+		panic(fmt.Sprintf("p2p: multiple registrations for %s", path))
+	}
+	m.handlers[path] = h
+}
+
+// HandleFunc registers the handler function for the path.
+func (m *ServeMux) HandleFunc(path string, f func(ResponseWriter, *Request) error) {
+	m.Handle(path, HandlerFunc(f))
+}
+
+// Serve implements the Handler interface and dispatches the request to the
+// handler for its path.
+//
+// Returns a *StatusError with StatusNotFound for unknown paths.
+func (m *ServeMux) Serve(w ResponseWriter, r *Request) error {
+	m.mu.RLock()
+	h, ok := m.handlers[r.Path]
+	m.mu.RUnlock()
+
+	if !ok {
+		return NewError(StatusNotFound, fmt.Sprintf("no handler for %q", r.Path))
+	}
+
+	return h.Serve(w, r)
+}
@@ -7,25 +7,119 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/toqns/toqns/foundation/address"
 )
 
-// ErrUnsupportedProtocol is returned when an unsupported protocol is provided.
-var ErrUnsupportedProtocol = errors.New("unsupported protocol")
+var (
+	// ErrUnsupportedProtocol is returned when an unsupported protocol is provided.
+	ErrUnsupportedProtocol = errors.New("unsupported protocol")
+
+	// ErrNotListening is returned when sending a request before the node is listening.
+	ErrNotListening = errors.New("node is not listening")
+)
 
 // Node represents a node on the p2p network.
 type Node struct {
-	Address     address.Address
-	conn        net.Conn
-	Encoder     RequestEncoder
-	Decoder     RequestDecoder
-	Handler     Handler
-	inShutdown  bool
-	hasShutdown bool
-	shutdown    chan struct{}
-	reqChan     chan Request
-	Log         Logger
+	// Address is the primary address of the node. Its ID identifies the
+	// node on the network.
+	Address address.Address
+
+	// ListenAddrs are the addresses the node listens on. When empty, the
+	// node listens on Address.
+	ListenAddrs []address.Address
+
+	// AnnounceAddrs are the addresses the node advertises to peers, such
+	// as a public address that differs from the bind address. When empty,
+	// the listen addresses are advertised.
+	AnnounceAddrs []address.Address
+
+	Encoder RequestEncoder
+	Decoder RequestDecoder
+	Handler Handler
+
+	// Version is the software version of the node, which is exchanged
+	// during the handshake.
+	Version string
+
+	// NetworkID identifies the network or chain the node belongs to.
+	// Peers with a different NetworkID are rejected during the handshake.
+	NetworkID string
+
+	// GenesisHash is the hash of the network's genesis. When set, peers
+	// with a different or without a GenesisHash are rejected during the
+	// handshake.
+	GenesisHash string
+
+	// Protocols are the application protocols the node supports.
+	Protocols []string
+
+	// Encodings are the names of the payload encodings the node supports,
+	// such as "json".
+	Encodings []string
+
+	// Resolver resolves hostnames of addresses. When nil,
+	// address.DefaultResolver is used.
+	Resolver address.Resolver
+
+	// Identity proves the node's ID to peers during handshakes, and
+	// verifies theirs. When nil, IDs aren't authenticated.
+	Identity Identity
+
+	// VersionCompatible reports whether a peer's version can be used
+	// together with Version. When nil, CompatibleVersions is used.
+	VersionCompatible func(local, remote string) bool
+
+	// MaxRequests is the maximum number of requests that are served at
+	// once. Requests beyond it are refused with StatusBusy. When zero,
+	// DefaultMaxRequests is used.
+	MaxRequests int
+
+	inShutdown   bool
+	hasShutdown  bool
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	reqChan      chan Request
+	handlers     chan struct{}
+	handling     sync.WaitGroup
+	Log          Logger
+
+	nextID      uint64
+	mu          sync.Mutex
+	pending     map[uint64]pendingRequest
+	peers       map[string]Peer
+	challenges  map[string]challenge
+	revoked     map[string]bool
+	revokedFile string
+	transports  []transport
+	resolved    map[string]address.Address
+}
+
+// DefaultMaxRequests is the maximum number of requests that are served at
+// once, for nodes without MaxRequests.
+const DefaultMaxRequests = 1024
+
+// maxMessageSize is the maximum size of a message, which is limited by
+// the maximum payload of a UDP datagram over IPv4: 65535 bytes minus the
+// 8 byte UDP header and the 20 byte IP header.
+const maxMessageSize = 65507
+
+// pendingRequest is a request that waits for its response.
+type pendingRequest struct {
+	ch chan *Response
+
+	// ip and port are the host the request was sent to. Responses from
+	// other hosts are dropped.
+	ip   net.IP
+	port int
+}
+
+// message is the envelope for requests and responses sent over the network.
+type message struct {
+	Request  *Request  `json:",omitempty"`
+	Response *Response `json:",omitempty"`
 }
 
 func (n *Node) log(l LogLevel, msg string, kv ...any) {
@@ -34,97 +128,346 @@ func (n *Node) log(l LogLevel, msg string, kv ...any) {
 	}
 }
 
-func (n *Node) handleRequests() error {
+// handleRequests serves the requests until the node is shut down. Each
+// request holds a handler slot, which it took when it was received, until
+// it's served.
+func (n *Node) handleRequests() {
+	defer n.handling.Done()
+
 	for {
 		select {
 		case <-n.shutdown:
-			break
+			return
 		case r := <-n.reqChan:
-			if err := n.Handler.Serve(r.Response, &r); err != nil {
-				r.Response.StatusCode = StatusInternalServerError
-				r.Response.Status = err.Error()
-			}
-
-			// TODO: Send response.
+			n.handling.Add(1)
+			go func() {
+				defer func() {
+					<-n.handlers
+					n.handling.Done()
+				}()
+				n.handleRequest(r)
+			}()
 		}
 	}
 }
 
-// handleRequest handles incoming connection.
-func (n *Node) handleMessage(from net.IP, b []byte) error {
-	r := Request{}
-	if err := n.Decoder.Unmarshal(b, &r); err != nil {
-		return fmt.Errorf("decoding request: %w", err)
+// handleRequest serves a single request and sends the response back to
+// the requester.
+func (n *Node) handleRequest(r Request) {
+	n.respond(r, n.serve(r.Response, &r))
+}
+
+// respond sends the response to the request back to the requester. The
+// status of the response is set from the error of serving it, if any.
+func (n *Node) respond(r Request, err error) {
+	if err != nil {
+		var e *StatusError
+		if errors.As(err, &e) {
+			r.Response.WriteStatusWithExplanation(e.Code, e.Message)
+		} else {
+			r.Response.WriteStatusWithExplanation(StatusInternalServerError, err.Error())
+		}
 	}
 
-	if from.IsPrivate() || from.IsUnspecified() {
-		r.From.LocIP = &from
-	} else {
-		r.From.ExtIP = &from
+	if r.Response.StatusCode == 0 {
+		r.Response.WriteStatus(StatusOK)
 	}
 
-	r.From.ExtIP = &from
-	r.Response = &Response{From: r.To, To: r.From}
+	b, err := n.Encoder.Marshal(message{Response: r.Response})
+	if err != nil {
+		n.log(Error, "handleRequest", "status", "encoding response failed", "to", r.From.ID, "ERROR", err)
+		return
+	}
 
-	n.reqChan <- r
+	if err := r.reply(b); err != nil {
+		n.log(Warning, "handleRequest", "status", "sending response failed", "to", r.From.ID, "ERROR", err)
+	}
+}
 
-	return nil
+// serve dispatches the request to the built-in handlers or to the
+// node's Handler. Only peers that completed a handshake from the IP of the
+// request are served by the Handler.
+func (n *Node) serve(w ResponseWriter, r *Request) error {
+	if n.IsRevoked(r.From.ID) {
+		return NewError(StatusForbidden, fmt.Sprintf("%v: %s", ErrRevokedID, r.From.ID))
+	}
+
+	switch r.Path {
+	case HandshakePath:
+		return n.serveHandshake(w, r)
+	case HandshakeAuthPath:
+		return n.serveHandshakeAuth(w, r)
+	}
+
+	if !n.isPeer(r.From.ID, ipOf(r.remote)) {
+		return NewError(StatusUnauthorized, fmt.Sprintf("no handshake with %s", r.From.ID))
+	}
+
+	return n.Handler.Serve(w, r)
 }
 
-// handleUDPConnections is the connection handler for UDP connections.
-func (n *Node) handleUDPConnections() error {
-	conn, ok := n.conn.(*net.UDPConn)
-	if !ok {
-		return fmt.Errorf("connection should be *net.UDPConn, but got %T", conn)
+// handleMessage handles an incoming message.
+//
+// Responses to requests in the message are sent with reply.
+func (n *Node) handleMessage(from net.Addr, b []byte, reply func([]byte) error) error {
+	var m message
+	if err := n.Decoder.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("decoding message: %w", err)
 	}
 
-	go func() {
-		for {
-			select {
-			case <-n.shutdown:
-				break
-			default:
-				buf := make([]byte, 2048)
-				s, addr, err := conn.ReadFrom(buf)
-				if err != nil {
-					// TODO: Handle error?
-					fmt.Println("Error:" + err.Error())
-					continue
-				}
-				fromIP := net.ParseIP(addr.String())
-				if err := n.handleMessage(fromIP, []byte(buf[:s])); err != nil {
-					// TODO: Handle error?
-					fmt.Println("Error:" + err.Error())
-					continue
-				}
+	switch {
+	case m.Response != nil:
+		ip, port := hostOf(from)
+
+		n.mu.Lock()
+		p, ok := n.pending[m.Response.ID]
+		if ok && p.ip.Equal(ip) && p.port == port {
+			delete(n.pending, m.Response.ID)
+		} else {
+			ok = false
+		}
+		n.mu.Unlock()
+
+		if !ok {
+			return fmt.Errorf("unexpected response with id %d", m.Response.ID)
+		}
+		p.ch <- m.Response
+
+	case m.Request != nil:
+		r := *m.Request
+		r.remote = from
+		r.reply = reply
+
+		if ip := ipOf(from); ip != nil {
+			r.From.ExtIP = nil
+			r.From.LocIP = nil
+			if ip.IsPrivate() || ip.IsUnspecified() || ip.IsLoopback() {
+				r.From.LocIP = &ip
+			} else {
+				r.From.ExtIP = &ip
 			}
 		}
-	}()
+
+		r.Response = &Response{ID: r.ID, From: r.To, To: r.From}
+
+		// Requests beyond the ones that can be served at once are refused
+		// rather than queued.
+		select {
+		case n.handlers <- struct{}{}:
+		default:
+			n.respond(r, NewError(StatusBusy, "too many requests in progress"))
+			return nil
+		}
+
+		select {
+		case n.reqChan <- r:
+		case <-n.shutdown:
+			<-n.handlers
+		}
+
+	default:
+		return errors.New("empty message")
+	}
 
 	return nil
 }
 
-// listenAndServeUDP sets up a UDP listener and starts the
-// connection handler.
-func (n *Node) listenAndServeUDP() error {
-	s, err := net.ResolveUDPAddr("udp", n.Address.Addr())
+// Send sends a request with the provided path and payload to the node with
+// the provided address and waits for the response.
+//
+// If the response has a non-OK status code, the response is returned
+// together with a *StatusError for the status. A request that exceeds the
+// maximum message size of the transport fails with ErrTooLarge.
+//
+// Hostnames are resolved before sending, and are resolved again after a
+// request to the resolved IP has failed.
+func (n *Node) Send(ctx context.Context, to address.Address, path string, payload []byte) (*Response, error) {
+	to, err := n.resolve(ctx, to)
 	if err != nil {
-		return fmt.Errorf("resolving udp address: %w", err)
+		return nil, err
+	}
+
+	if !to.HasIP() {
+		return nil, fmt.Errorf("address %s has no ip", to.ID)
+	}
+
+	t, err := n.transportFor(to)
+	if err != nil {
+		return nil, err
+	}
+
+	r := Request{
+		ID:      atomic.AddUint64(&n.nextID, 1),
+		Path:    path,
+		To:      to,
+		From:    n.Address,
+		Payload: payload,
+	}
+
+	// The recipient is unknown for addresses without an ID.
+	if to.ID == "" {
+		r.To = address.Address{}
+	}
+
+	if src := t.addr(); src.Port != 0 {
+		r.From.Port = src.Port
+		r.From.Proto = src.Proto
 	}
 
-	conn, err := net.ListenUDP("udp", s)
+	ch := make(chan *Response, 1)
+	n.mu.Lock()
+	if n.pending == nil {
+		n.pending = make(map[uint64]pendingRequest)
+	}
+	n.pending[r.ID] = pendingRequest{ch: ch, ip: to.IP(), port: int(to.Port)}
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		delete(n.pending, r.ID)
+		n.mu.Unlock()
+	}()
+
+	b, err := n.Encoder.Marshal(message{Request: &r})
 	if err != nil {
-		return fmt.Errorf("creating listener: %w", err)
+		return nil, fmt.Errorf("encoding request: %w", err)
 	}
-	n.conn = conn
 
-	return n.handleUDPConnections()
+	if err := t.send(ctx, to.Addr(), b); err != nil {
+		n.forget(to)
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		n.forget(to)
+		return nil, fmt.Errorf("waiting for response: %w", ctx.Err())
+	case resp := <-ch:
+		return resp, resp.Err()
+	}
+}
+
+// hostOf returns the IP and port of a network address.
+func hostOf(a net.Addr) (net.IP, int) {
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+// ipOf returns the IP of a network address.
+func ipOf(a net.Addr) net.IP {
+	ip, _ := hostOf(a)
+	return ip
+}
+
+// resolve returns the address with its hostname resolved. Resolved
+// addresses are cached until forgotten.
+func (n *Node) resolve(ctx context.Context, a address.Address) (address.Address, error) {
+	if a.HasIP() || a.Host == "" {
+		return a, nil
+	}
+
+	n.mu.Lock()
+	r, ok := n.resolved[a.Host]
+	n.mu.Unlock()
+	if ok {
+		a.ExtIP = r.ExtIP
+		a.LocIP = r.LocIP
+		return a, nil
+	}
+
+	r, err := a.Resolve(ctx, n.Resolver)
+	if err != nil {
+		return address.Address{}, err
+	}
+
+	n.mu.Lock()
+	if n.resolved == nil {
+		n.resolved = make(map[string]address.Address)
+	}
+	n.resolved[a.Host] = r
+	n.mu.Unlock()
+
+	return r, nil
+}
+
+// forget removes the cached resolution of the address' hostname, so it's
+// resolved again on the next request.
+func (n *Node) forget(a address.Address) {
+	if a.Host == "" {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.resolved, a.Host)
+}
+
+// transportFor returns the transport to use for sending to the provided
+// address.
+//
+// The transport must use the same protocol as the address, and preferably
+// listens on an IP of the same family as the address' IP. A transport
+// listening on the unspecified IPv6 address is used as a dual-stack
+// fallback.
+func (n *Node) transportFor(to address.Address) (transport, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.transports) == 0 {
+		return nil, ErrNotListening
+	}
+
+	var fallback transport
+	for _, t := range n.transports {
+		a := t.addr()
+		if !strings.EqualFold(a.Proto, to.Proto) {
+			continue
+		}
+
+		if sameFamily(a.IP(), to.IP()) {
+			return t, nil
+		}
+
+		if fallback == nil || a.IP().Equal(net.IPv6unspecified) {
+			fallback = t
+		}
+	}
+
+	if fallback == nil {
+		return nil, fmt.Errorf("no listener for protocol %s: %w", to.Proto, ErrUnsupportedProtocol)
+	}
+
+	return fallback, nil
 }
 
-// ListenAndServe is a blocking function that will start the network listener for
-// the selected procotol.
+// Addrs returns the addresses the node listens on.
+func (n *Node) Addrs() []address.Address {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	addrs := make([]address.Address, len(n.transports))
+	for i, t := range n.transports {
+		addrs[i] = t.addr()
+	}
+
+	return addrs
+}
+
+// announceAddrs returns the addresses the node advertises to peers.
+func (n *Node) announceAddrs() []address.Address {
+	if len(n.AnnounceAddrs) > 0 {
+		return n.AnnounceAddrs
+	}
+	return n.Addrs()
+}
+
+// ListenAndServe will start the network listener for the selected procotol.
 func (n *Node) ListenAndServe() error {
-	n.log(Debug, "ListenAndServe", "status", "listening")
 	if n.Handler == nil {
 		return fmt.Errorf("nil handler")
 	}
@@ -145,19 +488,89 @@ func (n *Node) ListenAndServe() error {
 		n.reqChan = make(chan Request)
 	}
 
+	if n.handlers == nil {
+		max := n.MaxRequests
+		if max <= 0 {
+			max = DefaultMaxRequests
+		}
+		n.handlers = make(chan struct{}, max)
+	}
+
+	n.handling.Add(1)
 	go n.handleRequests()
 
-	switch strings.ToLower(n.Address.Proto) {
-	case "udp":
-		return n.listenAndServeUDP()
-	default:
-		return ErrUnsupportedProtocol
+	addrs := n.ListenAddrs
+	if len(addrs) == 0 {
+		addrs = []address.Address{n.Address}
 	}
+
+	for _, a := range addrs {
+		a.ID = n.Address.ID
+
+		t, err := n.listen(a)
+		if err != nil {
+			n.closeTransports()
+			return fmt.Errorf("listening on %s: %w", a.String(), err)
+		}
+
+		n.mu.Lock()
+		n.transports = append(n.transports, t)
+		n.mu.Unlock()
+
+		n.log(Debug, "ListenAndServe", "status", "listening", "address", t.addr().String())
+	}
+
+	// Use the port that was assigned by the system when listening on port 0.
+	if n.Address.Port == 0 {
+		n.Address.Port = n.transports[0].addr().Port
+	}
+
+	return nil
+}
+
+// closeTransports closes all transports of the node.
+func (n *Node) closeTransports() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var err error
+	for _, t := range n.transports {
+		if cerr := t.close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	n.transports = nil
+
+	return err
 }
 
-// Shutdown gracefully stops the node.
+// Shutdown gracefully stops the node. New requests are no longer served,
+// and the requests in progress are given until the context is done to
+// finish before the listeners are closed. Calling it again has no effect
+// other than waiting for the requests in progress.
 func (n *Node) Shutdown(ctx context.Context) error {
-	// TODO: Prevent "Error:read udp [::]:3000: use of closed network connection" on shutdown.
-	n.shutdown <- struct{}{}
-	return n.conn.Close()
+	n.shutdownOnce.Do(func() {
+		if n.shutdown != nil {
+			close(n.shutdown)
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		n.handling.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("waiting for requests in progress: %w", ctx.Err())
+	}
+
+	if cerr := n.closeTransports(); cerr != nil && err == nil {
+		err = cerr
+	}
+
+	return err
 }
@@ -0,0 +1,263 @@
+package p2p_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/toqns/toqns/foundation/address"
+	"github.com/toqns/toqns/foundation/p2p"
+)
+
+func TestListenAddrs(t *testing.T) {
+	t.Log("Given the need to listen on multiple addresses.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen a node listens on UDP and TCP.", testID)
+		{
+			ip := net.ParseIP("127.0.0.1")
+			pub := net.ParseIP("8.8.8.8")
+
+			a := p2p.Node{
+				Address: address.Address{ID: "a", LocIP: &ip, Proto: "udp"},
+				ListenAddrs: []address.Address{
+					{LocIP: &ip, Proto: "udp"},
+					{LocIP: &ip, Proto: "tcp"},
+				},
+				AnnounceAddrs: []address.Address{
+					{ID: "a", ExtIP: &pub, Port: 3000, Proto: "udp"},
+				},
+				Encoder: p2p.RequestEncoderFunc(json.Marshal),
+				Decoder: p2p.RequestDecoderFunc(json.Unmarshal),
+				Handler: p2p.HandleFunc(func(p2p.ResponseWriter, *p2p.Request) error { return nil }),
+				Version: "v1.0.0",
+			}
+			if err := a.ListenAndServe(); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to listen: %v.", failed, testID, err)
+			}
+			defer a.Shutdown(context.Background())
+			t.Logf("\t%s\tTest %d:\tShould be able to listen.", success, testID)
+
+			addrs := a.Addrs()
+			if len(addrs) != 2 || addrs[0].Port == 0 || addrs[1].Port == 0 {
+				t.Fatalf("\t%s\tTest %d:\tShould listen on 2 addresses with assigned ports, but got: %v.", failed, testID, addrs)
+			}
+			t.Logf("\t%s\tTest %d:\tShould listen on 2 addresses with assigned ports.", success, testID)
+
+			b := p2p.Node{
+				Address: address.Address{ID: "b", LocIP: &ip, Proto: "tcp"},
+				Encoder: p2p.RequestEncoderFunc(json.Marshal),
+				Decoder: p2p.RequestDecoderFunc(json.Unmarshal),
+				Handler: p2p.HandleFunc(func(p2p.ResponseWriter, *p2p.Request) error { return nil }),
+				Version: "v1.0.0",
+			}
+			if err := b.ListenAndServe(); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to listen: %v.", failed, testID, err)
+			}
+			defer b.Shutdown(context.Background())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			if _, err := a.Handshake(ctx, b.Address); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to complete a handshake over TCP: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to complete a handshake over TCP.", success, testID)
+
+			p, ok := b.Peer("a")
+			if !ok || len(p.Handshake.ListenAddrs) != 1 || p.Handshake.ListenAddrs[0] != "a@8.8.8.8/3000/udp" {
+				t.Fatalf("\t%s\tTest %d:\tShould get the announce address, but got: %v.", failed, testID, p.Handshake.ListenAddrs)
+			}
+			t.Logf("\t%s\tTest %d:\tShould get the announce address.", success, testID)
+		}
+	}
+}
+
+func TestSourceFamily(t *testing.T) {
+	t.Log("Given the need to send from the listen address of the destination's IP family.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen a node listens on IPv4 and IPv6.", testID)
+		{
+			ip4 := net.ParseIP("127.0.0.1")
+			ip6 := net.ParseIP("::1")
+			pub := net.ParseIP("8.8.8.8")
+
+			a := p2p.Node{
+				Address: address.Address{ID: "a", LocIP: &ip4, Proto: "udp"},
+				ListenAddrs: []address.Address{
+					{LocIP: &ip4, Proto: "udp"},
+					{LocIP: &ip6, Proto: "udp"},
+				},
+				AnnounceAddrs: []address.Address{
+					{ID: "a", ExtIP: &pub, Port: 3000, Proto: "udp"},
+				},
+				Encoder: p2p.RequestEncoderFunc(json.Marshal),
+				Decoder: p2p.RequestDecoderFunc(json.Unmarshal),
+				Handler: p2p.HandleFunc(func(p2p.ResponseWriter, *p2p.Request) error { return nil }),
+				Version: "v1.0.0",
+			}
+			if err := a.ListenAndServe(); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to listen: %v.", failed, testID, err)
+			}
+			defer a.Shutdown(context.Background())
+
+			addrs := a.Addrs()
+			if len(addrs) != 2 {
+				t.Fatalf("\t%s\tTest %d:\tShould listen on 2 addresses, but got: %v.", failed, testID, addrs)
+			}
+			t.Logf("\t%s\tTest %d:\tShould listen on IPv4 and IPv6.", success, testID)
+
+			for _, tt := range []struct {
+				name string
+				ip   net.IP
+				src  address.Address
+			}{
+				{name: "IPv4", ip: ip4, src: addrs[0]},
+				{name: "IPv6", ip: ip6, src: addrs[1]},
+			} {
+				ip := tt.ip
+				b := p2p.Node{
+					Address: address.Address{ID: "b", LocIP: &ip, Proto: "udp"},
+					Encoder: p2p.RequestEncoderFunc(json.Marshal),
+					Decoder: p2p.RequestDecoderFunc(json.Unmarshal),
+					Handler: p2p.HandleFunc(func(p2p.ResponseWriter, *p2p.Request) error { return nil }),
+					Version: "v1.0.0",
+				}
+				if err := b.ListenAndServe(); err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to listen on %s: %v.", failed, testID, tt.name, err)
+				}
+				defer b.Shutdown(context.Background())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+				defer cancel()
+
+				if _, err := a.Handshake(ctx, b.Address); err != nil {
+					t.Fatalf("\t%s\tTest %d:\tShould be able to complete a handshake over %s: %v.", failed, testID, tt.name, err)
+				}
+
+				p, ok := b.Peer("a")
+				if !ok || !p.Address.IP().Equal(tt.ip) || p.Address.Port != tt.src.Port {
+					t.Fatalf("\t%s\tTest %d:\tShould send to %s from %s, but got: %v.", failed, testID, tt.name, tt.src.Addr(), p.Address.Addr())
+				}
+				t.Logf("\t%s\tTest %d:\tShould send to %s from %s.", success, testID, tt.name, tt.src.Addr())
+
+				if len(p.Handshake.ListenAddrs) != 1 || p.Handshake.ListenAddrs[0] != "a@8.8.8.8/3000/udp" {
+					t.Fatalf("\t%s\tTest %d:\tShould announce the announce address over %s, but got: %v.", failed, testID, tt.name, p.Handshake.ListenAddrs)
+				}
+				t.Logf("\t%s\tTest %d:\tShould announce the announce address over %s.", success, testID, tt.name)
+			}
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	t.Log("Given the need to limit and finish the requests in progress.")
+	{
+		ip := net.ParseIP("127.0.0.1")
+		started := make(chan struct{})
+		release := make(chan struct{})
+
+		a := p2p.Node{
+			Address: address.Address{ID: "a", LocIP: &ip, Proto: "tcp"},
+			Encoder: p2p.RequestEncoderFunc(json.Marshal),
+			Decoder: p2p.RequestDecoderFunc(json.Unmarshal),
+			Handler: p2p.HandleFunc(func(w p2p.ResponseWriter, r *p2p.Request) error {
+				if r.Path == "block" {
+					started <- struct{}{}
+					<-release
+				}
+				return nil
+			}),
+			Version:     "v1.0.0",
+			MaxRequests: 1,
+		}
+		if err := a.ListenAndServe(); err != nil {
+			t.Fatalf("\t%s\tShould be able to listen: %v.", failed, err)
+		}
+		defer a.Shutdown(context.Background())
+
+		b := p2p.Node{
+			Address: address.Address{ID: "b", LocIP: &ip, Proto: "tcp"},
+			Encoder: p2p.RequestEncoderFunc(json.Marshal),
+			Decoder: p2p.RequestDecoderFunc(json.Unmarshal),
+			Handler: p2p.HandleFunc(func(p2p.ResponseWriter, *p2p.Request) error { return nil }),
+			Version: "v1.0.0",
+		}
+		if err := b.ListenAndServe(); err != nil {
+			t.Fatalf("\t%s\tShould be able to listen: %v.", failed, err)
+		}
+		defer b.Shutdown(context.Background())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		if _, err := b.Handshake(ctx, a.Address); err != nil {
+			t.Fatalf("\t%s\tShould be able to complete a handshake: %v.", failed, err)
+		}
+
+		testID := 0
+		t.Logf("\tTest %d:\tWhen more requests arrive than the node serves at once.", testID)
+		{
+			go b.Send(ctx, a.Address, "block", nil)
+			<-started
+
+			if _, err := b.Send(ctx, a.Address, "other", nil); !errors.Is(err, p2p.ErrBusy) {
+				t.Fatalf("\t%s\tTest %d:\tShould refuse the request with ErrBusy, got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould refuse the request with ErrBusy.", success, testID)
+		}
+
+		testID = 1
+		t.Logf("\tTest %d:\tWhen the node shuts down with a request in progress.", testID)
+		{
+			sctx, scancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer scancel()
+
+			if err := a.Shutdown(sctx); !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("\t%s\tTest %d:\tShould stop waiting for the request when the context is done, got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould stop waiting for the request when the context is done.", success, testID)
+
+			close(release)
+			if err := a.Shutdown(context.Background()); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to shut down again: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould be able to shut down again.", success, testID)
+		}
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	t.Log("Given the need to refuse requests that exceed the message size.")
+	{
+		testID := 0
+		t.Logf("\tTest %d:\tWhen a request doesn't fit in a datagram.", testID)
+		{
+			ip := net.ParseIP("127.0.0.1")
+
+			a := p2p.Node{
+				Address: address.Address{ID: "a", LocIP: &ip, Proto: "udp"},
+				Encoder: p2p.RequestEncoderFunc(json.Marshal),
+				Decoder: p2p.RequestDecoderFunc(json.Unmarshal),
+				Handler: p2p.HandleFunc(func(p2p.ResponseWriter, *p2p.Request) error { return nil }),
+				Version: "v1.0.0",
+			}
+			if err := a.ListenAndServe(); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to listen: %v.", failed, testID, err)
+			}
+			defer a.Shutdown(context.Background())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			if _, err := a.Send(ctx, a.Address, "large", make([]byte, 64<<10)); !errors.Is(err, p2p.ErrTooLarge) {
+				t.Fatalf("\t%s\tTest %d:\tShould fail with ErrTooLarge, got: %v.", failed, testID, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould fail with ErrTooLarge.", success, testID)
+		}
+	}
+}
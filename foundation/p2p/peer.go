@@ -0,0 +1,206 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/toqns/toqns/foundation/address"
+	"github.com/toqns/toqns/foundation/atomicfile"
+)
+
+// ErrRevokedID is returned for peers whose ID has been revoked.
+var ErrRevokedID = errors.New("peer id revoked")
+
+// Peer represents a node the node has completed a handshake with.
+type Peer struct {
+	Address   address.Address
+	Handshake Handshake
+	Time      time.Time
+
+	// remote is the IP the peer completed the handshake from. Requests of
+	// the peer must come from it.
+	remote net.IP
+}
+
+// addPeer stores the peer with the provided address and handshake, which
+// it completed from the remote IP.
+func (n *Node) addPeer(a address.Address, h Handshake, remote net.IP) Peer {
+	p := Peer{Address: a, Handshake: h, Time: time.Now(), remote: remote}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.peers == nil {
+		n.peers = make(map[string]Peer)
+	}
+	n.peers[a.ID] = p
+
+	return p
+}
+
+// Peer returns the peer with the provided ID.
+func (n *Node) Peer(id string) (Peer, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	p, ok := n.peers[id]
+	return p, ok
+}
+
+// isPeer reports whether the ID is the ID of a peer that completed the
+// handshake from the IP.
+func (n *Node) isPeer(id string, ip net.IP) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	p, ok := n.peers[id]
+	return ok && p.remote.Equal(ip)
+}
+
+// Peers returns all peers the node has completed a handshake with.
+func (n *Node) Peers() []Peer {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	peers := make([]Peer, 0, len(n.peers))
+	for _, p := range n.peers {
+		peers = append(peers, p)
+	}
+
+	return peers
+}
+
+// RemovePeer removes the peer with the provided ID.
+func (n *Node) RemovePeer(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.peers, id)
+}
+
+// RotatePeer replaces the ID of a peer and revokes the old ID.
+//
+// Returns the peer with its new ID, or false if there is no peer with the
+// old ID. The old ID is revoked in either case.
+func (n *Node) RotatePeer(oldID, newID string) (Peer, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.revokeLocked(oldID)
+
+	p, ok := n.peers[oldID]
+	if !ok {
+		return Peer{}, false
+	}
+	delete(n.peers, oldID)
+
+	// The peer may already have completed a handshake with its new ID.
+	if np, ok := n.peers[newID]; ok {
+		return np, true
+	}
+
+	p.Address.ID = newID
+	p.Handshake.ID = newID
+	n.peers[newID] = p
+
+	return p, true
+}
+
+// Revoke revokes the ID, so that handshakes of peers with the ID are
+// rejected. A peer with the ID is removed.
+func (n *Node) Revoke(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.revokeLocked(id)
+	delete(n.peers, id)
+}
+
+// revokeLocked revokes the ID, and stores the revoked IDs if they are
+// persisted. The lock must be held.
+func (n *Node) revokeLocked(id string) {
+	if n.revoked[id] {
+		return
+	}
+
+	if n.revoked == nil {
+		n.revoked = make(map[string]bool)
+	}
+	n.revoked[id] = true
+
+	if n.revokedFile == "" {
+		return
+	}
+
+	if err := n.saveRevokedLocked(); err != nil {
+		n.log(Error, "revoke", "status", "storing revoked ids failed", "id", id, "ERROR", err)
+	}
+}
+
+// LoadRevoked reads the revoked IDs from the file, and stores the IDs that
+// are revoked from now on in it, so they stay revoked after a restart. A
+// file that doesn't exist yet is created on the first revocation.
+func (n *Node) LoadRevoked(name string) error {
+	var ids []string
+
+	b, err := os.ReadFile(name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("reading revoked ids: %w", err)
+	default:
+		if err := json.Unmarshal(b, &ids); err != nil {
+			return fmt.Errorf("decoding revoked ids: %w", err)
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.revoked == nil {
+		n.revoked = make(map[string]bool)
+	}
+	for _, id := range ids {
+		n.revoked[id] = true
+		delete(n.peers, id)
+	}
+	n.revokedFile = name
+
+	// IDs that were revoked before are stored as well.
+	if len(n.revoked) > len(ids) {
+		return n.saveRevokedLocked()
+	}
+
+	return nil
+}
+
+// saveRevokedLocked writes the revoked IDs to the revoked file. The lock
+// must be held.
+func (n *Node) saveRevokedLocked() error {
+	ids := make([]string, 0, len(n.revoked))
+	for id := range n.revoked {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	b, err := json.MarshalIndent(ids, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding revoked ids: %w", err)
+	}
+
+	return atomicfile.Write(n.revokedFile, b)
+}
+
+// IsRevoked reports whether the ID has been revoked.
+func (n *Node) IsRevoked(id string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.revoked[id]
+}
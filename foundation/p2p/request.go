@@ -1,9 +1,19 @@
 package p2p
 
-import "github.com/toqns/toqns/foundation/address"
+import (
+	"net"
+
+	"github.com/toqns/toqns/foundation/address"
+)
 
 // Request represents a request to a node.
 type Request struct {
+	// ID identifies the request, so the sender can match the response to it.
+	ID uint64
+
+	// Path is the name of the requested resource, such as "p2p/handshake".
+	Path string
+
 	// To is the address the request is intended for.
 	To address.Address
 
@@ -14,5 +24,11 @@ type Request struct {
 	Payload []byte
 
 	// Response holds the response to the request.
-	Response *Response
+	Response *Response `json:"-"`
+
+	// remote is the network address the request was received from.
+	remote net.Addr
+
+	// reply sends the encoded response to the requester.
+	reply func([]byte) error
 }
@@ -18,6 +18,9 @@ type ResponseWriter interface {
 
 // Response represents the response to a request.
 type Response struct {
+	// ID is the ID of the request this is a response to.
+	ID uint64
+
 	// From is the responsing node.
 	From address.Address
 
@@ -58,3 +61,15 @@ func (r *Response) WriteStatusWithExplanation(code int, e string) {
 	r.StatusCode = code
 	r.Status = e
 }
+
+// Err returns a *StatusError for responses with a non-OK status code, or nil
+// otherwise.
+//
+// The returned error can be checked with errors.Is against the package's
+// status errors, such as ErrNotFound, or unwrapped with errors.As.
+func (r *Response) Err() error {
+	if r.StatusCode >= 200 && r.StatusCode < 300 {
+		return nil
+	}
+	return NewError(r.StatusCode, r.Status)
+}
@@ -7,7 +7,14 @@ const (
 	StatusPaymentRequired     = 402
 	StatusForbidden           = 403
 	StatusNotFound            = 404
+	StatusTimeout             = 408
+	StatusConflict            = 409
+	StatusGone                = 410
+	StatusTooLarge            = 413
+	StatusTooManyRequests     = 429
 	StatusInternalServerError = 500
+	StatusBusy                = 503
+	StatusVersionMismatch     = 505
 )
 
 // StatusText returns a default explanation for the provided status.
@@ -19,12 +26,28 @@ func StatusText(code int) string {
 		return "Bad request"
 	case StatusUnauthorized:
 		return "Unauthorized"
+	case StatusPaymentRequired:
+		return "Payment required"
 	case StatusForbidden:
 		return "Forbidden"
 	case StatusNotFound:
 		return "Not found"
+	case StatusTimeout:
+		return "Timeout"
+	case StatusConflict:
+		return "Conflict"
+	case StatusGone:
+		return "Gone"
+	case StatusTooLarge:
+		return "Payload too large"
+	case StatusTooManyRequests:
+		return "Too many requests"
 	case StatusInternalServerError:
 		return "Internal Server Error"
+	case StatusBusy:
+		return "Busy"
+	case StatusVersionMismatch:
+		return "Version mismatch"
 	default:
 		return ""
 	}
@@ -0,0 +1,351 @@
+package p2p
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/toqns/toqns/foundation/address"
+)
+
+// maxFrameSize is the maximum size of a message sent over a stream
+// transport, such as TCP.
+const maxFrameSize = 16 << 20
+
+// transport is a network listener for a single listen address.
+type transport interface {
+	// addr returns the address the transport listens on.
+	addr() address.Address
+
+	// send sends the data to the provided host address (ip:port). The
+	// context bounds setting up a connection, for transports that need
+	// one.
+	send(ctx context.Context, to string, b []byte) error
+
+	// close stops the transport.
+	close() error
+}
+
+// listen starts a transport for the provided listen address.
+func (n *Node) listen(a address.Address) (transport, error) {
+	switch strings.ToLower(a.Proto) {
+	case "udp":
+		return n.listenUDP(a)
+	case "tcp":
+		return n.listenTCP(a)
+	default:
+		return nil, ErrUnsupportedProtocol
+	}
+}
+
+// sameFamily reports whether both IPs are IPv4, or both are IPv6.
+func sameFamily(a, b net.IP) bool {
+	return (a.To4() != nil) == (b.To4() != nil)
+}
+
+// =============================================================================
+
+// udpTransport is a transport for UDP.
+type udpTransport struct {
+	n    *Node
+	a    address.Address
+	conn *net.UDPConn
+}
+
+// listenUDP sets up a UDP listener and starts the connection handler.
+func (n *Node) listenUDP(a address.Address) (*udpTransport, error) {
+	s, err := net.ResolveUDPAddr("udp", a.Addr())
+	if err != nil {
+		return nil, fmt.Errorf("resolving udp address: %w", err)
+	}
+
+	conn, err := net.ListenUDP("udp", s)
+	if err != nil {
+		return nil, fmt.Errorf("creating listener: %w", err)
+	}
+
+	// Use the port that was assigned by the system when listening on port 0.
+	if a.Port == 0 {
+		a.Port = uint(conn.LocalAddr().(*net.UDPAddr).Port)
+	}
+
+	t := udpTransport{n: n, a: a, conn: conn}
+	go t.serve()
+
+	return &t, nil
+}
+
+// serve reads messages from the connection until it is closed.
+func (t *udpTransport) serve() {
+	for {
+		buf := make([]byte, maxMessageSize)
+		s, from, err := t.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			t.n.log(Warning, "udpTransport", "status", "reading message failed", "ERROR", err)
+			continue
+		}
+
+		reply := func(b []byte) error {
+			_, err := t.conn.WriteTo(b, from)
+			return err
+		}
+
+		if err := t.n.handleMessage(from, buf[:s], reply); err != nil {
+			t.n.log(Warning, "udpTransport", "status", "handling message failed", "from", from.String(), "ERROR", err)
+		}
+	}
+}
+
+func (t *udpTransport) addr() address.Address {
+	return t.a
+}
+
+func (t *udpTransport) send(ctx context.Context, to string, b []byte) error {
+	if len(b) > maxMessageSize {
+		return fmt.Errorf("%w: message of %d bytes exceeds the maximum of %d bytes", ErrTooLarge, len(b), maxMessageSize)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", to)
+	if err != nil {
+		return fmt.Errorf("resolving udp address: %w", err)
+	}
+
+	if _, err := t.conn.WriteTo(b, addr); err != nil {
+		return fmt.Errorf("writing message: %w", err)
+	}
+
+	return nil
+}
+
+func (t *udpTransport) close() error {
+	return t.conn.Close()
+}
+
+// =============================================================================
+
+// tcpConn is a TCP connection that messages are written to as
+// length-prefixed frames.
+type tcpConn struct {
+	net.Conn
+	mu sync.Mutex
+}
+
+// writeFrame writes the data as a single frame.
+func (c *tcpConn) writeFrame(b []byte) error {
+	if len(b) > maxFrameSize {
+		return fmt.Errorf("%w: message of %d bytes exceeds the maximum of %d bytes", ErrTooLarge, len(b), maxFrameSize)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(b)))
+	if _, err := c.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := c.Write(b)
+	return err
+}
+
+// readFrame reads a single frame.
+func (c *tcpConn) readFrame() ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(c, size[:]); err != nil {
+		return nil, err
+	}
+
+	s := binary.BigEndian.Uint32(size[:])
+	if s > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the maximum of %d bytes", s, maxFrameSize)
+	}
+
+	b := make([]byte, s)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// tcpTransport is a transport for TCP.
+type tcpTransport struct {
+	n      *Node
+	a      address.Address
+	ln     *net.TCPListener
+	mu     sync.Mutex
+	conns  map[string]*tcpConn
+	dials  map[string]*tcpDial
+	closed bool
+}
+
+// tcpDial is a connection that's being dialed. Sends to the same host wait
+// for it instead of dialing again.
+type tcpDial struct {
+	done chan struct{}
+	c    *tcpConn
+	err  error
+}
+
+// listenTCP sets up a TCP listener and starts accepting connections.
+func (n *Node) listenTCP(a address.Address) (*tcpTransport, error) {
+	s, err := net.ResolveTCPAddr("tcp", a.Addr())
+	if err != nil {
+		return nil, fmt.Errorf("resolving tcp address: %w", err)
+	}
+
+	ln, err := net.ListenTCP("tcp", s)
+	if err != nil {
+		return nil, fmt.Errorf("creating listener: %w", err)
+	}
+
+	// Use the port that was assigned by the system when listening on port 0.
+	if a.Port == 0 {
+		a.Port = uint(ln.Addr().(*net.TCPAddr).Port)
+	}
+
+	t := tcpTransport{n: n, a: a, ln: ln, conns: make(map[string]*tcpConn), dials: make(map[string]*tcpDial)}
+	go t.serve()
+
+	return &t, nil
+}
+
+// serve accepts connections until the listener is closed.
+func (t *tcpTransport) serve() {
+	for {
+		conn, err := t.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			t.n.log(Warning, "tcpTransport", "status", "accepting connection failed", "ERROR", err)
+			continue
+		}
+
+		c := tcpConn{Conn: conn}
+		t.track(conn.RemoteAddr().String(), &c)
+		go t.read(&c)
+	}
+}
+
+// read reads messages from the connection until it is closed.
+func (t *tcpTransport) read(c *tcpConn) {
+	defer func() {
+		t.untrack(c.RemoteAddr().String(), c)
+		c.Close()
+	}()
+
+	for {
+		b, err := c.readFrame()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				t.n.log(Warning, "tcpTransport", "status", "reading message failed", "from", c.RemoteAddr().String(), "ERROR", err)
+			}
+			return
+		}
+
+		if err := t.n.handleMessage(c.RemoteAddr(), b, c.writeFrame); err != nil {
+			t.n.log(Warning, "tcpTransport", "status", "handling message failed", "from", c.RemoteAddr().String(), "ERROR", err)
+		}
+	}
+}
+
+func (t *tcpTransport) track(key string, c *tcpConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns[key] = c
+}
+
+func (t *tcpTransport) untrack(key string, c *tcpConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns[key] == c {
+		delete(t.conns, key)
+	}
+}
+
+func (t *tcpTransport) addr() address.Address {
+	return t.a
+}
+
+// send writes the data to an existing connection with the host, or dials
+// a new connection when there's none.
+func (t *tcpTransport) send(ctx context.Context, to string, b []byte) error {
+	c, err := t.conn(ctx, to)
+	if err != nil {
+		return fmt.Errorf("dialing: %w", err)
+	}
+
+	if err := c.writeFrame(b); err != nil {
+		return fmt.Errorf("writing message: %w", err)
+	}
+
+	return nil
+}
+
+// conn returns the connection with the host. The first send to a host
+// without a connection dials it, and concurrent sends wait for that dial.
+func (t *tcpTransport) conn(ctx context.Context, to string) (*tcpConn, error) {
+	t.mu.Lock()
+	if c, ok := t.conns[to]; ok {
+		t.mu.Unlock()
+		return c, nil
+	}
+
+	if d, ok := t.dials[to]; ok {
+		t.mu.Unlock()
+
+		select {
+		case <-d.done:
+			return d.c, d.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	d := tcpDial{done: make(chan struct{})}
+	t.dials[to] = &d
+	t.mu.Unlock()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", to)
+
+	t.mu.Lock()
+	delete(t.dials, to)
+	switch {
+	case err != nil:
+		d.err = err
+	case t.closed:
+		conn.Close()
+		d.err = net.ErrClosed
+	default:
+		d.c = &tcpConn{Conn: conn}
+		t.conns[to] = d.c
+		go t.read(d.c)
+	}
+	t.mu.Unlock()
+	close(d.done)
+
+	return d.c, d.err
+}
+
+func (t *tcpTransport) close() error {
+	err := t.ln.Close()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for _, c := range t.conns {
+		c.Close()
+	}
+
+	return err
+}
@@ -0,0 +1,39 @@
+// Package terminal provides functionality for reading input from a terminal.
+package terminal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// stdin buffers standard input. It's shared by all reads, so input that's
+// buffered by a read isn't lost for the next one.
+var stdin = bufio.NewReader(os.Stdin)
+
+// ReadPassword prints the prompt and reads a line from standard input
+// without echoing it, if standard input is a terminal.
+func ReadPassword(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+
+	fd := int(os.Stdin.Fd())
+	if isTerminal(fd) {
+		return readPassword(fd)
+	}
+
+	return readLine()
+}
+
+// readLine reads a single line from standard input without the line
+// ending.
+func readLine() ([]byte, error) {
+	line, err := stdin.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return nil, fmt.Errorf("reading input: %w", err)
+	}
+
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
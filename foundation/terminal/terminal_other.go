@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package terminal
+
+// isTerminal reports whether the file descriptor is a terminal. Terminals
+// aren't detected on this platform, so input is always echoed.
+func isTerminal(fd int) bool {
+	return false
+}
+
+// readPassword reads a line from standard input.
+func readPassword(fd int) ([]byte, error) {
+	return readLine()
+}
@@ -0,0 +1,33 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package terminal
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// isTerminal reports whether the file descriptor is a terminal.
+func isTerminal(fd int) bool {
+	_, err := unix.IoctlGetTermios(fd, ioctlReadTermios)
+	return err == nil
+}
+
+// readPassword reads a line from the terminal with echo disabled.
+func readPassword(fd int) ([]byte, error) {
+	termios, err := unix.IoctlGetTermios(fd, ioctlReadTermios)
+	if err != nil {
+		return nil, fmt.Errorf("getting terminal state: %w", err)
+	}
+
+	noEcho := *termios
+	noEcho.Lflag &^= unix.ECHO
+	noEcho.Lflag |= unix.ICANON | unix.ISIG
+	if err := unix.IoctlSetTermios(fd, ioctlWriteTermios, &noEcho); err != nil {
+		return nil, fmt.Errorf("disabling echo: %w", err)
+	}
+	defer unix.IoctlSetTermios(fd, ioctlWriteTermios, termios)
+
+	return readLine()
+}